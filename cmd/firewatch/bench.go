@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/JeremyFenwick/firewatch/internal/bench"
+	"github.com/JeremyFenwick/firewatch/internal/chaos"
+)
+
+// runBench implements `firewatch bench <service> <host:port>`. Returns the exit status, 1 if any
+// operation failed
+func runBench(args []string) int {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	clients := flags.Int("clients", bench.DefaultClients, "simulated clients running at once")
+	duration := flags.Duration("duration", bench.DefaultDuration, "how long to generate load for")
+	ramp := flags.Duration("ramp", 0, "start the clients spread over this long")
+	pause := flags.Duration("pause", 0, "how long each client waits between operations")
+	faults := flags.String("faults", "", "faults to inject into linereversal's datagrams, as for -chaos")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: firewatch bench [flags] <service> <host:port>")
+		fmt.Fprintln(flags.Output(), "Services:", strings.Join(bench.Services(), ", "))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	injected, err := chaos.Parse(*faults)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid -faults:", err)
+		return 2
+	}
+
+	// Interrupting a run still prints what was measured so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	options := bench.Options{Clients: *clients, Duration: *duration, Ramp: *ramp, Pause: *pause, Faults: injected}
+	report, err := bench.Run(ctx, flags.Arg(0), flags.Arg(1), options)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flags.Usage()
+		return 2
+	}
+	report.Write(os.Stdout)
+	if report.Errors() > 0 {
+		return 1
+	}
+	return 0
+}
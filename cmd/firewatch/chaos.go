@@ -0,0 +1,31 @@
+//go:build chaos
+
+package main
+
+import (
+	"flag"
+	"log/slog"
+
+	"github.com/JeremyFenwick/firewatch/internal/chaos"
+	"github.com/JeremyFenwick/firewatch/internal/server"
+)
+
+// Staging builds can inject network faults into every service:
+//
+//	go build -tags chaos ./cmd/firewatch
+//	firewatch -chaos loss=0.05,reorder=0.05,short_read=0.5,latency=20ms
+func init() {
+	spec := flag.String("chaos", "", "network faults to inject into every service, such as loss=0.05,latency=20ms")
+	injectFaults = func(logger *slog.Logger) error {
+		if *spec == "" {
+			return nil
+		}
+		faults, err := chaos.Parse(*spec)
+		if err != nil {
+			return err
+		}
+		server.InjectFaults(faults)
+		logger.Warn("Injecting network faults", "faults", *spec)
+		return nil
+	}
+}
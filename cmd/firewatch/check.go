@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/JeremyFenwick/firewatch/internal/check"
+)
+
+// runCheck implements `firewatch check <service> <host:port>`. Exits 1 if any case fails
+func runCheck(args []string) {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	timeout := flags.Duration("timeout", check.DefaultTimeout, "time allowed for each case")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: firewatch check [-timeout d] <service> <host:port>")
+		fmt.Fprintln(flags.Output(), "Services:", strings.Join(check.Services(), ", "))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	failed, err := check.Run(context.Background(), flags.Arg(0), flags.Arg(1), *timeout, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flags.Usage()
+		os.Exit(2)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -1,37 +1,307 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/JeremyFenwick/firewatch/internal/budgetchat"
-	"github.com/JeremyFenwick/firewatch/internal/insecuresocketslayer"
-	"github.com/JeremyFenwick/firewatch/internal/jobcenter"
-	"github.com/JeremyFenwick/firewatch/internal/linereversal"
-	"github.com/JeremyFenwick/firewatch/internal/meanstoanend"
-	"github.com/JeremyFenwick/firewatch/internal/mobinthemiddle"
-	"github.com/JeremyFenwick/firewatch/internal/primetime"
-	"github.com/JeremyFenwick/firewatch/internal/smoketest"
-	"github.com/JeremyFenwick/firewatch/internal/speeddaemon"
-	"github.com/JeremyFenwick/firewatch/internal/unusualdatabase"
-	"github.com/JeremyFenwick/firewatch/internal/voraciouscodestorage"
+	"github.com/JeremyFenwick/firewatch/internal/capture"
+	"github.com/JeremyFenwick/firewatch/internal/config"
+	"github.com/JeremyFenwick/firewatch/internal/logging"
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/JeremyFenwick/firewatch/internal/service"
 )
 
+// injectFaults applies -chaos, which only builds with the chaos tag have
+var injectFaults = func(logger *slog.Logger) error { return nil }
+
 func main() {
-	go func() {
-		log.Println(http.ListenAndServe(":8080", nil)) // used for the pprof profiler
-	}()
-	go smoketest.Listen(5000)
-	go primetime.Listen(5001)
-	go meanstoanend.Listen(5002)
-	go budgetchat.Listen(5003)
-	go unusualdatabase.Listen(5004)
-	go mobinthemiddle.Listen(5005, "chat.protohackers.com", 16963)
-	go speeddaemon.Listen(5006)
-	go linereversal.Listen(5007)
-	go insecuresocketslayer.Listen(5008)
-	go jobcenter.Listen(5009)
-	go voraciouscodestorage.Listen(5010)
-	select {}
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		runCheck(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(runBench(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "services" {
+		runServices(os.Args[2:])
+		return
+	}
+
+	configPath := flag.String("config", os.Getenv("FIREWATCH_CONFIG"), "path to a YAML or JSON config file")
+	only := flag.String("services", "", "comma separated services to start, overriding enabled in the config")
+	flag.Parse()
+
+	cfg := config.Default()
+	if *configPath != "" {
+		loaded, err := config.Load(*configPath)
+		if err != nil {
+			fatal(slog.Default(), "Could not load config", err)
+		}
+		cfg = loaded
+	}
+	logger := newLogger(cfg.Log.Format, cfg.Log.Level)
+	slog.SetDefault(logger)
+	if *only != "" {
+		if err := selectServices(cfg, *only); err != nil {
+			fatal(logger, "Invalid -services", err)
+		}
+	}
+
+	// Set when this process is taking over from another one
+	stateDir := takeStateDir()
+
+	registry := metrics.NewRegistry()
+	var group service.Group
+	var admin net.Listener
+	if *cfg.Admin.Enabled {
+		http.Handle("/metrics", registry)
+		http.Handle("/services", group.StatusHandler())
+		http.Handle("/healthz", group.HealthHandler())
+		http.Handle("/readyz", group.ReadyHandler())
+		http.Handle("GET /connections", group.ConnectionsHandler())
+		http.Handle("DELETE /connections/{service}/{id}", group.DisconnectHandler())
+		listener, err := server.Listen(cfg.Admin.Address)
+		if err != nil {
+			fatal(logger, "Admin server failed to start", err)
+		}
+		admin = listener
+		go func() {
+			err := http.Serve(listener, nil) // used for the pprof profiler and metrics
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Error("Admin server stopped", "address", cfg.Admin.Address, "error", err)
+			}
+		}()
+	}
+
+	// The admin server is left out, so it can still be used to watch the faults
+	if err := injectFaults(logger); err != nil {
+		fatal(logger, "Invalid -chaos", err)
+	}
+
+	recorders := make(map[string]*capture.Recorder)
+	certificates := make(map[string]*server.TLS)
+	// launch starts a service, or starts it again after an abandoned upgrade
+	launch := func(def service.Definition, stateDir string) error {
+		settings := cfg.Services[def.Name]
+		if recorder := recorders[def.Name]; recorder != nil {
+			recorder.Close()
+		}
+		started, err := startService(def, settings, newLogger(cfg.Log.Format, settings.LogLevel).With("service", def.Name), stateDir)
+		if err != nil {
+			return err
+		}
+		if started.tls != nil {
+			certificates[def.Name] = started.tls
+		}
+		if started.recorder != nil {
+			recorders[def.Name] = started.recorder
+		}
+		if old := group.Replace(def, started.srv); old != nil {
+			registry.Replace(old.Metrics(), started.srv.Metrics())
+		} else {
+			registry.Register(started.srv.Metrics())
+		}
+		return nil
+	}
+	for _, def := range service.Definitions() {
+		if !cfg.Services[def.Name].IsEnabled() {
+			logger.Info("Service is disabled", "service", def.Name)
+			continue
+		}
+		// A service that can't start is reported on /healthz rather than taking the others down
+		if err := launch(def, stateDir); err != nil {
+			logger.Error("Service failed to start", "service", def.Name, "error", err)
+			group.Fail(def, err)
+		}
+	}
+	if unused := server.CloseInherited(); unused > 0 {
+		logger.Warn("Closed passed sockets no service listens on", "sockets", unused)
+	}
+	if stateDir != "" {
+		os.RemoveAll(stateDir)
+	}
+	notifyReady(logger)
+
+	// Wait for a shutdown signal, then give open connections a chance to finish. SIGHUP reloads
+	// the TLS certificates and SIGUSR2 hands over to a new process started from the executable
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+	received := <-signals
+	for received == syscall.SIGHUP || received == syscall.SIGUSR2 {
+		if received == syscall.SIGHUP {
+			reloadTLS(logger, certificates)
+		} else if upgrade(logger, &group, cfg.ShutdownTimeout.Duration(), launch) {
+			// The new process answers health checks from now on
+			if admin != nil {
+				admin.Close()
+			}
+			break
+		}
+		received = <-signals
+	}
+	logger.Info("Draining connections", "signal", received.String(), "timeout", cfg.ShutdownTimeout.Duration())
+	shutdown(logger, &group, cfg.ShutdownTimeout.Duration())
+	for _, recorder := range recorders {
+		if err := recorder.Close(); err != nil {
+			logger.Error("Capture was incomplete", "error", err)
+		}
+	}
+	logger.Info("Shutdown complete")
+}
+
+// running is a started service and the resources that belong to it
+type running struct {
+	srv      service.Service
+	tls      *server.TLS       // Reloaded on SIGHUP, nil without TLS
+	recorder *capture.Recorder // Closed on shutdown, nil without capture
+}
+
+// startService creates a service from its settings and starts it. A Stateful service first loads
+// any state in stateDir handed over by the process this one took over from
+func startService(def service.Definition, settings config.Service, logger *slog.Logger, stateDir string) (running, error) {
+	srv := def.New(settings.Options())
+	srv.SetLogger(logger)
+	if s, ok := srv.(service.Stateful); ok && stateDir != "" {
+		if err := restoreState(s, service.StateFile(stateDir, def.Name)); err != nil {
+			return running{}, err
+		}
+	}
+	if l, ok := srv.(service.Limited); ok {
+		l.SetLimits(connectionLimits(settings.Limits))
+	}
+	if settings.ProxyProtocol {
+		p, ok := srv.(service.Proxied)
+		if !ok {
+			return running{}, errors.New("the PROXY protocol is not supported by this service")
+		}
+		p.SetProxyProtocol(true)
+	}
+	started := running{srv: srv}
+	if settings.TLS != nil {
+		s, ok := srv.(service.Secured)
+		if !ok {
+			return running{}, errors.New("tls is not supported by this service")
+		}
+		t, err := server.NewTLS(settings.TLS.CertFile, settings.TLS.KeyFile, settings.TLS.ClientCAFile)
+		if err != nil {
+			return running{}, fmt.Errorf("could not load TLS settings: %w", err)
+		}
+		s.SetTLS(t)
+		started.tls = t
+	}
+	if settings.Capture != "" {
+		r, ok := srv.(service.Recorded)
+		if !ok {
+			return running{}, errors.New("capture is not supported by this service")
+		}
+		recorder, err := capture.Create(settings.Capture, def.Name, string(def.Transport))
+		if err != nil {
+			return running{}, fmt.Errorf("could not start capture: %w", err)
+		}
+		r.SetRecorder(recorder)
+		started.recorder = recorder
+		logger.Info("Capturing traffic", "path", settings.Capture)
+	}
+	if err := srv.Start(settings.ListenAddress()); err != nil {
+		if started.recorder != nil {
+			started.recorder.Close()
+		}
+		return running{}, err
+	}
+	return started, nil
+}
+
+func restoreState(s service.Stateful, path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// The service was not running in the previous process
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not load handed over state: %w", err)
+	}
+	defer file.Close()
+
+	return s.Restore(file)
+}
+
+// selectServices enables the comma separated services in names and disables every other one
+func selectServices(cfg *config.Config, names string) error {
+	selected := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if _, known := service.Lookup(name); !known {
+			return fmt.Errorf("unknown service %q", name)
+		}
+		selected[name] = true
+	}
+	for name, settings := range cfg.Services {
+		enabled := selected[name]
+		settings.Enabled = &enabled
+		cfg.Services[name] = settings
+	}
+	return nil
+}
+
+func reloadTLS(logger *slog.Logger, certificates map[string]*server.TLS) {
+	for name, t := range certificates {
+		if err := t.Reload(); err != nil {
+			logger.Error("Could not reload TLS settings, keeping the previous ones", "service", name, "error", err)
+			continue
+		}
+		logger.Info("Reloaded TLS settings", "service", name)
+	}
+}
+
+func connectionLimits(limits config.Limits) server.Limits {
+	return server.Limits{
+		MaxConnections:      limits.MaxConnections,
+		MaxConnectionsPerIP: limits.MaxConnectionsPerIP,
+		AcceptRate:          limits.AcceptRate,
+		AcceptBurst:         limits.AcceptBurst,
+		ReadTimeout:         limits.ReadTimeout.Duration(),
+		WriteTimeout:        limits.WriteTimeout.Duration(),
+	}
+}
+
+// newLogger builds a logger writing to stderr. The config has already been validated
+func newLogger(format, level string) *slog.Logger {
+	parsed, err := logging.ParseLevel(level)
+	if err != nil {
+		fatal(slog.Default(), "Invalid log level", err)
+	}
+	logger, err := logging.New(os.Stderr, format, parsed)
+	if err != nil {
+		fatal(slog.Default(), "Invalid log format", err)
+	}
+	return logger
+}
+
+func fatal(logger *slog.Logger, message string, err error) {
+	logger.Error(message, "error", err)
+	os.Exit(1)
+}
+
+func shutdown(logger *slog.Logger, group *service.Group, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := group.Stop(ctx); err != nil {
+		logger.Warn("Services did not drain in time", "error", err)
+	}
 }
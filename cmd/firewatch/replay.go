@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/capture"
+	"github.com/JeremyFenwick/firewatch/internal/config"
+	"github.com/JeremyFenwick/firewatch/internal/service"
+)
+
+// runReplay implements `firewatch replay <capture file>`. The capture is played against a fresh
+// local instance of the recorded service, or -target, and the responses are compared with the
+// recorded ones. Returns the exit status, 1 if any session differs
+func runReplay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := flags.String("target", "", "host:port of a running server to replay against instead of a local instance")
+	configPath := flags.String("config", "", "config file with the local instance's settings, such as its upstream")
+	speed := flags.Float64("speed", 1, "replay speed, 1 is real time and 0 sends frames back to back")
+	settle := flags.Duration("settle", time.Second, "how long to wait for responses after each session's last frame")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: firewatch replay [flags] <capture file>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	recorded, err := capture.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	address := *target
+	if address == "" {
+		srv, stop, err := startReplayTarget(recorded.Header.Service, *configPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		address = srv.Addr().String()
+		defer stop()
+	}
+
+	results := capture.Replay(context.Background(), recorded, address, capture.Options{Speed: *speed, Settle: *settle})
+	differ := 0
+	for _, result := range results {
+		if result.Match() {
+			fmt.Printf("SAME session %d (%s)\n", result.Session, result.Remote)
+			continue
+		}
+		differ++
+		fmt.Printf("DIFF session %d (%s): %s\n", result.Session, result.Remote, result.Diff())
+	}
+	fmt.Printf("%d sessions replayed, %d differ\n", len(results), differ)
+	if differ > 0 {
+		return 1
+	}
+	return 0
+}
+
+// startReplayTarget starts a local instance of service on a free loopback port. Its storage starts
+// out empty in a temporary directory, which stop removes after stopping the instance
+func startReplayTarget(name, configPath string) (srv service.Service, stop func(), err error) {
+	def, known := service.Lookup(name)
+	if !known {
+		return nil, nil, fmt.Errorf("capture is of unknown service %q", name)
+	}
+	cfg := config.Default()
+	if configPath != "" {
+		loaded, err := config.Load(configPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		cfg = loaded
+	}
+	settings := cfg.Services[name]
+	dataDir := ""
+	if def.Storage {
+		dataDir, err = os.MkdirTemp("", "firewatch-replay")
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not create a data directory: %w", err)
+		}
+		settings.DataDir = dataDir
+	}
+	srv = def.New(settings.Options())
+	srv.SetLogger(newLogger(cfg.Log.Format, "warn").With("service", name))
+	if err := srv.Start("127.0.0.1:0"); err != nil {
+		removeDataDir(dataDir)
+		return nil, nil, fmt.Errorf("could not start %s: %w", name, err)
+	}
+	stop = func() {
+		srv.Stop(context.Background())
+		removeDataDir(dataDir)
+	}
+	return srv, stop, nil
+}
+
+// removeDataDir removes the temporary data directory of a replay target, if it has one
+func removeDataDir(dataDir string) {
+	if dataDir != "" {
+		os.RemoveAll(dataDir)
+	}
+}
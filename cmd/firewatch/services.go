@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/JeremyFenwick/firewatch/internal/config"
+	"github.com/JeremyFenwick/firewatch/internal/service"
+	_ "github.com/JeremyFenwick/firewatch/internal/service/builtin"
+)
+
+// runServices implements `firewatch services`, which lists every registered service and whether
+// the config starts it
+func runServices(args []string) {
+	flags := flag.NewFlagSet("services", flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv("FIREWATCH_CONFIG"), "path to a YAML or JSON config file")
+	flags.Parse(args)
+
+	cfg := config.Default()
+	if *configPath != "" {
+		loaded, err := config.Load(*configPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		cfg = loaded
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTRANSPORT\tDEFAULT PORT\tLISTEN\tENABLED")
+	for _, def := range service.Definitions() {
+		settings := cfg.Services[def.Name]
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%t\n", def.Name, def.Transport, def.Port, settings.ListenAddress(), settings.IsEnabled())
+	}
+	w.Flush()
+}
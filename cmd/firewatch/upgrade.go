@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/JeremyFenwick/firewatch/internal/service"
+)
+
+// A process handing over on SIGUSR2 passes these to its replacement along with LISTEN_FDS and
+// server.HandoffEnv
+const (
+	stateEnv = "FIREWATCH_STATE"    // Directory of service state files
+	readyEnv = "FIREWATCH_READY_FD" // Written to by the new process once its services have started
+)
+
+// How long a new process gets to start its services before the handoff is abandoned
+const upgradeTimeout = 30 * time.Second
+
+// upgrade starts this executable again with the same arguments, handing it every listening socket
+// and the state of the Stateful services. It returns true once the new process is serving, when
+// this one should drain its connections and exit. Otherwise the services that were handed off are
+// started again with restart and this process carries on
+func upgrade(logger *slog.Logger, group *service.Group, timeout time.Duration, restart func(def service.Definition, stateDir string) error) bool {
+	executable, err := os.Executable()
+	if err != nil {
+		logger.Error("Could not find the executable, not upgrading", "error", err)
+		return false
+	}
+	stateDir, err := os.MkdirTemp("", "firewatch-handoff-")
+	if err != nil {
+		logger.Error("Could not create a state directory, not upgrading", "error", err)
+		return false
+	}
+	files := server.Files()
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	logger.Info("Upgrading", "executable", executable, "sockets", len(files))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	handedOff, err := group.Handoff(ctx, stateDir)
+	cancel()
+	if err == nil {
+		var pid int
+		pid, err = startUpgrade(executable, files, stateDir)
+		if err == nil {
+			// The new process removes the state directory once it has loaded it
+			logger.Info("New process is serving, handing over", "pid", pid)
+			return true
+		}
+	}
+	logger.Error("Upgrade failed, carrying on", "error", err)
+
+	// The handed off services stopped reading their sockets, so they take them back
+	if err := server.Inherit(files); err != nil {
+		logger.Error("Could not take back sockets", "error", err)
+	}
+	for _, def := range handedOff {
+		if err := restart(def, stateDir); err != nil {
+			logger.Error("Service failed to restart", "service", def.Name, "error", err)
+		}
+	}
+	server.CloseInherited()
+	os.RemoveAll(stateDir)
+	return false
+}
+
+// startUpgrade starts the new process and waits for it to report that its services have started.
+// It is killed if it does not
+func startUpgrade(executable string, files []*os.File, stateDir string) (int, error) {
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, fmt.Errorf("could not create ready pipe: %w", err)
+	}
+	defer ready.Close()
+
+	// os/exec would put the shared sockets into blocking mode, which stalls the accept loops of
+	// this process while it drains, so the descriptors are passed as they are
+	fds := []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd()}
+	for _, file := range files {
+		fd, err := descriptor(file)
+		if err != nil {
+			readyWriter.Close()
+			return 0, err
+		}
+		fds = append(fds, fd)
+	}
+	fds = append(fds, readyWriter.Fd())
+	env := append(os.Environ(),
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		server.HandoffEnv+"="+strconv.Itoa(os.Getpid()),
+		stateEnv+"="+stateDir,
+		readyEnv+"="+strconv.Itoa(len(fds)-1),
+	)
+	pid, _, err := syscall.StartProcess(executable, os.Args, &syscall.ProcAttr{Env: env, Files: fds})
+	readyWriter.Close()
+	if err != nil {
+		return 0, fmt.Errorf("could not start %s: %w", executable, err)
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return 0, err
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		// The pipe closes without a line if the new process exits
+		_, err := bufio.NewReader(ready).ReadString('\n')
+		if err != nil {
+			err = errors.New("new process exited before its services started")
+		}
+		result <- err
+	}()
+	select {
+	case err = <-result:
+	case <-time.After(upgradeTimeout):
+		err = fmt.Errorf("new process did not start its services within %s", upgradeTimeout)
+	}
+	if err != nil {
+		process.Kill()
+		process.Wait()
+		return 0, err
+	}
+	return pid, nil
+}
+
+// descriptor returns the file descriptor of file without changing its blocking mode, which
+// File.Fd does
+func descriptor(file *os.File) (uintptr, error) {
+	raw, err := file.SyscallConn()
+	if err != nil {
+		return 0, fmt.Errorf("could not pass %s: %w", file.Name(), err)
+	}
+	var fd uintptr
+	err = raw.Control(func(d uintptr) { fd = d })
+	return fd, err
+}
+
+// takeStateDir returns the directory of state handed over by the previous process, if there was one
+func takeStateDir() string {
+	dir := os.Getenv(stateEnv)
+	os.Unsetenv(stateEnv)
+	return dir
+}
+
+// notifyReady tells whoever started this process that its services have started: the firewatch it
+// is taking over from, and systemd when run as a notify service
+func notifyReady(logger *slog.Logger) {
+	if fd, err := strconv.Atoi(os.Getenv(readyEnv)); err == nil {
+		os.Unsetenv(readyEnv)
+		ready := os.NewFile(uintptr(fd), "ready")
+		if _, err := ready.Write([]byte("ready\n")); err != nil {
+			logger.Warn("Could not tell the previous process we are ready", "error", err)
+		}
+		ready.Close()
+	}
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		logger.Warn("Could not notify systemd", "error", err)
+		return
+	}
+	defer conn.Close()
+	// MAINPID lets systemd follow the service to a process that took over from another
+	if _, err := fmt.Fprintf(conn, "READY=1\nMAINPID=%d", os.Getpid()); err != nil {
+		logger.Warn("Could not notify systemd", "error", err)
+	}
+}
@@ -0,0 +1,289 @@
+// Package bench generates concurrent load against a running firewatch service and reports the
+// throughput, latency and errors of each kind of operation. Where check asks whether a service is
+// correct, bench finds out how it behaves with many clients at once
+package bench
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/chaos"
+)
+
+// Defaults for a zero Options
+const (
+	DefaultClients  = 10
+	DefaultDuration = 10 * time.Second
+)
+
+// How long a client that failed waits before starting again
+const restartDelay = 100 * time.Millisecond
+
+// Options controls a run
+type Options struct {
+	Clients  int           // Simulated clients running at once
+	Duration time.Duration // How long to generate load for, including the ramp
+	Ramp     time.Duration // Clients start spread over this long rather than all at once
+	Pause    time.Duration // How long each client waits between operations
+	Faults   chaos.Faults  // Injected into linereversal's datagrams
+}
+
+// Load drives one simulated client until ctx is done, timing each operation with the Worker. If
+// the client can't carry on it returns the error, which it has already recorded against the
+// operation that failed, and is started again after a short delay
+type Load func(ctx context.Context, w *Worker) error
+
+// loads builds the Load for each service. A builder is called once per run, so clients of the same
+// run can share state such as names that must not clash with earlier runs
+var loads = map[string]func() Load{
+	"smoketest":            smoketestLoad,
+	"primetime":            primetimeLoad,
+	"meanstoanend":         meanstoanendLoad,
+	"budgetchat":           budgetchatLoad,
+	"unusualdatabase":      unusualdatabaseLoad,
+	"speeddaemon":          speeddaemonLoad,
+	"linereversal":         linereversalLoad,
+	"mobinthemiddle":       budgetchatLoad,
+	"insecuresocketslayer": insecuresocketslayerLoad,
+	"jobcenter":            jobcenterLoad,
+	"voraciouscodestorage": voraciouscodestorageLoad,
+}
+
+// Services returns the names of every service with a load, sorted
+func Services() []string {
+	names := make([]string, 0, len(loads))
+	for name := range loads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Worker is one simulated client
+type Worker struct {
+	ID      int // From 0 to Clients-1, for loads where clients play different roles
+	Clients int
+	Address string
+	Faults  chaos.Faults
+
+	pause    time.Duration
+	recorder *recorder
+}
+
+// Time runs fn as operation op and records how long it took. Errors caused by the end of the run
+// are not counted
+func (w *Worker) Time(ctx context.Context, op string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	w.Observe(ctx, op, time.Since(start), err)
+	return err
+}
+
+// Observe records an operation timed by the load itself, such as a message that was sent by one
+// client and received by another
+func (w *Worker) Observe(ctx context.Context, op string, latency time.Duration, err error) {
+	if err != nil && ended(ctx) {
+		return
+	}
+	w.recorder.observe(op, latency, err)
+}
+
+// Pause waits between operations. It returns false once ctx is done
+func (w *Worker) Pause(ctx context.Context) bool {
+	return sleep(ctx, w.pause)
+}
+
+// Run generates load against the service at address and reports on it once opts.Duration has
+// passed or ctx is done
+func Run(ctx context.Context, service, address string, opts Options) (*Report, error) {
+	newLoad, ok := loads[service]
+	if !ok {
+		return nil, fmt.Errorf("no load for service %q", service)
+	}
+	if opts.Clients <= 0 {
+		opts.Clients = DefaultClients
+	}
+	if opts.Duration <= 0 {
+		opts.Duration = DefaultDuration
+	}
+	load := newLoad()
+	recorder := &recorder{operations: make(map[string]*operation)}
+	ctx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for id := range opts.Clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !sleep(ctx, opts.Ramp*time.Duration(id)/time.Duration(opts.Clients)) {
+				return
+			}
+			w := &Worker{ID: id, Clients: opts.Clients, Address: address, Faults: opts.Faults, pause: opts.Pause, recorder: recorder}
+			for ctx.Err() == nil {
+				if err := load(ctx, w); err != nil {
+					sleep(ctx, restartDelay)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return recorder.report(service, time.Since(start)), nil
+}
+
+// ended reports whether the run is over. Sockets given ctx's deadline can time out a moment
+// before ctx itself is done
+func ended(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	return ctx.Err() != nil || ok && !time.Now().Before(deadline)
+}
+
+// sleep waits for d. It returns false if ctx was done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// recorder collects every operation of a run
+type recorder struct {
+	mutex      sync.Mutex
+	operations map[string]*operation
+}
+
+type operation struct {
+	latencies  []time.Duration // Of the operations that succeeded
+	errors     int
+	firstError error
+}
+
+func (r *recorder) observe(op string, latency time.Duration, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	o := r.operations[op]
+	if o == nil {
+		o = &operation{}
+		r.operations[op] = o
+	}
+	if err != nil {
+		o.errors++
+		if o.firstError == nil {
+			o.firstError = err
+		}
+		return
+	}
+	o.latencies = append(o.latencies, latency)
+}
+
+func (r *recorder) report(service string, elapsed time.Duration) *Report {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	report := &Report{Service: service, Elapsed: elapsed}
+	for name, o := range r.operations {
+		slices.Sort(o.latencies)
+		stats := Stats{Name: name, Count: len(o.latencies), Errors: o.errors, FirstError: o.firstError}
+		if stats.Count > 0 {
+			stats.Throughput = float64(stats.Count) / elapsed.Seconds()
+			stats.P50 = percentile(o.latencies, 0.5)
+			stats.P90 = percentile(o.latencies, 0.9)
+			stats.P99 = percentile(o.latencies, 0.99)
+			stats.Max = o.latencies[len(o.latencies)-1]
+		}
+		report.Operations = append(report.Operations, stats)
+	}
+	sort.Slice(report.Operations, func(i, j int) bool {
+		return report.Operations[i].Name < report.Operations[j].Name
+	})
+	return report
+}
+
+// percentile returns the latency that fraction p of sorted are at or below
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	index := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(index, 0)]
+}
+
+// Report is the outcome of a run
+type Report struct {
+	Service    string
+	Elapsed    time.Duration
+	Operations []Stats // Sorted by name
+}
+
+// Stats describes one kind of operation. Latencies only cover the operations that succeeded
+type Stats struct {
+	Name       string
+	Count      int     // Succeeded
+	Errors     int     // Failed
+	Throughput float64 // Successes per second
+	P50        time.Duration
+	P90        time.Duration
+	P99        time.Duration
+	Max        time.Duration
+	FirstError error
+}
+
+// Operation returns the stats for the named operation
+func (r *Report) Operation(name string) (Stats, bool) {
+	for _, stats := range r.Operations {
+		if stats.Name == name {
+			return stats, true
+		}
+	}
+	return Stats{}, false
+}
+
+// Errors is the number of operations that failed
+func (r *Report) Errors() int {
+	total := 0
+	for _, stats := range r.Operations {
+		total += stats.Errors
+	}
+	return total
+}
+
+// Write prints the report as a table, followed by the first error of each operation that had one
+func (r *Report) Write(w io.Writer) error {
+	fmt.Fprintf(w, "%s for %s\n", r.Service, r.Elapsed.Round(time.Millisecond))
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "operation\tok\terrors\tper sec\tp50\tp90\tp99\tmax\t")
+	for _, s := range r.Operations {
+		fmt.Fprintf(table, "%s\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\t\n", s.Name, s.Count, s.Errors, s.Throughput,
+			round(s.P50), round(s.P90), round(s.P99), round(s.Max))
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	for _, s := range r.Operations {
+		if s.FirstError != nil {
+			fmt.Fprintf(w, "%s first error: %v\n", s.Name, s.FirstError)
+		}
+	}
+	return nil
+}
+
+// round keeps latencies readable without hiding sub-millisecond ones
+func round(d time.Duration) time.Duration {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond)
+	}
+	return d.Round(100 * time.Microsecond)
+}
@@ -0,0 +1,71 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/pkg/budgetchat"
+)
+
+// How often each chat user says something. Every message goes to every other user, so the load
+// grows with the square of the clients
+const chatInterval = time.Second
+
+// budgetchatLoad has each user join, talk every chatInterval and time how long everyone else's
+// messages take to arrive. It also drives mobinthemiddle, which speaks the same protocol
+func budgetchatLoad() Load {
+	run := rand.IntN(1000000)
+	return func(ctx context.Context, w *Worker) error {
+		var client *budgetchat.Client
+		err := w.Time(ctx, "join", func() error {
+			var err error
+			client, err = budgetchat.Join(ctx, w.Address, fmt.Sprintf("u%dr%d", w.ID, run))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		// Messages carry the time they were sent, so delivery is timed by the receiver
+		failed := make(chan error, 1)
+		go func() {
+			for {
+				event, err := client.Receive(ctx)
+				if err != nil {
+					w.Observe(ctx, "receive", 0, err)
+					failed <- err
+					return
+				}
+				if event.Kind != budgetchat.Message {
+					continue
+				}
+				if sent, err := strconv.ParseInt(event.Text, 10, 64); err == nil {
+					w.Observe(ctx, "deliver", time.Since(time.Unix(0, sent)), nil)
+				}
+			}
+		}()
+
+		// Users start talking at different times so the messages don't arrive in bursts
+		wait := rand.N(chatInterval)
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case err := <-failed:
+				return err
+			case <-time.After(wait + w.pause):
+			}
+			wait = chatInterval
+			err := w.Time(ctx, "send", func() error {
+				return client.Send(ctx, strconv.FormatInt(time.Now().UnixNano(), 10))
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+
+	"github.com/JeremyFenwick/firewatch/pkg/isl"
+)
+
+// insecuresocketslayerLoad sends lists of five toys through xor(123), addpos, reversebits and
+// checks the server picks the one with the most copies
+func insecuresocketslayerLoad() Load {
+	return func(ctx context.Context, w *Worker) error {
+		client, err := isl.NewClient(w.Address, []byte{0x02, 0x7b, 0x05, 0x01, 0x00})
+		if err != nil {
+			w.Observe(ctx, "request", 0, err)
+			return err
+		}
+		defer client.Close()
+		for w.Pause(ctx) {
+			toys := make([]string, 5)
+			best, most := "", -1
+			for i := range toys {
+				copies := rand.IntN(1000)
+				toys[i] = fmt.Sprintf("%dx toy %d", copies, i)
+				if copies > most {
+					best, most = toys[i], copies
+				}
+			}
+			err := w.Time(ctx, "request", func() error {
+				toy, err := client.MostCopies(ctx, strings.Join(toys, ","))
+				if err == nil && toy != best {
+					err = fmt.Errorf("got %q, want %q", toy, best)
+				}
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,48 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+
+	"github.com/JeremyFenwick/firewatch/pkg/jobcenter"
+)
+
+// jobcenterLoad makes half the clients producers that put jobs with random priorities in four
+// queues, and the other half consumers that wait for a job from any of them and delete it
+func jobcenterLoad() Load {
+	run := rand.IntN(1000000)
+	queues := make([]string, 4)
+	for i := range queues {
+		queues[i] = fmt.Sprintf("bench-%d-%d", run, i)
+	}
+	return func(ctx context.Context, w *Worker) error {
+		client := jobcenter.NewClient(w.Address)
+		defer client.Close()
+		for w.Pause(ctx) {
+			var err error
+			if w.ID%2 == 0 {
+				err = w.Time(ctx, "put", func() error {
+					_, err := client.Put(ctx, queues[rand.IntN(len(queues))], map[string]any{"worker": w.ID}, rand.IntN(100))
+					return err
+				})
+			} else {
+				var job *jobcenter.Job
+				err = w.Time(ctx, "get", func() error {
+					var err error
+					job, err = client.Get(ctx, queues, true)
+					return err
+				})
+				if err == nil {
+					err = w.Time(ctx, "delete", func() error {
+						return client.Delete(ctx, job.ID)
+					})
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
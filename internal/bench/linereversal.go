@@ -0,0 +1,72 @@
+package bench
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/chaos"
+	"github.com/JeremyFenwick/firewatch/pkg/lrcp"
+)
+
+// linereversalLoad opens an LRCP session and sends 100 letter lines, checking each comes back
+// reversed. The session's datagrams go through the run's faults, so loss costs a retransmission
+func linereversalLoad() Load {
+	return func(ctx context.Context, w *Worker) error {
+		var dialer lrcp.Dialer
+		if w.Faults != (chaos.Faults{}) {
+			socket, err := net.ListenPacket("udp", ":0")
+			if err != nil {
+				w.Observe(ctx, "connect", 0, err)
+				return err
+			}
+			dialer.Socket = chaos.PacketConn(socket, w.Faults)
+		}
+		var conn *lrcp.Conn
+		err := w.Time(ctx, "connect", func() error {
+			var err error
+			conn, err = dialer.Dial(ctx, w.Address)
+			return err
+		})
+		if err != nil {
+			if dialer.Socket != nil {
+				dialer.Socket.Close()
+			}
+			return err
+		}
+		defer conn.Close()
+		stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Unix(1, 0)) })
+		defer stop()
+
+		reader := bufio.NewReader(conn)
+		line := make([]byte, 100)
+		for w.Pause(ctx) {
+			for i := range line {
+				line[i] = byte('a' + rand.IntN(26))
+			}
+			err := w.Time(ctx, "line", func() error {
+				if _, err := conn.Write(append(line, '\n')); err != nil {
+					return err
+				}
+				reply, err := reader.ReadString('\n')
+				if err != nil {
+					return err
+				}
+				want := slices.Clone(line)
+				slices.Reverse(want)
+				if reply != string(want)+"\n" {
+					return fmt.Errorf("sent %q, got %q back", line, reply)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
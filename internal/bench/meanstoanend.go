@@ -0,0 +1,32 @@
+package bench
+
+import (
+	"context"
+	"math/rand/v2"
+
+	"github.com/JeremyFenwick/firewatch/pkg/meanstoanend"
+)
+
+// meanstoanendLoad inserts prices at increasing timestamps and asks for the mean of the last ten
+// after every tenth
+func meanstoanendLoad() Load {
+	return func(ctx context.Context, w *Worker) error {
+		client := meanstoanend.NewClient(w.Address)
+		defer client.Close()
+		for timestamp := int32(1); w.Pause(ctx); timestamp++ {
+			err := w.Time(ctx, "insert", func() error {
+				return client.Insert(ctx, timestamp, rand.Int32N(1000))
+			})
+			if err == nil && timestamp%10 == 0 {
+				err = w.Time(ctx, "mean", func() error {
+					_, err := client.Mean(ctx, timestamp-9, timestamp)
+					return err
+				})
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
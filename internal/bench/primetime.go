@@ -0,0 +1,35 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"math/rand/v2"
+
+	"github.com/JeremyFenwick/firewatch/pkg/primetime"
+)
+
+// primetimeLoad asks about random numbers, checking each answer
+func primetimeLoad() Load {
+	return func(ctx context.Context, w *Worker) error {
+		client := primetime.NewClient(w.Address)
+		defer client.Close()
+		for w.Pause(ctx) {
+			number := rand.Int64N(1 << 40)
+			err := w.Time(ctx, "isPrime", func() error {
+				prime, err := client.IsPrime(ctx, number)
+				if err != nil {
+					return err
+				}
+				if prime != big.NewInt(number).ProbablyPrime(20) {
+					return fmt.Errorf("wrong answer for %d", number)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,36 @@
+package bench
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand/v2"
+
+	"github.com/JeremyFenwick/firewatch/pkg/smoketest"
+)
+
+// smoketestLoad echoes 4KB of random bytes over a new connection each time
+func smoketestLoad() Load {
+	return func(ctx context.Context, w *Worker) error {
+		data := make([]byte, 4096)
+		for w.Pause(ctx) {
+			for i := range data {
+				data[i] = byte(rand.IntN(256))
+			}
+			err := w.Time(ctx, "echo", func() error {
+				echoed, err := smoketest.Echo(ctx, w.Address, data)
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(echoed, data) {
+					return fmt.Errorf("echoed %d bytes that differ from the %d sent", len(echoed), len(data))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
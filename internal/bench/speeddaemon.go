@@ -0,0 +1,78 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/pkg/speeddaemon"
+)
+
+// speedRoads is how many roads the cameras are spread over
+const speedRoads = 16
+
+// speeddaemonLoad makes one client in ten a dispatcher for every road and the rest pairs of
+// cameras ten miles apart. Every car they see is speeding, so each pair of plates produces a
+// ticket, timed from the second plate until a dispatcher receives it
+func speeddaemonLoad() Load {
+	run := rand.IntN(1000000)
+	var due sync.Map // Plate -> when its ticket became due
+	return func(ctx context.Context, w *Worker) error {
+		if w.ID%10 == 0 {
+			return dispatch(ctx, w, &due)
+		}
+		return watchRoad(ctx, w, run, &due)
+	}
+}
+
+func dispatch(ctx context.Context, w *Worker, due *sync.Map) error {
+	roads := make([]speeddaemon.U16, speedRoads)
+	for i := range roads {
+		roads[i] = speeddaemon.U16(i)
+	}
+	dispatcher := speeddaemon.NewDispatcher(w.Address, roads...)
+	defer dispatcher.Close()
+	for {
+		ticket, err := dispatcher.Ticket(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			w.Observe(ctx, "ticket", 0, err)
+			return err
+		}
+		if since, ok := due.LoadAndDelete(ticket.Plate); ok {
+			w.Observe(ctx, "ticket", time.Since(since.(time.Time)), nil)
+		}
+	}
+}
+
+func watchRoad(ctx context.Context, w *Worker, run int, due *sync.Map) error {
+	road := speeddaemon.U16(w.ID % speedRoads)
+	entry := speeddaemon.NewCamera(w.Address, road, 0, 60)
+	defer entry.Close()
+	exit := speeddaemon.NewCamera(w.Address, road, 10, 60)
+	defer exit.Close()
+	for n := 0; w.Pause(ctx); n++ {
+		plate := speeddaemon.Str(fmt.Sprintf("R%dW%dN%d", run, w.ID, n))
+		// 10 miles in 5 minutes is 120mph
+		timestamp := speeddaemon.U32(n * 600)
+		err := w.Time(ctx, "plate", func() error {
+			return entry.Observe(ctx, plate, timestamp)
+		})
+		if err != nil {
+			return err
+		}
+		due.Store(plate, time.Now())
+		err = w.Time(ctx, "plate", func() error {
+			return exit.Observe(ctx, plate, timestamp+300)
+		})
+		if err != nil {
+			due.Delete(plate)
+			return err
+		}
+	}
+	return nil
+}
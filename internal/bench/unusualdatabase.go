@@ -0,0 +1,47 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+
+	"github.com/JeremyFenwick/firewatch/pkg/unusualdatabase"
+)
+
+// unusualdatabaseLoad sets a key of its own and reads it back. Datagrams can overtake each other,
+// so the value may still be the one before
+func unusualdatabaseLoad() Load {
+	run := rand.IntN(1000000)
+	return func(ctx context.Context, w *Worker) error {
+		client, err := unusualdatabase.Dial(ctx, w.Address)
+		if err != nil {
+			w.Observe(ctx, "insert", 0, err)
+			return err
+		}
+		defer client.Close()
+		key := fmt.Sprintf("bench-%d-%d", run, w.ID)
+		previous := ""
+		for n := 0; w.Pause(ctx); n++ {
+			value := strconv.Itoa(n)
+			err := w.Time(ctx, "insert", func() error {
+				return client.Insert(ctx, key, value)
+			})
+			if err != nil {
+				return err
+			}
+			err = w.Time(ctx, "retrieve", func() error {
+				got, err := client.Retrieve(ctx, key)
+				if err == nil && got != value && got != previous {
+					err = fmt.Errorf("%s is %q, want %q", key, got, value)
+				}
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			previous = value
+		}
+		return nil
+	}
+}
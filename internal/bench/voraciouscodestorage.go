@@ -0,0 +1,47 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+
+	"github.com/JeremyFenwick/firewatch/pkg/vcs"
+)
+
+// voraciouscodestorageLoad puts new revisions of ten files per client, reading back four times for
+// every put and listing the client's directory every twentieth operation
+func voraciouscodestorageLoad() Load {
+	run := rand.IntN(1000000)
+	return func(ctx context.Context, w *Worker) error {
+		client := vcs.NewClient(w.Address)
+		defer client.Close()
+		dir := fmt.Sprintf("/bench%d/w%d", run, w.ID)
+		var last string
+		for n := 0; w.Pause(ctx); n++ {
+			var err error
+			switch {
+			case n%20 == 19:
+				err = w.Time(ctx, "list", func() error {
+					_, err := client.List(ctx, dir)
+					return err
+				})
+			case n%5 == 0:
+				last = fmt.Sprintf("%s/file%d.txt", dir, n/5%10)
+				data := fmt.Sprintf("revision %d of %s\n", n, last)
+				err = w.Time(ctx, "put", func() error {
+					_, err := client.Put(ctx, last, []byte(data))
+					return err
+				})
+			default:
+				err = w.Time(ctx, "get", func() error {
+					_, err := client.Get(ctx, last)
+					return err
+				})
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
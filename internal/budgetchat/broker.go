@@ -2,15 +2,17 @@ package budgetchat
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 	"sync"
 )
 
 type broker struct {
-	mutex   sync.Mutex
-	users   map[string]chan<- string
-	channel chan *brokerMessage
+	quit     chan struct{}
+	quitOnce sync.Once
+	mutex    sync.Mutex
+	users    map[string]chan<- string
+	channel  chan *brokerMessage
 }
 
 type messageType int
@@ -39,7 +41,12 @@ func newBrokerMessage(op messageType, sender, payload string, senderChannel chan
 
 func (b *broker) initateBroker() {
 	for {
-		message := <-b.channel
+		var message *brokerMessage
+		select {
+		case <-b.quit:
+			return
+		case message = <-b.channel:
+		}
 		switch message.op {
 		case register:
 			registerUser(b, message.sender, message.senderChannel)
@@ -48,11 +55,23 @@ func (b *broker) initateBroker() {
 		case logoff:
 			userLogoff(b, message.sender)
 		default:
-			log.Printf("Unknown message type received: %d", message.op)
+			slog.Error("Unknown broker message type received", "service", "budgetchat", "op", message.op)
 		}
 	}
 }
 
+func (b *broker) stop() {
+	b.quitOnce.Do(func() { close(b.quit) })
+}
+
+// roomSize returns the number of users in the chat room
+func (b *broker) roomSize() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return len(b.users)
+}
+
 func registerUser(b *broker, name string, userChannel chan<- string) error {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
@@ -5,68 +5,164 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"strings"
 	"unicode"
+
+	"github.com/JeremyFenwick/firewatch/internal/capture"
+	"github.com/JeremyFenwick/firewatch/internal/logging"
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/JeremyFenwick/firewatch/internal/service"
 )
 
+var errInvalidName = errors.New("invalid name")
+
 type user struct {
 	name      string
 	ctx       context.Context
 	cancelCtx context.CancelFunc
-	logger    *log.Logger
+	logger    *slog.Logger
 	conn      net.Conn
 	broker    *broker
 	scanner   *bufio.Scanner
 	channel   chan string
 }
 
-func Listen(port int) {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+type Server struct {
+	broker  *broker
+	metrics *metrics.Service
+	logger  *slog.Logger
+	tcp     server.TCPServer
+}
+
+func init() {
+	service.Register(service.Definition{
+		Name:      "budgetchat",
+		Transport: service.TCP,
+		Port:      5003,
+		New:       func(service.Options) service.Service { return NewServer() },
+	})
+}
 
-	broker := &broker{
-		users:   make(map[string]chan<- string, 0),
-		channel: make(chan *brokerMessage, 50),
+func NewServer() *Server {
+	s := &Server{
+		broker: &broker{
+			quit:    make(chan struct{}),
+			users:   make(map[string]chan<- string, 0),
+			channel: make(chan *brokerMessage, 50),
+		},
+		metrics: metrics.NewService("budgetchat"),
 	}
-	go broker.initateBroker()
+	s.metrics.RegisterGaugeFunc("budgetchat_room_size", "Users currently in the chat room", func() float64 {
+		return float64(s.broker.roomSize())
+	})
+	go s.broker.initateBroker()
+	s.tcp.Metrics = s.metrics
+	s.SetLogger(slog.Default().With("service", "budgetchat"))
+	s.tcp.Handler = func(ctx context.Context, conn net.Conn) {
+		handleConnection(ctx, conn, s.broker, s.metrics)
+	}
+	return s
+}
+
+// Serve accepts connections on listener until the server is stopped
+func (s *Server) Serve(listener net.Listener) error {
+	s.logger.Info("Budget chat listening", "address", listener.Addr().String())
+	return s.tcp.Serve(listener)
+}
 
-	listener, err := net.Listen("tcp4", fmt.Sprintf(":%d", port))
+// Start listens on address and serves in the background. Use port 0 to pick a free port
+func (s *Server) Start(address string) error {
+	listener, err := server.Listen(address)
 	if err != nil {
-		log.Fatal("Could not start listener. REASON: " + err.Error())
+		return fmt.Errorf("could not start listener: %w", err)
 	}
-	log.Printf("Means to an end listening on port %d\n", port)
-	defer listener.Close()
+	s.logger.Info("Budget chat listening", "address", listener.Addr().String())
+	return s.tcp.Start(listener)
+}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Println("Encountered error accepting connection. REASON: " + err.Error())
-			continue
-		}
+// Addr returns the listening address, or nil before the server has started
+func (s *Server) Addr() net.Addr {
+	return s.tcp.Addr()
+}
 
-		go handleConnection(conn, broker)
-	}
+// Err returns why the server stopped accepting connections on its own, or nil while it is serving
+func (s *Server) Err() error {
+	return s.tcp.Err()
+}
+
+// Metrics returns the server's counters so they can be added to a metrics.Registry
+func (s *Server) Metrics() *metrics.Service {
+	return s.metrics
 }
 
-func handleConnection(conn net.Conn, broker *broker) {
+// SetLogger replaces the server's logger. Call it before the server is started
+func (s *Server) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+	s.tcp.Logger = logger
+}
+
+// SetLimits sets the connection limits. Call it before the server is started
+func (s *Server) SetLimits(limits server.Limits) {
+	s.tcp.Limits = limits
+}
+
+// SetTLS serves every connection over TLS. Call it before the server is started
+func (s *Server) SetTLS(t *server.TLS) {
+	s.tcp.TLS = t
+}
+
+// SetProxyProtocol expects connections to open with a PROXY protocol header giving the real client
+// address. Call it before the server is started
+func (s *Server) SetProxyProtocol(enabled bool) {
+	s.tcp.ProxyProtocol = enabled
+}
+
+// SetRecorder captures the traffic of every connection to r. Call it before the server is started
+func (s *Server) SetRecorder(r *capture.Recorder) {
+	s.tcp.Recorder = r
+}
+
+// Sessions lists the connected clients
+func (s *Server) Sessions() []server.SessionInfo {
+	return s.tcp.Sessions()
+}
+
+// Disconnect closes the client connection with id. Returns false if there is none
+func (s *Server) Disconnect(id uint64) bool {
+	return s.tcp.Disconnect(id)
+}
+
+// Stop stops accepting connections and lets chatting users stay until ctx expires
+func (s *Server) Stop(ctx context.Context) error {
+	err := s.tcp.Stop(ctx)
+	s.broker.stop()
+	return err
+}
+
+func handleConnection(serverCtx context.Context, conn net.Conn, broker *broker, m *metrics.Service) {
 	defer conn.Close()
 
 	scanner := bufio.NewScanner(conn)
-	logger := log.New(log.Writer(),
-		fmt.Sprintf("[%s] ", conn.RemoteAddr().String()),
-		log.Flags()|log.Lmsgprefix|log.Lshortfile)
+	logger := logging.FromContext(serverCtx)
 	// Get the username
 	userName, err := getUserName(conn, scanner)
+	if errors.Is(err, errInvalidName) {
+		m.ProtocolErrors.Inc()
+	}
 	if err != nil {
-		logger.Println(err)
+		logger.Debug("Could not get a name", "error", err)
 		return
 	}
+	server.SessionFromContext(serverCtx).SetIdentity(userName)
 	// Register the user
 	userChannel := make(chan string, 10)
 	broker.channel <- newBrokerMessage(register, userName, "", userChannel)
 	// Join the chat and begin reading and writing
-	ctx, cancelCtx := context.WithCancel(context.Background())
+	logger = logger.With("user", userName)
+	ctx, cancelCtx := context.WithCancel(serverCtx)
 	user := user{
 		name:      userName,
 		ctx:       ctx,
@@ -77,7 +173,7 @@ func handleConnection(conn net.Conn, broker *broker) {
 		scanner:   scanner,
 		channel:   userChannel,
 	}
-	logger.Println("User joined the chat")
+	logger.Debug("User joined the chat")
 	go userReader(&user)
 	userWriter(&user)
 }
@@ -96,9 +192,8 @@ func getUserName(conn net.Conn, scanner *bufio.Scanner) (string, error) {
 	// Validate the username
 	userName, err := validate(scanner.Bytes())
 	if err != nil {
-		message := fmt.Sprintf("Invalid name: %s\n", err)
-		conn.Write([]byte(message))
-		return "", errors.New(message)
+		conn.Write([]byte(fmt.Sprintf("Invalid name: %s\n", err)))
+		return "", fmt.Errorf("%w: %v", errInvalidName, err)
 	}
 	return userName, nil
 }
@@ -107,18 +202,18 @@ func userReader(user *user) {
 	for {
 		select {
 		case <-user.ctx.Done():
-			user.logger.Println("Reader done")
+			user.logger.Debug("Reader done")
 			return
 		default:
 			gotSomething := user.scanner.Scan()
 			if !gotSomething {
-				user.logger.Println("Unexpected error reading scan")
+				user.logger.Debug("User left the chat", "error", user.scanner.Err())
 				user.cancelCtx()
 				user.broker.channel <- newBrokerMessage(logoff, user.name, "", nil)
 				return
 			}
 			message := user.scanner.Text()
-			user.logger.Println(message)
+			user.logger.Debug("Received message", "message", message)
 			user.broker.channel <- newBrokerMessage(send, user.name, message, nil)
 		}
 	}
@@ -128,12 +223,12 @@ func userWriter(user *user) {
 	for {
 		select {
 		case <-user.ctx.Done():
-			user.logger.Println("Writer done")
+			user.logger.Debug("Writer done")
 			return
 		case message := <-user.channel:
 			_, err := user.conn.Write([]byte(message + "\n"))
 			if err != nil {
-				user.logger.Printf("%s: Error writing to client: %s", user.name, err)
+				user.logger.Debug("Error writing to client", "error", err)
 				user.cancelCtx()
 				user.broker.channel <- newBrokerMessage(logoff, user.name, "", nil)
 				return
@@ -0,0 +1,97 @@
+// Package capture records the traffic of a service to a file and replays it against another
+// instance so the responses can be compared
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Event says what a frame records
+type Event string
+
+const (
+	Open  Event = "open"  // A client connected, or a UDP peer sent its first datagram
+	In    Event = "in"    // Bytes read from the client
+	Out   Event = "out"   // Bytes written to the client
+	EOF   Event = "eof"   // The client finished sending, possibly with a half close
+	Close Event = "close" // The connection was closed, or a UDP peer went idle
+)
+
+// Header is the first line of a capture file
+type Header struct {
+	Service   string    `json:"service"`
+	Transport string    `json:"transport"` // tcp or udp
+	Started   time.Time `json:"started"`
+}
+
+// Frame is a single timestamped event on one session. A session is a TCP connection or all the
+// datagrams exchanged with one UDP peer
+type Frame struct {
+	Time    time.Time `json:"time"`
+	Session uint64    `json:"session"`
+	Event   Event     `json:"event"`
+	Remote  string    `json:"remote,omitempty"`
+	Data    []byte    `json:"data,omitempty"`
+}
+
+// Capture is a capture file read back into memory
+type Capture struct {
+	Header Header
+	Frames []Frame
+}
+
+// ReadFile reads a capture file written by a Recorder
+func ReadFile(path string) (*Capture, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open capture: %w", err)
+	}
+	defer file.Close()
+	return Read(file)
+}
+
+// Read reads a capture. A frame cut short by a crash is dropped, anything else malformed is an
+// error
+func Read(r io.Reader) (*Capture, error) {
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	var capture Capture
+	if err := decoder.Decode(&capture.Header); err != nil {
+		return nil, fmt.Errorf("could not read capture header: %w", err)
+	}
+	if capture.Header.Transport != "tcp" && capture.Header.Transport != "udp" {
+		return nil, fmt.Errorf("capture has unknown transport %q", capture.Header.Transport)
+	}
+	for {
+		var frame Frame
+		err := decoder.Decode(&frame)
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return &capture, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read frame %d: %w", len(capture.Frames)+1, err)
+		}
+		capture.Frames = append(capture.Frames, frame)
+	}
+}
+
+// Sessions returns the frames of each session, in the order the sessions opened
+func (c *Capture) Sessions() [][]Frame {
+	var sessions [][]Frame
+	index := make(map[uint64]int)
+	for _, frame := range c.Frames {
+		i, exists := index[frame.Session]
+		if !exists {
+			i = len(sessions)
+			index[frame.Session] = i
+			sessions = append(sessions, nil)
+		}
+		sessions[i] = append(sessions[i], frame)
+	}
+	return sessions
+}
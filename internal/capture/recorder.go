@@ -0,0 +1,203 @@
+package capture
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Recorder writes the traffic of wrapped connections to a capture file. It is safe for
+// concurrent use. Recording stops at the first write error, which Close returns
+type Recorder struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+	closer  io.Closer
+	session uint64
+	err     error
+}
+
+// Create truncates path and starts a capture of service, which listens on transport
+func Create(path, service, transport string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not create capture: %w", err)
+	}
+	r, err := NewRecorder(file, service, transport)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	r.closer = file
+	return r, nil
+}
+
+// NewRecorder starts a capture written to w
+func NewRecorder(w io.Writer, service, transport string) (*Recorder, error) {
+	r := &Recorder{encoder: json.NewEncoder(w)}
+	header := Header{Service: service, Transport: transport, Started: time.Now()}
+	if err := r.encoder.Encode(header); err != nil {
+		return nil, fmt.Errorf("could not write capture header: %w", err)
+	}
+	return r, nil
+}
+
+// Close stops recording and closes the file opened by Create
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	err := r.err
+	if r.err == nil {
+		r.err = net.ErrClosed
+	}
+	if r.closer != nil {
+		if closeErr := r.closer.Close(); err == nil {
+			err = closeErr
+		}
+		r.closer = nil
+	}
+	return err
+}
+
+func (r *Recorder) newSession() uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.session++
+	return r.session
+}
+
+func (r *Recorder) write(session uint64, event Event, remote string, data []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.err != nil {
+		return
+	}
+	frame := Frame{Time: time.Now(), Session: session, Event: event, Remote: remote, Data: data}
+	r.err = r.encoder.Encode(frame)
+}
+
+// Conn wraps conn so everything read from and written to it is recorded as a new session
+func (r *Recorder) Conn(conn net.Conn) net.Conn {
+	c := &recordedConn{Conn: conn, recorder: r, session: r.newSession()}
+	r.write(c.session, Open, conn.RemoteAddr().String(), nil)
+	return c
+}
+
+type recordedConn struct {
+	net.Conn
+	recorder  *Recorder
+	session   uint64
+	eofOnce   sync.Once
+	closeOnce sync.Once
+}
+
+func (c *recordedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.recorder.write(c.session, In, "", b[:n])
+	}
+	if err == io.EOF {
+		c.eofOnce.Do(func() { c.recorder.write(c.session, EOF, "", nil) })
+	}
+	return n, err
+}
+
+func (c *recordedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.recorder.write(c.session, Out, "", b[:n])
+	}
+	return n, err
+}
+
+func (c *recordedConn) Close() error {
+	c.closeOnce.Do(func() { c.recorder.write(c.session, Close, "", nil) })
+	return c.Conn.Close()
+}
+
+// A UDP peer's session is closed once it has been idle for PeerIdleTimeout, or when MaxPeers others
+// have been seen more recently
+const (
+	PeerIdleTimeout = 5 * time.Minute
+	MaxPeers        = 10_000
+)
+
+// PacketConn wraps conn so every datagram is recorded. Each peer address gets its own session
+func (r *Recorder) PacketConn(conn net.PacketConn) net.PacketConn {
+	return &recordedPacketConn{PacketConn: conn, recorder: r, order: list.New(), peers: make(map[string]*list.Element)}
+}
+
+type recordedPacketConn struct {
+	net.PacketConn
+	recorder *Recorder
+	mutex    sync.Mutex
+	order    *list.List // Of *peer, most recently seen first
+	peers    map[string]*list.Element
+}
+
+type peer struct {
+	remote   string
+	session  uint64
+	lastSeen time.Time
+}
+
+// session returns the session for a peer, opening one the first time the peer is seen or after its
+// last one was closed
+func (c *recordedPacketConn) session(addr net.Addr) uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	c.closeIdle(now)
+	remote := addr.String()
+	if element, exists := c.peers[remote]; exists {
+		p := element.Value.(*peer)
+		p.lastSeen = now
+		c.order.MoveToFront(element)
+		return p.session
+	}
+	if c.order.Len() >= MaxPeers {
+		c.closePeer(c.order.Back())
+	}
+	p := &peer{remote: remote, session: c.recorder.newSession(), lastSeen: now}
+	c.peers[remote] = c.order.PushFront(p)
+	c.recorder.write(p.session, Open, remote, nil)
+	return p.session
+}
+
+// closeIdle closes the sessions of peers idle for PeerIdleTimeout. The caller holds c.mutex
+func (c *recordedPacketConn) closeIdle(now time.Time) {
+	for oldest := c.order.Back(); oldest != nil && now.Sub(oldest.Value.(*peer).lastSeen) >= PeerIdleTimeout; oldest = c.order.Back() {
+		c.closePeer(oldest)
+	}
+}
+
+// closePeer records the end of a peer's session and forgets it. The caller holds c.mutex
+func (c *recordedPacketConn) closePeer(element *list.Element) {
+	p := c.order.Remove(element).(*peer)
+	delete(c.peers, p.remote)
+	c.recorder.write(p.session, Close, "", nil)
+}
+
+func (c *recordedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if addr != nil {
+		c.recorder.write(c.session(addr), In, "", b[:n])
+	}
+	return n, addr, err
+}
+
+func (c *recordedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	if err == nil {
+		c.recorder.write(c.session(addr), Out, "", b[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,185 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Options control how a capture is replayed
+type Options struct {
+	// Speed scales the gaps between recorded frames: 1 replays in real time, 2 at double speed.
+	// 0 sends every frame as soon as the one before it has been sent
+	Speed float64
+	// Settle is how long a session keeps listening for responses after its last recorded frame
+	Settle time.Duration
+}
+
+// Result compares what the server sent on one session when it was recorded with what it sent
+// during the replay. UDP datagrams are each followed by a newline
+type Result struct {
+	Session uint64
+	Remote  string // The address of the recorded client
+	Want    []byte
+	Got     []byte
+	Err     error // Set if the session could not be replayed
+}
+
+// How many bytes either side of the first difference Diff shows
+const diffContext = 32
+
+// Match reports whether the replayed responses are identical to the recorded ones
+func (r Result) Match() bool {
+	return r.Err == nil && bytes.Equal(r.Want, r.Got)
+}
+
+// Diff describes the first difference between the recorded and replayed responses, or returns
+// an empty string if there is none
+func (r Result) Diff() string {
+	if r.Err != nil {
+		return r.Err.Error()
+	}
+	i := 0
+	for i < len(r.Want) && i < len(r.Got) && r.Want[i] == r.Got[i] {
+		i++
+	}
+	if i == len(r.Want) && i == len(r.Got) {
+		return ""
+	}
+	return fmt.Sprintf("responses differ at byte %d: want %q, got %q", i, excerpt(r.Want, i), excerpt(r.Got, i))
+}
+
+func excerpt(b []byte, i int) []byte {
+	return b[max(0, i-diffContext):min(len(b), i+diffContext)]
+}
+
+// Replay plays every session in the capture against the server at address, keeping the sessions'
+// relative timing, and returns one result per session in the order they opened
+func Replay(ctx context.Context, c *Capture, address string, options Options) []Result {
+	sessions := c.Sessions()
+	if len(sessions) == 0 {
+		return nil
+	}
+	p := &player{
+		network: c.Header.Transport,
+		address: address,
+		options: options,
+		origin:  sessions[0][0].Time,
+		start:   time.Now(),
+	}
+	results := make([]Result, len(sessions))
+	var wg sync.WaitGroup
+	for i, frames := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = p.replay(ctx, frames)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+type player struct {
+	network string
+	address string
+	options Options
+	origin  time.Time // When the first recorded session opened
+	start   time.Time // When the replay started
+}
+
+// wait sleeps until the replay reaches the point at which a frame was recorded
+func (p *player) wait(ctx context.Context, at time.Time) error {
+	if p.options.Speed <= 0 {
+		return ctx.Err()
+	}
+	offset := time.Duration(float64(at.Sub(p.origin)) / p.options.Speed)
+	timer := time.NewTimer(time.Until(p.start.Add(offset)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *player) replay(ctx context.Context, frames []Frame) Result {
+	result := Result{Session: frames[0].Session, Remote: frames[0].Remote}
+	for _, frame := range frames {
+		if frame.Event == Out {
+			result.Want = append(result.Want, frame.Data...)
+			if p.network == "udp" {
+				result.Want = append(result.Want, '\n')
+			}
+		}
+	}
+	if err := p.wait(ctx, frames[0].Time); err != nil {
+		result.Err = err
+		return result
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, p.network, p.address)
+	if err != nil {
+		result.Err = fmt.Errorf("could not connect: %w", err)
+		return result
+	}
+	received := p.receive(conn)
+
+	for _, frame := range frames {
+		if err := p.wait(ctx, frame.Time); err != nil {
+			result.Err = err
+			break
+		}
+		switch frame.Event {
+		case In:
+			_, err = conn.Write(frame.Data)
+		case EOF:
+			if tcp, ok := conn.(*net.TCPConn); ok {
+				err = tcp.CloseWrite()
+			}
+		}
+		if err != nil {
+			// The server may have hung up, which the responses will show
+			break
+		}
+	}
+	// Give the server a chance to send late responses, unless it has already hung up
+	select {
+	case <-received.done:
+	case <-time.After(p.options.Settle):
+	case <-ctx.Done():
+	}
+	conn.Close()
+	<-received.done
+	result.Got = received.data
+	return result
+}
+
+type responses struct {
+	data []byte
+	done chan struct{}
+}
+
+// receive collects everything the server sends until the connection is closed
+func (p *player) receive(conn net.Conn) *responses {
+	r := &responses{done: make(chan struct{})}
+	go func() {
+		defer close(r.done)
+		buffer := make([]byte, 64*1024)
+		for {
+			n, err := conn.Read(buffer)
+			r.data = append(r.data, buffer[:n]...)
+			if p.network == "udp" && err == nil {
+				r.data = append(r.data, '\n')
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return r
+}
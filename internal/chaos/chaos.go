@@ -0,0 +1,318 @@
+// Package chaos wraps connections to inject the faults real networks produce: latency, lost,
+// duplicated and reordered datagrams, and streams that arrive in pieces. Services are meant to
+// cope with all of them, so tests and staging builds run them behind these wrappers
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a split write waits between pieces, so they reach the peer as separate segments
+const pieceGap = time.Millisecond
+
+// Faults says which faults to inject. Probabilities are from 0 (never) to 1 (always)
+type Faults struct {
+	Latency    time.Duration // Added to every read and write
+	Jitter     time.Duration // Up to this much more latency, picked each time
+	Loss       float64       // Datagrams dropped
+	Duplicate  float64       // Datagrams delivered twice
+	Reorder    float64       // Datagrams held back until the next one has been delivered
+	ShortRead  float64       // Stream reads that return only part of the data available
+	ShortWrite float64       // Stream writes sent in several pieces
+	Seed       uint64        // Makes the faults repeatable. Zero picks a random seed
+}
+
+// Parse reads faults written as comma separated settings, such as
+// "latency=20ms,jitter=10ms,loss=0.05,duplicate=0.01,reorder=0.05,short_read=0.5,short_write=0.5,seed=1"
+func Parse(spec string) (Faults, error) {
+	var f Faults
+	for _, setting := range strings.Split(spec, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(setting, "=")
+		if !ok {
+			return Faults{}, fmt.Errorf("invalid fault %q, want name=value", setting)
+		}
+		var err error
+		switch key {
+		case "latency":
+			f.Latency, err = time.ParseDuration(value)
+		case "jitter":
+			f.Jitter, err = time.ParseDuration(value)
+		case "loss":
+			f.Loss, err = probability(value)
+		case "duplicate":
+			f.Duplicate, err = probability(value)
+		case "reorder":
+			f.Reorder, err = probability(value)
+		case "short_read":
+			f.ShortRead, err = probability(value)
+		case "short_write":
+			f.ShortWrite, err = probability(value)
+		case "seed":
+			f.Seed, err = strconv.ParseUint(value, 10, 64)
+		default:
+			return Faults{}, fmt.Errorf("unknown fault %q", key)
+		}
+		if err != nil {
+			return Faults{}, fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+	if f.Latency < 0 || f.Jitter < 0 {
+		return Faults{}, errors.New("latency and jitter can't be negative")
+	}
+	return f, nil
+}
+
+func probability(value string) (float64, error) {
+	p, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 1 {
+		return 0, fmt.Errorf("%v is not between 0 and 1", p)
+	}
+	return p, nil
+}
+
+// random is a source of faults safe for concurrent use
+type random struct {
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+func newRandom(seed uint64) *random {
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	return &random{rand: rand.New(rand.NewPCG(seed, seed))}
+}
+
+// chance reports true with probability p
+func (r *random) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.rand.Float64() < p
+}
+
+// between returns a number from 1 to n
+func (r *random) between(n int) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return 1 + r.rand.IntN(n)
+}
+
+func (r *random) uint64() uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.rand.Uint64()
+}
+
+func (r *random) delay(f Faults) time.Duration {
+	if f.Jitter <= 0 {
+		return f.Latency
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return f.Latency + time.Duration(r.rand.Int64N(int64(f.Jitter)))
+}
+
+// Listener wraps every connection l accepts with Conn
+func Listener(l net.Listener, f Faults) net.Listener {
+	return &listener{Listener: l, faults: f, random: newRandom(f.Seed)}
+}
+
+type listener struct {
+	net.Listener
+	faults Faults
+	random *random
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	// Each connection gets its own faults, repeatable from the listener's seed
+	f := l.faults
+	f.Seed = l.random.uint64()
+	return Conn(conn, f), nil
+}
+
+// Conn wraps a stream connection. Reads and writes are delayed, reads can return part of what
+// arrived and writes can be sent in pieces. The data itself is never lost or changed
+func Conn(conn net.Conn, f Faults) net.Conn {
+	return &chaosConn{Conn: conn, faults: f, random: newRandom(f.Seed)}
+}
+
+type chaosConn struct {
+	net.Conn
+	faults Faults
+	random *random
+
+	// Only used by the reader
+	unread  []byte // Arrived but not yet returned after a short read
+	readErr error  // Returned once unread is empty
+}
+
+func (c *chaosConn) Read(b []byte) (int, error) {
+	if len(c.unread) == 0 {
+		if c.readErr != nil {
+			err := c.readErr
+			c.readErr = nil
+			return 0, err
+		}
+		n, err := c.Conn.Read(b)
+		if n == 0 {
+			return 0, err
+		}
+		c.unread = append(c.unread[:0], b[:n]...)
+		c.readErr = err
+		time.Sleep(c.random.delay(c.faults))
+	}
+	n := copy(b, c.unread)
+	if n > 1 && c.random.chance(c.faults.ShortRead) {
+		n = c.random.between(n - 1)
+	}
+	c.unread = c.unread[n:]
+	return n, nil
+}
+
+func (c *chaosConn) Write(b []byte) (int, error) {
+	time.Sleep(c.random.delay(c.faults))
+	if len(b) < 2 || !c.random.chance(c.faults.ShortWrite) {
+		return c.Conn.Write(b)
+	}
+	written := 0
+	for written < len(b) {
+		if written > 0 {
+			time.Sleep(pieceGap)
+		}
+		piece := c.random.between(len(b) - written)
+		n, err := c.Conn.Write(b[written : written+piece])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// CloseWrite half closes the connection if the wrapped one can
+func (c *chaosConn) CloseWrite() error {
+	if closer, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// PacketConn wraps a datagram socket. Datagrams in both directions can be delayed, lost,
+// duplicated or held back until the next one has gone through. A held back datagram stays held
+// until another one arrives or is sent
+func PacketConn(conn net.PacketConn, f Faults) net.PacketConn {
+	return &chaosPacketConn{PacketConn: conn, faults: f, random: newRandom(f.Seed)}
+}
+
+type datagram struct {
+	data []byte
+	addr net.Addr
+}
+
+type chaosPacketConn struct {
+	net.PacketConn
+	faults Faults
+	random *random
+
+	readMutex sync.Mutex
+	queued    []datagram // Read already, delivered before reading again
+	heldIn    *datagram
+
+	writeMutex sync.Mutex
+	heldOut    *datagram
+}
+
+func (c *chaosPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	for len(c.queued) == 0 {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+		if c.random.chance(c.faults.Loss) {
+			continue
+		}
+		in := datagram{data: append([]byte(nil), b[:n]...), addr: addr}
+		if c.heldIn == nil && c.random.chance(c.faults.Reorder) {
+			c.heldIn = &in
+			continue
+		}
+		c.queued = append(c.queued, in)
+		if c.heldIn != nil {
+			c.queued = append(c.queued, *c.heldIn)
+			c.heldIn = nil
+		}
+		if c.random.chance(c.faults.Duplicate) {
+			c.queued = append(c.queued, in)
+		}
+	}
+	in := c.queued[0]
+	c.queued = c.queued[1:]
+	time.Sleep(c.random.delay(c.faults))
+	return copy(b, in.data), in.addr, nil
+}
+
+// WriteTo reports every datagram as sent, including those it drops or sends later
+func (c *chaosPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if c.random.chance(c.faults.Loss) {
+		return len(b), nil
+	}
+	out := datagram{data: append([]byte(nil), b...), addr: addr}
+	if c.heldOut == nil && c.random.chance(c.faults.Reorder) {
+		c.heldOut = &out
+		return len(b), nil
+	}
+	err := c.send(out)
+	if c.heldOut != nil {
+		c.send(*c.heldOut)
+		c.heldOut = nil
+	}
+	if c.random.chance(c.faults.Duplicate) {
+		c.send(out)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// send writes a datagram now, or in the background once its latency has passed
+func (c *chaosPacketConn) send(out datagram) error {
+	delay := c.random.delay(c.faults)
+	if delay <= 0 {
+		_, err := c.PacketConn.WriteTo(out.data, out.addr)
+		return err
+	}
+	time.AfterFunc(delay, func() { c.PacketConn.WriteTo(out.data, out.addr) })
+	return nil
+}
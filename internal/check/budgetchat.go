@@ -0,0 +1,83 @@
+package check
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+var budgetchatCases = []Case{
+	{Name: "join, chat and leave", Run: checkChat},
+	{Name: "illegal name", Run: checkIllegalName},
+}
+
+// joinChat connects and picks name. Returns the room membership line
+func joinChat(ctx context.Context, address, name string) (*lineClient, string, error) {
+	client, err := dialLines(ctx, address)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := client.readLine(); err != nil {
+		client.close()
+		return nil, "", fmt.Errorf("no welcome message: %w", err)
+	}
+	if err := client.send(name); err != nil {
+		client.close()
+		return nil, "", err
+	}
+	room, err := client.readLine()
+	if err != nil {
+		client.close()
+		return nil, "", fmt.Errorf("no room list after joining as %s: %w", name, err)
+	}
+	if !strings.HasPrefix(room, "*") {
+		client.close()
+		return nil, "", fmt.Errorf("room list %q does not start with *", room)
+	}
+	return client, room, nil
+}
+
+func checkChat(ctx context.Context, address string) error {
+	alice, bob := unique("alice"), unique("bob")
+	aliceClient, _, err := joinChat(ctx, address, alice)
+	if err != nil {
+		return err
+	}
+	defer aliceClient.close()
+	bobClient, room, err := joinChat(ctx, address, bob)
+	if err != nil {
+		return err
+	}
+	defer bobClient.close()
+	if !strings.Contains(room, alice) {
+		return fmt.Errorf("room list %q does not name %s", room, alice)
+	}
+	if err := aliceClient.expectEventually(fmt.Sprintf("* %s has entered the room", bob)); err != nil {
+		return err
+	}
+	if err := bobClient.send("hello alice"); err != nil {
+		return err
+	}
+	if err := aliceClient.expectEventually(fmt.Sprintf("[%s] hello alice", bob)); err != nil {
+		return err
+	}
+	bobClient.close()
+	return aliceClient.expectEventually(fmt.Sprintf("* %s has left the room", bob))
+}
+
+func checkIllegalName(ctx context.Context, address string) error {
+	for _, name := range []string{"", "not allowed!", strings.Repeat("a", 100)} {
+		client, err := dialLines(ctx, address)
+		if err != nil {
+			return err
+		}
+		client.readLine()
+		client.send(name)
+		err = client.expectClosed()
+		client.close()
+		if err != nil {
+			return fmt.Errorf("name %q: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+// Package check holds conformance suites that exercise a running firewatch service over the
+// network, the same way the protohackers grader does
+package check
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// DefaultTimeout is how long a single case may run
+const DefaultTimeout = 10 * time.Second
+
+// Case is a single scenario. Run opens its own connections to address and must give up once
+// ctx is done
+type Case struct {
+	Name string
+	Run  func(ctx context.Context, address string) error
+}
+
+var suites = map[string][]Case{
+	"smoketest":            smoketestCases,
+	"primetime":            primetimeCases,
+	"meanstoanend":         meanstoanendCases,
+	"budgetchat":           budgetchatCases,
+	"unusualdatabase":      unusualdatabaseCases,
+	"speeddaemon":          speeddaemonCases,
+	"linereversal":         linereversalCases,
+	"mobinthemiddle":       mobinthemiddleCases,
+	"insecuresocketslayer": insecuresocketslayerCases,
+	"jobcenter":            jobcenterCases,
+	"voraciouscodestorage": voraciouscodestorageCases,
+	"pestcontrol":          pestcontrolCases,
+}
+
+// Services returns the names of every service with a suite, sorted
+func Services() []string {
+	names := make([]string, 0, len(suites))
+	for name := range suites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Suite returns the cases for a service
+func Suite(service string) ([]Case, bool) {
+	cases, ok := suites[service]
+	return cases, ok
+}
+
+// Run runs the service's suite against address and writes a PASS or FAIL line per case to w.
+// Each case gets timeout to finish. Returns the number of cases that failed
+func Run(ctx context.Context, service, address string, timeout time.Duration, w io.Writer) (int, error) {
+	cases, ok := Suite(service)
+	if !ok {
+		return 0, fmt.Errorf("no suite for service %q", service)
+	}
+	failed := 0
+	for _, c := range cases {
+		caseCtx, cancel := context.WithTimeout(ctx, timeout)
+		start := time.Now()
+		err := c.Run(caseCtx, address)
+		elapsed := time.Since(start).Round(time.Millisecond)
+		cancel()
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "FAIL %s/%s (%s): %v\n", service, c.Name, elapsed, err)
+			continue
+		}
+		fmt.Fprintf(w, "PASS %s/%s (%s)\n", service, c.Name, elapsed)
+	}
+	fmt.Fprintf(w, "%d passed, %d failed\n", len(cases)-failed, failed)
+	return failed, nil
+}
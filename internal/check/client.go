@@ -0,0 +1,175 @@
+package check
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+)
+
+// dial connects to address and applies the ctx deadline to the connection
+func dial(ctx context.Context, network, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+// unique returns a name that won't clash with earlier runs against the same deployment
+func unique(prefix string) string {
+	return fmt.Sprintf("%s%d", prefix, rand.Uint32())
+}
+
+// lineClient speaks a newline delimited protocol
+type lineClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialLines(ctx context.Context, address string) (*lineClient, error) {
+	conn, err := dial(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &lineClient{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func (c *lineClient) send(line string) error {
+	_, err := c.conn.Write([]byte(line + "\n"))
+	if err != nil {
+		return fmt.Errorf("could not send %q: %w", line, err)
+	}
+	return nil
+}
+
+// readLine returns the next line without its newline
+func (c *lineClient) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("could not read a line: %w", err)
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+// expect reads the next line and checks it is want
+func (c *lineClient) expect(want string) error {
+	line, err := c.readLine()
+	if err != nil {
+		return fmt.Errorf("waiting for %q: %w", want, err)
+	}
+	if line != want {
+		return fmt.Errorf("got %q, want %q", line, want)
+	}
+	return nil
+}
+
+// expectEventually skips lines until one is want. Used where other clients may be talking
+func (c *lineClient) expectEventually(want string) error {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return fmt.Errorf("waiting for %q: %w", want, err)
+		}
+		if line == want {
+			return nil
+		}
+	}
+}
+
+func (c *lineClient) expectClosed() error {
+	return expectClosed(c.reader)
+}
+
+func (c *lineClient) close() {
+	c.conn.Close()
+}
+
+// expectClosed reads until the server closes the connection
+func expectClosed(r io.Reader) error {
+	_, err := io.Copy(io.Discard, r)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errors.New("server did not close the connection")
+	}
+	// A reset is as good as a close
+	return nil
+}
+
+// udpClient sends datagrams and waits for replies, resending on loss
+type udpClient struct {
+	conn net.Conn
+}
+
+// How long a datagram is given to be answered before it is sent again
+const udpRetry = 500 * time.Millisecond
+
+func dialUDP(ctx context.Context, address string) (*udpClient, error) {
+	conn, err := dial(ctx, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &udpClient{conn: conn}, nil
+}
+
+func (c *udpClient) send(payload string) error {
+	_, err := c.conn.Write([]byte(payload))
+	if err != nil {
+		return fmt.Errorf("could not send %q: %w", payload, err)
+	}
+	return nil
+}
+
+// receive returns the next datagram, or a timeout error after wait
+func (c *udpClient) receive(ctx context.Context, wait time.Duration) (string, error) {
+	deadline := time.Now().Add(wait)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	c.conn.SetReadDeadline(deadline)
+	buffer := make([]byte, 1000)
+	n, err := c.conn.Read(buffer)
+	if err != nil {
+		return "", err
+	}
+	return string(buffer[:n]), nil
+}
+
+// request sends payload until a reply is accepted by match or ctx is done
+func (c *udpClient) request(ctx context.Context, payload string, match func(reply string) bool) (string, error) {
+	for ctx.Err() == nil {
+		if err := c.send(payload); err != nil {
+			return "", err
+		}
+		for {
+			reply, err := c.receive(ctx, udpRetry)
+			if err != nil {
+				break
+			}
+			if match(reply) {
+				return reply, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no reply to %q", payload)
+}
+
+func (c *udpClient) close() {
+	c.conn.Close()
+}
+
+func expectEqual[T comparable](what string, got, want T) error {
+	if got != want {
+		return fmt.Errorf("%s: got %v, want %v", what, got, want)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package check
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/JeremyFenwick/firewatch/pkg/isl"
+)
+
+var insecuresocketslayerCases = []Case{
+	{Name: "cipher", Run: checkCipher},
+	{Name: "no-op cipher", Run: checkNoOpCipher},
+}
+
+// islClient encodes what it sends and decodes what it reads with the session cipher
+type islClient struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	cipher   *isl.Cipher
+	sent     int
+	received int
+}
+
+func (c *islClient) send(line string) error {
+	encoded := c.cipher.EncodeData(c.sent, []byte(line+"\n"))
+	c.sent += len(encoded)
+	_, err := c.conn.Write(encoded)
+	return err
+}
+
+func (c *islClient) readLine() (string, error) {
+	var line []byte
+	for {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return "", fmt.Errorf("reading a line: %w", err)
+		}
+		decoded := c.cipher.DecodeData(c.received, []byte{b})[0]
+		c.received++
+		if decoded == '\n' {
+			return string(line), nil
+		}
+		line = append(line, decoded)
+	}
+}
+
+func checkCipher(ctx context.Context, address string) error {
+	conn, err := dial(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// xor(123), addpos, reversebits from the problem statement
+	spec := []byte{0x02, 0x7b, 0x05, 0x01, 0x00}
+	cipher, err := isl.NewCipher(spec)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(spec); err != nil {
+		return err
+	}
+	client := &islClient{conn: conn, reader: bufio.NewReader(conn), cipher: cipher}
+	requests := []struct{ request, response string }{
+		{"4x dog,5x car", "5x car"},
+		{"3x rat,2x cat", "3x rat"},
+		{"10x toy car,15x dog on a string,4x inflatable motorcycle", "15x dog on a string"},
+	}
+	for _, r := range requests {
+		if err := client.send(r.request); err != nil {
+			return err
+		}
+		line, err := client.readLine()
+		if err != nil {
+			return err
+		}
+		if err := expectEqual("most common toy", line, r.response); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkNoOpCipher(ctx context.Context, address string) error {
+	for _, spec := range [][]byte{{0x00}, {0x02, 0x00, 0x00}, {0x02, 0xab, 0x02, 0xab, 0x00}} {
+		conn, err := dial(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+		conn.Write(spec)
+		err = expectClosed(conn)
+		conn.Close()
+		if err != nil {
+			return fmt.Errorf("cipher %x: %w", spec, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package check
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+var jobcenterCases = []Case{
+	{Name: "put, get and delete", Run: checkPutGetDelete},
+	{Name: "highest priority first", Run: checkPriority},
+	{Name: "abort", Run: checkAbort},
+	{Name: "disconnect aborts jobs", Run: checkDisconnectAborts},
+	{Name: "wait for a job", Run: checkWait},
+	{Name: "invalid request", Run: checkInvalidJobRequest},
+}
+
+type jobResponse struct {
+	Status string `json:"status"`
+	ID     *int   `json:"id"`
+	Job    any    `json:"job"`
+	Pri    *int   `json:"pri"`
+	Queue  string `json:"queue"`
+}
+
+// jobRequest sends request and returns the parsed response
+func jobRequest(client *lineClient, request map[string]any) (*jobResponse, error) {
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.send(string(encoded)); err != nil {
+		return nil, err
+	}
+	line, err := client.readLine()
+	if err != nil {
+		return nil, err
+	}
+	var response jobResponse
+	if err := json.Unmarshal([]byte(line), &response); err != nil {
+		return nil, fmt.Errorf("response %q is not JSON: %w", line, err)
+	}
+	return &response, nil
+}
+
+func putJob(client *lineClient, queue string, priority int) (int, error) {
+	response, err := jobRequest(client, map[string]any{"request": "put", "queue": queue, "job": map[string]any{"title": "check"}, "pri": priority})
+	if err != nil {
+		return 0, err
+	}
+	if response.Status != "ok" || response.ID == nil {
+		return 0, fmt.Errorf("put returned status %q", response.Status)
+	}
+	return *response.ID, nil
+}
+
+// getJob returns the id of the job handed out, or an error if there was none
+func getJob(client *lineClient, queue string, wait bool) (*jobResponse, error) {
+	response, err := jobRequest(client, map[string]any{"request": "get", "queues": []string{queue}, "wait": wait})
+	if err != nil {
+		return nil, err
+	}
+	if response.Status != "ok" || response.ID == nil {
+		return nil, fmt.Errorf("get returned status %q", response.Status)
+	}
+	return response, nil
+}
+
+func expectStatus(client *lineClient, request map[string]any, want string) error {
+	response, err := jobRequest(client, request)
+	if err != nil {
+		return err
+	}
+	return expectEqual(fmt.Sprintf("status of %v", request["request"]), response.Status, want)
+}
+
+func checkPutGetDelete(ctx context.Context, address string) error {
+	client, err := dialLines(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	queue := unique("queue")
+	id, err := putJob(client, queue, 123)
+	if err != nil {
+		return err
+	}
+	job, err := getJob(client, queue, false)
+	if err != nil {
+		return err
+	}
+	if err := expectEqual("job id", *job.ID, id); err != nil {
+		return err
+	}
+	if err := expectEqual("job queue", job.Queue, queue); err != nil {
+		return err
+	}
+	if err := expectStatus(client, map[string]any{"request": "delete", "id": id}, "ok"); err != nil {
+		return err
+	}
+	if err := expectStatus(client, map[string]any{"request": "delete", "id": id}, "no-job"); err != nil {
+		return err
+	}
+	return expectStatus(client, map[string]any{"request": "get", "queues": []string{queue}}, "no-job")
+}
+
+func checkPriority(ctx context.Context, address string) error {
+	client, err := dialLines(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	first, second := unique("queue"), unique("queue")
+	if _, err := putJob(client, first, 1); err != nil {
+		return err
+	}
+	high, err := putJob(client, second, 50)
+	if err != nil {
+		return err
+	}
+	response, err := jobRequest(client, map[string]any{"request": "get", "queues": []string{first, second}})
+	if err != nil {
+		return err
+	}
+	if response.ID == nil {
+		return fmt.Errorf("get returned status %q", response.Status)
+	}
+	return expectEqual("job id", *response.ID, high)
+}
+
+func checkAbort(ctx context.Context, address string) error {
+	client, err := dialLines(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	queue := unique("queue")
+	id, err := putJob(client, queue, 1)
+	if err != nil {
+		return err
+	}
+	if _, err := getJob(client, queue, false); err != nil {
+		return err
+	}
+	if err := expectStatus(client, map[string]any{"request": "abort", "id": id}, "ok"); err != nil {
+		return err
+	}
+	job, err := getJob(client, queue, false)
+	if err != nil {
+		return fmt.Errorf("aborted job was not requeued: %w", err)
+	}
+	return expectEqual("job id", *job.ID, id)
+}
+
+func checkDisconnectAborts(ctx context.Context, address string) error {
+	worker, err := dialLines(ctx, address)
+	if err != nil {
+		return err
+	}
+	queue := unique("queue")
+	id, err := putJob(worker, queue, 1)
+	if err != nil {
+		worker.close()
+		return err
+	}
+	if _, err := getJob(worker, queue, false); err != nil {
+		worker.close()
+		return err
+	}
+	worker.close()
+
+	client, err := dialLines(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	job, err := getJob(client, queue, true)
+	if err != nil {
+		return err
+	}
+	return expectEqual("job id", *job.ID, id)
+}
+
+func checkWait(ctx context.Context, address string) error {
+	waiter, err := dialLines(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer waiter.close()
+	queue := unique("queue")
+	got := make(chan *jobResponse, 1)
+	errs := make(chan error, 1)
+	go func() {
+		job, err := getJob(waiter, queue, true)
+		if err != nil {
+			errs <- err
+			return
+		}
+		got <- job
+	}()
+
+	client, err := dialLines(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	id, err := putJob(client, queue, 1)
+	if err != nil {
+		return err
+	}
+	select {
+	case job := <-got:
+		return expectEqual("job id", *job.ID, id)
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("waiting client never got the job: %w", ctx.Err())
+	}
+}
+
+func checkInvalidJobRequest(ctx context.Context, address string) error {
+	client, err := dialLines(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	for _, request := range []string{`not json`, `{"request":"nope"}`, `{"queue":"q"}`} {
+		if err := client.send(request); err != nil {
+			return err
+		}
+		line, err := client.readLine()
+		if err != nil {
+			return err
+		}
+		var response jobResponse
+		json.Unmarshal([]byte(line), &response)
+		if err := expectEqual(fmt.Sprintf("status for %s", request), response.Status, "error"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package check
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+var linereversalCases = []Case{
+	{Name: "reverse a line", Run: checkReverseLine},
+	{Name: "retransmit unacked data", Run: checkRetransmit},
+	{Name: "unknown session", Run: checkUnknownSession},
+}
+
+// lrcpClient is one LRCP session
+type lrcpClient struct {
+	*udpClient
+	session int
+}
+
+func dialLRCP(ctx context.Context, address string) (*lrcpClient, error) {
+	client, err := dialUDP(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	c := &lrcpClient{udpClient: client, session: rand.IntN(1 << 30)}
+	ack := fmt.Sprintf("/ack/%d/0/", c.session)
+	if _, err := c.request(ctx, fmt.Sprintf("/connect/%d/", c.session), func(reply string) bool { return reply == ack }); err != nil {
+		client.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// expectAll waits for every packet in want, ignoring anything else such as duplicates
+func (c *lrcpClient) expectAll(ctx context.Context, want ...string) error {
+	missing := make(map[string]bool)
+	for _, packet := range want {
+		missing[packet] = true
+	}
+	for len(missing) > 0 {
+		packet, err := c.receive(ctx, time.Hour)
+		if err != nil {
+			return fmt.Errorf("still waiting for %q: %w", want, err)
+		}
+		delete(missing, packet)
+	}
+	return nil
+}
+
+func (c *lrcpClient) closeSession(ctx context.Context) error {
+	reply := fmt.Sprintf("/close/%d/", c.session)
+	_, err := c.request(ctx, reply, func(packet string) bool { return packet == reply })
+	return err
+}
+
+func checkReverseLine(ctx context.Context, address string) error {
+	client, err := dialLRCP(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	if err := client.send(fmt.Sprintf("/data/%d/0/hello\\/world\n/", client.session)); err != nil {
+		return err
+	}
+	if err := client.expectAll(ctx,
+		fmt.Sprintf("/ack/%d/12/", client.session),
+		fmt.Sprintf("/data/%d/0/dlrow\\/olleh\n/", client.session)); err != nil {
+		return err
+	}
+	if err := client.send(fmt.Sprintf("/ack/%d/12/", client.session)); err != nil {
+		return err
+	}
+	return client.closeSession(ctx)
+}
+
+func checkRetransmit(ctx context.Context, address string) error {
+	client, err := dialLRCP(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	data := fmt.Sprintf("/data/%d/0/olleh\n/", client.session)
+	if err := client.send(fmt.Sprintf("/data/%d/0/hello\n/", client.session)); err != nil {
+		return err
+	}
+	if err := client.expectAll(ctx, data); err != nil {
+		return err
+	}
+	// Without an ack the server has to send the data again
+	if err := client.expectAll(ctx, data); err != nil {
+		return fmt.Errorf("data was not retransmitted: %w", err)
+	}
+	if err := client.send(fmt.Sprintf("/ack/%d/6/", client.session)); err != nil {
+		return err
+	}
+	return client.closeSession(ctx)
+}
+
+func checkUnknownSession(ctx context.Context, address string) error {
+	client, err := dialUDP(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	session := rand.IntN(1 << 30)
+	want := fmt.Sprintf("/close/%d/", session)
+	_, err = client.request(ctx, fmt.Sprintf("/data/%d/0/hello\n/", session), func(reply string) bool { return reply == want })
+	return err
+}
@@ -0,0 +1,110 @@
+package check
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+var meanstoanendCases = []Case{
+	{Name: "example session", Run: checkMeansExample},
+	{Name: "empty and reversed ranges", Run: checkMeansEmpty},
+	{Name: "sessions are separate", Run: checkMeansSeparate},
+}
+
+func meansMessage(kind byte, first, second int32) []byte {
+	message := make([]byte, 9)
+	message[0] = kind
+	binary.BigEndian.PutUint32(message[1:], uint32(first))
+	binary.BigEndian.PutUint32(message[5:], uint32(second))
+	return message
+}
+
+func meansQuery(conn net.Conn, minTime, maxTime int32) (int32, error) {
+	if _, err := conn.Write(meansMessage('Q', minTime, maxTime)); err != nil {
+		return 0, err
+	}
+	var response [4]byte
+	if _, err := io.ReadFull(conn, response[:]); err != nil {
+		return 0, fmt.Errorf("reading the query response: %w", err)
+	}
+	return int32(binary.BigEndian.Uint32(response[:])), nil
+}
+
+func checkMeansExample(ctx context.Context, address string) error {
+	conn, err := dial(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// Sent as one write to make sure the server does its own framing
+	var inserts []byte
+	inserts = append(inserts, meansMessage('I', 12345, 101)...)
+	inserts = append(inserts, meansMessage('I', 12346, 102)...)
+	inserts = append(inserts, meansMessage('I', 12347, 100)...)
+	inserts = append(inserts, meansMessage('I', 40960, 5)...)
+	if _, err := conn.Write(inserts); err != nil {
+		return err
+	}
+	mean, err := meansQuery(conn, 12288, 16384)
+	if err != nil {
+		return err
+	}
+	return expectEqual("mean", mean, 101)
+}
+
+func checkMeansEmpty(ctx context.Context, address string) error {
+	conn, err := dial(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(meansMessage('I', 1000, -50)); err != nil {
+		return err
+	}
+	mean, err := meansQuery(conn, 2000, 3000)
+	if err != nil {
+		return err
+	}
+	if err := expectEqual("mean of an empty range", mean, 0); err != nil {
+		return err
+	}
+	mean, err = meansQuery(conn, 1001, 999)
+	if err != nil {
+		return err
+	}
+	if err := expectEqual("mean of a reversed range", mean, 0); err != nil {
+		return err
+	}
+	mean, err = meansQuery(conn, 1000, 1000)
+	if err != nil {
+		return err
+	}
+	return expectEqual("mean of a negative price", mean, -50)
+}
+
+func checkMeansSeparate(ctx context.Context, address string) error {
+	first, err := dial(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer first.Close()
+	second, err := dial(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer second.Close()
+	if _, err := first.Write(meansMessage('I', 1, 100)); err != nil {
+		return err
+	}
+	if _, err := meansQuery(first, 1, 1); err != nil {
+		return err
+	}
+	mean, err := meansQuery(second, 0, 10)
+	if err != nil {
+		return err
+	}
+	return expectEqual("mean seen by another client", mean, 0)
+}
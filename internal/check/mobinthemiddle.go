@@ -0,0 +1,43 @@
+package check
+
+import (
+	"context"
+	"fmt"
+)
+
+// The proxy must behave like the chat it sits in front of, apart from the rewritten addresses
+var mobinthemiddleCases = []Case{
+	{Name: "join, chat and leave", Run: checkChat},
+	{Name: "boguscoin rewrite", Run: checkBoguscoinRewrite},
+}
+
+// Tony's address from the problem statement
+const tonysBoguscoin = "7YWHMfk9JZe0LM0g1ZauHuiSxhI"
+
+func checkBoguscoinRewrite(ctx context.Context, address string) error {
+	alice, bob := unique("alice"), unique("bob")
+	aliceClient, _, err := joinChat(ctx, address, alice)
+	if err != nil {
+		return err
+	}
+	defer aliceClient.close()
+	bobClient, _, err := joinChat(ctx, address, bob)
+	if err != nil {
+		return err
+	}
+	defer bobClient.close()
+	messages := []struct{ sent, received string }{
+		{"Send it to 7F1u3wSD5RbOHQmupo9nx4TnhQ please", "Send it to " + tonysBoguscoin + " please"},
+		{"7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX", tonysBoguscoin},
+		{"This is a product ID, not 7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T-1234", "This is a product ID, not 7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T-1234"},
+	}
+	for _, message := range messages {
+		if err := bobClient.send(message.sent); err != nil {
+			return err
+		}
+		if err := aliceClient.expectEventually(fmt.Sprintf("[%s] %s", bob, message.received)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package check
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+
+	"github.com/JeremyFenwick/firewatch/pkg/pestcontrol"
+)
+
+var pestcontrolCases = []Case{
+	{Name: "hello", Run: checkPestHello},
+	{Name: "bad checksum", Run: checkBadChecksum},
+	{Name: "visit before hello", Run: checkVisitBeforeHello},
+}
+
+// dialPest connects and checks the server opens with a valid hello
+func dialPest(ctx context.Context, address string) (*lineClient, error) {
+	client, err := dialLines(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	message, err := pestcontrol.ReadMessage(client.reader)
+	if err != nil {
+		client.close()
+		return nil, fmt.Errorf("could not read hello: %w", err)
+	}
+	if hello, ok := message.(*pestcontrol.HelloMessage); !ok || !hello.Valid() {
+		client.close()
+		return nil, fmt.Errorf("server opened with message 0x%02x instead of a valid hello", message.GetType())
+	}
+	return client, nil
+}
+
+func (c *lineClient) sendMessage(message pestcontrol.Message) error {
+	encoded, err := message.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(encoded)
+	return err
+}
+
+// expectPestError checks the server replies with an Error and then hangs up
+func expectPestError(reader *bufio.Reader) error {
+	message, err := pestcontrol.ReadMessage(reader)
+	if err != nil {
+		return fmt.Errorf("waiting for an error: %w", err)
+	}
+	if _, ok := message.(*pestcontrol.ErrorMessage); !ok {
+		return fmt.Errorf("got message 0x%02x, want an error", message.GetType())
+	}
+	return expectClosed(reader)
+}
+
+func checkPestHello(ctx context.Context, address string) error {
+	client, err := dialPest(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	return client.sendMessage(&pestcontrol.HelloMessage{Protocol: pestcontrol.Protocol, Version: pestcontrol.Version})
+}
+
+func checkBadChecksum(ctx context.Context, address string) error {
+	client, err := dialPest(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	hello, err := (&pestcontrol.HelloMessage{Protocol: pestcontrol.Protocol, Version: pestcontrol.Version}).Encode()
+	if err != nil {
+		return err
+	}
+	hello[len(hello)-1]++
+	if _, err := client.conn.Write(hello); err != nil {
+		return err
+	}
+	return expectPestError(client.reader)
+}
+
+func checkVisitBeforeHello(ctx context.Context, address string) error {
+	client, err := dialPest(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	if err := client.sendMessage(&pestcontrol.SiteVisitMessage{Site: 1}); err != nil {
+		return err
+	}
+	return expectPestError(client.reader)
+}
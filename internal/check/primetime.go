@@ -0,0 +1,143 @@
+package check
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var primetimeCases = []Case{
+	{Name: "primes", Run: checkPrimes},
+	{Name: "pipelined requests", Run: checkPipelinedPrimes},
+	{Name: "malformed requests", Run: checkMalformedPrimes},
+}
+
+type primeResponse struct {
+	Method *string `json:"method"`
+	Prime  *bool   `json:"prime"`
+}
+
+// parsePrimeResponse returns an error unless line is a well formed response
+func parsePrimeResponse(line string) (bool, error) {
+	var response primeResponse
+	if err := json.Unmarshal([]byte(line), &response); err != nil {
+		return false, fmt.Errorf("response %q is not JSON: %w", line, err)
+	}
+	if response.Method == nil || *response.Method != "isPrime" || response.Prime == nil {
+		return false, fmt.Errorf("response %q is not an isPrime response", line)
+	}
+	return *response.Prime, nil
+}
+
+var primeRequests = []struct {
+	number string
+	prime  bool
+}{
+	{"7", true},
+	{"8", false},
+	{"1", false},
+	{"-7", false},
+	{"7.5", false},
+	{"7919", true},
+	{"2147483647", true},
+	{"7.0", true},
+	{"2305843009213693951", true},  // Above 2^53, so a float64 can't hold it
+	{"2305843009213693953", false}, // Rounds to the same float64 as 2^61-1
+	{"618970019642690137449562111", true},
+	{"618970019642690137449562113", false},
+}
+
+func checkPrimes(ctx context.Context, address string) error {
+	client, err := dialLines(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	for _, request := range primeRequests {
+		if err := client.send(fmt.Sprintf(`{"method":"isPrime","number":%s}`, request.number)); err != nil {
+			return err
+		}
+		line, err := client.readLine()
+		if err != nil {
+			return err
+		}
+		prime, err := parsePrimeResponse(line)
+		if err != nil {
+			return err
+		}
+		if err := expectEqual("prime("+request.number+")", prime, request.prime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkPipelinedPrimes(ctx context.Context, address string) error {
+	client, err := dialLines(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	var batch strings.Builder
+	for _, request := range primeRequests {
+		fmt.Fprintf(&batch, `{"number":%s,"method":"isPrime","extra":true}`+"\n", request.number)
+	}
+	if _, err := io.WriteString(client.conn, batch.String()); err != nil {
+		return err
+	}
+	for _, request := range primeRequests {
+		line, err := client.readLine()
+		if err != nil {
+			return err
+		}
+		prime, err := parsePrimeResponse(line)
+		if err != nil {
+			return err
+		}
+		if err := expectEqual("prime("+request.number+")", prime, request.prime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var malformedPrimeRequests = []string{
+	`not json`,
+	`{"method":"isPrime"}`,
+	`{"method":"isPrime","number":"7"}`,
+	`{"method":"isComposite","number":7}`,
+	`{"number":7}`,
+}
+
+// checkMalformedPrimes expects a single malformed response and a disconnect for each request
+func checkMalformedPrimes(ctx context.Context, address string) error {
+	for _, request := range malformedPrimeRequests {
+		client, err := dialLines(ctx, address)
+		if err != nil {
+			return err
+		}
+		err = func() error {
+			defer client.close()
+			if err := client.send(request); err != nil {
+				return err
+			}
+			response, err := io.ReadAll(client.reader)
+			if err != nil {
+				return fmt.Errorf("request %q: %w", request, err)
+			}
+			if len(response) == 0 {
+				return fmt.Errorf("request %q: disconnected without a malformed response", request)
+			}
+			if _, err := parsePrimeResponse(strings.TrimSpace(string(response))); err == nil {
+				return fmt.Errorf("request %q: got a well formed response %q", request, response)
+			}
+			return nil
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
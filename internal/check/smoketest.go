@@ -0,0 +1,71 @@
+package check
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+var smoketestCases = []Case{
+	{Name: "echo", Run: checkEcho},
+	{Name: "concurrent clients", Run: checkConcurrentEcho},
+}
+
+// checkEcho sends binary data, half closes and expects exactly the same bytes back
+func checkEcho(ctx context.Context, address string) error {
+	payload := make([]byte, 100*1024)
+	rand.Read(payload)
+	return echo(ctx, address, payload)
+}
+
+func checkConcurrentEcho(ctx context.Context, address string) error {
+	errs := make(chan error, 5)
+	var wg sync.WaitGroup
+	for i := range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- echo(ctx, address, bytes.Repeat([]byte{byte('a' + i)}, 10*1024))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func echo(ctx context.Context, address string, payload []byte) error {
+	conn, err := dial(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// Write in the background so a server that echoes as it reads can't deadlock us
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(payload)
+		if err == nil {
+			err = conn.(*net.TCPConn).CloseWrite()
+		}
+		writeErr <- err
+	}()
+	received, err := io.ReadAll(conn)
+	if err != nil {
+		return fmt.Errorf("reading the echo: %w", err)
+	}
+	if err := <-writeErr; err != nil {
+		return fmt.Errorf("sending: %w", err)
+	}
+	if !bytes.Equal(received, payload) {
+		return fmt.Errorf("echoed %d bytes that differ from the %d sent", len(received), len(payload))
+	}
+	return nil
+}
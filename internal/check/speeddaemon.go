@@ -0,0 +1,163 @@
+package check
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+
+	"github.com/JeremyFenwick/firewatch/pkg/speeddaemon"
+)
+
+var speeddaemonCases = []Case{
+	{Name: "ticket", Run: checkTicket},
+	{Name: "heartbeat", Run: checkHeartbeat},
+	{Name: "illegal message", Run: checkSpeedIllegalMessage},
+	{Name: "plate from a dispatcher", Run: checkPlateFromDispatcher},
+}
+
+// speedClient reads speed daemon messages off a connection
+type speedClient struct {
+	conn    net.Conn
+	pending []byte
+}
+
+func dialSpeed(ctx context.Context, address string, messages ...speeddaemon.ClientMessage) (*speedClient, error) {
+	conn, err := dial(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	client := &speedClient{conn: conn}
+	if err := client.send(messages...); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func (c *speedClient) send(messages ...speeddaemon.ClientMessage) error {
+	for _, message := range messages {
+		encoded, err := message.Encode()
+		if err != nil {
+			return err
+		}
+		if _, err := c.conn.Write(encoded); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *speedClient) receive() (speeddaemon.ClientMessage, error) {
+	for {
+		buffer := speeddaemon.NewSdBuffer(c.pending)
+		message, err := speeddaemon.Decode(buffer)
+		if err == nil {
+			c.pending = c.pending[buffer.ValidBytes:]
+			return message, nil
+		}
+		if !errors.Is(err, speeddaemon.ErrIncompleteMessage) {
+			return nil, fmt.Errorf("server sent an invalid message: %w", err)
+		}
+		data := make([]byte, 1024)
+		n, err := c.conn.Read(data)
+		if err != nil {
+			return nil, fmt.Errorf("reading a message: %w", err)
+		}
+		c.pending = append(c.pending, data[:n]...)
+	}
+}
+
+func (c *speedClient) close() {
+	c.conn.Close()
+}
+
+func checkTicket(ctx context.Context, address string) error {
+	// A fresh road and plate so tickets from earlier runs don't get in the way
+	road := speeddaemon.U16(rand.IntN(60000) + 1000)
+	plate := speeddaemon.Str(unique("UN1X"))
+	first, err := dialSpeed(ctx, address,
+		&speeddaemon.IAmCameraMessage{Road: road, Mile: 8, Limit: 60},
+		&speeddaemon.PlateMessage{Plate: plate, Timestamp: 0})
+	if err != nil {
+		return err
+	}
+	defer first.close()
+	second, err := dialSpeed(ctx, address,
+		&speeddaemon.IAmCameraMessage{Road: road, Mile: 9, Limit: 60},
+		&speeddaemon.PlateMessage{Plate: plate, Timestamp: 45})
+	if err != nil {
+		return err
+	}
+	defer second.close()
+	dispatcher, err := dialSpeed(ctx, address, &speeddaemon.IAmDispatcherMessage{Numroads: 1, Roads: []speeddaemon.U16{road}})
+	if err != nil {
+		return err
+	}
+	defer dispatcher.close()
+
+	message, err := dispatcher.receive()
+	if err != nil {
+		return err
+	}
+	ticket, ok := message.(*speeddaemon.TicketMessage)
+	if !ok {
+		return fmt.Errorf("expected a ticket, got message 0x%02x", message.GetType())
+	}
+	want := speeddaemon.TicketMessage{Plate: plate, Road: road, MileOne: 8, TimeStampOne: 0, MileTwo: 9, TimeStampTwo: 45, Speed: 8000}
+	return expectEqual("ticket", *ticket, want)
+}
+
+func checkHeartbeat(ctx context.Context, address string) error {
+	client, err := dialSpeed(ctx, address, &speeddaemon.WantHeartbeatMessage{Interval: 1})
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	for range 3 {
+		message, err := client.receive()
+		if err != nil {
+			return err
+		}
+		if err := expectEqual("message type", message.GetType(), speeddaemon.HeartbeatType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expectSpeedError expects an error message followed by a disconnect
+func expectSpeedError(client *speedClient) error {
+	message, err := client.receive()
+	if err != nil {
+		return err
+	}
+	if err := expectEqual("message type", message.GetType(), speeddaemon.ErrorMsgType); err != nil {
+		return err
+	}
+	return expectClosed(client.conn)
+}
+
+func checkSpeedIllegalMessage(ctx context.Context, address string) error {
+	client, err := dialSpeed(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	if _, err := client.conn.Write([]byte{0xff}); err != nil {
+		return err
+	}
+	return expectSpeedError(client)
+}
+
+func checkPlateFromDispatcher(ctx context.Context, address string) error {
+	client, err := dialSpeed(ctx, address,
+		&speeddaemon.IAmDispatcherMessage{Numroads: 1, Roads: []speeddaemon.U16{1}},
+		&speeddaemon.PlateMessage{Plate: "UN1X", Timestamp: 0})
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	return expectSpeedError(client)
+}
@@ -0,0 +1,90 @@
+package check
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+var unusualdatabaseCases = []Case{
+	{Name: "insert and retrieve", Run: checkInsertRetrieve},
+	{Name: "version", Run: checkVersion},
+	{Name: "version is read only", Run: checkVersionReadOnly},
+}
+
+// retrieve asks for key until the reply for it arrives
+func retrieve(ctx context.Context, client *udpClient, key string) (string, error) {
+	reply, err := client.request(ctx, key, func(reply string) bool {
+		return strings.HasPrefix(reply, key+"=")
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(reply, key+"="), nil
+}
+
+func checkInsertRetrieve(ctx context.Context, address string) error {
+	client, err := dialUDP(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	key := unique("key")
+	// Inserts get no reply, so keep inserting until the value can be read back
+	for _, value := range []string{"first", "a=b=c", ""} {
+		for {
+			if err := client.send(key + "=" + value); err != nil {
+				return err
+			}
+			got, err := retrieve(ctx, client, key)
+			if err != nil {
+				return err
+			}
+			if got == value {
+				break
+			}
+		}
+	}
+	missing, err := retrieve(ctx, client, unique("missing"))
+	if err != nil {
+		return err
+	}
+	return expectEqual("value of a missing key", missing, "")
+}
+
+func checkVersion(ctx context.Context, address string) error {
+	client, err := dialUDP(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	version, err := retrieve(ctx, client, "version")
+	if err != nil {
+		return err
+	}
+	if version == "" {
+		return errors.New("version is empty")
+	}
+	return nil
+}
+
+func checkVersionReadOnly(ctx context.Context, address string) error {
+	client, err := dialUDP(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	for range 3 {
+		if err := client.send("version=hacked"); err != nil {
+			return err
+		}
+	}
+	version, err := retrieve(ctx, client, "version")
+	if err != nil {
+		return err
+	}
+	if version == "hacked" {
+		return errors.New("version was changed by an insert")
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package check
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+var voraciouscodestorageCases = []Case{
+	{Name: "help", Run: checkHelp},
+	{Name: "put and get", Run: checkPutGet},
+	{Name: "revisions", Run: checkRevisions},
+	{Name: "list", Run: checkList},
+	{Name: "illegal file name", Run: checkIllegalFileName},
+	{Name: "illegal method", Run: checkIllegalMethod},
+}
+
+// dialVCS connects and waits for the server's first READY
+func dialVCS(ctx context.Context, address string) (*lineClient, error) {
+	client, err := dialLines(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.expect("READY"); err != nil {
+		client.close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// put stores data at path and checks the server reports revision
+func (c *lineClient) put(path, data string, revision int) error {
+	if _, err := fmt.Fprintf(c.conn, "PUT %s %d\n%s", path, len(data), data); err != nil {
+		return fmt.Errorf("could not send PUT: %w", err)
+	}
+	if err := c.expect(fmt.Sprintf("OK r%d", revision)); err != nil {
+		return err
+	}
+	return c.expect("READY")
+}
+
+// get fetches path, with an optional revision, and checks it holds want
+func (c *lineClient) get(path, revision, want string) error {
+	command := "GET " + path
+	if revision != "" {
+		command += " " + revision
+	}
+	if err := c.send(command); err != nil {
+		return err
+	}
+	if err := c.expect(fmt.Sprintf("OK %d", len(want))); err != nil {
+		return err
+	}
+	data := make([]byte, len(want))
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		return fmt.Errorf("could not read file contents: %w", err)
+	}
+	if err := expectEqual("file contents", string(data), want); err != nil {
+		return err
+	}
+	return c.expect("READY")
+}
+
+func checkHelp(ctx context.Context, address string) error {
+	client, err := dialVCS(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	if err := client.send("help"); err != nil {
+		return err
+	}
+	if err := client.expect("OK Usage: HELP|GET|PUT|LIST"); err != nil {
+		return err
+	}
+	return client.expect("READY")
+}
+
+func checkPutGet(ctx context.Context, address string) error {
+	client, err := dialVCS(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	path := "/" + unique("check") + "/file.txt"
+	if err := client.put(path, "hello\nworld\n", 1); err != nil {
+		return err
+	}
+	return client.get(path, "", "hello\nworld\n")
+}
+
+func checkRevisions(ctx context.Context, address string) error {
+	client, err := dialVCS(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	path := "/" + unique("check") + "/file.txt"
+	if err := client.put(path, "first\n", 1); err != nil {
+		return err
+	}
+	// Storing the same contents again does not create a revision
+	if err := client.put(path, "first\n", 1); err != nil {
+		return err
+	}
+	if err := client.put(path, "second\n", 2); err != nil {
+		return err
+	}
+	if err := client.get(path, "r1", "first\n"); err != nil {
+		return err
+	}
+	if err := client.get(path, "", "second\n"); err != nil {
+		return err
+	}
+	if err := client.send("GET " + path + " r3"); err != nil {
+		return err
+	}
+	if err := client.expect("ERR no such revision"); err != nil {
+		return err
+	}
+	return client.expect("READY")
+}
+
+func checkList(ctx context.Context, address string) error {
+	client, err := dialVCS(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	dir := "/" + unique("check")
+	if err := client.put(dir+"/b.txt", "b\n", 1); err != nil {
+		return err
+	}
+	if err := client.put(dir+"/a/c.txt", "c\n", 1); err != nil {
+		return err
+	}
+	if err := client.send("LIST " + dir); err != nil {
+		return err
+	}
+	for _, want := range []string{"OK 2", "a/ DIR", "b.txt r1", "READY"} {
+		if err := client.expect(want); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkIllegalFileName(ctx context.Context, address string) error {
+	client, err := dialVCS(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	if err := client.send("GET /bad*name"); err != nil {
+		return err
+	}
+	return client.expect("ERR illegal file name")
+}
+
+func checkIllegalMethod(ctx context.Context, address string) error {
+	client, err := dialVCS(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	if err := client.send("FETCH /file"); err != nil {
+		return err
+	}
+	if err := client.expect("ERR illegal method FETCH"); err != nil {
+		return err
+	}
+	return client.expectClosed()
+}
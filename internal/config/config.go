@@ -0,0 +1,349 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/logging"
+	"github.com/JeremyFenwick/firewatch/internal/service"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the top level firewatch configuration file
+type Config struct {
+	Admin           Admin              `json:"admin" yaml:"admin"`
+	Log             Log                `json:"log" yaml:"log"`
+	ShutdownTimeout Duration           `json:"shutdown_timeout" yaml:"shutdown_timeout"` // How long open connections get to finish on shutdown
+	Services        map[string]Service `json:"services" yaml:"services"`
+}
+
+// DefaultShutdownTimeout is used when the config does not set shutdown_timeout
+const DefaultShutdownTimeout = 10 * time.Second
+
+// Log configures the process wide logger
+type Log struct {
+	Format string `json:"format" yaml:"format"` // json or text
+	Level  string `json:"level" yaml:"level"`   // Default level for every service
+}
+
+// Admin configures the HTTP server used for the profiler and metrics
+type Admin struct {
+	Enabled *bool  `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	Address string `json:"address" yaml:"address"`
+}
+
+// Service configures a single protohackers service. Zero values are filled in from the defaults
+type Service struct {
+	Enabled  *bool  `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	Address  string `json:"address" yaml:"address"`     // Bind address, empty means all interfaces over IPv4 and IPv6
+	Port     int    `json:"port" yaml:"port"`           // Listening port
+	Upstream string `json:"upstream" yaml:"upstream"`   // host:port of the upstream server, if the service has one
+	DataDir  string `json:"data_dir" yaml:"data_dir"`   // Storage directory, if the service has one
+	LogLevel string `json:"log_level" yaml:"log_level"` // Overrides log.level for this service
+	Capture  string `json:"capture" yaml:"capture"`     // File to record the service's traffic to, see firewatch replay
+	TLS      *TLS   `json:"tls,omitempty" yaml:"tls,omitempty"`
+	// Expect a PROXY protocol header with the real client address, v1 or v2 for TCP and v2 for UDP
+	ProxyProtocol bool   `json:"proxy_protocol" yaml:"proxy_protocol"`
+	Limits        Limits `json:"limits" yaml:"limits"`
+}
+
+// TLS turns on TLS for a TCP service. The files are read again on SIGHUP
+type TLS struct {
+	CertFile     string `json:"cert_file" yaml:"cert_file"`           // PEM certificate chain
+	KeyFile      string `json:"key_file" yaml:"key_file"`             // PEM private key
+	ClientCAFile string `json:"client_ca_file" yaml:"client_ca_file"` // If set, clients must present a certificate signed by one of these CAs
+}
+
+// Limits are the per service tuning knobs. Not every limit applies to every service
+type Limits struct {
+	MaxBytes       int64    `json:"max_bytes" yaml:"max_bytes"`             // Per connection byte quota (smoketest, discard, chargen)
+	SessionTimeout Duration `json:"session_timeout" yaml:"session_timeout"` // Idle session expiry (linereversal)
+
+	// Connection limits for the TCP services. Unset means unlimited
+	MaxConnections      int      `json:"max_connections" yaml:"max_connections"`               // Concurrent connections across all clients
+	MaxConnectionsPerIP int      `json:"max_connections_per_ip" yaml:"max_connections_per_ip"` // Concurrent connections from one IP
+	AcceptRate          float64  `json:"accept_rate" yaml:"accept_rate"`                       // New connections per second
+	AcceptBurst         int      `json:"accept_burst" yaml:"accept_burst"`                     // New connections allowed at once above accept_rate
+	ReadTimeout         Duration `json:"read_timeout" yaml:"read_timeout"`                     // Close the connection after this long without data
+	WriteTimeout        Duration `json:"write_timeout" yaml:"write_timeout"`                   // Close the connection if a write blocks this long
+}
+
+// HasConnectionLimits reports whether any of the TCP connection limits are set
+func (l Limits) HasConnectionLimits() bool {
+	return l.MaxConnections != 0 || l.MaxConnectionsPerIP != 0 || l.AcceptRate != 0 || l.AcceptBurst != 0 ||
+		l.ReadTimeout != 0 || l.WriteTimeout != 0
+}
+
+// defaults returns the settings a service runs with when the config does not mention it
+func defaults(def service.Definition) Service {
+	return Service{
+		Enabled:  boolPtr(!def.Disabled),
+		Port:     def.Port,
+		Upstream: def.Defaults.Upstream,
+		DataDir:  def.Defaults.DataDir,
+		Limits:   Limits{MaxBytes: def.Defaults.MaxBytes, SessionTimeout: Duration(def.Defaults.SessionTimeout)},
+	}
+}
+
+// Default returns the configuration firewatch runs with when no file is given
+func Default() *Config {
+	definitions := service.Definitions()
+	cfg := &Config{
+		Admin:    Admin{Address: ":8080"},
+		Services: make(map[string]Service, len(definitions)),
+	}
+	for _, def := range definitions {
+		cfg.Services[def.Name] = defaults(def)
+	}
+	cfg.applyDefaults()
+	return cfg
+}
+
+// Load reads a YAML or JSON config file, fills in defaults and validates the result
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %w", err)
+	}
+	var cfg Config
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("could not parse %s: %w", path, err)
+		}
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&cfg); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %w", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config file extension %q, expected .yaml, .yml or .json", filepath.Ext(path))
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	cfg.applyDefaults()
+	return &cfg, nil
+}
+
+// applyDefaults fills in every unset field from the registered service definitions
+func (c *Config) applyDefaults() {
+	if c.Admin.Enabled == nil {
+		c.Admin.Enabled = boolPtr(true)
+	}
+	if c.Admin.Address == "" {
+		c.Admin.Address = ":8080"
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = Duration(DefaultShutdownTimeout)
+	}
+	if c.Log.Format == "" {
+		c.Log.Format = logging.JSON
+	}
+	if c.Log.Level == "" {
+		c.Log.Level = "info"
+	}
+	definitions := service.Definitions()
+	if c.Services == nil {
+		c.Services = make(map[string]Service, len(definitions))
+	}
+	for _, def := range definitions {
+		settings := merge(c.Services[def.Name], defaults(def))
+		if settings.LogLevel == "" {
+			settings.LogLevel = c.Log.Level
+		}
+		c.Services[def.Name] = settings
+	}
+}
+
+func merge(settings, defaults Service) Service {
+	if settings.Enabled == nil {
+		settings.Enabled = boolPtr(defaults.IsEnabled())
+	}
+	if settings.Address == "" {
+		settings.Address = defaults.Address
+	}
+	if settings.Port == 0 {
+		settings.Port = defaults.Port
+	}
+	if settings.Upstream == "" {
+		settings.Upstream = defaults.Upstream
+	}
+	if settings.DataDir == "" {
+		settings.DataDir = defaults.DataDir
+	}
+	if settings.Limits.MaxBytes == 0 {
+		settings.Limits.MaxBytes = defaults.Limits.MaxBytes
+	}
+	if settings.Limits.SessionTimeout == 0 {
+		settings.Limits.SessionTimeout = defaults.Limits.SessionTimeout
+	}
+	return settings
+}
+
+// Validate checks the file contents before defaults are applied. All problems are reported together
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Admin.Address != "" {
+		if _, _, err := net.SplitHostPort(c.Admin.Address); err != nil {
+			errs = append(errs, fmt.Errorf("admin: address %q must be host:port: %v", c.Admin.Address, err))
+		}
+	}
+	if c.ShutdownTimeout < 0 {
+		errs = append(errs, fmt.Errorf("shutdown_timeout must not be negative"))
+	}
+	if _, err := logging.New(io.Discard, c.Log.Format, 0); err != nil {
+		errs = append(errs, fmt.Errorf("log: %w", err))
+	}
+	if c.Log.Level != "" {
+		if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+			errs = append(errs, fmt.Errorf("log: %w", err))
+		}
+	}
+	// Sort the names so errors are reported in a stable order
+	names := make([]string, 0, len(c.Services))
+	for name := range c.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		def, known := service.Lookup(name)
+		if !known {
+			errs = append(errs, fmt.Errorf("services: unknown service %q", name))
+			continue
+		}
+		if err := c.Services[name].validate(def); err != nil {
+			errs = append(errs, fmt.Errorf("services.%s: %w", name, err))
+		}
+	}
+	// Two enabled services can't share a port on the same transport and host. A service bound to
+	// every interface shares it with any other service on that port
+	used := make(map[string]string)
+	onPort := make(map[string]string)
+	for _, def := range service.Definitions() {
+		settings := merge(c.Services[def.Name], defaults(def))
+		if !*settings.Enabled {
+			continue
+		}
+		port := fmt.Sprintf("%s/%d", def.Transport, settings.Port)
+		host := bindHost(settings.Address)
+		other, exists := used[port+"/"+host]
+		if !exists {
+			other, exists = used[port+"/"]
+		}
+		if !exists && host == "" {
+			other, exists = onPort[port]
+		}
+		if exists {
+			errs = append(errs, fmt.Errorf("services.%s: port %d/%s is already used by %s", def.Name, settings.Port, def.Transport, other))
+			continue
+		}
+		used[port+"/"+host] = def.Name
+		if _, exists := onPort[port]; !exists {
+			onPort[port] = def.Name
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s Service) validate(def service.Definition) error {
+	var errs []error
+	if s.Port < 0 || s.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port %d must be between 1 and 65535", s.Port))
+	}
+	if strings.Contains(s.Address, ":") && net.ParseIP(s.Address) == nil {
+		errs = append(errs, fmt.Errorf("address %q is not a valid host or IP", s.Address))
+	}
+	if s.Upstream != "" {
+		if def.Defaults.Upstream == "" {
+			errs = append(errs, fmt.Errorf("upstream is not supported by this service"))
+		} else if _, port, err := net.SplitHostPort(s.Upstream); err != nil {
+			errs = append(errs, fmt.Errorf("upstream %q must be host:port: %v", s.Upstream, err))
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			errs = append(errs, fmt.Errorf("upstream %q has an invalid port", s.Upstream))
+		}
+	}
+	if s.DataDir != "" && !def.Storage {
+		errs = append(errs, fmt.Errorf("data_dir is not supported by this service"))
+	}
+	if s.LogLevel != "" {
+		if _, err := logging.ParseLevel(s.LogLevel); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if s.Limits.MaxBytes < 0 {
+		errs = append(errs, fmt.Errorf("limits.max_bytes must not be negative"))
+	}
+	if s.Limits.SessionTimeout < 0 {
+		errs = append(errs, fmt.Errorf("limits.session_timeout must not be negative"))
+	}
+	if def.Transport != service.TCP && s.Limits.HasConnectionLimits() {
+		errs = append(errs, fmt.Errorf("connection limits are not supported by this service"))
+	}
+	if s.TLS != nil {
+		if def.Transport != service.TCP {
+			errs = append(errs, fmt.Errorf("tls is not supported by this service"))
+		} else if s.TLS.CertFile == "" || s.TLS.KeyFile == "" {
+			errs = append(errs, fmt.Errorf("tls needs both cert_file and key_file"))
+		}
+	}
+	if s.Limits.MaxConnections < 0 || s.Limits.MaxConnectionsPerIP < 0 || s.Limits.AcceptBurst < 0 {
+		errs = append(errs, fmt.Errorf("limits.max_connections, max_connections_per_ip and accept_burst must not be negative"))
+	}
+	if s.Limits.AcceptRate < 0 {
+		errs = append(errs, fmt.Errorf("limits.accept_rate must not be negative"))
+	}
+	if s.Limits.ReadTimeout < 0 || s.Limits.WriteTimeout < 0 {
+		errs = append(errs, fmt.Errorf("limits.read_timeout and write_timeout must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// IsEnabled reports whether the service should be started
+func (s Service) IsEnabled() bool {
+	return s.Enabled == nil || *s.Enabled
+}
+
+// Options returns the settings the service is created with
+func (s Service) Options() service.Options {
+	return service.Options{
+		Upstream:       s.Upstream,
+		DataDir:        s.DataDir,
+		MaxBytes:       s.Limits.MaxBytes,
+		SessionTimeout: s.Limits.SessionTimeout.Duration(),
+	}
+}
+
+// bindHost returns the host a service binds to, or "" if it binds every interface. An unspecified
+// IP such as 0.0.0.0 or :: binds every interface just as an empty address does
+func bindHost(address string) string {
+	if ip := net.ParseIP(address); ip != nil {
+		if ip.IsUnspecified() {
+			return ""
+		}
+		return ip.String()
+	}
+	return address
+}
+
+// ListenAddress returns the host:port the service binds to
+func (s Service) ListenAddress() string {
+	return net.JoinHostPort(s.Address, strconv.Itoa(s.Port))
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
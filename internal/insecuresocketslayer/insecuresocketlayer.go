@@ -3,9 +3,19 @@ package insecuresocketslayer
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
+
+	"github.com/JeremyFenwick/firewatch/internal/capture"
+	"github.com/JeremyFenwick/firewatch/internal/logging"
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/JeremyFenwick/firewatch/internal/service"
+	"github.com/JeremyFenwick/firewatch/pkg/isl"
 )
 
 const BufferSize = 5001      // Spec says this is the maximum size of a completed message
@@ -16,35 +26,110 @@ type Client struct {
 	IncomingPosition int
 	OutboundPosition int
 	Reader           *bufio.Reader
-	Cipher           *Cipher
-	Logger           *log.Logger
+	Cipher           *isl.Cipher
+	Logger           *slog.Logger
 	Buffer           []byte
 }
 
-func Listen(port int) {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+type Server struct {
+	metrics *metrics.Service
+	logger  *slog.Logger
+	tcp     server.TCPServer
+}
 
-	listener, err := net.Listen("tcp4", fmt.Sprintf(":%d", port))
-	if err != nil {
-		// Use Fatalf for formatted error messages
-		log.Fatalf("Could not start listener. REASON: %v", err)
+func init() {
+	service.Register(service.Definition{
+		Name:      "insecuresocketslayer",
+		Transport: service.TCP,
+		Port:      5008,
+		New:       func(service.Options) service.Service { return NewServer() },
+	})
+}
+
+func NewServer() *Server {
+	s := &Server{metrics: metrics.NewService("insecuresocketslayer")}
+	s.tcp.Metrics = s.metrics
+	s.SetLogger(slog.Default().With("service", "insecuresocketslayer"))
+	s.tcp.Handler = func(ctx context.Context, conn net.Conn) {
+		handleConnection(ctx, conn, s.metrics)
 	}
-	log.Printf("Insecure socket layer now listening on port %d\n", port)
-	defer listener.Close()
+	return s
+}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			// Use Printf for formatted error messages
-			log.Printf("Encountered error accepting connection. REASON: %v", err)
-			continue
-		}
+// Serve accepts connections on listener until the server is stopped
+func (s *Server) Serve(listener net.Listener) error {
+	s.logger.Info("Insecure socket layer now listening", "address", listener.Addr().String())
+	return s.tcp.Serve(listener)
+}
 
-		go handleConnection(conn)
+// Start listens on address and serves in the background. Use port 0 to pick a free port
+func (s *Server) Start(address string) error {
+	listener, err := server.Listen(address)
+	if err != nil {
+		return fmt.Errorf("could not start listener: %w", err)
 	}
+	s.logger.Info("Insecure socket layer now listening", "address", listener.Addr().String())
+	return s.tcp.Start(listener)
+}
+
+// Addr returns the listening address, or nil before the server has started
+func (s *Server) Addr() net.Addr {
+	return s.tcp.Addr()
+}
+
+// Err returns why the server stopped accepting connections on its own, or nil while it is serving
+func (s *Server) Err() error {
+	return s.tcp.Err()
+}
+
+// Metrics returns the server's counters so they can be added to a metrics.Registry
+func (s *Server) Metrics() *metrics.Service {
+	return s.metrics
 }
 
-func handleConnection(conn net.Conn) {
+// SetLogger replaces the server's logger. Call it before the server is started
+func (s *Server) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+	s.tcp.Logger = logger
+}
+
+// SetLimits sets the connection limits. Call it before the server is started
+func (s *Server) SetLimits(limits server.Limits) {
+	s.tcp.Limits = limits
+}
+
+// SetTLS serves every connection over TLS. Call it before the server is started
+func (s *Server) SetTLS(t *server.TLS) {
+	s.tcp.TLS = t
+}
+
+// SetProxyProtocol expects connections to open with a PROXY protocol header giving the real client
+// address. Call it before the server is started
+func (s *Server) SetProxyProtocol(enabled bool) {
+	s.tcp.ProxyProtocol = enabled
+}
+
+// SetRecorder captures the traffic of every connection to r. Call it before the server is started
+func (s *Server) SetRecorder(r *capture.Recorder) {
+	s.tcp.Recorder = r
+}
+
+// Sessions lists the connected clients
+func (s *Server) Sessions() []server.SessionInfo {
+	return s.tcp.Sessions()
+}
+
+// Disconnect closes the client connection with id. Returns false if there is none
+func (s *Server) Disconnect(id uint64) bool {
+	return s.tcp.Disconnect(id)
+}
+
+// Stop stops accepting connections and waits for open ones to finish until ctx expires
+func (s *Server) Stop(ctx context.Context) error {
+	return s.tcp.Stop(ctx)
+}
+
+func handleConnection(ctx context.Context, conn net.Conn, m *metrics.Service) {
 	defer conn.Close()
 	client := &Client{
 		Conn:             conn,
@@ -52,29 +137,31 @@ func handleConnection(conn net.Conn) {
 		Reader:           bufio.NewReader(conn),
 		OutboundPosition: 0,
 		Buffer:           make([]byte, 0, BufferSize),
-		Logger: log.New(log.Writer(),
-			fmt.Sprintf("[%s] ", conn.RemoteAddr().String()),
-			log.Flags()|log.Lmsgprefix|log.Lshortfile),
+		Logger:           logging.FromContext(ctx),
 	}
-	log.Printf("Handling connection from %s", conn.RemoteAddr())
 	// Get the cipher
 	specBytes, err := readCipherSpecBytes(client.Reader)
 	if err != nil {
-		client.Logger.Printf("Error reading cipher spec bytes: %v", err)
+		client.Logger.Debug("Error reading cipher spec bytes", "error", err)
+		if !errors.Is(err, io.EOF) {
+			m.ProtocolErrors.Inc()
+		}
 		return
 	}
-	cipher, err := NewCipher(specBytes)
+	cipher, err := isl.NewCipher(specBytes)
 	if err != nil {
-		client.Logger.Printf("Error creating cipher: %v", err)
+		client.Logger.Debug("Error creating cipher", "error", err)
+		m.ProtocolErrors.Inc()
 		return
 	}
 	if !cipher.Valid {
-		client.Logger.Printf("Invalid cipher")
+		client.Logger.Debug("Invalid cipher")
+		m.ProtocolErrors.Inc()
 		return
 	}
 	client.Cipher = cipher
 	// Begin handling the connection
-	recieveLoop(client)
+	recieveLoop(client, m)
 }
 
 func readCipherSpecBytes(reader *bufio.Reader) ([]byte, error) {
@@ -109,7 +196,7 @@ func readCipherSpecBytes(reader *bufio.Reader) ([]byte, error) {
 }
 
 // Loop for reading data from the client
-func recieveLoop(client *Client) {
+func recieveLoop(client *Client, m *metrics.Service) {
 	temp := make([]byte, BufferSize)
 	// Being the loop to read data from the client
 	for {
@@ -118,11 +205,11 @@ func recieveLoop(client *Client) {
 			return
 		}
 		if readBytes == 0 {
-			client.Logger.Printf("Empty data received from client")
+			client.Logger.Debug("Empty data received from client")
 			return
 		}
 		decoded := client.Cipher.DecodeData(client.IncomingPosition, temp[:readBytes])
-		client.Logger.Printf("Decoded data of length: %d", len(decoded))
+		client.Logger.Debug("Decoded data", "bytes", len(decoded))
 		client.IncomingPosition += readBytes
 		client.Buffer = append(client.Buffer, decoded...)
 		// Loop through the buffer to find new lines
@@ -131,9 +218,9 @@ func recieveLoop(client *Client) {
 			if newLineIndex == -1 {
 				break // No new line found, exit the loop
 			}
-			err = respondToClient(client, client.Buffer[:newLineIndex+1])
+			err = respondToClient(client, client.Buffer[:newLineIndex+1], m)
 			if err != nil {
-				client.Logger.Printf("Error responding to client: %v", err)
+				client.Logger.Debug("Error responding to client", "error", err)
 				return
 			}
 			// Remove the processed data from the buffer
@@ -143,10 +230,11 @@ func recieveLoop(client *Client) {
 }
 
 // Respond to the client with the most common toy
-func respondToClient(client *Client, decoded []byte) error {
+func respondToClient(client *Client, decoded []byte, m *metrics.Service) error {
 	// Handle the incoming data
 	plainToy, err := MostCommonToy(decoded)
 	if err != nil {
+		m.ProtocolErrors.Inc()
 		return err
 	}
 	// Handle the outgoing data
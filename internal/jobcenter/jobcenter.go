@@ -2,19 +2,34 @@ package jobcenter
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/capture"
+	"github.com/JeremyFenwick/firewatch/internal/logging"
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/JeremyFenwick/firewatch/internal/service"
+	protocol "github.com/JeremyFenwick/firewatch/pkg/jobcenter"
 )
 
 // Client represents a client connection to the job center.
 
 type Client struct {
+	Ctx    context.Context
 	Conn   net.Conn
 	Reader *bufio.Reader
 	Jobs   []*Job
+
+	metrics *metrics.Service
+	logger  *slog.Logger
+	session *server.Session
 }
 
 func (c *Client) returnAllJobs(queueManager *QueueManager) {
@@ -24,6 +39,20 @@ func (c *Client) returnAllJobs(queueManager *QueueManager) {
 		}
 	}
 	c.Jobs = nil
+	c.updateIdentity()
+}
+
+// updateIdentity shows the jobs the client holds in the admin API
+func (c *Client) updateIdentity() {
+	if len(c.Jobs) == 0 {
+		c.session.SetIdentity("")
+		return
+	}
+	ids := make([]string, len(c.Jobs))
+	for i, job := range c.Jobs {
+		ids[i] = strconv.Itoa(job.Id)
+	}
+	c.session.SetIdentity("holding jobs " + strings.Join(ids, ", "))
 }
 
 func (c *Client) hasJob(id int) (*Job, bool) {
@@ -39,6 +68,7 @@ func (c *Client) deleteJob(id int) bool {
 	for i, j := range c.Jobs {
 		if j.Id == id {
 			c.Jobs = append(c.Jobs[:i], c.Jobs[i+1:]...)
+			c.updateIdentity()
 			return true
 		}
 	}
@@ -47,53 +77,144 @@ func (c *Client) deleteJob(id int) bool {
 
 func (c *Client) addJob(job *Job) {
 	c.Jobs = append(c.Jobs, job)
+	c.updateIdentity()
 }
 
-// Listen starts the job center server on the specified port.
+// Server is the job center server. Clients holding jobs are given until the stop deadline
+// to finish them before their jobs are returned to the queues.
 
-func Listen(port int) {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+type Server struct {
+	queueManager *QueueManager
+	metrics      *metrics.Service
+	logger       *slog.Logger
+	tcp          server.TCPServer
+}
 
-	listener, err := net.Listen("tcp4", fmt.Sprintf(":%d", port))
+func init() {
+	service.Register(service.Definition{
+		Name:      "jobcenter",
+		Transport: service.TCP,
+		Port:      5009,
+		New:       func(service.Options) service.Service { return NewServer() },
+	})
+}
+
+func NewServer() *Server {
+	s := &Server{
+		queueManager: NewQueueManager(),
+		metrics:      metrics.NewService("jobcenter"),
+	}
+	// Totals rather than a series per queue, since clients choose the queue names
+	s.metrics.RegisterGaugeFunc("jobcenter_queues", "Queues holding at least one job", func() float64 {
+		queues, _ := s.queueManager.Counts()
+		return float64(queues)
+	})
+	s.metrics.RegisterGaugeFunc("jobcenter_jobs_queued", "Jobs waiting across all queues", func() float64 {
+		_, jobs := s.queueManager.Counts()
+		return float64(jobs)
+	})
+	s.tcp.Metrics = s.metrics
+	s.SetLogger(slog.Default().With("service", "jobcenter"))
+	s.tcp.Handler = func(ctx context.Context, conn net.Conn) {
+		handleConnection(ctx, conn, s.queueManager, s.metrics)
+	}
+	return s
+}
+
+// Serve accepts connections on listener until the server is stopped
+func (s *Server) Serve(listener net.Listener) error {
+	s.logger.Info("Job center now listening", "address", listener.Addr().String())
+	return s.tcp.Serve(listener)
+}
+
+// Start listens on address and serves in the background. Use port 0 to pick a free port
+func (s *Server) Start(address string) error {
+	listener, err := server.Listen(address)
 	if err != nil {
-		// Use Fatalf for formatted error messages
-		log.Fatalf("Could not start listener. REASON: %v", err)
+		return fmt.Errorf("could not start listener: %w", err)
 	}
-	log.Printf("Job center now listening on port %d\n", port)
-	defer listener.Close()
+	s.logger.Info("Job center now listening", "address", listener.Addr().String())
+	return s.tcp.Start(listener)
+}
 
-	queueManager := NewQueueManager()
+// Addr returns the listening address, or nil before the server has started
+func (s *Server) Addr() net.Addr {
+	return s.tcp.Addr()
+}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			// Use Printf for formatted error messages
-			log.Printf("Encountered error accepting connection. REASON: %v", err)
-			continue
-		}
+// Err returns why the server stopped accepting connections on its own, or nil while it is serving
+func (s *Server) Err() error {
+	return s.tcp.Err()
+}
 
-		go handleConnection(conn, queueManager)
-	}
+// Metrics returns the server's counters so they can be added to a metrics.Registry
+func (s *Server) Metrics() *metrics.Service {
+	return s.metrics
+}
+
+// SetLogger replaces the server's logger. Call it before the server is started
+func (s *Server) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+	s.tcp.Logger = logger
+}
+
+// SetLimits sets the connection limits. Call it before the server is started
+func (s *Server) SetLimits(limits server.Limits) {
+	s.tcp.Limits = limits
+}
+
+// SetTLS serves every connection over TLS. Call it before the server is started
+func (s *Server) SetTLS(t *server.TLS) {
+	s.tcp.TLS = t
+}
+
+// SetProxyProtocol expects connections to open with a PROXY protocol header giving the real client
+// address. Call it before the server is started
+func (s *Server) SetProxyProtocol(enabled bool) {
+	s.tcp.ProxyProtocol = enabled
 }
 
-func handleConnection(conn net.Conn, queueManager *QueueManager) {
+// SetRecorder captures the traffic of every connection to r. Call it before the server is started
+func (s *Server) SetRecorder(r *capture.Recorder) {
+	s.tcp.Recorder = r
+}
+
+// Sessions lists the connected clients
+func (s *Server) Sessions() []server.SessionInfo {
+	return s.tcp.Sessions()
+}
+
+// Disconnect closes the client connection with id. Returns false if there is none
+func (s *Server) Disconnect(id uint64) bool {
+	return s.tcp.Disconnect(id)
+}
+
+// Stop stops accepting connections and waits for open ones to finish until ctx expires
+func (s *Server) Stop(ctx context.Context) error {
+	return s.tcp.Stop(ctx)
+}
+
+func handleConnection(ctx context.Context, conn net.Conn, queueManager *QueueManager, m *metrics.Service) {
 	defer conn.Close()
 
 	client := &Client{
-		Conn:   conn,
-		Reader: bufio.NewReader(conn),
-		Jobs:   make([]*Job, 0),
+		Ctx:     ctx,
+		Conn:    conn,
+		Reader:  bufio.NewReader(conn),
+		Jobs:    make([]*Job, 0),
+		metrics: m,
+		logger:  logging.FromContext(ctx),
+		session: server.SessionFromContext(ctx),
 	}
 	defer client.returnAllJobs(queueManager)
 
-	log.Printf("Handling connection from %s", conn.RemoteAddr())
 	for {
 		clientData, err := client.Reader.ReadString('\n')
 		if err != nil {
-			log.Printf("Error reading from client: %v", err)
+			client.logger.Debug("Error reading from client", "error", err)
 			return
 		}
-		request := parseJsonLine([]byte(clientData))
+		request := ParseJsonLine([]byte(clientData))
 		if request.Error != nil {
 			err := fmt.Errorf("error parsing request: %v", request.Error)
 			handleError(client, err)
@@ -101,7 +222,7 @@ func handleConnection(conn net.Conn, queueManager *QueueManager) {
 		}
 		err = messageDispatch(client, request, queueManager)
 		if err != nil {
-			log.Printf("Error dispatching message: %v", err)
+			client.logger.Warn("Error dispatching message", "error", err)
 			return
 		}
 	}
@@ -130,21 +251,24 @@ func messageDispatch(client *Client, request Request, queueManager *QueueManager
 }
 
 func handleError(client *Client, err error) {
-	response := ErrorResponse{
+	if client.metrics != nil {
+		client.metrics.ProtocolErrors.Inc()
+	}
+	response := protocol.ErrorResponse{
 		Status: "error",
 		Error:  err.Error(),
 	}
 	responseData, err := json.Marshal(response)
 	if err != nil {
-		log.Printf("Error marshaling error response: %v", err)
+		client.logger.Error("Error marshaling error response", "error", err)
 		return
 	}
 	client.Conn.Write(append(responseData, '\n'))
 }
 
-func handleAbort(client *Client, request *AbortRequest, queueManager *QueueManager) {
-	log.Printf("Handling ABORT request for client: %s", client.Conn.RemoteAddr())
-	abortResponse := AbortResponse{}
+func handleAbort(client *Client, request *protocol.AbortRequest, queueManager *QueueManager) {
+	client.logger.Debug("Handling ABORT request", "id", request.Id)
+	abortResponse := protocol.AbortResponse{}
 	job, jobFound := client.hasJob(request.Id)
 	jobExists := queueManager.JobExists(request.Id)
 	if jobFound {
@@ -162,14 +286,14 @@ func handleAbort(client *Client, request *AbortRequest, queueManager *QueueManag
 
 	responseData, err := json.Marshal(abortResponse)
 	if err != nil {
-		log.Printf("Error marshaling ABORT response: %v", err)
+		client.logger.Error("Error marshaling ABORT response", "error", err)
 		return
 	}
 	client.Conn.Write(append(responseData, '\n'))
 }
 
-func handleDelete(client *Client, request *DeleteRequest, queueManager *QueueManager) {
-	log.Printf("Handling DELETE request for client: %s", client.Conn.RemoteAddr())
+func handleDelete(client *Client, request *protocol.DeleteRequest, queueManager *QueueManager) {
+	client.logger.Debug("Handling DELETE request", "id", request.Id)
 	job, exists := client.hasJob(request.Id)
 	deleted := false
 	if exists {
@@ -179,7 +303,7 @@ func handleDelete(client *Client, request *DeleteRequest, queueManager *QueueMan
 		// Else, try to delete the job from the queue manager
 		deleted = queueManager.DeleteJob(request.Id)
 	}
-	deleteResponse := DeleteResponse{}
+	deleteResponse := protocol.DeleteResponse{}
 	if deleted {
 		deleteResponse.Status = "ok"
 	} else {
@@ -187,14 +311,14 @@ func handleDelete(client *Client, request *DeleteRequest, queueManager *QueueMan
 	}
 	responseData, err := json.Marshal(deleteResponse)
 	if err != nil {
-		log.Printf("Error marshaling DELETE response: %v", err)
+		client.logger.Error("Error marshaling DELETE response", "error", err)
 		return
 	}
 	client.Conn.Write(append(responseData, '\n'))
 }
 
-func handlePut(client *Client, request *PutRequest, queueManager *QueueManager) {
-	log.Printf("Handling PUT request for client: %s", client.Conn.RemoteAddr())
+func handlePut(client *Client, request *protocol.PutRequest, queueManager *QueueManager) {
+	client.logger.Debug("Handling PUT request", "queue", request.Queue)
 	newJob := &Job{
 		Priority: request.Priority,
 		Id:       queueManager.GetNextId(),
@@ -202,29 +326,29 @@ func handlePut(client *Client, request *PutRequest, queueManager *QueueManager)
 		Queue:    request.Queue,
 	}
 	queueManager.PutJob(request.Queue, newJob)
-	putResponse := PutResponse{
+	putResponse := protocol.PutResponse{
 		Status: "ok",
 		Id:     newJob.Id,
 	}
 	responseData, err := json.Marshal(putResponse)
 	if err != nil {
-		log.Printf("Error marshaling PUT response: %v", err)
+		client.logger.Error("Error marshaling PUT response", "error", err)
 		return
 	}
 	client.Conn.Write(append(responseData, '\n'))
 }
 
-func handleGet(client *Client, request *GetRequest, queueManager *QueueManager) {
-	log.Printf("Handling GET request for client: %s", client.Conn.RemoteAddr())
-	getResponse := GetResponse{}
+func handleGet(client *Client, request *protocol.GetRequest, queueManager *QueueManager) {
+	client.logger.Debug("Handling GET request", "queues", request.Queues)
+	getResponse := protocol.GetResponse{}
 	job, exists := queueManager.GetPriorityJob(request.Queues...)
 	// If no job exists and wait is false, return "no-job" status
 	if !exists && !*request.Wait {
-		log.Printf("No jobs found in queues: %v", request.Queues)
+		client.logger.Debug("No jobs found", "queues", request.Queues)
 		getResponse.Status = "no-job"
 		responseData, err := json.Marshal(getResponse)
 		if err != nil {
-			log.Printf("Error marshaling GET response: %v", err)
+			client.logger.Error("Error marshaling GET response", "error", err)
 			return
 		}
 		client.Conn.Write(append(responseData, '\n'))
@@ -233,7 +357,7 @@ func handleGet(client *Client, request *GetRequest, queueManager *QueueManager)
 		var err error // Here we need to wait for a job
 		job, err = waitForJob(client, queueManager, request.Queues)
 		if err != nil {
-			log.Printf("Error waiting for job: %v", err)
+			client.logger.Debug("Stopped waiting for job", "error", err)
 			return
 		}
 	}
@@ -248,7 +372,7 @@ func handleGet(client *Client, request *GetRequest, queueManager *QueueManager)
 
 	responseData, err := json.Marshal(getResponse)
 	if err != nil {
-		log.Printf("Error marshaling GET response: %v", err)
+		client.logger.Error("Error marshaling GET response", "error", err)
 		return
 	}
 	client.Conn.Write(append(responseData, '\n'))
@@ -257,7 +381,11 @@ func handleGet(client *Client, request *GetRequest, queueManager *QueueManager)
 func waitForJob(client *Client, queueManager *QueueManager, queues []string) (*Job, error) {
 	job, exists := queueManager.GetPriorityJob(queues...)
 	for !exists {
-		time.Sleep(5 * time.Second)
+		select {
+		case <-client.Ctx.Done():
+			return nil, fmt.Errorf("server stopped while waiting for job: %s", client.Conn.RemoteAddr())
+		case <-time.After(5 * time.Second):
+		}
 		client.Conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
 		// Check to see if the client is still connected
 		_, err := client.Conn.Write([]byte{})
@@ -1,7 +1,7 @@
 package jobcenter
 
 import (
-	"log"
+	"log/slog"
 	"slices"
 	"sync"
 )
@@ -291,7 +291,7 @@ func (mh *MaxHeap[T, I]) lastIndex() int {
 func (mh *MaxHeap[T, I]) swap(i, j int) {
 	size := len(mh.data)
 	if i < 0 || i >= size || j < 0 || j >= size {
-		log.Printf("Swap indices %d and %d out of bounds for heap of size %d", i, j, size)
+		slog.Error("Swap indices out of bounds", "i", i, "j", j, "size", size)
 		return
 	}
 	mh.data[i], mh.data[j] = mh.data[j], mh.data[i]
@@ -300,7 +300,7 @@ func (mh *MaxHeap[T, I]) swap(i, j int) {
 func (mh *MaxHeap[T, I]) siftUp(index int) {
 	size := len(mh.data)
 	if index < 0 || index >= size {
-		log.Printf("Index %d out of bounds for heap of size %d", index, size)
+		slog.Error("Index out of bounds", "index", index, "size", size)
 		return
 	}
 	for index > 0 {
@@ -316,11 +316,11 @@ func (mh *MaxHeap[T, I]) siftUp(index int) {
 func (mh *MaxHeap[T, I]) siftDown(index int) {
 	lastIndex := mh.lastIndex()
 	if lastIndex < 0 {
-		log.Printf("Attempting to sift down an empty heap")
+		slog.Error("Attempting to sift down an empty heap")
 		return
 	}
 	if index < 0 || index > lastIndex {
-		log.Printf("Index %d out of bounds for heap of size %d", index, lastIndex+1)
+		slog.Error("Index out of bounds", "index", index, "size", lastIndex+1)
 		return
 	}
 	for {
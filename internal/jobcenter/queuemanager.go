@@ -1,7 +1,7 @@
 package jobcenter
 
 import (
-	"log"
+	"log/slog"
 	"sync"
 )
 
@@ -53,6 +53,15 @@ func (qm *QueueManager) PutJob(queueName string, job *Job) {
 	qm.JobLocations[job.Id] = queueName
 }
 
+// Counts returns how many queues hold jobs and how many jobs are waiting across them. Empty queues
+// are dropped, so clients can't grow either by using many queue names
+func (qm *QueueManager) Counts() (queues, jobs int) {
+	qm.Mutex.RLock()
+	defer qm.Mutex.RUnlock()
+
+	return len(qm.Queues), len(qm.JobLocations)
+}
+
 // GetPriorityJob retrieves the job with the highest priority from the specified queues.
 // If multiple queues are specified, it returns the job with the highest priority across all specified queues.
 func (qm *QueueManager) GetPriorityJob(queues ...string) (*Job, bool) {
@@ -82,6 +91,9 @@ func (qm *QueueManager) GetPriorityJob(queues ...string) (*Job, bool) {
 	}
 	delete(qm.JobLocations, candidate.Id)
 	qm.Queues[candidate.Queue].Pop()
+	if qm.Queues[candidate.Queue].Size() == 0 {
+		delete(qm.Queues, candidate.Queue)
+	}
 	return candidate, true
 }
 
@@ -97,7 +109,7 @@ func (qm *QueueManager) DeleteJob(jobId int) bool {
 	}
 	removed := qm.Queues[queueName].Delete(jobId)
 	if !removed {
-		log.Printf("Failed to delete job %d from queue %s. It was in the job locations map but not the queue itself.", jobId, queueName)
+		slog.Error("Failed to delete job. It was in the job locations map but not the queue itself", "id", jobId, "queue", queueName)
 		return false
 	}
 	delete(qm.JobLocations, jobId)
@@ -3,6 +3,8 @@ package jobcenter
 import (
 	"encoding/json"
 	"fmt"
+
+	protocol "github.com/JeremyFenwick/firewatch/pkg/jobcenter"
 )
 
 // WRAPPER STRUCT
@@ -20,20 +22,20 @@ const (
 type Request struct {
 	// The request type (e.g., "put", "get", "delete", "abort")
 	Type    ProcessResultType
-	Request *PutRequest
-	Get     *GetRequest
-	Delete  *DeleteRequest
-	Abort   *AbortRequest
+	Request *protocol.PutRequest
+	Get     *protocol.GetRequest
+	Delete  *protocol.DeleteRequest
+	Abort   *protocol.AbortRequest
 	Error   error
 	RawJson []byte // Keep raw JSON for debugging
 }
 
 // JSON PARSING FUNCTION
 
-// parseJsonLine attempts to parse the jsonBytes into one of the known structures
-func parseJsonLine(jsonBytes []byte) Request {
+// ParseJsonLine attempts to parse the jsonBytes into one of the known structures
+func ParseJsonLine(jsonBytes []byte) Request {
 	// 1. Peek at the 'request' field first
-	var baseReq Base
+	var baseReq protocol.Base
 	err := json.Unmarshal(jsonBytes, &baseReq)
 	if err != nil {
 		// JSON syntax is invalid, we cannot even determine the request type
@@ -47,7 +49,7 @@ func parseJsonLine(jsonBytes []byte) Request {
 	// 2. Decide the target type based on the 'request' field
 	switch baseReq.Request {
 	case "put": // Example request type string
-		var data PutRequest
+		var data protocol.PutRequest
 		err = json.Unmarshal(jsonBytes, &data)
 		if err != nil {
 			// Valid JSON syntax, but doesn't match RequestData structure
@@ -56,7 +58,7 @@ func parseJsonLine(jsonBytes []byte) Request {
 		return Request{Type: Put, Request: &data, RawJson: jsonBytes}
 
 	case "get": // Example request type string
-		var data GetRequest
+		var data protocol.GetRequest
 		err = json.Unmarshal(jsonBytes, &data)
 		if err != nil {
 			return Request{Type: Error, Error: fmt.Errorf("failed to parse as GetData: %w", err), RawJson: jsonBytes}
@@ -64,7 +66,7 @@ func parseJsonLine(jsonBytes []byte) Request {
 		return Request{Type: Get, Get: &data, RawJson: jsonBytes}
 
 	case "delete": // Example request type string
-		var data DeleteRequest
+		var data protocol.DeleteRequest
 		err = json.Unmarshal(jsonBytes, &data)
 		if err != nil {
 			return Request{Type: Error, Error: fmt.Errorf("failed to parse as DeleteData: %w", err), RawJson: jsonBytes}
@@ -72,7 +74,7 @@ func parseJsonLine(jsonBytes []byte) Request {
 		return Request{Type: Delete, Delete: &data, RawJson: jsonBytes}
 
 	case "abort": // Example request type string
-		var data AbortRequest
+		var data protocol.AbortRequest
 		err = json.Unmarshal(jsonBytes, &data)
 		if err != nil {
 			return Request{Type: Error, Error: fmt.Errorf("failed to parse as AbortData: %w", err), RawJson: jsonBytes}
@@ -97,66 +99,3 @@ type Job struct {
 	Content  interface{} `json:"job"`
 	Queue    string      `json:"queue"`
 }
-
-// Base is used to peek at the 'request' field only
-type Base struct {
-	Request string `json:"request"`
-}
-
-// PutRequest represents the main JSON structure
-type PutRequest struct {
-	Request  string      `json:"request"` // Field names must be exported (start with uppercase)
-	Queue    string      `json:"queue"`
-	Job      interface{} `json:"job"` // Use the Job struct type for the nested object
-	Priority int         `json:"pri"` // Map Go's "Priority" field to JSON's "pri" key
-}
-
-type PutResponse struct {
-	Status string `json:"status"`
-	Id     int    `json:"id"`
-}
-
-// GetRequest represents the JSON structure
-type GetRequest struct {
-	Request string   `json:"request"`
-	Queues  []string `json:"queues"`
-
-	// Use a pointer (*bool) for the optional "wait" field.
-	// If "wait" is missing in the JSON, this field will be nil.
-	// If "wait" is present (true or false), this field will point to the boolean value.
-	// "omitempty" is good practice for marshaling: if Wait is nil, the key won't be included.
-	Wait *bool `json:"wait,omitempty"`
-}
-
-type GetResponse struct {
-	Status   string      `json:"status"`
-	ID       *int        `json:"id,omitempty"`
-	Job      interface{} `json:"job,omitempty"`
-	Priority *int        `json:"pri,omitempty"`
-	Queue    *string     `json:"queue,omitempty"`
-}
-
-// DeleteRequest represents the JSON structure for deleting a job
-type DeleteRequest struct {
-	Request string `json:"request"`
-	Id      int    `json:"id"`
-}
-
-type DeleteResponse struct {
-	Status string `json:"status"`
-}
-
-// AbortRequest represents the JSON structure for aborting a job
-type AbortRequest struct {
-	Request string `json:"request"`
-	Id      int    `json:"id"`
-}
-
-type AbortResponse struct {
-	Status string `json:"status"`
-}
-
-type ErrorResponse struct {
-	Status string `json:"status"`
-	Error  string `json:"error"`
-}
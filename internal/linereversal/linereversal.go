@@ -1,42 +1,201 @@
 package linereversal
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"math"
 	"net"
-	"os"
+	"sync"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/capture"
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/JeremyFenwick/firewatch/internal/service"
+	"github.com/JeremyFenwick/firewatch/pkg/lrcp"
 )
 
+// How often Stop checks whether the remaining sessions have closed
+const drainPollInterval = 50 * time.Millisecond
+
 type udpMessage struct {
 	data   []byte
 	sender net.Addr
 }
 
-func Listen(port int) {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+type Server struct {
+	sessionManager *SessionManager
+	metrics        *metrics.Service
+	logger         *slog.Logger
+	mutex          sync.Mutex
+	udp            net.PacketConn
+	recorder       *capture.Recorder
+	proxyProtocol  bool
+	done           chan struct{}
+	stopping       bool
+	handingOff     bool
+	restored       []SessionState // Sessions to carry on once the server starts
+}
+
+func init() {
+	service.Register(service.Definition{
+		Name:      "linereversal",
+		Transport: service.UDP,
+		Port:      5007,
+		Defaults:  service.Options{SessionTimeout: SessionTimeout},
+		New:       func(o service.Options) service.Service { return NewServer(o.SessionTimeout) },
+	})
+}
+
+// NewServer creates an LRCP server. Sessions are closed after sessionTimeout without a message
+func NewServer(sessionTimeout time.Duration) *Server {
+	s := &Server{
+		sessionManager: NewSessionManager(sessionTimeout),
+		metrics:        metrics.NewService("linereversal"),
+	}
+	s.metrics.RegisterGaugeFunc("linereversal_open_sessions", "LRCP sessions that have not closed", func() float64 {
+		return float64(s.sessionManager.OpenSessions())
+	})
+	s.metrics.RegisterCounter("linereversal_retransmissions_total", "Data messages sent again after no ack", &s.sessionManager.Retransmissions)
+	s.SetLogger(slog.Default().With("service", "linereversal"))
+	return s
+}
+
+// Serve runs LRCP sessions over udp until the server is stopped. The socket is closed on return
+func (s *Server) Serve(udp net.PacketConn) error {
+	udp = s.instrument(udp)
+	if err := s.attach(udp); err != nil {
+		return err
+	}
+	s.logger.Info("Line reversal listening", "address", udp.LocalAddr().String())
+	return s.serve(udp)
+}
 
-	// Determine if we are local or remote (fly io)
-	bindingAddress := getBindingAddress(port)
-	// Setup the udp listener
-	udp, err := net.ListenPacket("udp", bindingAddress)
+// Start listens on address and serves in the background. Use port 0 to pick a free port
+func (s *Server) Start(address string) error {
+	udp, err := server.ListenPacket(address)
 	if err != nil {
-		log.Fatalf("can't listen on %d/udp: %s", port, err)
+		return err
+	}
+	udp = s.instrument(udp)
+	if err := s.attach(udp); err != nil {
+		return err
+	}
+	s.logger.Info("Line reversal listening", "address", udp.LocalAddr().String())
+	go s.serve(udp)
+	return nil
+}
+
+// Addr returns the address being listened on, or nil if the server has not started
+func (s *Server) Addr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.udp == nil {
+		return nil
+	}
+	return s.udp.LocalAddr()
+}
+
+// Metrics returns the server's counters so they can be added to a metrics.Registry
+func (s *Server) Metrics() *metrics.Service {
+	return s.metrics
+}
+
+// SetLogger replaces the server's logger. Call it before the server is started
+func (s *Server) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+	s.sessionManager.Logger = logger
+}
+
+// SetRecorder captures every datagram to r. Call it before the server is started
+func (s *Server) SetRecorder(r *capture.Recorder) {
+	s.recorder = r
+}
+
+// SetProxyProtocol expects every datagram to start with a PROXY protocol v2 header giving the
+// real client address. Call it before the server is started
+func (s *Server) SetProxyProtocol(enabled bool) {
+	s.proxyProtocol = enabled
+}
+
+// Sessions lists the open LRCP sessions
+func (s *Server) Sessions() []server.SessionInfo {
+	return s.sessionManager.Sessions()
+}
+
+// Disconnect closes the LRCP session with id. Returns false if it is not open
+func (s *Server) Disconnect(id uint64) bool {
+	if id > math.MaxInt32 {
+		return false
+	}
+	return s.sessionManager.Disconnect(int(id))
+}
+
+// instrument wraps udp so proxy headers are stripped, its traffic is counted and, if a recorder
+// is set, captured
+func (s *Server) instrument(udp net.PacketConn) net.PacketConn {
+	if s.proxyProtocol {
+		udp = server.ProxyPacketConn(udp)
 	}
+	if s.recorder != nil {
+		udp = s.recorder.PacketConn(udp)
+	}
+	return metrics.CountPacketConn(udp, s.metrics)
+}
+
+func (s *Server) attach(udp net.PacketConn) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopping {
+		udp.Close()
+		return server.ErrServerClosed
+	}
+	if s.udp != nil {
+		udp.Close()
+		return server.ErrServerStarted
+	}
+	s.udp = udp
+	s.done = make(chan struct{})
+	if len(s.restored) > 0 {
+		s.sessionManager.Restore(udp, s.restored)
+		s.logger.Info("Restored sessions", "sessions", len(s.restored))
+		s.restored = nil
+	}
+	return nil
+}
+
+func (s *Server) serve(udp net.PacketConn) error {
+	defer close(s.done)
 	defer udp.Close()
+
 	// Setup the incoming buffer
 	incoming := make(chan *udpMessage, 1000)
-	defer close(incoming)
-	// Setup the session manager
-	sessionManager := NewSessionManager()
+	processed := make(chan struct{})
+	// Messages already read are handled before the socket is closed
+	defer func() {
+		close(incoming)
+		<-processed
+	}()
 	// Start the incoming buffer
-	go incomingBuffer(incoming, udp, sessionManager)
-	log.Printf("Line reversal listening on port %d", port)
+	go func() {
+		defer close(processed)
+		incomingBuffer(incoming, udp, s.sessionManager, s.metrics, s.logger)
+	}()
 	// Start recieving messages
 	for {
 		buffer := make([]byte, 999)
 		n, senderAddress, err := udp.ReadFrom(buffer)
 		if err != nil {
-			log.Println("Could not recieve packet, continuing...")
+			if errors.Is(err, net.ErrClosed) || s.isHandingOff() {
+				return server.ErrServerClosed
+			}
+			s.logger.Warn("Could not receive packet, continuing", "error", err)
 			continue
 		}
 		udpMessage := &udpMessage{
@@ -47,7 +206,84 @@ func Listen(port int) {
 	}
 }
 
-func incomingBuffer(incoming chan *udpMessage, udpConn net.PacketConn, sessionManager *SessionManager) {
+// Stop refuses new sessions and waits for the open ones to close. When ctx expires the
+// remaining sessions are sent a close message before the socket is closed
+func (s *Server) Stop(ctx context.Context) error {
+	s.mutex.Lock()
+	s.stopping = true
+	udp, done := s.udp, s.done
+	s.mutex.Unlock()
+	defer s.sessionManager.Stop()
+	if udp == nil {
+		return nil
+	}
+	s.sessionManager.Drain()
+	// Sessions still need the socket to exchange data and acks while they finish
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	var err error
+drain:
+	for s.sessionManager.OpenSessions() > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			s.logger.Warn("Drain deadline reached, closing sessions", "sessions", s.sessionManager.OpenSessions())
+			s.sessionManager.CloseAll()
+			// Give the sessions a moment to send their close messages
+			time.Sleep(drainPollInterval)
+			break drain
+		case <-ticker.C:
+		}
+	}
+	udp.Close()
+	<-done
+	return err
+}
+
+func (s *Server) isHandingOff() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.handingOff
+}
+
+// Handoff stops reading datagrams, leaving any that arrive for the next process, and writes the
+// open sessions for Restore. The sessions are not closed, so their clients carry on unaware
+func (s *Server) Handoff(ctx context.Context, w io.Writer) error {
+	s.mutex.Lock()
+	s.stopping = true
+	s.handingOff = true
+	udp, done := s.udp, s.done
+	states := s.restored
+	s.mutex.Unlock()
+	defer s.sessionManager.Stop()
+	if udp != nil {
+		// Unblock the read loop
+		udp.SetReadDeadline(time.Now())
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		states = s.sessionManager.Handoff()
+	}
+	return json.NewEncoder(w).Encode(states)
+}
+
+// Restore loads sessions written by Handoff. Call it before the server is started
+func (s *Server) Restore(r io.Reader) error {
+	var states []SessionState
+	if err := json.NewDecoder(r).Decode(&states); err != nil {
+		return fmt.Errorf("invalid session state: %w", err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.restored = append(s.restored, states...)
+	return nil
+}
+
+func incomingBuffer(incoming chan *udpMessage, udpConn net.PacketConn, sessionManager *SessionManager, m *metrics.Service, logger *slog.Logger) {
 	outputBuffer := make([]byte, 0, 999)
 	for {
 		// Read the incomingMessage from the channel
@@ -56,46 +292,51 @@ func incomingBuffer(incoming chan *udpMessage, udpConn net.PacketConn, sessionMa
 			return
 		}
 		// Process the data
-		decodedMessage, err := DecodeLRMessage(incomingMessage.data)
+		decodedMessage, err := lrcp.DecodeMessage(incomingMessage.data)
 		if err != nil {
-			log.Printf("Could not decode message: %s", err)
+			logger.Debug("Could not decode message", "remote", incomingMessage.sender.String(), "error", err)
+			m.ProtocolErrors.Inc()
 			continue
 		}
-		handleRequest(decodedMessage, incomingMessage.sender, udpConn, sessionManager, outputBuffer)
+		handleRequest(decodedMessage, incomingMessage.sender, udpConn, sessionManager, outputBuffer, logger.With("remote", incomingMessage.sender.String()))
 	}
 }
 
-func handleRequest(message *LRMessage, sender net.Addr, udpConn net.PacketConn, sessionManager *SessionManager, outputBuffer []byte) {
-	log.Printf("Recieved message: %s", message.String())
+func handleRequest(message *lrcp.Message, sender net.Addr, udpConn net.PacketConn, sessionManager *SessionManager, outputBuffer []byte, logger *slog.Logger) {
+	logger.Debug("Received message", "message", message.String())
 	switch message.Type {
 	case "connect":
-		sessionManager.CreateSession(udpConn, sender, message.Session)
+		if !sessionManager.CreateSession(udpConn, sender, message.Session) {
+			// We are shutting down and not accepting new sessions
+			sendCloseResponse(message.Session, udpConn, sender, outputBuffer, logger)
+			return
+		}
 		sessionManager.SendMessage(message.Session, ConnectMessage(sender))
 	case "data":
 		if !sessionManager.SessionExists(message.Session) {
-			sendCloseResponse(message.Session, udpConn, sender, outputBuffer)
+			sendCloseResponse(message.Session, udpConn, sender, outputBuffer, logger)
 		} else {
 			sessionManager.SendMessage(message.Session, DataMessage(message.Position, message.Data, sender))
 		}
 	case "ack":
 		if !sessionManager.SessionExists(message.Session) {
-			sendCloseResponse(message.Session, udpConn, sender, outputBuffer)
+			sendCloseResponse(message.Session, udpConn, sender, outputBuffer, logger)
 		} else {
 			sessionManager.SendMessage(message.Session, AckMessage(message.Length, sender))
 		}
 	case "close":
 		if !sessionManager.SessionExists(message.Session) {
-			sendCloseResponse(message.Session, udpConn, sender, outputBuffer)
+			sendCloseResponse(message.Session, udpConn, sender, outputBuffer, logger)
 		} else {
 			sessionManager.SendMessage(message.Session, CloseMessage(sender))
 		}
 	default:
-		log.Printf("Unknown message type: %s", message.Type)
+		logger.Debug("Unknown message type", "type", message.Type)
 	}
 }
 
-func sendCloseResponse(sessionId int, udpConn net.PacketConn, sender net.Addr, outputBuffer []byte) {
-	message := &LRMessage{
+func sendCloseResponse(sessionId int, udpConn net.PacketConn, sender net.Addr, outputBuffer []byte, logger *slog.Logger) {
+	message := &lrcp.Message{
 		Type:    "close",
 		Session: sessionId,
 	}
@@ -103,21 +344,12 @@ func sendCloseResponse(sessionId int, udpConn net.PacketConn, sender net.Addr, o
 	outputBuffer = outputBuffer[:0]
 	encodedBytes, err := message.Encode(outputBuffer)
 	if err != nil {
-		log.Printf("Error encoding message: %s", err)
+		logger.Error("Error encoding close message", "error", err)
 		return
 	}
 	// Send the message to the sender
 	_, err = udpConn.WriteTo(outputBuffer[:encodedBytes], sender)
 	if err != nil {
-		log.Printf("Error sending message: %s", err)
-	}
-}
-
-func getBindingAddress(port int) string {
-	_, exists := os.LookupEnv("FLY_APP_NAME")
-	if exists {
-		return fmt.Sprintf("fly-global-services:%d", port)
-	} else {
-		return fmt.Sprintf("0.0.0.0:%d", port)
+		logger.Debug("Error sending close message", "error", err)
 	}
 }
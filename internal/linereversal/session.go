@@ -2,10 +2,13 @@ package linereversal
 
 import (
 	"bytes"
-	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"sync/atomic"
 	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/pkg/lrcp"
 )
 
 const Retransmission = 200 * time.Millisecond // Performance tuning variable
@@ -14,13 +17,13 @@ const BufferCapacity = 64 * 1024 // 64KB
 
 // We use an actor model for the session
 type Session struct {
-	// Session state
-	IsClosed         bool
+	// Session state. IsClosed is also read by the session manager
+	IsClosed         atomic.Bool
 	Address          net.Addr
 	ID               int
 	Conn             net.PacketConn
 	Channel          chan SessionMessage
-	Logger           *log.Logger
+	Logger           *slog.Logger
 	LastAck          int
 	MaxAck           int
 	RecievedPosition int
@@ -40,42 +43,101 @@ type Session struct {
 
 	// Time for session expiration
 	LastMessage time.Time
+	Timeout     time.Duration
+
+	// Shared with the other sessions of the server
+	Retransmissions *metrics.Counter
+
+	// Read by the admin API while the session runs. Remote and Started are set before the receive
+	// loop starts and never change, and the counters are atomic
+	Remote   string // Client address when the session was opened
+	Started  time.Time
+	BytesIn  metrics.Counter // Stream bytes received from the client
+	BytesOut metrics.Counter // Stream bytes the client has acknowledged
+
+	// Closed when the receive loop returns
+	stopped chan struct{}
+}
+
+// SessionState is what a session needs to carry on in another process
+type SessionState struct {
+	ID               int       `json:"id"`
+	Address          string    `json:"address"`
+	Remote           string    `json:"remote"`
+	Started          time.Time `json:"started"`
+	RecievedPosition int       `json:"recieved_position"`
+	DataStore        []byte    `json:"data_store"`      // Received data without a newline yet
+	OutgoingBuffer   []byte    `json:"outgoing_buffer"` // Reversed lines the client has not acked, from WritePosition
+	WritePosition    int       `json:"write_position"`
+	LastAck          int       `json:"last_ack"`
+	BytesIn          int64     `json:"bytes_in"`
+	BytesOut         int64     `json:"bytes_out"`
 }
 
 // Used to track outgoing data in transit
 type PendingData struct {
 	Length  int
 	SentAt  time.Time
-	Payload *LRMessage
+	Payload *lrcp.Message
 }
 
-func NewSession(conn net.PacketConn, address net.Addr, id int, messageChannel chan SessionMessage) *Session {
-	session := &Session{
+func NewSession(conn net.PacketConn, address net.Addr, id int, messageChannel chan SessionMessage, timeout time.Duration, retransmissions *metrics.Counter, logger *slog.Logger) *Session {
+	session := newSession(conn, address, id, messageChannel, timeout, retransmissions, logger)
+	// Start the recieve loop
+	go session.RecieveMessage()
+	return session
+}
+
+// RestoreSession carries on a session from its handed off state. Unacked data is sent again
+func RestoreSession(conn net.PacketConn, address net.Addr, state SessionState, messageChannel chan SessionMessage, timeout time.Duration, retransmissions *metrics.Counter, logger *slog.Logger) *Session {
+	session := newSession(conn, address, state.ID, messageChannel, timeout, retransmissions, logger)
+	session.Remote = state.Remote
+	session.Started = state.Started
+	session.RecievedPosition = state.RecievedPosition
+	session.DataStore = append(session.DataStore, state.DataStore...)
+	session.OutgoingBuffer = append(session.OutgoingBuffer, state.OutgoingBuffer...)
+	session.WritePosition = state.WritePosition
+	session.LastAck = state.LastAck
+	session.MaxAck = state.WritePosition
+	session.BytesIn.Add(state.BytesIn)
+	session.BytesOut.Add(state.BytesOut)
+	// The client gets a full timeout from the restart
+	session.LastMessage = time.Now()
+	session.HandleOutgoingBuffer()
+
+	go session.RecieveMessage()
+	return session
+}
+
+func newSession(conn net.PacketConn, address net.Addr, id int, messageChannel chan SessionMessage, timeout time.Duration, retransmissions *metrics.Counter, logger *slog.Logger) *Session {
+	return &Session{
 		Conn:           conn,
 		Address:        address,
 		ID:             id,
-		IsClosed:       false,
 		Channel:        messageChannel,
-		Logger:         log.New(log.Writer(), fmt.Sprintf("Session %d: ", id), log.LstdFlags),
+		Logger:         logger.With("session", id),
 		DataStore:      make([]byte, 0, BufferCapacity),
 		OutgoingBuffer: make([]byte, 0, BufferCapacity),
 		SendBuffer:     make([]byte, 0, 1000),
 		Timer:          time.NewTimer(Retransmission),
-	}
+		Timeout:        timeout,
 
-	// Start the recieve loop
-	go session.RecieveMessage()
-	return session
+		Retransmissions: retransmissions,
+		Remote:          address.String(),
+		Started:         time.Now(),
+		stopped:         make(chan struct{}),
+	}
 }
 
 func (s *Session) RecieveMessage() {
+	defer close(s.stopped)
 	for {
 		select {
 		// The timer covers both data retransmission and session timeout
 		case <-s.Timer.C:
 			// Session has timed out
-			if time.Now().After(s.LastMessage.Add(SessionTimeout)) {
-				s.Logger.Println("Session timed out, closing session.")
+			if time.Now().After(s.LastMessage.Add(s.Timeout)) {
+				s.Logger.Debug("Session timed out, closing session")
 				s.Close()
 				return
 			}
@@ -84,13 +146,14 @@ func (s *Session) RecieveMessage() {
 				continue
 			}
 			// If the data is expired, we need to close the session
-			if time.Since(s.PendingData.SentAt) > SessionTimeout {
-				s.Logger.Printf("did not recieve acknowledgement from client after %s, closing session.", SessionTimeout)
+			if time.Since(s.PendingData.SentAt) > s.Timeout {
+				s.Logger.Debug("Did not receive acknowledgement from client, closing session", "timeout", s.Timeout)
 				s.Close()
 				return
 			}
 			// If the data is not expired, we need to retransmit it
-			s.Logger.Println("Retransmitting data to client")
+			s.Logger.Debug("Retransmitting data to client")
+			s.Retransmissions.Inc()
 			s.SendDataMessage(s.PendingData.Payload)
 			s.Timer.Reset(Retransmission)
 
@@ -98,7 +161,7 @@ func (s *Session) RecieveMessage() {
 		case msg, ok := <-s.Channel:
 			s.LastMessage = time.Now()
 			if !ok {
-				s.Logger.Println("Channel closed, exiting receive loop.")
+				s.Logger.Debug("Channel closed, exiting receive loop")
 				return
 			}
 			// Update the address if it is different
@@ -118,40 +181,63 @@ func (s *Session) RecieveMessage() {
 			// If we recieve an ack we need to handle it
 			case "recieved_ack":
 				s.HandleAck(msg.Number)
+			// Another process is taking the session over, so stop without telling the client
+			case "handoff":
+				s.Timer.Stop()
+				msg.State <- s.State()
+				return
 			}
 		}
 	}
 }
 
+// State returns what the session needs to carry on elsewhere. Only the receive loop may call it
+func (s *Session) State() SessionState {
+	return SessionState{
+		ID:               s.ID,
+		Address:          s.Address.String(),
+		Remote:           s.Remote,
+		Started:          s.Started,
+		RecievedPosition: s.RecievedPosition,
+		DataStore:        s.DataStore,
+		OutgoingBuffer:   s.OutgoingBuffer,
+		WritePosition:    s.WritePosition,
+		LastAck:          s.LastAck,
+		BytesIn:          s.BytesIn.Value(),
+		BytesOut:         s.BytesOut.Value(),
+	}
+}
+
 func (s *Session) Close() {
 	s.SendCloseMessage()
-	s.IsClosed = true
+	s.IsClosed.Store(true)
 }
 
 func (s *Session) HandleAck(length int) {
-	s.Logger.Printf("Recieved ack message: %d", length)
+	s.Logger.Debug("Received ack message", "length", length)
 	// If this is smaller than our last ack, we ignore it as it is a delayed message
 	if length < s.LastAck {
-		s.Logger.Printf("Received delayed ack message: u%d < %d", length, s.LastAck)
+		s.Logger.Debug("Received delayed ack message", "length", length, "last_ack", s.LastAck)
 		return
 	}
 	// If this is larger than our max ack, we need to close the session
 	if length > s.MaxAck {
-		s.Logger.Printf("Received ack message: %d > %d. Closing the session", length, s.MaxAck)
+		s.Logger.Debug("Received ack beyond sent data. Closing the session", "length", length, "max_ack", s.MaxAck)
 		s.Close()
 		return
 	}
 	// If we have no pending data, we can exit
 	if s.PendingData == nil {
-		s.Logger.Printf("Received ack message: %d. No pending data", length)
+		s.Logger.Debug("Received ack message with no pending data", "length", length)
 		return
 	}
 	// If the ack matches or is less that what we send, we can remove the acknowledged data
 	expectedLength := s.WritePosition + s.PendingData.Length
 	if length <= expectedLength {
-		s.Logger.Printf("Received ack for pending data: %d", length)
+		s.Logger.Debug("Received ack for pending data", "length", length)
 		s.Timer.Stop()
 		// Remove the acknowledged data from the outgoing buffer
+		s.BytesOut.Add(int64(length - s.WritePosition))
 		s.OutgoingBuffer = s.OutgoingBuffer[length-s.WritePosition:]
 		// Set the write position to the new position
 		s.WritePosition += length - s.WritePosition
@@ -172,13 +258,13 @@ func (s *Session) HandleOutgoingBuffer() {
 	// Create a new buffer for the message
 	buffer := make([]byte, 0, 1000)
 	// If we have pending data, we need to need to pack it and send it
-	newDataMessage := &LRMessage{
+	newDataMessage := &lrcp.Message{
 		Type:     "data",
 		Session:  s.ID,
 		Position: s.WritePosition,
 		Data:     buffer,
 	}
-	bytesUsed := PackDataMessage(newDataMessage, s.OutgoingBuffer, s.WritePosition)
+	bytesUsed := lrcp.PackDataMessage(newDataMessage, s.OutgoingBuffer, s.WritePosition)
 	// The max ack is the write position + the bytes used. Anything we recieve beyond this number from the client is invalid
 	s.MaxAck = s.WritePosition + bytesUsed
 	// Set the pending data
@@ -200,17 +286,14 @@ func (s *Session) HandleRecieveData(data []byte, position int) {
 		s.SendAckMessage(s.RecievedPosition)
 		return
 	}
-	// If the data is in order, we add it to the buffer
-	unescaped, err := UnescapeData(data)
-	if err != nil {
-		s.Logger.Println("Error unescaping data:", err)
-		return
-	}
+	// If the data is in order, we add it to the buffer. DecodeMessage has already unescaped it
+	unescaped := data
 	s.RecievedPosition += len(unescaped)
+	s.BytesIn.Add(int64(len(unescaped)))
 	// Send an ack in response
 	s.SendAckMessage(s.RecievedPosition)
 	// Transmit the data to the read channel
-	s.Logger.Printf("Recieved data of length %d \n", len(unescaped))
+	s.Logger.Debug("Received data", "length", len(unescaped))
 	s.DataStore = append(s.DataStore, unescaped...)
 	// We need to check to see if we recieved a newline
 	s.CheckDataStore()
@@ -245,7 +328,7 @@ func (s *Session) CheckDataStore() {
 }
 
 func (s *Session) SendCloseMessage() {
-	closeMessage := &LRMessage{
+	closeMessage := &lrcp.Message{
 		Type:    "close",
 		Session: s.ID,
 	}
@@ -253,34 +336,34 @@ func (s *Session) SendCloseMessage() {
 	s.SendBuffer = s.SendBuffer[:0]
 	messageLength, err := closeMessage.Encode(s.SendBuffer)
 	if err != nil {
-		s.Logger.Println("Error encoding close message:", err)
+		s.Logger.Error("Error encoding close message", "error", err)
 		return
 	}
 	_, err = s.Conn.WriteTo(s.SendBuffer[:messageLength], s.Address)
 	if err != nil {
-		s.Logger.Println("Error sending close message:", err)
+		s.Logger.Debug("Error sending close message", "error", err)
 		return
 	}
 }
 
-func (s *Session) SendDataMessage(message *LRMessage) {
+func (s *Session) SendDataMessage(message *lrcp.Message) {
 	// Reset the send buffer
 	s.SendBuffer = s.SendBuffer[:0]
 	messageLength, err := message.Encode(s.SendBuffer)
 	if err != nil {
-		s.Logger.Println("Error encoding data message:", err)
+		s.Logger.Error("Error encoding data message", "error", err)
 		return
 	}
-	s.Logger.Printf("Sending data message of length: %d. Expecting ack back of: %d \n", len(message.Data), s.MaxAck)
+	s.Logger.Debug("Sending data message", "length", len(message.Data), "expected_ack", s.MaxAck)
 	_, err = s.Conn.WriteTo(s.SendBuffer[:messageLength], s.Address)
 	if err != nil {
-		s.Logger.Println("Error sending data message:", err)
+		s.Logger.Debug("Error sending data message", "error", err)
 		return
 	}
 }
 
 func (s *Session) SendAckMessage(length int) {
-	ackMessage := &LRMessage{
+	ackMessage := &lrcp.Message{
 		Type:    "ack",
 		Session: s.ID,
 		Length:  length,
@@ -289,31 +372,12 @@ func (s *Session) SendAckMessage(length int) {
 	s.SendBuffer = s.SendBuffer[:0]
 	messageLength, err := ackMessage.Encode(s.SendBuffer)
 	if err != nil {
-		s.Logger.Println("Error encoding ack message:", err)
+		s.Logger.Error("Error encoding ack message", "error", err)
 		return
 	}
 	_, err = s.Conn.WriteTo(s.SendBuffer[:messageLength], s.Address)
 	if err != nil {
-		s.Logger.Println("Error sending ack message:", err)
+		s.Logger.Debug("Error sending ack message", "error", err)
 		return
 	}
 }
-
-func UnescapeData(data []byte) ([]byte, error) {
-	output := make([]byte, 0, len(data))
-	for i := 0; i < len(data); i++ {
-		// We end with an escaping slash which is invalid
-		if i == len(data)-1 && data[i] == '\\' {
-			return nil, fmt.Errorf("invalid data: %s", data)
-		}
-		// If we encounter an escaped slash, add the next character to the output
-		if data[i] == '\\' && i < len(data)-1 && (data[i+1] == '/' || data[i+1] == '\\') {
-			output = append(output, data[i+1])
-			i++
-			continue
-		}
-		// Otherwise, just add the character to the output
-		output = append(output, data[i])
-	}
-	return output, nil
-}
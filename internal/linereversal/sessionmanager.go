@@ -2,9 +2,14 @@ package linereversal
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"sort"
+	"sync"
 	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/server"
 )
 
 // Interval for monitoring sessions for closure
@@ -12,7 +17,15 @@ import (
 const MonitorInterval = 3 * time.Minute
 
 type SessionManager struct {
-	sessions map[int]*Session
+	mutex          sync.Mutex
+	sessions       map[int]*Session
+	sessionTimeout time.Duration
+	draining       bool
+	stop           chan struct{}
+	stopOnce       sync.Once
+
+	Retransmissions metrics.Counter
+	Logger          *slog.Logger
 }
 
 // Instructions for the sessions behavior
@@ -21,6 +34,7 @@ type SessionMessage struct {
 	Data    []byte // Payload
 	Number  int    // Either a position or length
 	Address net.Addr
+	State   chan<- SessionState // Where a handoff sends the session state
 }
 
 // Control messages
@@ -55,19 +69,35 @@ func ConnectMessage(address net.Addr) SessionMessage {
 	}
 }
 
-// Create a new session manager
-func NewSessionManager() *SessionManager {
+func HandoffMessage(state chan<- SessionState) SessionMessage {
+	return SessionMessage{
+		Type:  "handoff",
+		State: state,
+	}
+}
+
+// Create a new session manager. A zero timeout uses the default SessionTimeout
+func NewSessionManager(sessionTimeout time.Duration) *SessionManager {
+	if sessionTimeout <= 0 {
+		sessionTimeout = SessionTimeout
+	}
 	sm := &SessionManager{
-		sessions: make(map[int]*Session),
+		sessions:       make(map[int]*Session),
+		sessionTimeout: sessionTimeout,
+		stop:           make(chan struct{}),
+		Logger:         slog.Default(),
 	}
 	go sm.MonitorSessions()
 	return sm
 }
 
 func (sm *SessionManager) SessionExists(id int) bool {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
 	session, ok := sm.sessions[id]
 	if ok {
-		return !session.IsClosed
+		return !session.IsClosed.Load()
 	}
 	return ok
 }
@@ -75,40 +105,184 @@ func (sm *SessionManager) SessionExists(id int) bool {
 // Sessions close themselves, so we monitor them every 3 minutes
 func (sm *SessionManager) MonitorSessions() {
 	for {
+		sm.mutex.Lock()
 		for _, session := range sm.sessions {
-			if session.IsClosed {
-				log.Printf("Session %d is closed. Closing the channel and removing expired data", session.ID)
+			if session.IsClosed.Load() {
+				sm.Logger.Debug("Session is closed. Closing the channel and removing expired data", "session", session.ID)
 				close(session.Channel)
 				delete(sm.sessions, session.ID)
 			}
 		}
-		time.Sleep(MonitorInterval)
+		sm.mutex.Unlock()
+		select {
+		case <-sm.stop:
+			return
+		case <-time.After(MonitorInterval):
+		}
 	}
 }
 
-// Create a session. Does nothing if it already exists
-func (sm *SessionManager) CreateSession(conn net.PacketConn, address net.Addr, id int) {
+// Create a session. Does nothing if it already exists. Returns false if the session
+// could not be opened because the manager is draining
+func (sm *SessionManager) CreateSession(conn net.PacketConn, address net.Addr, id int) bool {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
 	if session, ok := sm.sessions[id]; ok {
 		// Session already exists
-		if session.IsClosed {
+		if session.IsClosed.Load() {
 			// Session is closed, so we can create a new one. Delete the existing first
 			delete(sm.sessions, id)
 		} else {
 			// Session is still open, so we do nothing
-			return
+			return true
 		}
 	}
+	if sm.draining {
+		return false
+	}
 	messageChannel := make(chan SessionMessage, 20)
-	sm.sessions[id] = NewSession(conn, address, id, messageChannel)
+	sm.sessions[id] = NewSession(conn, address, id, messageChannel, sm.sessionTimeout, &sm.Retransmissions, sm.Logger.With("remote", address.String()))
+	return true
+}
+
+// Drain stops new sessions from being created. Existing sessions carry on
+func (sm *SessionManager) Drain() {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	sm.draining = true
+}
+
+// OpenSessions returns the number of sessions that have not closed yet
+func (sm *SessionManager) OpenSessions() int {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	open := 0
+	for _, session := range sm.sessions {
+		if !session.IsClosed.Load() {
+			open++
+		}
+	}
+	return open
+}
+
+// CloseAll tells every open session to send a close message to its client
+func (sm *SessionManager) CloseAll() {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	for _, session := range sm.sessions {
+		if session.IsClosed.Load() {
+			continue
+		}
+		select {
+		case session.Channel <- CloseMessage(nil):
+		default:
+			sm.Logger.Warn("Session is busy, could not ask it to close", "session", session.ID)
+		}
+	}
+}
+
+// Sessions lists the open sessions for the admin API. The id of each is its LRCP session number.
+// Only the fields that are safe to read while a session runs are used
+func (sm *SessionManager) Sessions() []server.SessionInfo {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	sessions := make([]server.SessionInfo, 0, len(sm.sessions))
+	for _, session := range sm.sessions {
+		if session.IsClosed.Load() {
+			continue
+		}
+		sessions = append(sessions, server.SessionInfo{
+			ID:       uint64(session.ID),
+			Remote:   session.Remote,
+			Started:  session.Started,
+			BytesIn:  session.BytesIn.Value(),
+			BytesOut: session.BytesOut.Value(),
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions
+}
+
+// Disconnect tells the session with id to close. Returns false if it is not open
+func (sm *SessionManager) Disconnect(id int) bool {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	session, ok := sm.sessions[id]
+	if !ok || session.IsClosed.Load() {
+		return false
+	}
+	select {
+	case session.Channel <- CloseMessage(nil):
+		return true
+	default:
+		sm.Logger.Warn("Session is busy, could not ask it to close", "session", id)
+		return false
+	}
+}
+
+// Handoff stops every open session without closing it and returns their state. The sessions are
+// removed, so the manager can be stopped without waiting for them
+func (sm *SessionManager) Handoff() []SessionState {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	states := make([]SessionState, 0, len(sm.sessions))
+	for id, session := range sm.sessions {
+		delete(sm.sessions, id)
+		reply := make(chan SessionState, 1)
+		select {
+		case session.Channel <- HandoffMessage(reply):
+		case <-session.stopped:
+		}
+		// A session that closed itself first has nothing to hand over
+		<-session.stopped
+		select {
+		case state := <-reply:
+			states = append(states, state)
+		default:
+		}
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].ID < states[j].ID })
+	return states
+}
+
+// Restore recreates sessions from another process, answering their clients on conn
+func (sm *SessionManager) Restore(conn net.PacketConn, states []SessionState) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	for _, state := range states {
+		address, err := net.ResolveUDPAddr("udp", state.Address)
+		if err != nil {
+			sm.Logger.Warn("Could not restore session", "session", state.ID, "error", err)
+			continue
+		}
+		messageChannel := make(chan SessionMessage, 20)
+		sm.sessions[state.ID] = RestoreSession(conn, address, state, messageChannel, sm.sessionTimeout, &sm.Retransmissions, sm.Logger.With("remote", state.Address))
+	}
+}
+
+// Stop ends the session monitor
+func (sm *SessionManager) Stop() {
+	sm.stopOnce.Do(func() { close(sm.stop) })
 }
 
 // Send a session a message
 func (sm *SessionManager) SendMessage(id int, msg SessionMessage) error {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
 	session, ok := sm.sessions[id]
 	if !ok {
 		return fmt.Errorf("could not send message, session %d not found", id)
 	}
-	if session.IsClosed {
+	if session.IsClosed.Load() {
 		return fmt.Errorf("could not send message, session %d is closed", id)
 	}
 	session.Channel <- msg
@@ -2,11 +2,18 @@ package meanstoanend
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+
+	"github.com/JeremyFenwick/firewatch/internal/capture"
+	"github.com/JeremyFenwick/firewatch/internal/logging"
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/JeremyFenwick/firewatch/internal/service"
 )
 
 type messageType int
@@ -23,30 +30,116 @@ type message struct {
 	second int32
 }
 
-func Listen(port int) {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+type Server struct {
+	metrics *metrics.Service
+	logger  *slog.Logger
+	tcp     server.TCPServer
+}
 
-	listener, err := net.Listen("tcp4", fmt.Sprintf(":%d", port))
-	if err != nil {
-		log.Fatal("Could not start listener. REASON: " + err.Error())
+func init() {
+	service.Register(service.Definition{
+		Name:      "meanstoanend",
+		Transport: service.TCP,
+		Port:      5002,
+		New:       func(service.Options) service.Service { return NewServer() },
+	})
+}
+
+func NewServer() *Server {
+	s := &Server{metrics: metrics.NewService("meanstoanend")}
+	s.tcp.Metrics = s.metrics
+	s.SetLogger(slog.Default().With("service", "meanstoanend"))
+	s.tcp.Handler = func(ctx context.Context, conn net.Conn) {
+		handleConnection(ctx, conn, s.metrics)
 	}
-	log.Printf("Means to an end listening on port %d\n", port)
-	defer listener.Close()
+	return s
+}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Println("Encountered error accepting connection. REASON: " + err.Error())
-			continue
-		}
+// Serve accepts connections on listener until the server is stopped
+func (s *Server) Serve(listener net.Listener) error {
+	s.logger.Info("Means to an end listening", "address", listener.Addr().String())
+	return s.tcp.Serve(listener)
+}
 
-		go handleConnection(conn)
+// Start listens on address and serves in the background. Use port 0 to pick a free port
+func (s *Server) Start(address string) error {
+	listener, err := server.Listen(address)
+	if err != nil {
+		return fmt.Errorf("could not start listener: %w", err)
 	}
+	s.logger.Info("Means to an end listening", "address", listener.Addr().String())
+	return s.tcp.Start(listener)
+}
+
+// Addr returns the listening address, or nil before the server has started
+func (s *Server) Addr() net.Addr {
+	return s.tcp.Addr()
+}
+
+// Err returns why the server stopped accepting connections on its own, or nil while it is serving
+func (s *Server) Err() error {
+	return s.tcp.Err()
+}
+
+// Metrics returns the server's counters so they can be added to a metrics.Registry
+func (s *Server) Metrics() *metrics.Service {
+	return s.metrics
+}
+
+// SetLogger replaces the server's logger. Call it before the server is started
+func (s *Server) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+	s.tcp.Logger = logger
 }
 
-func handleConnection(conn net.Conn) {
+// SetLimits sets the connection limits. Call it before the server is started
+func (s *Server) SetLimits(limits server.Limits) {
+	s.tcp.Limits = limits
+}
+
+// SetTLS serves every connection over TLS. Call it before the server is started
+func (s *Server) SetTLS(t *server.TLS) {
+	s.tcp.TLS = t
+}
+
+// SetProxyProtocol expects connections to open with a PROXY protocol header giving the real client
+// address. Call it before the server is started
+func (s *Server) SetProxyProtocol(enabled bool) {
+	s.tcp.ProxyProtocol = enabled
+}
+
+// SetRecorder captures the traffic of every connection to r. Call it before the server is started
+func (s *Server) SetRecorder(r *capture.Recorder) {
+	s.tcp.Recorder = r
+}
+
+// Sessions lists the connected clients
+func (s *Server) Sessions() []server.SessionInfo {
+	return s.tcp.Sessions()
+}
+
+// Disconnect closes the client connection with id. Returns false if there is none
+func (s *Server) Disconnect(id uint64) bool {
+	return s.tcp.Disconnect(id)
+}
+
+// Stop stops accepting connections and waits for open ones to finish until ctx expires
+func (s *Server) Stop(ctx context.Context) error {
+	return s.tcp.Stop(ctx)
+}
+
+func handleConnection(ctx context.Context, conn net.Conn, m *metrics.Service) {
 	defer conn.Close()
-	reader := bufio.NewReader(conn)
+	logger := logging.FromContext(ctx)
+	if err := Session(conn, conn, logger, m); err != nil {
+		logger.Debug("Failed to receive message from connection", "error", err)
+	}
+}
+
+// Session reads 9 byte messages from r until it runs out, writing the answer to each query to w.
+// Prices only last for the session. A partial message at the end is ignored
+func Session(r io.Reader, w io.Writer, logger *slog.Logger, m *metrics.Service) error {
+	reader := bufio.NewReader(r)
 
 	history := map[int32]int32{}
 
@@ -54,15 +147,17 @@ func handleConnection(conn net.Conn) {
 		buffer := make([]byte, 9)
 		_, err := io.ReadFull(reader, buffer)
 		if err == io.ErrUnexpectedEOF || err == io.EOF {
-			return
+			return nil
 		}
 		if err != nil {
-			log.Println("Failed to receive message from connection:", err)
-			return
+			return err
 		}
 
 		message := extractMessage(buffer)
-		handleMessage(message, history, conn)
+		if message.messageType == Unknown {
+			m.ProtocolErrors.Inc()
+		}
+		handleMessage(message, history, w, logger)
 	}
 }
 
@@ -91,22 +186,22 @@ func extractMessage(data []byte) *message {
 	}
 }
 
-func handleMessage(message *message, history map[int32]int32, conn net.Conn) {
+func handleMessage(message *message, history map[int32]int32, w io.Writer, logger *slog.Logger) {
 	if message.messageType == Insert {
 		history[message.first] = message.second
 	} else if message.messageType == Query {
-		handleQuery(message.first, message.second, history, conn)
+		handleQuery(message.first, message.second, history, w, logger)
 	} else {
 		return
 	}
 }
 
-func handleQuery(start, end int32, history map[int32]int32, conn net.Conn) {
+func handleQuery(start, end int32, history map[int32]int32, w io.Writer, logger *slog.Logger) {
 	var count int64
 	var sum int64
 	var average int32
 
-	log.Printf("Processing query for range %d-%d with history: %+v\n", start, end, history) // Added detailed log
+	logger.Debug("Processing query", "start", start, "end", end, "prices", len(history))
 
 	for time, price := range history {
 		if time >= start && time <= end {
@@ -122,12 +217,11 @@ func handleQuery(start, end int32, history map[int32]int32, conn net.Conn) {
 
 	response := make([]byte, 4)
 	binary.BigEndian.PutUint32(response, uint32(average))
-	log.Printf("Responding with average: %d", average)
 
-	bytes, err := conn.Write(response)
+	_, err := w.Write(response)
 	if err != nil {
-		log.Println("Could not write to client:", err)
+		logger.Debug("Could not write to client", "error", err)
 		return
 	}
-	log.Printf("Successfully sent %d bytes", bytes)
+	logger.Debug("Responded to query", "average", average)
 }
@@ -0,0 +1,62 @@
+package metrics
+
+import "net"
+
+// countingConn adds the bytes read and written on a connection to a service's totals
+type countingConn struct {
+	net.Conn
+	service *Service
+}
+
+// CountConn wraps conn so its traffic is added to the service's byte counters
+func CountConn(conn net.Conn, s *Service) net.Conn {
+	return &countingConn{Conn: conn, service: s}
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.service.BytesIn.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.service.BytesOut.Add(int64(n))
+	return n, err
+}
+
+// Uncounted returns the connection CountConn wrapped and a function that adds bytes moved over it
+// to the service's counters. Other connections are returned as they are
+func Uncounted(conn net.Conn) (net.Conn, func(in, out int64)) {
+	c, ok := conn.(*countingConn)
+	if !ok {
+		return conn, func(in, out int64) {}
+	}
+	return c.Conn, func(in, out int64) {
+		c.service.BytesIn.Add(in)
+		c.service.BytesOut.Add(out)
+	}
+}
+
+// countingPacketConn is countingConn for UDP services
+type countingPacketConn struct {
+	net.PacketConn
+	service *Service
+}
+
+// CountPacketConn wraps conn so its traffic is added to the service's byte counters
+func CountPacketConn(conn net.PacketConn, s *Service) net.PacketConn {
+	return &countingPacketConn{PacketConn: conn, service: s}
+}
+
+func (c *countingPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	c.service.BytesIn.Add(int64(n))
+	return n, addr, err
+}
+
+func (c *countingPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	c.service.BytesOut.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a value that only goes up
+type Counter struct {
+	value atomic.Int64
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Add(n int64) {
+	c.value.Add(n)
+}
+
+func (c *Counter) Value() int64 {
+	return c.value.Load()
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	value atomic.Int64
+}
+
+func (g *Gauge) Inc() {
+	g.value.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.value.Add(-1)
+}
+
+func (g *Gauge) Add(n int64) {
+	g.value.Add(n)
+}
+
+func (g *Gauge) Set(n int64) {
+	g.value.Store(n)
+}
+
+func (g *Gauge) Value() int64 {
+	return g.value.Load()
+}
+
+type kind string
+
+const (
+	counterKind kind = "counter"
+	gaugeKind   kind = "gauge"
+)
+
+// metric is a service specific metric. collect returns the value for each label value, an
+// empty label means the metric has no extra label
+type metric struct {
+	name    string
+	help    string
+	kind    kind
+	label   string
+	collect func() map[string]float64
+}
+
+// Service holds the metrics for a single protohackers service. The connection metrics are
+// updated by the server, anything else is registered by the service itself
+type Service struct {
+	Name                string
+	ActiveConnections   Gauge
+	AcceptedConnections Counter
+	RejectedConnections Counter
+	BytesIn             Counter
+	BytesOut            Counter
+	ProtocolErrors      Counter
+
+	mutex   sync.Mutex
+	metrics []metric
+}
+
+func NewService(name string) *Service {
+	return &Service{Name: name}
+}
+
+// RegisterCounter exports c as firewatch_<name>
+func (s *Service) RegisterCounter(name, help string, c *Counter) {
+	s.register(metric{name: name, help: help, kind: counterKind, collect: func() map[string]float64 {
+		return map[string]float64{"": float64(c.Value())}
+	}})
+}
+
+// RegisterGauge exports g as firewatch_<name>
+func (s *Service) RegisterGauge(name, help string, g *Gauge) {
+	s.register(metric{name: name, help: help, kind: gaugeKind, collect: func() map[string]float64 {
+		return map[string]float64{"": float64(g.Value())}
+	}})
+}
+
+// RegisterGaugeFunc exports a gauge whose value is read from fn on every scrape
+func (s *Service) RegisterGaugeFunc(name, help string, fn func() float64) {
+	s.register(metric{name: name, help: help, kind: gaugeKind, collect: func() map[string]float64 {
+		return map[string]float64{"": fn()}
+	}})
+}
+
+// RegisterGaugeVecFunc exports a gauge with one sample per key of the map returned by fn.
+// The keys are used as the value of label
+func (s *Service) RegisterGaugeVecFunc(name, help, label string, fn func() map[string]float64) {
+	s.register(metric{name: name, help: help, kind: gaugeKind, label: label, collect: fn})
+}
+
+func (s *Service) register(m metric) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.metrics = append(s.metrics, m)
+}
+
+func (s *Service) registered() []metric {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]metric(nil), s.metrics...)
+}
@@ -0,0 +1,149 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const prefix = "firewatch_"
+
+// ContentType is the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Registry collects the metrics of every registered service and serves them over HTTP
+type Registry struct {
+	mutex    sync.Mutex
+	services []*Service
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) Register(s *Service) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.services = append(r.services, s)
+}
+
+// Replace swaps a registered service for another, such as a restarted instance of it
+func (r *Registry) Replace(old, s *Service) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for i, registered := range r.services {
+		if registered == old {
+			r.services[i] = s
+			return
+		}
+	}
+	r.services = append(r.services, s)
+}
+
+type sample struct {
+	labels string
+	value  float64
+}
+
+type family struct {
+	help    string
+	kind    kind
+	samples []sample
+}
+
+// connection metrics every service exports
+var standard = []struct {
+	name  string
+	help  string
+	kind  kind
+	value func(s *Service) int64
+}{
+	{"connections_active", "Connections currently open", gaugeKind, func(s *Service) int64 { return s.ActiveConnections.Value() }},
+	{"connections_accepted_total", "Connections accepted since start", counterKind, func(s *Service) int64 { return s.AcceptedConnections.Value() }},
+	{"connections_rejected_total", "Connections closed on accept by a connection limit", counterKind, func(s *Service) int64 { return s.RejectedConnections.Value() }},
+	{"bytes_received_total", "Bytes read from clients", counterKind, func(s *Service) int64 { return s.BytesIn.Value() }},
+	{"bytes_sent_total", "Bytes written to clients", counterKind, func(s *Service) int64 { return s.BytesOut.Value() }},
+	{"protocol_errors_total", "Malformed or invalid requests from clients", counterKind, func(s *Service) int64 { return s.ProtocolErrors.Value() }},
+}
+
+// Write writes every metric in the Prometheus text format
+func (r *Registry) Write(w io.Writer) error {
+	r.mutex.Lock()
+	services := append([]*Service(nil), r.services...)
+	r.mutex.Unlock()
+
+	buffered := bufio.NewWriter(w)
+	for _, m := range standard {
+		f := &family{help: m.help, kind: m.kind}
+		for _, s := range services {
+			f.samples = append(f.samples, sample{labels: serviceLabel(s), value: float64(m.value(s))})
+		}
+		writeFamily(buffered, m.name, f)
+	}
+	// Group the service specific metrics by name so each family is only described once
+	families := make(map[string]*family)
+	for _, s := range services {
+		for _, m := range s.registered() {
+			f, exists := families[m.name]
+			if !exists {
+				f = &family{help: m.help, kind: m.kind}
+				families[m.name] = f
+			}
+			values := m.collect()
+			keys := make([]string, 0, len(values))
+			for key := range values {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				labels := serviceLabel(s)
+				if m.label != "" {
+					labels += fmt.Sprintf(",%s=\"%s\"", m.label, escape(key))
+				}
+				f.samples = append(f.samples, sample{labels: labels, value: values[key]})
+			}
+		}
+	}
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeFamily(buffered, name, families[name])
+	}
+	return buffered.Flush()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	if err := r.Write(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeFamily(w io.Writer, name string, f *family) {
+	fmt.Fprintf(w, "# HELP %s%s %s\n", prefix, name, f.help)
+	fmt.Fprintf(w, "# TYPE %s%s %s\n", prefix, name, f.kind)
+	for _, s := range f.samples {
+		fmt.Fprintf(w, "%s%s{%s} %s\n", prefix, name, s.labels, strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+}
+
+func serviceLabel(s *Service) string {
+	return fmt.Sprintf("service=\"%s\"", escape(s.Name))
+}
+
+// Label values only escape backslashes, quotes and newlines
+var escaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\"", "\\\"")
+
+func escape(value string) string {
+	return escaper.Replace(value)
+}
@@ -4,47 +4,147 @@ import (
 	"bufio"
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/capture"
+	"github.com/JeremyFenwick/firewatch/internal/logging"
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/JeremyFenwick/firewatch/internal/service"
 )
 
+// DefaultUpstream is the public budget chat server run by protohackers
+const DefaultUpstream = "chat.protohackers.com:16963"
+
 type contextPackage struct {
 	ctx    context.Context
 	cancel context.CancelFunc
-	logger *log.Logger
+	logger *slog.Logger
 	wg     *sync.WaitGroup
 }
 
-func Listen(port int, upstream string, upstreamPort int) {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+type Server struct {
+	upstreamAddress string
+	upstream        server.UpstreamCheck
+	metrics         *metrics.Service
+	logger          *slog.Logger
+	tcp             server.TCPServer
+}
+
+func init() {
+	service.Register(service.Definition{
+		Name:      "mobinthemiddle",
+		Transport: service.TCP,
+		Port:      5005,
+		Defaults:  service.Options{Upstream: DefaultUpstream},
+		New:       func(o service.Options) service.Service { return NewServer(o.Upstream) },
+	})
+}
 
-	listener, err := net.Listen("tcp4", fmt.Sprintf(":%d", port))
+// NewServer proxies budget chat clients to the upstream host:port, rewriting Boguscoin addresses
+func NewServer(upstreamAddress string) *Server {
+	s := &Server{upstreamAddress: upstreamAddress, metrics: metrics.NewService("mobinthemiddle")}
+	s.upstream.Address = upstreamAddress
+	s.tcp.Metrics = s.metrics
+	s.SetLogger(slog.Default().With("service", "mobinthemiddle"))
+	s.tcp.Handler = func(ctx context.Context, conn net.Conn) {
+		handleConnection(ctx, conn, s.upstreamAddress)
+	}
+	return s
+}
+
+// Serve accepts connections on listener until the server is stopped
+func (s *Server) Serve(listener net.Listener) error {
+	s.logger.Info("Mob in the middle now listening", "address", listener.Addr().String())
+	return s.tcp.Serve(listener)
+}
+
+// Start listens on address and serves in the background. Use port 0 to pick a free port
+func (s *Server) Start(address string) error {
+	listener, err := server.Listen(address)
 	if err != nil {
-		log.Fatalf("Could not start listener. REASON: %v", err)
+		return fmt.Errorf("could not start listener: %w", err)
 	}
-	log.Printf("Mob in the middle now listening on port %d\n", port)
-	defer listener.Close()
+	s.logger.Info("Mob in the middle now listening", "address", listener.Addr().String())
+	return s.tcp.Start(listener)
+}
 
-	upstreamAddress := net.JoinHostPort(upstream, fmt.Sprintf("%d", upstreamPort))
+// Addr returns the listening address, or nil before the server has started
+func (s *Server) Addr() net.Addr {
+	return s.tcp.Addr()
+}
 
-	for {
-		clientConn, err := listener.Accept()
-		if err != nil {
-			log.Printf("Encountered error accepting connection. REASON: %v", err)
-			continue
-		}
-		go handleConnection(clientConn, upstreamAddress)
+// Err returns why the server stopped accepting connections on its own, or nil while it is serving
+func (s *Server) Err() error {
+	return s.tcp.Err()
+}
+
+// Metrics returns the server's counters so they can be added to a metrics.Registry
+func (s *Server) Metrics() *metrics.Service {
+	return s.metrics
+}
+
+// SetLogger replaces the server's logger. Call it before the server is started
+func (s *Server) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+	s.tcp.Logger = logger
+}
+
+// SetLimits sets the connection limits. Call it before the server is started
+func (s *Server) SetLimits(limits server.Limits) {
+	s.tcp.Limits = limits
+}
+
+// SetTLS serves every connection over TLS. Call it before the server is started
+func (s *Server) SetTLS(t *server.TLS) {
+	s.tcp.TLS = t
+}
+
+// SetProxyProtocol expects connections to open with a PROXY protocol header giving the real client
+// address. Call it before the server is started
+func (s *Server) SetProxyProtocol(enabled bool) {
+	s.tcp.ProxyProtocol = enabled
+}
+
+// SetRecorder captures the traffic of every connection to r. Call it before the server is started
+func (s *Server) SetRecorder(r *capture.Recorder) {
+	s.tcp.Recorder = r
+}
+
+// Sessions lists the connected clients
+func (s *Server) Sessions() []server.SessionInfo {
+	return s.tcp.Sessions()
+}
+
+// Disconnect closes the client connection with id. Returns false if there is none
+func (s *Server) Disconnect(id uint64) bool {
+	return s.tcp.Disconnect(id)
+}
+
+// Check reports whether the upstream server accepted a connection within the last
+// server.DefaultUpstreamCheckTTL
+func (s *Server) Check(ctx context.Context) error {
+	if err := s.upstream.Check(ctx); err != nil {
+		return fmt.Errorf("upstream %s is unreachable: %w", s.upstreamAddress, err)
 	}
+	return nil
+}
+
+// Stop stops accepting connections and waits for proxied sessions to end until ctx expires
+func (s *Server) Stop(ctx context.Context) error {
+	return s.tcp.Stop(ctx)
 }
 
-func handleConnection(victimConn net.Conn, upstreamAddress string) {
+func handleConnection(serverCtx context.Context, victimConn net.Conn, upstreamAddress string) {
+	logger := logging.FromContext(serverCtx)
 	// Connect to upstream server
 	upstreamConn, err := net.Dial("tcp", upstreamAddress)
 	if err != nil {
-		log.Println("Could not connect to upstream server")
+		logger.Warn("Could not connect to upstream server", "upstream", upstreamAddress, "error", err)
 		victimConn.Close()
 		return
 	}
@@ -54,10 +154,7 @@ func handleConnection(victimConn net.Conn, upstreamAddress string) {
 	upstreamReader := bufio.NewReader(upstreamConn)
 
 	// Setup context package
-	ctx, cancel := context.WithCancel(context.Background())
-	logger := log.New(log.Writer(),
-		fmt.Sprintf("[%s] ", victimConn.RemoteAddr().String()),
-		log.Flags()|log.Lmsgprefix|log.Lshortfile)
+	ctx, cancel := context.WithCancel(serverCtx)
 	var wg sync.WaitGroup
 	wg.Add(2)
 	contextPackage := &contextPackage{
@@ -70,6 +167,8 @@ func handleConnection(victimConn net.Conn, upstreamAddress string) {
 	// Start bidirectional relay
 	go relayMessages(clientReader, "victim", upstreamConn, "upstream", victimConn, contextPackage)
 	go relayMessages(upstreamReader, "upstream", victimConn, "victim", upstreamConn, contextPackage)
+	// Wait for both directions so the connection counts as in-flight until it is done
+	wg.Wait()
 }
 
 func relayMessages(
@@ -96,7 +195,7 @@ func relayMessages(
 			// Read until newline
 			message, err := sourceReader.ReadString('\n')
 			if err != nil {
-				contextP.logger.Printf("%s reader no longer active. Exiting", sourceName)
+				contextP.logger.Debug("Reader no longer active. Exiting", "source", sourceName)
 				contextP.cancel()
 				return
 			}
@@ -110,12 +209,12 @@ func relayMessages(
 			// Add the newline back
 			_, err = fmt.Fprintln(destConn, injectedMessage)
 			if err != nil {
-				contextP.logger.Printf("Could not write to %s. Exiting...", destName)
+				contextP.logger.Debug("Could not write. Exiting", "destination", destName)
 				contextP.cancel()
 				return
 			}
 
-			contextP.logger.Printf("Sent message from %s to %s: %q", sourceName, destName, injectedMessage)
+			contextP.logger.Debug("Relayed message", "source", sourceName, "destination", destName, "message", injectedMessage)
 		}
 	}
 }
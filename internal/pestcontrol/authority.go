@@ -0,0 +1,105 @@
+package pestcontrol
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"time"
+
+	protocol "github.com/JeremyFenwick/firewatch/pkg/pestcontrol"
+)
+
+// How long a single exchange with the authority server may take
+const authorityTimeout = 10 * time.Second
+
+// authority is a connection to the Authority server for a single site
+type authority struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	targets []protocol.Target
+}
+
+// dialAuthority connects to the authority server, says hello and fetches the site's targets
+func dialAuthority(address string, site protocol.U32) (*authority, error) {
+	conn, err := net.DialTimeout("tcp", address, authorityTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to authority: %w", err)
+	}
+	a := &authority{conn: conn, reader: bufio.NewReader(conn)}
+	if err := a.handshake(site); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *authority) handshake(site protocol.U32) error {
+	reply, err := a.exchange(&protocol.HelloMessage{Protocol: protocol.Protocol, Version: protocol.Version})
+	if err != nil {
+		return err
+	}
+	if hello, ok := reply.(*protocol.HelloMessage); !ok || !hello.Valid() {
+		return fmt.Errorf("authority did not say hello, got message 0x%02x", reply.GetType())
+	}
+	reply, err = a.exchange(&protocol.DialAuthorityMessage{Site: site})
+	if err != nil {
+		return err
+	}
+	targets, ok := reply.(*protocol.TargetPopulationsMessage)
+	if !ok {
+		return fmt.Errorf("expected target populations, got message 0x%02x", reply.GetType())
+	}
+	if targets.Site != site {
+		return fmt.Errorf("asked for the targets of site %d, got site %d", site, targets.Site)
+	}
+	a.targets = targets.Populations
+	return nil
+}
+
+// createPolicy returns the id of the new policy
+func (a *authority) createPolicy(species protocol.Str, action protocol.U8) (protocol.U32, error) {
+	reply, err := a.exchange(&protocol.CreatePolicyMessage{Species: species, Action: action})
+	if err != nil {
+		return 0, err
+	}
+	result, ok := reply.(*protocol.PolicyResultMessage)
+	if !ok {
+		return 0, fmt.Errorf("expected a policy result, got message 0x%02x", reply.GetType())
+	}
+	return result.Policy, nil
+}
+
+func (a *authority) deletePolicy(policy protocol.U32) error {
+	reply, err := a.exchange(&protocol.DeletePolicyMessage{Policy: policy})
+	if err != nil {
+		return err
+	}
+	if _, ok := reply.(*protocol.OKMessage); !ok {
+		return fmt.Errorf("expected OK, got message 0x%02x", reply.GetType())
+	}
+	return nil
+}
+
+// exchange sends a message and waits for the reply. An Error reply is returned as an error
+func (a *authority) exchange(message protocol.Message) (protocol.Message, error) {
+	a.conn.SetDeadline(time.Now().Add(authorityTimeout))
+	encoded, err := message.Encode()
+	if err != nil {
+		return nil, fmt.Errorf("could not encode message: %w", err)
+	}
+	if _, err := a.conn.Write(encoded); err != nil {
+		return nil, fmt.Errorf("could not write to authority: %w", err)
+	}
+	reply, err := protocol.ReadMessage(a.reader)
+	if err != nil {
+		return nil, fmt.Errorf("could not read from authority: %w", err)
+	}
+	if authorityError, ok := reply.(*protocol.ErrorMessage); ok {
+		return nil, fmt.Errorf("authority error: %s", authorityError.Content)
+	}
+	return reply, nil
+}
+
+func (a *authority) close() {
+	a.conn.Close()
+}
@@ -0,0 +1,212 @@
+package pestcontrol
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+
+	"github.com/JeremyFenwick/firewatch/internal/capture"
+	"github.com/JeremyFenwick/firewatch/internal/logging"
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/JeremyFenwick/firewatch/internal/service"
+	protocol "github.com/JeremyFenwick/firewatch/pkg/pestcontrol"
+)
+
+// DefaultAuthority is the public authority server run by protohackers
+const DefaultAuthority = "pestcontrol.protohackers.com:20547"
+
+type Server struct {
+	sites     *SiteManager
+	authority server.UpstreamCheck
+	metrics   *metrics.Service
+	logger    *slog.Logger
+	tcp       server.TCPServer
+}
+
+func init() {
+	service.Register(service.Definition{
+		Name:      "pestcontrol",
+		Transport: service.TCP,
+		Port:      5011,
+		Defaults:  service.Options{Upstream: DefaultAuthority},
+		New:       func(o service.Options) service.Service { return NewServer(o.Upstream) },
+	})
+}
+
+// NewServer creates a pest control server that fetches targets and sets policies through the
+// authority server at authorityAddress (host:port)
+func NewServer(authorityAddress string) *Server {
+	s := &Server{
+		sites:   NewSiteManager(authorityAddress),
+		metrics: metrics.NewService("pestcontrol"),
+	}
+	s.authority.Address = authorityAddress
+	s.metrics.RegisterCounter("pestcontrol_site_visits_total", "Site visits received from clients", &s.sites.Visits)
+	s.metrics.RegisterGauge("pestcontrol_policies_active", "Policies currently in force across all sites", &s.sites.Policies)
+	s.tcp.Metrics = s.metrics
+	s.SetLogger(slog.Default().With("service", "pestcontrol"))
+	s.tcp.Handler = func(ctx context.Context, conn net.Conn) {
+		handleConnection(ctx, conn, s.sites, s.metrics)
+	}
+	return s
+}
+
+// Serve accepts connections on listener until the server is stopped
+func (s *Server) Serve(listener net.Listener) error {
+	s.logger.Info("Pest control now listening", "address", listener.Addr().String())
+	return s.tcp.Serve(listener)
+}
+
+// Start listens on address and serves in the background. Use port 0 to pick a free port
+func (s *Server) Start(address string) error {
+	listener, err := server.Listen(address)
+	if err != nil {
+		return fmt.Errorf("could not start listener: %w", err)
+	}
+	s.logger.Info("Pest control now listening", "address", listener.Addr().String())
+	return s.tcp.Start(listener)
+}
+
+// Addr returns the listening address, or nil before the server has started
+func (s *Server) Addr() net.Addr {
+	return s.tcp.Addr()
+}
+
+// Err returns why the server stopped accepting connections on its own, or nil while it is serving
+func (s *Server) Err() error {
+	return s.tcp.Err()
+}
+
+// Metrics returns the server's counters so they can be added to a metrics.Registry
+func (s *Server) Metrics() *metrics.Service {
+	return s.metrics
+}
+
+// SetLogger replaces the server's logger. Call it before the server is started
+func (s *Server) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+	s.sites.Logger = logger
+	s.tcp.Logger = logger
+}
+
+// SetLimits sets the connection limits. Call it before the server is started
+func (s *Server) SetLimits(limits server.Limits) {
+	s.tcp.Limits = limits
+}
+
+// SetTLS serves every connection over TLS. Call it before the server is started
+func (s *Server) SetTLS(t *server.TLS) {
+	s.tcp.TLS = t
+}
+
+// SetProxyProtocol expects connections to open with a PROXY protocol header giving the real client
+// address. Call it before the server is started
+func (s *Server) SetProxyProtocol(enabled bool) {
+	s.tcp.ProxyProtocol = enabled
+}
+
+// SetRecorder captures the traffic of every connection to r. Call it before the server is started
+func (s *Server) SetRecorder(r *capture.Recorder) {
+	s.tcp.Recorder = r
+}
+
+// Sessions lists the connected clients
+func (s *Server) Sessions() []server.SessionInfo {
+	return s.tcp.Sessions()
+}
+
+// Disconnect closes the client connection with id. Returns false if there is none
+func (s *Server) Disconnect(id uint64) bool {
+	return s.tcp.Disconnect(id)
+}
+
+// Check reports whether the authority server accepted a connection within the last
+// server.DefaultUpstreamCheckTTL
+func (s *Server) Check(ctx context.Context) error {
+	if err := s.authority.Check(ctx); err != nil {
+		return fmt.Errorf("authority %s is unreachable: %w", s.authority.Address, err)
+	}
+	return nil
+}
+
+// Stop stops accepting connections, waits for open ones to finish until ctx expires and then
+// closes the authority connections
+func (s *Server) Stop(ctx context.Context) error {
+	err := s.tcp.Stop(ctx)
+	return errors.Join(err, s.sites.Stop(ctx))
+}
+
+func handleConnection(ctx context.Context, conn net.Conn, sites *SiteManager, m *metrics.Service) {
+	defer conn.Close()
+	logger := logging.FromContext(ctx)
+
+	// Both sides open with a hello
+	if err := send(conn, &protocol.HelloMessage{Protocol: protocol.Protocol, Version: protocol.Version}); err != nil {
+		logger.Debug("Error sending hello", "error", err)
+		return
+	}
+	reader := bufio.NewReader(conn)
+	greeted := false
+	for {
+		message, err := protocol.ReadMessage(reader)
+		if errors.Is(err, protocol.ErrInvalidMessage) {
+			sendError(conn, m, logger, err.Error())
+			return
+		}
+		if err != nil {
+			if err != io.EOF {
+				logger.Debug("Error reading from client", "error", err)
+			}
+			return
+		}
+		switch message := message.(type) {
+		case *protocol.HelloMessage:
+			if greeted || !message.Valid() {
+				sendError(conn, m, logger, "bad hello")
+				return
+			}
+			greeted = true
+		case *protocol.SiteVisitMessage:
+			if !greeted {
+				sendError(conn, m, logger, "expected hello")
+				return
+			}
+			counts, ok := message.Counts()
+			if !ok {
+				sendError(conn, m, logger, "conflicting counts for the same species")
+				return
+			}
+			logger.Debug("Site visit", "site", message.Site, "species", len(counts))
+			server.SessionFromContext(ctx).SetIdentity(fmt.Sprintf("site %d", message.Site))
+			if !sites.Visit(message.Site, counts) {
+				return
+			}
+		default:
+			sendError(conn, m, logger, fmt.Sprintf("unexpected message 0x%02x", message.GetType()))
+			return
+		}
+	}
+}
+
+func send(conn net.Conn, message protocol.Message) error {
+	encoded, err := message.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(encoded)
+	return err
+}
+
+// sendError tells the client what it did wrong and counts it. The caller closes the connection
+func sendError(conn net.Conn, m *metrics.Service, logger *slog.Logger, content string) {
+	m.ProtocolErrors.Inc()
+	logger.Debug("Protocol error", "error", content)
+	if err := send(conn, &protocol.ErrorMessage{Content: protocol.Str(content)}); err != nil {
+		logger.Debug("Error sending error message", "error", err)
+	}
+}
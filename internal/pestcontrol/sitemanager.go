@@ -0,0 +1,187 @@
+package pestcontrol
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	protocol "github.com/JeremyFenwick/firewatch/pkg/pestcontrol"
+)
+
+type policy struct {
+	id     protocol.U32
+	action protocol.U8
+}
+
+// site is an actor that owns the authority connection and policies of one site. Visits are
+// applied one at a time in the order they arrive
+type site struct {
+	id        protocol.U32
+	visits    chan map[protocol.Str]protocol.U32
+	authority *authority
+	policies  map[protocol.Str]policy
+	logger    *slog.Logger
+}
+
+// SiteManager hands site visits to the actor for each site
+type SiteManager struct {
+	authorityAddress string
+	mutex            sync.Mutex
+	sites            map[protocol.U32]*site
+	quit             chan struct{}
+	quitOnce         sync.Once
+	wg               sync.WaitGroup
+
+	Logger   *slog.Logger
+	Visits   metrics.Counter
+	Policies metrics.Gauge // Policies currently in force across all sites
+}
+
+func NewSiteManager(authorityAddress string) *SiteManager {
+	return &SiteManager{
+		authorityAddress: authorityAddress,
+		sites:            make(map[protocol.U32]*site),
+		quit:             make(chan struct{}),
+		Logger:           slog.Default(),
+	}
+}
+
+// Visit queues the populations counted at a site. Returns false if the manager is stopping
+func (sm *SiteManager) Visit(siteID protocol.U32, counts map[protocol.Str]protocol.U32) bool {
+	s := sm.site(siteID)
+	if s == nil {
+		return false
+	}
+	select {
+	case s.visits <- counts:
+		sm.Visits.Inc()
+		return true
+	case <-sm.quit:
+		return false
+	}
+}
+
+func (sm *SiteManager) site(siteID protocol.U32) *site {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	select {
+	case <-sm.quit:
+		return nil
+	default:
+	}
+	if s, exists := sm.sites[siteID]; exists {
+		return s
+	}
+	s := &site{
+		id:       siteID,
+		visits:   make(chan map[protocol.Str]protocol.U32, 20),
+		policies: make(map[protocol.Str]policy),
+		logger:   sm.Logger.With("site", siteID),
+	}
+	sm.sites[siteID] = s
+	sm.wg.Add(1)
+	go sm.run(s)
+	return s
+}
+
+// Stop ends every site actor and closes their authority connections. Queued visits are
+// dropped. Waits for the actors to exit until ctx expires
+func (sm *SiteManager) Stop(ctx context.Context) error {
+	sm.mutex.Lock()
+	sm.quitOnce.Do(func() { close(sm.quit) })
+	sm.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		sm.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (sm *SiteManager) run(s *site) {
+	defer sm.wg.Done()
+	defer s.disconnect(sm)
+
+	for {
+		select {
+		case <-sm.quit:
+			return
+		case counts := <-s.visits:
+			if err := s.apply(sm.authorityAddress, counts, sm); err != nil {
+				s.logger.Warn("Could not update policies", "error", err)
+				// Start again from a fresh connection on the next visit
+				s.disconnect(sm)
+			}
+		}
+	}
+}
+
+// apply creates and deletes policies so each target species with a count outside its range has
+// exactly one policy with the right action
+func (s *site) apply(authorityAddress string, counts map[protocol.Str]protocol.U32, sm *SiteManager) error {
+	if s.authority == nil {
+		a, err := dialAuthority(authorityAddress, s.id)
+		if err != nil {
+			return err
+		}
+		s.logger.Debug("Connected to authority", "targets", len(a.targets))
+		s.authority = a
+	}
+	for _, target := range s.authority.targets {
+		// Species that were not seen have a count of zero
+		action := actionFor(counts[target.Species], target)
+		current, exists := s.policies[target.Species]
+		if exists && current.action == action {
+			continue
+		}
+		if exists {
+			if err := s.authority.deletePolicy(current.id); err != nil {
+				return err
+			}
+			delete(s.policies, target.Species)
+			sm.Policies.Dec()
+			s.logger.Debug("Deleted policy", "species", target.Species, "policy", current.id)
+		}
+		if action == 0 {
+			continue
+		}
+		id, err := s.authority.createPolicy(target.Species, action)
+		if err != nil {
+			return err
+		}
+		s.policies[target.Species] = policy{id: id, action: action}
+		sm.Policies.Inc()
+		s.logger.Debug("Created policy", "species", target.Species, "policy", id, "action", action)
+	}
+	return nil
+}
+
+func (s *site) disconnect(sm *SiteManager) {
+	if s.authority == nil {
+		return
+	}
+	s.authority.close()
+	s.authority = nil
+	sm.Policies.Add(-int64(len(s.policies)))
+	s.policies = make(map[protocol.Str]policy)
+}
+
+// actionFor returns the policy a count needs, or 0 for none
+func actionFor(count protocol.U32, target protocol.Target) protocol.U8 {
+	switch {
+	case count < target.Min:
+		return protocol.Conserve
+	case count > target.Max:
+		return protocol.Cull
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,124 @@
+package primetime
+
+import (
+	"container/list"
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+)
+
+// DefaultCacheSize is how many responses a server remembers unless SetCacheSize is called
+const DefaultCacheSize = 10_000
+
+// Requests and responses longer than these aren't cached, so a few huge ones can't fill memory
+const (
+	maxCacheKey       = 256
+	maxCachedResponse = 4096
+)
+
+// Cache is a least recently used cache of encoded responses, safe for concurrent use
+type Cache struct {
+	Hits   metrics.Counter
+	Misses metrics.Counter
+
+	mutex    sync.Mutex
+	capacity int
+	order    *list.List // Of *cacheEntry, most recently used first
+	entries  map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key   string
+	value []byte
+}
+
+// NewCache returns a cache holding up to capacity responses. A capacity of 0 caches nothing
+func NewCache(capacity int) *Cache {
+	return &Cache{
+		capacity: max(capacity, 0),
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Get returns the response stored under key. The value must not be modified
+func (c *Cache) Get(key string) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		c.Misses.Inc()
+		return nil, false
+	}
+	c.Hits.Inc()
+	c.order.MoveToFront(element)
+	return element.Value.(*cacheEntry).value, true
+}
+
+// Add stores value under key, evicting the least recently used response if the cache is full
+func (c *Cache) Add(key string, value []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.capacity == 0 {
+		return
+	}
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*cacheEntry).value = value
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, value: value})
+	c.evict()
+}
+
+// Resize changes how many responses the cache holds, evicting the least recently used ones
+func (c *Cache) Resize(capacity int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.capacity = max(capacity, 0)
+	c.evict()
+}
+
+// Len returns how many responses are cached
+func (c *Cache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.order.Len()
+}
+
+// evict drops the least recently used responses until the cache fits. The caller holds c.mutex
+func (c *Cache) evict() {
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// cacheKey identifies request by its fields as they were written. It reports false for requests
+// that can't be cached
+func cacheKey(request *Request) (string, bool) {
+	if _, ok := methods[request.Method]; !ok {
+		return "", false
+	}
+
+	var key strings.Builder
+	key.WriteString(request.Method)
+	for _, field := range []any{request.Number, request.From, request.To} {
+		key.WriteByte(0)
+		switch value := field.(type) {
+		case nil:
+		case json.Number:
+			key.WriteString(value.String())
+		default:
+			return "", false
+		}
+	}
+	return key.String(), key.Len() <= maxCacheKey
+}
@@ -0,0 +1,251 @@
+package primetime
+
+import (
+	"fmt"
+	"math/big"
+	"slices"
+)
+
+// Limits on the work a single request can ask for
+const (
+	MaxSearchBits = 1024       // nextPrime, prevPrime and primesInRange
+	MaxPrimeCount = 10_000_000 // The largest number primeCount counts up to
+	MaxRange      = 10_000     // The most numbers primesInRange looks through
+)
+
+// methods answers each kind of request
+var methods = map[string]func(*Request) (any, error){
+	"isPrime":       isPrime,
+	"factorize":     factorize,
+	"nextPrime":     nextPrime,
+	"prevPrime":     prevPrime,
+	"primeCount":    primeCount,
+	"primesInRange": primesInRange,
+}
+
+// FactorsResponse answers factorize. Factors are in ascending order, repeated by multiplicity
+type FactorsResponse struct {
+	Method  string   `json:"method"`
+	Factors []uint64 `json:"factors"`
+}
+
+// NumberResponse answers nextPrime and prevPrime
+type NumberResponse struct {
+	Method string   `json:"method"`
+	Number *big.Int `json:"number"`
+}
+
+// CountResponse answers primeCount
+type CountResponse struct {
+	Method string `json:"method"`
+	Count  int    `json:"count"`
+}
+
+// PrimesResponse answers primesInRange. Primes are in ascending order
+type PrimesResponse struct {
+	Method string     `json:"method"`
+	Primes []*big.Int `json:"primes"`
+}
+
+var (
+	one = big.NewInt(1)
+	two = big.NewInt(2)
+)
+
+func factorize(request *Request) (any, error) {
+	number, err := integerField("number", request.Number)
+	if err != nil {
+		return nil, err
+	}
+	if number.Sign() <= 0 || !number.IsUint64() {
+		return nil, fmt.Errorf("factorize takes numbers from 1 to 2^64-1, not %s", number)
+	}
+
+	return &FactorsResponse{Method: "factorize", Factors: Factorize(number.Uint64())}, nil
+}
+
+func nextPrime(request *Request) (any, error) {
+	number, err := searchField("number", request.Number)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NumberResponse{Method: "nextPrime", Number: NextPrime(number)}, nil
+}
+
+func prevPrime(request *Request) (any, error) {
+	number, err := searchField("number", request.Number)
+	if err != nil {
+		return nil, err
+	}
+	if number.Cmp(two) <= 0 {
+		return nil, fmt.Errorf("there is no prime below %s", number)
+	}
+
+	return &NumberResponse{Method: "prevPrime", Number: PrevPrime(number)}, nil
+}
+
+func primeCount(request *Request) (any, error) {
+	number, err := integerField("number", request.Number)
+	if err != nil {
+		return nil, err
+	}
+	if number.Cmp(big.NewInt(MaxPrimeCount)) > 0 {
+		return nil, fmt.Errorf("primeCount counts up to %d, not %s", MaxPrimeCount, number)
+	}
+
+	count := 0
+	if number.Sign() > 0 {
+		count = PrimeCount(int(number.Int64()))
+	}
+
+	return &CountResponse{Method: "primeCount", Count: count}, nil
+}
+
+func primesInRange(request *Request) (any, error) {
+	from, err := searchField("from", request.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := searchField("to", request.To)
+	if err != nil {
+		return nil, err
+	}
+	if from.Cmp(to) > 0 {
+		return nil, fmt.Errorf("from %s is greater than to %s", from, to)
+	}
+	if size := new(big.Int).Sub(to, from); size.Cmp(big.NewInt(MaxRange)) >= 0 {
+		return nil, fmt.Errorf("a range holds at most %d numbers", MaxRange)
+	}
+
+	primes := []*big.Int{}
+	for n := new(big.Int).Set(from); n.Cmp(to) <= 0; n.Add(n, one) {
+		if IsPrimeBig(n) {
+			primes = append(primes, new(big.Int).Set(n))
+		}
+	}
+
+	return &PrimesResponse{Method: "primesInRange", Primes: primes}, nil
+}
+
+// searchField returns the integer field called name, which must be small enough to search from
+func searchField(name string, value any) (*big.Int, error) {
+	number, err := integerField(name, value)
+	if err != nil {
+		return nil, err
+	}
+	if number.BitLen() > MaxSearchBits {
+		return nil, fmt.Errorf("%s has more than %d bits", name, MaxSearchBits)
+	}
+
+	return number, nil
+}
+
+// NextPrime returns the smallest prime greater than n
+func NextPrime(n *big.Int) *big.Int {
+	if n.Cmp(two) < 0 {
+		return big.NewInt(2)
+	}
+
+	// Only odd numbers after 2 can be prime
+	candidate := new(big.Int).Add(n, one)
+	if candidate.Bit(0) == 0 {
+		candidate.Add(candidate, one)
+	}
+	for !IsPrimeBig(candidate) {
+		candidate.Add(candidate, two)
+	}
+
+	return candidate
+}
+
+// PrevPrime returns the largest prime less than n, or nil if n is 2 or less
+func PrevPrime(n *big.Int) *big.Int {
+	if n.Cmp(two) <= 0 {
+		return nil
+	}
+	if n.Cmp(big.NewInt(3)) == 0 {
+		return big.NewInt(2)
+	}
+
+	candidate := new(big.Int).Sub(n, one)
+	if candidate.Bit(0) == 0 {
+		candidate.Sub(candidate, one)
+	}
+	for !IsPrimeBig(candidate) {
+		candidate.Sub(candidate, two)
+	}
+
+	return candidate
+}
+
+// PrimeCount returns how many primes there are up to and including n, which must be at most
+// MaxPrimeCount
+func PrimeCount(n int) int {
+	return smallPrimes().count(n)
+}
+
+// Factorize returns the prime factors of n in ascending order, repeated by multiplicity. 1 has
+// none
+func Factorize(n uint64) []uint64 {
+	factors := []uint64{}
+
+	// Trial division first, so pollardRho only sees numbers without small factors
+	for p := uint64(2); p < 1000 && p*p <= n; p++ {
+		for n%p == 0 {
+			factors = append(factors, p)
+			n /= p
+		}
+	}
+
+	factors = factorizeLarge(n, factors)
+	slices.Sort(factors)
+	return factors
+}
+
+// factorizeLarge appends the prime factors of n, which has none below 1000, to factors
+func factorizeLarge(n uint64, factors []uint64) []uint64 {
+	if n == 1 {
+		return factors
+	}
+	if millerRabin(n) {
+		return append(factors, n)
+	}
+
+	divisor := pollardRho(n)
+	factors = factorizeLarge(divisor, factors)
+	return factorizeLarge(n/divisor, factors)
+}
+
+// pollardRho returns a divisor of n other than 1 and n. n must be odd and composite
+func pollardRho(n uint64) uint64 {
+	// x -> x^2+c mod n
+	step := func(x, c uint64) uint64 {
+		x = mulMod(x, x, n)
+		sum := x + c
+		if sum < x || sum >= n {
+			sum -= n
+		}
+		return sum
+	}
+
+	for c := uint64(1); ; c++ {
+		slow, fast, divisor := uint64(2), uint64(2), uint64(1)
+		for divisor == 1 {
+			slow = step(slow, c)
+			fast = step(step(fast, c), c)
+			divisor = gcd(max(slow, fast)-min(slow, fast), n)
+		}
+		if divisor != n {
+			return divisor
+		}
+		// The cycle closed without finding a divisor, so try another polynomial
+	}
+}
+
+func gcd(a, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
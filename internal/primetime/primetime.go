@@ -2,17 +2,42 @@ package primetime
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math"
+	"math/big"
+	"math/bits"
 	"net"
+	"strconv"
+	"strings"
+
+	"github.com/JeremyFenwick/firewatch/internal/capture"
+	"github.com/JeremyFenwick/firewatch/internal/logging"
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/JeremyFenwick/firewatch/internal/service"
 )
 
+// Integers with more bits than this aren't tested. isPrime answers those it can tell are composite
+// from their last digit, and refuses the rest like the other methods do
+const maxBits = 4096
+
+// maxDigits is how many decimal digits an integer of maxBits bits can have
+const maxDigits = maxBits*30103/100000 + 1
+
+// errTooLarge is returned by parseInteger for integers with more than maxBits bits
+var errTooLarge = fmt.Errorf("more than %d bits", maxBits)
+
 type Request struct {
 	Method string `json:"method"`
 	Number any    `json:"number"`
+	From   any    `json:"from"` // primesInRange only
+	To     any    `json:"to"`   // primesInRange only
 }
 
 type Response struct {
@@ -20,29 +45,116 @@ type Response struct {
 	Prime  bool   `json:"prime"`
 }
 
-func Listen(port int) {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+type Server struct {
+	cache   *Cache
+	metrics *metrics.Service
+	logger  *slog.Logger
+	tcp     server.TCPServer
+}
 
-	listener, err := net.Listen("tcp4", fmt.Sprintf(":%d", port))
-	if err != nil {
-		log.Fatal("Could not started listener. REASON: " + err.Error())
+func init() {
+	service.Register(service.Definition{
+		Name:      "primetime",
+		Transport: service.TCP,
+		Port:      5001,
+		New:       func(service.Options) service.Service { return NewServer() },
+	})
+}
+
+func NewServer() *Server {
+	s := &Server{cache: NewCache(DefaultCacheSize), metrics: metrics.NewService("primetime")}
+	s.metrics.RegisterCounter("primetime_cache_hits_total", "Requests answered from the response cache", &s.cache.Hits)
+	s.metrics.RegisterCounter("primetime_cache_misses_total", "Requests that missed the response cache", &s.cache.Misses)
+	s.tcp.Metrics = s.metrics
+	s.SetLogger(slog.Default().With("service", "primetime"))
+	s.tcp.Handler = func(ctx context.Context, conn net.Conn) {
+		handleConnection(ctx, conn, s.cache, s.metrics)
 	}
-	log.Printf("Prime time now listening on port %d\n", port)
-	defer listener.Close()
+	return s
+}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Println("Encountered error accepting connection. REASON: " + err.Error())
-			continue
-		}
+// Serve accepts connections on listener until the server is stopped
+func (s *Server) Serve(listener net.Listener) error {
+	s.logger.Info("Prime time now listening", "address", listener.Addr().String())
+	return s.tcp.Serve(listener)
+}
 
-		go handleConnection(conn)
+// Start listens on address and serves in the background. Use port 0 to pick a free port
+func (s *Server) Start(address string) error {
+	listener, err := server.Listen(address)
+	if err != nil {
+		return fmt.Errorf("could not start listener: %w", err)
 	}
+	s.logger.Info("Prime time now listening", "address", listener.Addr().String())
+	return s.tcp.Start(listener)
+}
+
+// Addr returns the listening address, or nil before the server has started
+func (s *Server) Addr() net.Addr {
+	return s.tcp.Addr()
 }
 
-func handleConnection(conn net.Conn) {
+// Err returns why the server stopped accepting connections on its own, or nil while it is serving
+func (s *Server) Err() error {
+	return s.tcp.Err()
+}
+
+// Metrics returns the server's counters so they can be added to a metrics.Registry
+func (s *Server) Metrics() *metrics.Service {
+	return s.metrics
+}
+
+// SetLogger replaces the server's logger. Call it before the server is started
+func (s *Server) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+	s.tcp.Logger = logger
+}
+
+// SetLimits sets the connection limits. Call it before the server is started
+func (s *Server) SetLimits(limits server.Limits) {
+	s.tcp.Limits = limits
+}
+
+// SetCacheSize sets how many responses are remembered, so numbers that are asked about again
+// aren't worked out again. 0 turns the cache off
+func (s *Server) SetCacheSize(size int) {
+	s.cache.Resize(size)
+}
+
+// SetTLS serves every connection over TLS. Call it before the server is started
+func (s *Server) SetTLS(t *server.TLS) {
+	s.tcp.TLS = t
+}
+
+// SetProxyProtocol expects connections to open with a PROXY protocol header giving the real client
+// address. Call it before the server is started
+func (s *Server) SetProxyProtocol(enabled bool) {
+	s.tcp.ProxyProtocol = enabled
+}
+
+// SetRecorder captures the traffic of every connection to r. Call it before the server is started
+func (s *Server) SetRecorder(r *capture.Recorder) {
+	s.tcp.Recorder = r
+}
+
+// Sessions lists the connected clients
+func (s *Server) Sessions() []server.SessionInfo {
+	return s.tcp.Sessions()
+}
+
+// Disconnect closes the client connection with id. Returns false if there is none
+func (s *Server) Disconnect(id uint64) bool {
+	return s.tcp.Disconnect(id)
+}
+
+// Stop stops accepting connections and waits for open ones to finish until ctx expires
+func (s *Server) Stop(ctx context.Context) error {
+	return s.tcp.Stop(ctx)
+}
+
+func handleConnection(ctx context.Context, conn net.Conn, cache *Cache, m *metrics.Service) {
 	defer conn.Close()
+	logger := logging.FromContext(ctx)
 	reader := bufio.NewReader(conn)
 
 	for {
@@ -51,117 +163,320 @@ func handleConnection(conn net.Conn) {
 			return
 		}
 		if err != nil {
-			log.Println("Failed to receive message from connection:", err)
+			logger.Debug("Failed to receive message from connection", "error", err)
 			return
 		}
 
-		err = isPrimeResponse(requestBytes, conn)
+		err = respond(requestBytes, conn, cache, m, logger)
 		if err != nil {
 			return
 		}
 	}
 }
 
-func isPrimeResponse(request []byte, conn net.Conn) error {
+func respond(request []byte, conn net.Conn, cache *Cache, m *metrics.Service, logger *slog.Logger) error {
 	requestStruct, err := decodeJson(request)
 	if err != nil {
+		m.ProtocolErrors.Inc()
 		responseError := fmt.Sprintf("Failed to parse recieved json. Closing connection. REASON: %s", err.Error())
-		log.Println(responseError)
+		logger.Debug("Malformed request", "error", err)
 		conn.Write([]byte(responseError))
 		return err
 	}
 
-	response, err := createResponse(requestStruct)
-	if err != nil {
-		log.Println("Failed to generate response. REASON: " + err.Error())
-		return err
+	key, cacheable := cacheKey(requestStruct)
+	var line []byte
+	var cached bool
+	if cacheable {
+		line, cached = cache.Get(key)
 	}
 
-	bytes, err := encodeJson(response)
-	if err != nil {
-		log.Println("Failed to encode json. Closing connection. REASON: " + err.Error())
-		return err
+	if !cached {
+		response, err := createResponse(requestStruct)
+		if err != nil {
+			m.ProtocolErrors.Inc()
+			logger.Debug("Failed to generate response", "error", err)
+			conn.Write([]byte(fmt.Sprintf("Malformed request. Closing connection. REASON: %s", err.Error())))
+			return err
+		}
+
+		bytes, err := encodeJson(response)
+		if err != nil {
+			logger.Error("Failed to encode json. Closing connection", "error", err)
+			return err
+		}
+
+		line = append(bytes, '\n')
+		if cacheable && len(line) <= maxCachedResponse {
+			cache.Add(key, line)
+		}
 	}
 
-	_, err = conn.Write(append(bytes, []byte("\n")...))
+	_, err = conn.Write(line)
 	if err != nil {
-		log.Println("Failed to send bytes. Closing connection. REASON: " + err.Error())
+		logger.Debug("Failed to send bytes. Closing connection", "error", err)
 		return err
 	}
 
 	return nil
 }
 
+// decodeJson keeps the number as it was written, so integers too big for a float64 stay exact
 func decodeJson(data []byte) (*Request, error) {
 	var request Request
-	err := json.Unmarshal(data, &request)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&request)
 	if err != nil {
 		return nil, err
 	}
 
-	if request.Number == nil {
-		return nil, fmt.Errorf("no number provided")
-	}
-
-	_, ok := request.Number.(float64)
-	if !ok {
-		return nil, fmt.Errorf("number field did not contain a number")
-	}
-
 	return &request, nil
 }
 
-func encodeJson(response *Response) ([]byte, error) {
-	bytes, err := json.Marshal(&response)
+func encodeJson(response any) ([]byte, error) {
+	bytes, err := json.Marshal(response)
 	if err != nil {
 		return nil, err
 	}
 	return bytes, nil
 }
 
-func createResponse(request *Request) (*Response, error) {
-	if request.Method != "isPrime" {
+func createResponse(request *Request) (any, error) {
+	method, ok := methods[request.Method]
+	if !ok {
 		return nil, fmt.Errorf("unknown request %s", request.Method)
 	}
 
-	primeResult := false
-	number, _ := request.Number.(float64)
+	return method(request)
+}
+
+func isPrime(request *Request) (any, error) {
+	number, err := numberField("number", request.Number)
+	if err != nil {
+		return nil, err
+	}
 
-	if number > 0 && math.Trunc(number) == number {
-		primeResult = IsPrime(int(number))
+	value, err := parseDecimal(number)
+	if err != nil {
+		return nil, err
+	}
+	integer, err := value.integer()
+	// Too large to test, but those that are negative or divisible by 2 or 5 are not prime. That
+	// includes every number written with a positive exponent, like 1e5000
+	if errors.Is(err, errTooLarge) && value.composite() {
+		return &Response{Method: "isPrime", Prime: false}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("number %s has %w", number, err)
 	}
 
 	return &Response{
 		Method: "isPrime",
-		Prime:  primeResult,
+		Prime:  integer != nil && IsPrimeBig(integer),
 	}, nil
 }
 
-// isPrime checks if a given integer n is a prime number.
+// numberField returns the value of the field called name, which must be a number
+func numberField(name string, value any) (json.Number, error) {
+	if value == nil {
+		return "", fmt.Errorf("no %s provided", name)
+	}
+
+	number, ok := value.(json.Number)
+	if !ok {
+		return "", fmt.Errorf("%s field did not contain a number", name)
+	}
+
+	return number, nil
+}
+
+// integerField returns the value of the field called name, which must be an integer
+func integerField(name string, value any) (*big.Int, error) {
+	number, err := numberField(name, value)
+	if err != nil {
+		return nil, err
+	}
+
+	integer, err := parseInteger(number)
+	if err != nil {
+		return nil, err
+	}
+	if integer == nil {
+		return nil, fmt.Errorf("%s %s is not an integer", name, number)
+	}
+
+	return integer, nil
+}
+
+// parseInteger returns the value of number if it is an integer, such as 7, 7.0 or 7e0, and nil
+// otherwise
+func parseInteger(number json.Number) (*big.Int, error) {
+	value, err := parseDecimal(number)
+	if err != nil {
+		return nil, err
+	}
+	integer, err := value.integer()
+	if err != nil {
+		return nil, fmt.Errorf("number %s has %w", number, err)
+	}
+	return integer, nil
+}
+
+// decimal is a number as written, its significant digits times a power of ten. Parsing it this
+// way keeps numbers like 1e100 exact, where a float would round them
+type decimal struct {
+	negative bool
+	digits   string // Without leading or trailing zeros. Empty for zero
+	exponent int64
+}
+
+// parseDecimal splits number, which is valid JSON, into a decimal
+func parseDecimal(number json.Number) (decimal, error) {
+	var d decimal
+	text := number.String()
+	if rest, ok := strings.CutPrefix(text, "-"); ok {
+		d.negative = true
+		text = rest
+	}
+	if mantissa, exponent, ok := strings.Cut(strings.ToLower(text), "e"); ok {
+		text = mantissa
+		var err error
+		d.exponent, err = strconv.ParseInt(exponent, 10, 64)
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			return decimal{}, fmt.Errorf("could not parse number %s: %w", number, err)
+		}
+		// Far past any integer that can be tested or fraction that can be written, and small enough
+		// that the sums below can't overflow
+		d.exponent = max(min(d.exponent, math.MaxInt32), math.MinInt32)
+	}
+	whole, fraction, _ := strings.Cut(text, ".")
+	d.digits = strings.TrimLeft(whole+fraction, "0")
+	d.exponent -= int64(len(fraction))
+	for strings.HasSuffix(d.digits, "0") {
+		d.digits = d.digits[:len(d.digits)-1]
+		d.exponent++
+	}
+	if d.digits == "" {
+		d.exponent = 0
+	}
+	return d, nil
+}
+
+// integer returns the value of d if it is an integer, and nil otherwise. It returns errTooLarge
+// for integers with more than maxBits bits
+func (d decimal) integer() (*big.Int, error) {
+	if d.exponent < 0 {
+		return nil, nil
+	}
+	if int64(len(d.digits))+d.exponent > maxDigits {
+		return nil, errTooLarge
+	}
+	integer, ok := new(big.Int).SetString(d.digits+strings.Repeat("0", int(d.exponent)), 10)
+	if !ok {
+		integer = new(big.Int)
+	}
+	if integer.BitLen() > maxBits {
+		return nil, errTooLarge
+	}
+	if d.negative {
+		integer.Neg(integer)
+	}
+	return integer, nil
+}
+
+// composite reports whether the integer d is negative or divisible by 2 or 5, so not prime
+func (d decimal) composite() bool {
+	if d.negative || d.digits == "" || d.exponent > 0 {
+		return true
+	}
+	return strings.ContainsAny(d.digits[len(d.digits)-1:], "024568")
+}
+
+// IsPrime checks whether n is prime. Numbers below 2^24 are looked up in a sieve shared by every
+// server, and larger ones get a deterministic Miller-Rabin test
 func IsPrime(n int) bool {
-	// Handle edge cases for numbers less than 2.
 	if n <= 1 {
 		return false
 	}
-	// 2 and 3 are prime numbers.
-	if n <= 3 {
-		return true
+	return isPrime64(uint64(n))
+}
+
+// IsPrimeBig checks whether n is prime. 64 bit numbers get the same exact answer as IsPrime.
+// Larger ones are probably prime, with a chance of error below 1 in 4^20
+func IsPrimeBig(n *big.Int) bool {
+	if n.Sign() <= 0 {
+		return false
 	}
-	// If n is divisible by 2 or 3, it's not prime.
-	if n%2 == 0 || n%3 == 0 {
+	if !n.IsUint64() {
+		return n.ProbablyPrime(20)
+	}
+	return isPrime64(n.Uint64())
+}
+
+func isPrime64(n uint64) bool {
+	if n < sieveLimit {
+		return smallPrimes().isPrime(n)
+	}
+	return millerRabin(n)
+}
+
+// Testing against these bases gives the right answer for every 64 bit number
+var millerRabinBases = []uint64{2, 3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37}
+
+// millerRabin checks whether n is prime
+func millerRabin(n uint64) bool {
+	if n < 2 {
 		return false
 	}
+	for _, base := range millerRabinBases {
+		if n%base == 0 {
+			return n == base
+		}
+	}
 
-	// Optimization: We only need to check divisors up to the square root of n.
-	// All other divisors will have a corresponding smaller divisor.
-	sqrtN := int(math.Sqrt(float64(n)))
+	// n-1 = d * 2^shift with d odd
+	shift := bits.TrailingZeros64(n - 1)
+	d := (n - 1) >> shift
 
-	// We only need to check divisors of the form 6k ± 1.
-	for i := 5; i <= sqrtN; i = i + 6 {
-		if n%i == 0 || n%(i+2) == 0 {
+	for _, base := range millerRabinBases {
+		x := powMod(base, d, n)
+		if x == 1 || x == n-1 {
+			continue
+		}
+		composite := true
+		for range shift - 1 {
+			x = mulMod(x, x, n)
+			if x == n-1 {
+				composite = false
+				break
+			}
+		}
+		if composite {
 			return false
 		}
 	}
 
 	return true
 }
+
+// mulMod returns a*b mod m without overflowing. a and b must be less than m
+func mulMod(a, b, m uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	_, rem := bits.Div64(hi, lo, m)
+	return rem
+}
+
+// powMod returns base^exponent mod m
+func powMod(base, exponent, m uint64) uint64 {
+	result := uint64(1)
+	base %= m
+	for exponent > 0 {
+		if exponent&1 == 1 {
+			result = mulMod(result, base, m)
+		}
+		base = mulMod(base, base, m)
+		exponent >>= 1
+	}
+	return result
+}
@@ -0,0 +1,87 @@
+package primetime
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Numbers below sieveLimit are looked up in a sieve shared by every server. It covers
+// MaxPrimeCount and takes 1MB, one bit for each odd number
+const sieveLimit = 1 << 24
+
+// The square root of sieveLimit
+const baseLimit = 1 << 12
+
+// The sieve is built a segment at a time so the bits being marked stay in the CPU cache
+const segmentBits = 1 << 18
+
+// smallPrimes builds the sieve on first use
+var smallPrimes = sync.OnceValue(newSieve)
+
+// sieve marks the odd composites below sieveLimit. Bit i is for the odd number 2i+1
+type sieve struct {
+	composite []uint64
+}
+
+func newSieve() *sieve {
+	const size = sieveLimit / 2
+	s := &sieve{composite: make([]uint64, size/64)}
+	// 1 is not prime
+	s.composite[0] = 1
+
+	// The odd primes up to the square root of sieveLimit are enough to find every composite
+	var basePrimes []int
+	baseComposite := make([]bool, baseLimit)
+	for p := 3; p < baseLimit; p += 2 {
+		if baseComposite[p] {
+			continue
+		}
+		basePrimes = append(basePrimes, p)
+		for multiple := p * p; multiple < baseLimit; multiple += 2 * p {
+			baseComposite[multiple] = true
+		}
+	}
+
+	for low := 0; low < size; low += segmentBits {
+		high := min(low+segmentBits, size)
+		for _, p := range basePrimes {
+			// The first odd multiple of p in the segment. 2i+1 is a multiple of p when i is
+			// (p-1)/2 mod p, and multiples below p*p were marked by smaller primes
+			i := low + ((p-1)/2-low%p+p)%p
+			i = max(i, p*p/2)
+			for ; i < high; i += p {
+				s.composite[i/64] |= 1 << (i % 64)
+			}
+		}
+	}
+
+	return s
+}
+
+// isPrime checks whether n, which must be below sieveLimit, is prime
+func (s *sieve) isPrime(n uint64) bool {
+	if n%2 == 0 {
+		return n == 2
+	}
+	i := n / 2
+	return s.composite[i/64]&(1<<(i%64)) == 0
+}
+
+// count returns how many primes there are up to and including n, which must be below sieveLimit
+func (s *sieve) count(n int) int {
+	if n < 2 {
+		return 0
+	}
+
+	// The odd numbers up to n are bits 0 to last
+	last := (n - 1) / 2
+	composites := 0
+	for _, word := range s.composite[:last/64] {
+		composites += bits.OnesCount64(word)
+	}
+	mask := uint64(1)<<(last%64+1) - 1
+	composites += bits.OnesCount64(s.composite[last/64] & mask)
+
+	// 2 is the only even prime
+	return 1 + last + 1 - composites
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// Sockets can be passed to firewatch instead of being bound by it, either by systemd socket
+// activation or by a running firewatch handing over to its replacement. Listen and ListenPacket
+// take an inherited socket on the same port before binding a new one
+
+// HandoffEnv is set by a firewatch handing its sockets to a new process. It stands in for
+// LISTEN_PID, which can't be known before the new process starts
+const HandoffEnv = "FIREWATCH_HANDOFF"
+
+// listenFDsStart is the first passed file descriptor, after stdin, stdout and stderr
+const listenFDsStart = 3
+
+var inherited struct {
+	once      sync.Once
+	mutex     sync.Mutex
+	listeners []net.Listener
+	packets   []net.PacketConn
+}
+
+// bound records every socket Listen and ListenPacket returned, so they can be handed over
+var bound struct {
+	mutex   sync.Mutex
+	sockets []filer
+}
+
+// filer is implemented by *net.TCPListener and *net.UDPConn
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Inherit adds sockets for Listen and ListenPacket to use before they bind new ones. Each file is
+// closed once its socket has been taken over
+func Inherit(files []*os.File) error {
+	loadActivation()
+	inherited.mutex.Lock()
+	defer inherited.mutex.Unlock()
+
+	for _, file := range files {
+		err := adopt(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Inherited returns how many passed sockets have not been claimed by Listen or ListenPacket
+func Inherited() int {
+	loadActivation()
+	inherited.mutex.Lock()
+	defer inherited.mutex.Unlock()
+
+	return len(inherited.listeners) + len(inherited.packets)
+}
+
+// CloseInherited closes the passed sockets no service claimed and returns how many there were
+func CloseInherited() int {
+	loadActivation()
+	inherited.mutex.Lock()
+	defer inherited.mutex.Unlock()
+
+	count := len(inherited.listeners) + len(inherited.packets)
+	for _, listener := range inherited.listeners {
+		listener.Close()
+	}
+	for _, conn := range inherited.packets {
+		conn.Close()
+	}
+	inherited.listeners, inherited.packets = nil, nil
+	return count
+}
+
+// loadActivation takes the sockets passed by systemd (LISTEN_PID and LISTEN_FDS) or by a handoff.
+// The variables are cleared so processes we start don't see them
+func loadActivation() {
+	inherited.once.Do(func() {
+		defer func() {
+			os.Unsetenv("LISTEN_PID")
+			os.Unsetenv("LISTEN_FDS")
+			os.Unsetenv("LISTEN_FDNAMES")
+			os.Unsetenv(HandoffEnv)
+		}()
+		count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || count <= 0 {
+			return
+		}
+		pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		if _, handoff := os.LookupEnv(HandoffEnv); pid != os.Getpid() && !handoff {
+			return
+		}
+		inherited.mutex.Lock()
+		defer inherited.mutex.Unlock()
+		for fd := listenFDsStart; fd < listenFDsStart+count; fd++ {
+			syscall.CloseOnExec(fd)
+			file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+			// Sockets we can't use are left for the process to exit with
+			adopt(file)
+			file.Close()
+		}
+	})
+}
+
+// adopt turns file into a listener or packet conn. The caller holds inherited.mutex
+func adopt(file *os.File) error {
+	if listener, err := net.FileListener(file); err == nil {
+		inherited.listeners = append(inherited.listeners, listener)
+		return nil
+	}
+	conn, err := net.FilePacketConn(file)
+	if err != nil {
+		return fmt.Errorf("passed file %s is not a socket: %w", file.Name(), err)
+	}
+	inherited.packets = append(inherited.packets, conn)
+	return nil
+}
+
+// claimListener returns an inherited listener for address, if there is one
+func claimListener(address string) net.Listener {
+	loadActivation()
+	inherited.mutex.Lock()
+	defer inherited.mutex.Unlock()
+
+	for i, listener := range inherited.listeners {
+		if matches(listener.Addr(), address) {
+			inherited.listeners = append(inherited.listeners[:i], inherited.listeners[i+1:]...)
+			return listener
+		}
+	}
+	return nil
+}
+
+// claimPacketConn returns an inherited UDP socket for address, if there is one
+func claimPacketConn(address string) net.PacketConn {
+	loadActivation()
+	inherited.mutex.Lock()
+	defer inherited.mutex.Unlock()
+
+	for i, conn := range inherited.packets {
+		if matches(conn.LocalAddr(), address) {
+			inherited.packets = append(inherited.packets[:i], inherited.packets[i+1:]...)
+			return conn
+		}
+	}
+	return nil
+}
+
+// matches reports whether a socket bound to addr serves address. The ports must be the same, and
+// so must the IPs when address has a literal one. Port 0 never matches
+func matches(addr net.Addr, address string) bool {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || port == 0 {
+		return false
+	}
+	var ip net.IP
+	var boundPort int
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip, boundPort = addr.IP, addr.Port
+	case *net.UDPAddr:
+		ip, boundPort = addr.IP, addr.Port
+	default:
+		return false
+	}
+	if boundPort != port {
+		return false
+	}
+	if want := net.ParseIP(host); want != nil {
+		return want.Equal(ip)
+	}
+	return true
+}
+
+// record notes a socket so Files can hand it over
+func record(socket any) {
+	f, ok := socket.(filer)
+	if !ok {
+		return
+	}
+	bound.mutex.Lock()
+	defer bound.mutex.Unlock()
+
+	bound.sockets = append(bound.sockets, f)
+}
+
+// Files returns a duplicate of every socket Listen and ListenPacket returned that is still open,
+// ready to be passed to another process
+func Files() []*os.File {
+	bound.mutex.Lock()
+	defer bound.mutex.Unlock()
+
+	var files []*os.File
+	open := bound.sockets[:0]
+	for _, socket := range bound.sockets {
+		file, err := socket.File()
+		if err != nil {
+			// Closed, so there is nothing to hand over
+			continue
+		}
+		files = append(files, file)
+		open = append(open, socket)
+	}
+	bound.sockets = open
+	return files
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+
+	"github.com/JeremyFenwick/firewatch/internal/chaos"
+)
+
+// FlyGlobalServices is the address UDP services must bind to on fly.io to receive traffic from
+// the public internet
+const FlyGlobalServices = "fly-global-services"
+
+// faults are injected into the sockets Listen and ListenPacket open, see InjectFaults
+var faults atomic.Pointer[chaos.Faults]
+
+// InjectFaults wraps the sockets Listen and ListenPacket open from now on with network faults. It
+// is meant for tests and staging builds, never production
+func InjectFaults(f chaos.Faults) {
+	faults.Store(&f)
+}
+
+// Listen opens a TCP listener for a service. The host part of address decides the IP versions:
+//
+//	":5000" or "" host     all interfaces, IPv4 and IPv6 (dual-stack)
+//	"0.0.0.0:5000"         all interfaces, IPv4 only
+//	"[::]:5000"            all interfaces, IPv6 only
+//	"10.0.0.1:5000"        that address only, likewise "[fd00::1]:5000"
+//	"host.internal:5000"   one address the name resolves to, IPv4 if it has one
+//
+// An inherited listener on the same port is used instead of binding, see Inherit
+func Listen(address string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %q: %w", address, err)
+	}
+	listener := claimListener(address)
+	if listener == nil {
+		listener, err = net.Listen(network("tcp", host), address)
+		if err != nil {
+			return nil, fmt.Errorf("can't listen on %s/tcp: %w", address, err)
+		}
+	}
+	record(listener)
+	if f := faults.Load(); f != nil {
+		listener = chaos.Listener(listener, *f)
+	}
+	return listener, nil
+}
+
+// ListenPacket opens a UDP socket for a service. Addresses are read as they are by Listen, except
+// that an empty host binds to FlyGlobalServices when running on fly.io
+func ListenPacket(address string) (net.PacketConn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %q: %w", address, err)
+	}
+	if host == "" && onFly() {
+		host = FlyGlobalServices
+		address = net.JoinHostPort(host, port)
+	}
+	conn := claimPacketConn(address)
+	if conn == nil {
+		conn, err = net.ListenPacket(network("udp", host), address)
+		if err != nil {
+			return nil, fmt.Errorf("can't listen on %s/udp: %w", address, err)
+		}
+	}
+	record(conn)
+	if f := faults.Load(); f != nil {
+		conn = chaos.PacketConn(conn, *f)
+	}
+	return conn, nil
+}
+
+// network narrows tcp or udp to the IP version of a literal host. Names and an empty host are left
+// to the resolver and the dual-stack socket
+func network(base, host string) string {
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return base
+	case ip.To4() != nil:
+		return base + "4"
+	default:
+		return base + "6"
+	}
+}
+
+// onFly reports whether we are running as a fly.io app
+func onFly() bool {
+	_, exists := os.LookupEnv("FLY_APP_NAME")
+	return exists
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Limits protect a TCPServer from clients that open too many connections or hold them
+// open doing nothing. The zero value of each field means no limit
+type Limits struct {
+	MaxConnections      int           // Concurrent connections across all clients
+	MaxConnectionsPerIP int           // Concurrent connections from a single remote IP
+	AcceptRate          float64       // Connections accepted per second, averaged
+	AcceptBurst         int           // Connections accepted at once before AcceptRate applies. Defaults to 1
+	ReadTimeout         time.Duration // How long a read may wait for data before the connection is closed
+	WriteTimeout        time.Duration // How long a write may block before the connection is closed
+}
+
+// Reasons a connection is rejected, used in logs and metrics
+const (
+	rejectMaxConnections = "max_connections"
+	rejectPerIP          = "max_connections_per_ip"
+	rejectRate           = "accept_rate"
+	rejectProxyHeader    = "proxy_header"
+)
+
+// rateLimiter is a token bucket refilled at rate tokens per second up to burst
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// allow takes a token if one is available at now
+func (r *rateLimiter) allow(now time.Time) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.last.IsZero() {
+		r.tokens = min(r.burst, r.tokens+now.Sub(r.last).Seconds()*r.rate)
+	}
+	r.last = now
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// idleConn refreshes the read or write deadline before every call so a connection is only
+// closed once it has been idle for the timeout. Deadlines set by the handler are replaced
+type idleConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+func withIdleTimeouts(conn net.Conn, limits Limits) net.Conn {
+	if limits.ReadTimeout <= 0 && limits.WriteTimeout <= 0 {
+		return conn
+	}
+	return &idleConn{Conn: conn, readTimeout: limits.ReadTimeout, writeTimeout: limits.WriteTimeout}
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	if c.readTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	return c.Conn.Write(p)
+}
+
+// remoteIP returns the IP part of the connection's remote address
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
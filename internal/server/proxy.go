@@ -0,0 +1,253 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidProxyHeader is returned when a connection or datagram does not start with a valid
+// PROXY protocol header
+var ErrInvalidProxyHeader = errors.New("invalid proxy protocol header")
+
+// How long a proxy has to send the header after connecting
+const proxyHeaderTimeout = 5 * time.Second
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// A v1 header is at most 107 bytes including the CRLF
+	proxyV1MaxLength = 107
+	proxyV2HeaderLen = 16
+	// Room for the largest address block and TLVs such as a unique id in a UDP header
+	proxyV2MaxBody = 512
+)
+
+// readProxyHeader reads a v1 or v2 header and returns the client address it carries. The address
+// is nil for health checks from the proxy itself (v1 UNKNOWN or v2 LOCAL)
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	// Check the first byte on its own so a client that skipped the header is turned away without
+	// waiting for bytes it will never send
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidProxyHeader, err)
+	}
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		start, err := r.Peek(len(proxyV1Prefix))
+		if err != nil || !bytes.Equal(start, proxyV1Prefix) {
+			return nil, fmt.Errorf("%w: bad v1 prefix", ErrInvalidProxyHeader)
+		}
+		return readProxyV1(r)
+	case proxyV2Signature[0]:
+	default:
+		return nil, fmt.Errorf("%w: no header", ErrInvalidProxyHeader)
+	}
+	header := make([]byte, proxyV2HeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidProxyHeader, err)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidProxyHeader, err)
+	}
+	return parseProxyV2(header, body)
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyV1MaxLength {
+			return nil, fmt.Errorf("%w: v1 header is too long", ErrInvalidProxyHeader)
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidProxyHeader, err)
+		}
+		line = append(line, b)
+	}
+	// PROXY TCP4 <source> <destination> <source port> <destination port>
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: malformed v1 header %q", ErrInvalidProxyHeader, line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("%w: bad source address in %q", ErrInvalidProxyHeader, line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// parseProxyV2 decodes the fixed 16 byte header and the address block that follows it. Any TLVs
+// after the addresses are ignored
+func parseProxyV2(header, body []byte) (net.Addr, error) {
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidProxyHeader)
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidProxyHeader, header[12]>>4)
+	}
+	switch header[12] & 0x0f {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("%w: unknown command %d", ErrInvalidProxyHeader, header[12]&0x0f)
+	}
+	family, transport := header[13]>>4, header[13]&0x0f
+	var ip net.IP
+	var port uint16
+	switch family {
+	case 0x1: // IPv4
+		if len(body) < 12 {
+			return nil, fmt.Errorf("%w: short IPv4 address block", ErrInvalidProxyHeader)
+		}
+		ip, port = net.IP(body[0:4]), binary.BigEndian.Uint16(body[8:10])
+	case 0x2: // IPv6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("%w: short IPv6 address block", ErrInvalidProxyHeader)
+		}
+		ip, port = net.IP(body[0:16]), binary.BigEndian.Uint16(body[32:34])
+	default:
+		// Unix sockets and unspecified families carry no address we can use
+		return nil, nil
+	}
+	ip = append(net.IP(nil), ip...)
+	switch transport {
+	case 0x1:
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	case 0x2:
+		return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// proxiedConn reports the client address from the PROXY header and replays anything the header
+// reader buffered past the header
+type proxiedConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	if c.reader.Buffered() > 0 {
+		return c.reader.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// acceptProxied reads the PROXY header from a new connection. Connections from the proxy itself
+// keep their own address
+func acceptProxied(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	reader := bufio.NewReaderSize(conn, proxyV1MaxLength)
+	remote, err := readProxyHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxiedConn{Conn: conn, reader: reader, remote: remote}, nil
+}
+
+// How long a UDP client is remembered after its last datagram, so replies can be sent through
+// the proxy it came from
+const proxiedPeerTTL = 10 * time.Minute
+
+// ProxyPacketConn expects every datagram read from conn to start with a PROXY protocol v2 header.
+// The header is stripped and ReadFrom reports the client address it carries. Writes to that client
+// are sent back to the proxy that forwarded its datagrams. Datagrams without a valid header are
+// dropped
+func ProxyPacketConn(conn net.PacketConn) net.PacketConn {
+	return &proxiedPacketConn{PacketConn: conn, peers: make(map[string]proxiedPeer)}
+}
+
+type proxiedPeer struct {
+	proxy    net.Addr
+	lastSeen time.Time
+}
+
+type proxiedPacketConn struct {
+	net.PacketConn
+	mutex     sync.Mutex
+	peers     map[string]proxiedPeer // Keyed by client address
+	lastSweep time.Time
+}
+
+func (c *proxiedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buffer := make([]byte, proxyV2HeaderLen+proxyV2MaxBody+len(b))
+	for {
+		n, proxy, err := c.PacketConn.ReadFrom(buffer)
+		if err != nil {
+			return 0, proxy, err
+		}
+		datagram := buffer[:n]
+		if n < proxyV2HeaderLen {
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(datagram[14:]))
+		if n < proxyV2HeaderLen+length {
+			continue
+		}
+		client, err := parseProxyV2(datagram[:proxyV2HeaderLen], datagram[proxyV2HeaderLen:proxyV2HeaderLen+length])
+		if err != nil {
+			continue
+		}
+		if client == nil {
+			client = proxy
+		} else {
+			c.remember(client, proxy)
+		}
+		return copy(b, datagram[proxyV2HeaderLen+length:]), client, nil
+	}
+}
+
+func (c *proxiedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	peer, exists := c.peers[addr.String()]
+	c.mutex.Unlock()
+	if exists {
+		addr = peer.proxy
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *proxiedPacketConn) remember(client, proxy net.Addr) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	c.peers[client.String()] = proxiedPeer{proxy: proxy, lastSeen: now}
+	if now.Sub(c.lastSweep) < time.Minute {
+		return
+	}
+	c.lastSweep = now
+	for key, peer := range c.peers {
+		if now.Sub(peer.lastSeen) > proxiedPeerTTL {
+			delete(c.peers, key)
+		}
+	}
+}
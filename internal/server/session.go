@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+)
+
+// Session is a live client as the admin API sees it: a TCP connection, or a protocol session for
+// the UDP services. Handlers describe who the client is with SetIdentity
+type Session struct {
+	ID       uint64 // Matches the conn_id or session the client's logs are tagged with
+	Remote   string
+	Started  time.Time
+	BytesIn  metrics.Counter
+	BytesOut metrics.Counter
+
+	mutex     sync.Mutex
+	identity  string
+	close     func()
+	closeOnce sync.Once
+}
+
+// SessionInfo is a snapshot of a Session
+type SessionInfo struct {
+	ID       uint64    `json:"id"`
+	Remote   string    `json:"remote"`
+	Started  time.Time `json:"started"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	Identity string    `json:"identity,omitempty"` // Role or name of the client, such as a chat nickname
+}
+
+// NewSession creates a session for a client at remote. close disconnects the client and is called
+// at most once
+func NewSession(id uint64, remote string, close func()) *Session {
+	return &Session{ID: id, Remote: remote, Started: time.Now(), close: close}
+}
+
+// SetIdentity records who the client is. Safe to call on a nil session, which handlers get when
+// they are run without a TCPServer
+func (s *Session) SetIdentity(identity string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.identity = identity
+}
+
+// Close disconnects the client
+func (s *Session) Close() {
+	s.closeOnce.Do(s.close)
+}
+
+// Info returns a snapshot of the session
+func (s *Session) Info() SessionInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return SessionInfo{
+		ID:       s.ID,
+		Remote:   s.Remote,
+		Started:  s.Started,
+		BytesIn:  s.BytesIn.Value(),
+		BytesOut: s.BytesOut.Value(),
+		Identity: s.identity,
+	}
+}
+
+type sessionKey struct{}
+
+// WithSession returns a copy of ctx carrying session
+func WithSession(ctx context.Context, session *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, session)
+}
+
+// SessionFromContext returns the session ctx carries, or nil
+func SessionFromContext(ctx context.Context) *Session {
+	session, _ := ctx.Value(sessionKey{}).(*Session)
+	return session
+}
+
+// Unwrap returns the connection under the byte counting the server adds to every TCP connection,
+// and a function to count the bytes copied over it directly. The kernel can only splice between
+// the sockets themselves, so a handler that hands its copying to io.Copy unwraps first. TLS,
+// capture, timeouts and PROXY headers stay in place, and io.Copy falls back to reading through
+// them
+func Unwrap(conn net.Conn) (net.Conn, func(in, out int64)) {
+	conn, count := metrics.Uncounted(conn)
+	c, ok := conn.(*sessionConn)
+	if !ok {
+		return conn, count
+	}
+	return c.Conn, func(in, out int64) {
+		count(in, out)
+		c.session.BytesIn.Add(in)
+		c.session.BytesOut.Add(out)
+	}
+}
+
+// sessionConn adds the bytes read and written on a connection to its session
+type sessionConn struct {
+	net.Conn
+	session *Session
+}
+
+func (c *sessionConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.session.BytesIn.Add(int64(n))
+	return n, err
+}
+
+func (c *sessionConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.session.BytesOut.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,354 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/capture"
+	"github.com/JeremyFenwick/firewatch/internal/logging"
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+)
+
+var (
+	// ErrServerClosed is returned by Serve once Stop has been called
+	ErrServerClosed = errors.New("server closed")
+	// ErrServerStarted is returned when a server is asked to serve a second listener
+	ErrServerStarted = errors.New("server already started")
+)
+
+// How long Stop waits for handlers to return after their connections are force closed
+const forceCloseGrace = 2 * time.Second
+
+// Handler serves a single connection. The context is cancelled if the connection is
+// force closed because the server could not drain in time. It carries a logger tagged with
+// the connection id, see logging.FromContext
+type Handler func(ctx context.Context, conn net.Conn)
+
+// TCPServer runs an accept loop and tracks live connections so they can be drained on shutdown
+type TCPServer struct {
+	Handler Handler
+	// Metrics, if set, counts connections and the bytes handlers read and write
+	Metrics *metrics.Service
+	// Logger is the service logger, slog.Default() if nil
+	Logger *slog.Logger
+	// Limits are applied to every accepted connection. Set them before the server is started
+	Limits Limits
+	// TLS, if set, is terminated on every connection before the handler sees it
+	TLS *TLS
+	// Recorder, if set, captures the traffic of every connection
+	Recorder *capture.Recorder
+	// ProxyProtocol expects every connection to open with a PROXY protocol v1 or v2 header. The
+	// client address it carries becomes the connection's RemoteAddr, and is what the per IP limit
+	// counts. Connections without a valid header are rejected
+	ProxyProtocol bool
+
+	mutex    sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]*Session
+	perIP    map[string]int
+	limiter  *rateLimiter
+	wg       sync.WaitGroup
+	stopping bool
+	// err is why the accept loop exited without Stop being called
+	err error
+}
+
+// Serve accepts connections until Stop is called. The listener is closed on return
+func (s *TCPServer) Serve(listener net.Listener) error {
+	if err := s.attach(listener); err != nil {
+		return err
+	}
+	return s.serve(listener)
+}
+
+// Start serves the listener in the background. Addr is valid once Start returns
+func (s *TCPServer) Start(listener net.Listener) error {
+	if err := s.attach(listener); err != nil {
+		return err
+	}
+	go func() {
+		err := s.serve(listener)
+		if err != nil && !errors.Is(err, ErrServerClosed) {
+			s.logger().Error("Server stopped", "address", listener.Addr().String(), "error", err)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address being listened on, or nil if the server has not started
+func (s *TCPServer) Addr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Err returns the error the accept loop exited with if it stopped without Stop being called, such
+// as when the listener was closed out from under it. It is nil while the server is serving
+func (s *TCPServer) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.err
+}
+
+func (s *TCPServer) attach(listener net.Listener) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopping {
+		listener.Close()
+		return ErrServerClosed
+	}
+	if s.listener != nil {
+		listener.Close()
+		return ErrServerStarted
+	}
+	s.listener = listener
+	if s.Limits.AcceptRate > 0 {
+		s.limiter = newRateLimiter(s.Limits.AcceptRate, s.Limits.AcceptBurst)
+	}
+	return nil
+}
+
+func (s *TCPServer) serve(listener net.Listener) error {
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.isStopping() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				s.mutex.Lock()
+				s.err = err
+				s.mutex.Unlock()
+				return err
+			}
+			s.logger().Warn("Encountered error accepting connection", "error", err)
+			continue
+		}
+		if s.limiter != nil && !s.limiter.allow(time.Now()) {
+			s.reject(conn, rejectRate)
+			continue
+		}
+		if s.ProxyProtocol {
+			// The header may be slow to arrive, so it is read off the accept loop
+			go s.serveProxied(conn)
+			continue
+		}
+		ctx, reason := s.track(conn)
+		if ctx == nil {
+			s.reject(conn, reason)
+			continue
+		}
+		go s.serveConn(ctx, conn)
+	}
+}
+
+func (s *TCPServer) serveProxied(conn net.Conn) {
+	proxied, err := acceptProxied(conn)
+	if err != nil {
+		s.logger().Debug("Could not read proxy header", "remote", conn.RemoteAddr().String(), "error", err)
+		s.reject(conn, rejectProxyHeader)
+		return
+	}
+	ctx, reason := s.track(proxied)
+	if ctx == nil {
+		s.reject(proxied, reason)
+		return
+	}
+	s.serveConn(ctx, proxied)
+}
+
+func (s *TCPServer) serveConn(ctx context.Context, conn net.Conn) {
+	defer s.untrack(conn)
+	session := SessionFromContext(ctx)
+	logger := s.logger().With("conn_id", session.ID, "remote", conn.RemoteAddr().String())
+	logger.Debug("Connection accepted")
+	defer logger.Debug("Connection closed")
+	ctx = logging.WithLogger(ctx, logger)
+	conn = withIdleTimeouts(conn, s.Limits)
+	if s.TLS != nil {
+		secure, err := s.TLS.handshake(ctx, conn)
+		if err != nil {
+			logger.Debug("TLS handshake failed", "error", err)
+			if s.Metrics != nil {
+				s.Metrics.ProtocolErrors.Inc()
+			}
+			return
+		}
+		conn = secure
+	}
+	// Record the decrypted traffic so it can be replayed against a plaintext server
+	if s.Recorder != nil {
+		conn = s.Recorder.Conn(conn)
+	}
+	conn = &sessionConn{Conn: conn, session: session}
+	if s.Metrics != nil {
+		s.Handler(ctx, metrics.CountConn(conn, s.Metrics))
+		return
+	}
+	s.Handler(ctx, conn)
+}
+
+func (s *TCPServer) logger() *slog.Logger {
+	if s.Logger == nil {
+		return slog.Default()
+	}
+	return s.Logger
+}
+
+// reject closes a connection refused by a limit. An empty reason means the server is stopping
+func (s *TCPServer) reject(conn net.Conn, reason string) {
+	conn.Close()
+	if reason == "" {
+		return
+	}
+	s.logger().Warn("Rejected connection", "remote", conn.RemoteAddr().String(), "reason", reason)
+	if s.Metrics != nil {
+		s.Metrics.RejectedConnections.Inc()
+	}
+}
+
+// track registers a connection, or returns a nil context and the reason it was refused. The
+// context carries the connection's Session
+func (s *TCPServer) track(conn net.Conn) (context.Context, string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopping {
+		return nil, ""
+	}
+	if s.Limits.MaxConnections > 0 && len(s.conns) >= s.Limits.MaxConnections {
+		return nil, rejectMaxConnections
+	}
+	ip := remoteIP(conn)
+	if s.Limits.MaxConnectionsPerIP > 0 && s.perIP[ip] >= s.Limits.MaxConnectionsPerIP {
+		return nil, rejectPerIP
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]*Session)
+		s.perIP = make(map[string]int)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	session := NewSession(logging.NextID(), conn.RemoteAddr().String(), func() {
+		cancel()
+		conn.Close()
+	})
+	s.conns[conn] = session
+	s.perIP[ip]++
+	s.wg.Add(1)
+	if s.Metrics != nil {
+		s.Metrics.AcceptedConnections.Inc()
+		s.Metrics.ActiveConnections.Inc()
+	}
+	return WithSession(ctx, session), ""
+}
+
+func (s *TCPServer) untrack(conn net.Conn) {
+	s.mutex.Lock()
+	session, exists := s.conns[conn]
+	if exists {
+		delete(s.conns, conn)
+		ip := remoteIP(conn)
+		if s.perIP[ip]--; s.perIP[ip] == 0 {
+			delete(s.perIP, ip)
+		}
+	}
+	s.mutex.Unlock()
+
+	if exists {
+		session.Close()
+		if s.Metrics != nil {
+			s.Metrics.ActiveConnections.Dec()
+		}
+		s.wg.Done()
+	}
+}
+
+func (s *TCPServer) isStopping() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.stopping
+}
+
+// ActiveConnections returns the number of connections currently being served
+func (s *TCPServer) ActiveConnections() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.conns)
+}
+
+// Sessions lists the connections currently being served, oldest first
+func (s *TCPServer) Sessions() []SessionInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sessions := make([]SessionInfo, 0, len(s.conns))
+	for _, session := range s.conns {
+		sessions = append(sessions, session.Info())
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions
+}
+
+// Disconnect closes the connection with id. Returns false if there is no such connection
+func (s *TCPServer) Disconnect(id uint64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, session := range s.conns {
+		if session.ID == id {
+			session.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// Stop closes the listener and waits for in-flight connections to finish. When ctx expires
+// the remaining connections are closed and ctx.Err() is returned
+func (s *TCPServer) Stop(ctx context.Context) error {
+	s.mutex.Lock()
+	s.stopping = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	// We ran out of time, so force the remaining connections closed
+	s.mutex.Lock()
+	s.logger().Warn("Drain deadline reached, closing connections", "connections", len(s.conns))
+	for _, session := range s.conns {
+		session.Close()
+	}
+	s.mutex.Unlock()
+	select {
+	case <-done:
+	case <-time.After(forceCloseGrace):
+		s.logger().Error("Connection handlers did not exit after being closed")
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// How long a client has to complete the TLS handshake
+const handshakeTimeout = 10 * time.Second
+
+// TLS terminates TLS for a TCP server. The files are read when it is created and again on Reload,
+// so certificates can be rotated while connections are being served
+type TLS struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile, if set, is a PEM bundle of the CAs that client certificates must be signed by.
+	// Clients without a valid certificate are refused
+	ClientCAFile string
+
+	config atomic.Pointer[tls.Config]
+}
+
+// NewTLS loads the certificate, key and optional client CAs
+func NewTLS(certFile, keyFile, clientCAFile string) (*TLS, error) {
+	t := &TLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: clientCAFile}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload reads the files again. New connections use the new settings, open ones are unaffected.
+// If anything can't be loaded the previous settings stay in place
+func (t *TLS) Reload() error {
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return fmt.Errorf("could not load TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if t.ClientCAFile != "" {
+		pem, err := os.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("could not read client CAs: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("client CA file has no PEM certificates")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	t.config.Store(config)
+	return nil
+}
+
+// Config returns a tls.Config that always uses the most recently loaded settings
+func (t *TLS) Config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return t.config.Load(), nil
+		},
+	}
+}
+
+// handshake runs the server side of the TLS handshake so failures are seen before the handler runs
+func (t *TLS) handshake(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	secure := tls.Server(conn, t.Config())
+	ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+	if err := secure.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return secure, nil
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultUpstreamCheckTTL is how long an UpstreamCheck remembers its result unless TTL is set
+const DefaultUpstreamCheckTTL = 30 * time.Second
+
+// UpstreamCheck reports whether a TCP upstream accepts connections. Results are remembered for
+// TTL, so frequent readiness probes don't each open a connection to a public server
+type UpstreamCheck struct {
+	Address string        // host:port of the upstream
+	TTL     time.Duration // Defaults to DefaultUpstreamCheckTTL
+
+	mutex   sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// Check dials the upstream unless it was dialled within the TTL, and returns the result of the
+// last dial. A dial cut short by ctx isn't remembered
+func (c *UpstreamCheck) Check(ctx context.Context) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = DefaultUpstreamCheckTTL
+	}
+	if !c.checked.IsZero() && time.Since(c.checked) < ttl {
+		return c.err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.Address)
+	if err == nil {
+		conn.Close()
+	}
+	if ctx.Err() == nil {
+		c.checked = time.Now()
+		c.err = err
+	}
+	return err
+}
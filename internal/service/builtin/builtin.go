@@ -0,0 +1,17 @@
+// Package builtin registers every service that ships with firewatch. Import it for its side effects
+package builtin
+
+import (
+	_ "github.com/JeremyFenwick/firewatch/internal/budgetchat"
+	_ "github.com/JeremyFenwick/firewatch/internal/insecuresocketslayer"
+	_ "github.com/JeremyFenwick/firewatch/internal/jobcenter"
+	_ "github.com/JeremyFenwick/firewatch/internal/linereversal"
+	_ "github.com/JeremyFenwick/firewatch/internal/meanstoanend"
+	_ "github.com/JeremyFenwick/firewatch/internal/mobinthemiddle"
+	_ "github.com/JeremyFenwick/firewatch/internal/pestcontrol"
+	_ "github.com/JeremyFenwick/firewatch/internal/primetime"
+	_ "github.com/JeremyFenwick/firewatch/internal/smoketest"
+	_ "github.com/JeremyFenwick/firewatch/internal/speeddaemon"
+	_ "github.com/JeremyFenwick/firewatch/internal/unusualdatabase"
+	_ "github.com/JeremyFenwick/firewatch/internal/voraciouscodestorage"
+)
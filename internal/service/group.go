@@ -0,0 +1,289 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/server"
+)
+
+// How long a Checker gets to answer before the service is reported degraded
+const checkTimeout = 5 * time.Second
+
+// State is how a service is doing
+type State string
+
+const (
+	Listening State = "listening" // Serving with no known problems
+	Degraded  State = "degraded"  // Serving, but a Checker reported a problem such as an unreachable upstream
+	Failed    State = "failed"    // Not serving, because it could not start or is no longer listening
+	Stopped   State = "stopped"   // Shut down on request
+)
+
+// Stats are a service's connection counters
+type Stats struct {
+	ActiveConnections   int64 `json:"active_connections"`
+	AcceptedConnections int64 `json:"accepted_connections"`
+	RejectedConnections int64 `json:"rejected_connections"`
+	BytesIn             int64 `json:"bytes_in"`
+	BytesOut            int64 `json:"bytes_out"`
+	ProtocolErrors      int64 `json:"protocol_errors"`
+}
+
+// Status reports on one service
+type Status struct {
+	Name      string    `json:"name"`
+	Transport Transport `json:"transport"`
+	Address   string    `json:"address"`
+	Started   time.Time `json:"started"`
+	State     State     `json:"state"`
+	Error     string    `json:"error,omitempty"` // Why the service is degraded or failed
+	Stats     Stats     `json:"stats"`
+}
+
+// Connection is a live client of a service
+type Connection struct {
+	Service string `json:"service"`
+	server.SessionInfo
+}
+
+var (
+	// ErrUnknownService is returned for a service that is not running
+	ErrUnknownService = errors.New("unknown service")
+	// ErrNotInspectable is returned for a service that can't list or disconnect its clients
+	ErrNotInspectable = errors.New("service does not track its clients")
+	// ErrUnknownConnection is returned when no live connection has the id
+	ErrUnknownConnection = errors.New("unknown connection")
+)
+
+type member struct {
+	def     Definition
+	srv     Service // nil if the service failed to start
+	started time.Time
+	err     error
+}
+
+// Group is the set of services a process is running
+type Group struct {
+	mutex   sync.Mutex
+	members []member
+	stopped bool
+}
+
+// Add records a service that has been started
+func (g *Group) Add(def Definition, srv Service) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.members = append(g.members, member{def: def, srv: srv, started: time.Now()})
+}
+
+// Fail records a service that could not be started, so it is reported rather than forgotten
+func (g *Group) Fail(def Definition, err error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.members = append(g.members, member{def: def, started: time.Now(), err: err})
+}
+
+// Replace records a started service in place of an earlier instance of it, such as one stopped by
+// an abandoned handoff. It returns the instance replaced, or nil if there was none
+func (g *Group) Replace(def Definition, srv Service) Service {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for i, m := range g.members {
+		if m.def.Name == def.Name {
+			g.members[i] = member{def: def, srv: srv, started: time.Now()}
+			return m.srv
+		}
+	}
+	g.members = append(g.members, member{def: def, srv: srv, started: time.Now()})
+	return nil
+}
+
+// StateFile is where the handed off state of service name is kept in dir
+func StateFile(dir, name string) string {
+	return filepath.Join(dir, name+".state")
+}
+
+// Handoff stops every Stateful service and writes its state to a StateFile in dir. The services
+// that stopped are returned even on error, so they can be restarted if the handoff is abandoned
+func (g *Group) Handoff(ctx context.Context, dir string) ([]Definition, error) {
+	g.mutex.Lock()
+	members := append([]member(nil), g.members...)
+	g.mutex.Unlock()
+
+	var handedOff []Definition
+	for _, m := range members {
+		stateful, ok := m.srv.(Stateful)
+		if !ok {
+			continue
+		}
+		file, err := os.Create(StateFile(dir, m.def.Name))
+		if err != nil {
+			return handedOff, fmt.Errorf("%s: %w", m.def.Name, err)
+		}
+		handedOff = append(handedOff, m.def)
+		err = stateful.Handoff(ctx, file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return handedOff, fmt.Errorf("%s: %w", m.def.Name, err)
+		}
+	}
+	return handedOff, nil
+}
+
+// Status reports on every service in the order they were added
+func (g *Group) Status(ctx context.Context) []Status {
+	g.mutex.Lock()
+	members := append([]member(nil), g.members...)
+	stopped := g.stopped
+	g.mutex.Unlock()
+
+	statuses := make([]Status, len(members))
+	var wg sync.WaitGroup
+	for i, m := range members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i] = m.status(ctx, stopped)
+		}()
+	}
+	wg.Wait()
+	return statuses
+}
+
+func (m member) status(ctx context.Context, stopped bool) Status {
+	status := Status{
+		Name:      m.def.Name,
+		Transport: m.def.Transport,
+		Started:   m.started,
+	}
+	if m.srv == nil {
+		status.State = Failed
+		status.Error = m.err.Error()
+		return status
+	}
+	counters := m.srv.Metrics()
+	status.Stats = Stats{
+		ActiveConnections:   counters.ActiveConnections.Value(),
+		AcceptedConnections: counters.AcceptedConnections.Value(),
+		RejectedConnections: counters.RejectedConnections.Value(),
+		BytesIn:             counters.BytesIn.Value(),
+		BytesOut:            counters.BytesOut.Value(),
+		ProtocolErrors:      counters.ProtocolErrors.Value(),
+	}
+	addr := m.srv.Addr()
+	if addr != nil {
+		status.Address = addr.String()
+	}
+	var exitErr error
+	if exited, ok := m.srv.(Exited); ok {
+		exitErr = exited.Err()
+	}
+	switch {
+	case stopped:
+		status.State = Stopped
+	case exitErr != nil:
+		status.State = Failed
+		status.Error = exitErr.Error()
+	case addr == nil:
+		status.State = Failed
+		status.Error = "not listening"
+	default:
+		status.State = Listening
+		if checker, ok := m.srv.(Checker); ok {
+			checkCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+			err := checker.Check(checkCtx)
+			cancel()
+			if err != nil {
+				status.State = Degraded
+				status.Error = err.Error()
+			}
+		}
+	}
+	return status
+}
+
+// Connections lists the live clients of every running service, or only the one named if name is
+// not empty
+func (g *Group) Connections(name string) ([]Connection, error) {
+	g.mutex.Lock()
+	members := append([]member(nil), g.members...)
+	g.mutex.Unlock()
+
+	connections := make([]Connection, 0)
+	found := name == ""
+	for _, m := range members {
+		if m.srv == nil || (name != "" && m.def.Name != name) {
+			continue
+		}
+		found = true
+		inspector, ok := m.srv.(Inspector)
+		if !ok {
+			continue
+		}
+		for _, session := range inspector.Sessions() {
+			connections = append(connections, Connection{Service: m.def.Name, SessionInfo: session})
+		}
+	}
+	if !found {
+		return nil, ErrUnknownService
+	}
+	return connections, nil
+}
+
+// Disconnect forcibly closes the client of service name with id
+func (g *Group) Disconnect(name string, id uint64) error {
+	g.mutex.Lock()
+	members := append([]member(nil), g.members...)
+	g.mutex.Unlock()
+
+	for _, m := range members {
+		if m.srv == nil || m.def.Name != name {
+			continue
+		}
+		inspector, ok := m.srv.(Inspector)
+		if !ok {
+			return ErrNotInspectable
+		}
+		if !inspector.Disconnect(id) {
+			return ErrUnknownConnection
+		}
+		return nil
+	}
+	return ErrUnknownService
+}
+
+// Stop stops every service at once and waits for them until ctx expires
+func (g *Group) Stop(ctx context.Context) error {
+	g.mutex.Lock()
+	members := append([]member(nil), g.members...)
+	g.stopped = true
+	g.mutex.Unlock()
+
+	errs := make([]error, len(members))
+	var wg sync.WaitGroup
+	for i, m := range members {
+		if m.srv == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m.srv.Stop(ctx); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", m.def.Name, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
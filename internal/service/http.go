@@ -0,0 +1,90 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// report is the body of the health endpoints
+type report struct {
+	OK       bool     `json:"ok"`
+	Services []Status `json:"services"`
+}
+
+// StatusHandler serves the status of every service as JSON
+func (g *Group) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(g.Status(r.Context()))
+	})
+}
+
+// ConnectionsHandler serves the live clients of every service as JSON. A service query parameter
+// limits the list to one service
+func (g *Group) ConnectionsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connections, err := g.Connections(r.URL.Query().Get("service"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(connections)
+	})
+}
+
+// DisconnectHandler closes the client given by the service and id path values. Register it with
+// a pattern such as "DELETE /connections/{service}/{id}"
+func (g *Group) DisconnectHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid connection id", http.StatusBadRequest)
+			return
+		}
+		err = g.Disconnect(r.PathValue("service"), id)
+		switch {
+		case errors.Is(err, ErrNotInspectable):
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+}
+
+// HealthHandler answers 200 while no service has failed, and 503 otherwise. A degraded service
+// is still serving and a stopped one is draining, so neither fails the check
+func (g *Group) HealthHandler() http.Handler {
+	return g.reportHandler(func(state State) bool {
+		return state != Failed
+	})
+}
+
+// ReadyHandler answers 200 only while every service is listening without problems, and 503
+// otherwise. It fails once shutdown starts so traffic can be moved away
+func (g *Group) ReadyHandler() http.Handler {
+	return g.reportHandler(func(state State) bool {
+		return state == Listening
+	})
+}
+
+// reportHandler serves every service's status, failing the request if accept rejects any state
+func (g *Group) reportHandler(accept func(state State) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := report{OK: true, Services: g.Status(r.Context())}
+		for _, status := range body.Services {
+			if !accept(status.State) {
+				body.OK = false
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !body.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(body)
+	})
+}
@@ -0,0 +1,150 @@
+// Package service is the registry of firewatch services. Each service package registers itself
+// from init, so adding a service only needs an import of its package
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/capture"
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/server"
+)
+
+// Transport is the network protocol a service listens on
+type Transport string
+
+const (
+	TCP Transport = "tcp"
+	UDP Transport = "udp"
+)
+
+// Service is implemented by every firewatch server
+type Service interface {
+	Start(address string) error
+	Addr() net.Addr // nil before the service has started
+	Stop(ctx context.Context) error
+	Metrics() *metrics.Service
+	SetLogger(logger *slog.Logger)
+}
+
+// Limited is implemented by services that accept connection limits
+type Limited interface {
+	SetLimits(limits server.Limits)
+}
+
+// Secured is implemented by services that can be served over TLS
+type Secured interface {
+	SetTLS(t *server.TLS)
+}
+
+// Proxied is implemented by services that can read the client address from a PROXY header
+type Proxied interface {
+	SetProxyProtocol(enabled bool)
+}
+
+// Recorded is implemented by services that can capture their traffic
+type Recorded interface {
+	SetRecorder(r *capture.Recorder)
+}
+
+// Checker is implemented by services that can tell whether they are working beyond accepting
+// connections, such as whether their upstream is reachable
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// Exited is implemented by services that can tell when they have stopped serving on their own.
+// Err returns why, or nil while the service is serving
+type Exited interface {
+	Err() error
+}
+
+// Inspector is implemented by services that can list their live clients and disconnect them
+type Inspector interface {
+	Sessions() []server.SessionInfo
+	Disconnect(id uint64) bool
+}
+
+// Stateful is implemented by services that keep client state in memory, which a restart would
+// lose. Handoff stops serving without ending client sessions and writes the state a new process
+// needs to carry on. Restore loads that state, and is called before Start
+type Stateful interface {
+	Handoff(ctx context.Context, w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+// Options are the settings a service is created with. Each service reads the ones it uses
+type Options struct {
+	Upstream       string        // host:port of the upstream server
+	DataDir        string        // Storage directory
+	MaxBytes       int64         // Per connection byte quota
+	SessionTimeout time.Duration // Idle session expiry
+}
+
+// Definition describes a service and how to create it
+type Definition struct {
+	Name      string
+	Transport Transport
+	Port      int     // Default listening port
+	Defaults  Options // A service without a default upstream does not take one
+	Storage   bool    // Whether the service keeps data in Options.DataDir
+	Disabled  bool    // Only started when the config enables it
+	New       func(options Options) Service
+}
+
+var (
+	mutex       sync.RWMutex
+	definitions = make(map[string]Definition)
+)
+
+// Register makes a service available to firewatch. It is meant to be called from init, so it
+// panics if the definition is incomplete or the name is already taken
+func Register(def Definition) {
+	if def.Name == "" || def.New == nil {
+		panic("service: Register needs a name and a constructor")
+	}
+	if def.Transport != TCP && def.Transport != UDP {
+		panic(fmt.Sprintf("service: %s has unknown transport %q", def.Name, def.Transport))
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if _, exists := definitions[def.Name]; exists {
+		panic(fmt.Sprintf("service: %s is registered twice", def.Name))
+	}
+	definitions[def.Name] = def
+}
+
+// Lookup returns the definition of a registered service
+func Lookup(name string) (Definition, bool) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	def, ok := definitions[name]
+	return def, ok
+}
+
+// Definitions returns every registered service in port order
+func Definitions() []Definition {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	defs := make([]Definition, 0, len(definitions))
+	for _, def := range definitions {
+		defs = append(defs, def)
+	}
+	sort.Slice(defs, func(i, j int) bool {
+		if defs[i].Port != defs[j].Port {
+			return defs[i].Port < defs[j].Port
+		}
+		return defs[i].Name < defs[j].Name
+	})
+	return defs
+}
@@ -0,0 +1,85 @@
+package smoketest
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net"
+
+	"github.com/JeremyFenwick/firewatch/internal/logging"
+	"github.com/JeremyFenwick/firewatch/internal/service"
+)
+
+// The most a chargen datagram carries, as RFC 864 suggests
+const maxChargenDatagram = 512
+
+func init() {
+	service.Register(service.Definition{
+		Name:      "chargen",
+		Transport: service.TCP,
+		Port:      5015,
+		Disabled:  true,
+		New:       func(o service.Options) service.Service { return NewChargenServer(o.MaxBytes) },
+	})
+	service.Register(service.Definition{
+		Name:      "chargen-udp",
+		Transport: service.UDP,
+		Port:      5016,
+		Disabled:  true,
+		New:       func(service.Options) service.Service { return NewChargenPacketServer() },
+	})
+}
+
+// chargenCycle is the pattern RFC 864 suggests: 72 character lines of the 95 printable ASCII
+// characters, each starting one character further on. It repeats after 95 lines
+var chargenCycle = func() []byte {
+	const printable, lineLength = 95, 72
+	var cycle []byte
+	for line := range printable {
+		for i := range lineLength {
+			cycle = append(cycle, byte(' '+(line+i)%printable))
+		}
+		cycle = append(cycle, '\r', '\n')
+	}
+	return cycle
+}()
+
+// chargenReader reads the chargen pattern forever
+type chargenReader struct {
+	offset int
+}
+
+func (r *chargenReader) Read(b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		copied := copy(b[n:], chargenCycle[r.offset:])
+		n += copied
+		r.offset = (r.offset + copied) % len(chargenCycle)
+	}
+	return n, nil
+}
+
+// NewChargenServer creates a character generator server (RFC 864), which sends the chargen
+// pattern until the client hangs up. What the client sends is ignored. Connections are closed
+// after maxBytes, or left open if it is 0
+func NewChargenServer(maxBytes int64) *Server {
+	return newServer("chargen", "Character generator", func(ctx context.Context, conn net.Conn) {
+		defer conn.Close()
+		logger := logging.FromContext(ctx)
+
+		n, err := io.Copy(conn, quota(&chargenReader{}, maxBytes))
+		if err != nil {
+			logger.Debug("Stopped generating characters", "bytes", n, "error", err)
+			return
+		}
+		logger.Info("Byte quota reached. Closing connection", "bytes", n)
+	})
+}
+
+// NewChargenPacketServer creates a UDP character generator, which answers every datagram with a
+// random length of the chargen pattern, up to 512 bytes
+func NewChargenPacketServer() *PacketServer {
+	return newPacketServer("chargen-udp", "UDP character generator", func([]byte) []byte {
+		return chargenCycle[:rand.IntN(maxChargenDatagram+1)]
+	})
+}
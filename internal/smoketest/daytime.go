@@ -0,0 +1,94 @@
+package smoketest
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/logging"
+	"github.com/JeremyFenwick/firewatch/internal/service"
+)
+
+// DaytimeLayout is the format of a daytime reply. RFC 867 leaves it open, so this is the one it
+// gives as an example
+const DaytimeLayout = "Monday, January 2, 2006 15:04:05-MST"
+
+// Seconds from 1900, where RFC 868 time starts, to the Unix epoch
+const timeEpoch = 2208988800
+
+func init() {
+	service.Register(service.Definition{
+		Name:      "daytime",
+		Transport: service.TCP,
+		Port:      5017,
+		Disabled:  true,
+		New:       func(service.Options) service.Service { return NewDaytimeServer() },
+	})
+	service.Register(service.Definition{
+		Name:      "daytime-udp",
+		Transport: service.UDP,
+		Port:      5018,
+		Disabled:  true,
+		New:       func(service.Options) service.Service { return NewDaytimePacketServer() },
+	})
+	service.Register(service.Definition{
+		Name:      "time",
+		Transport: service.TCP,
+		Port:      5019,
+		Disabled:  true,
+		New:       func(service.Options) service.Service { return NewTimeServer() },
+	})
+	service.Register(service.Definition{
+		Name:      "time-udp",
+		Transport: service.UDP,
+		Port:      5020,
+		Disabled:  true,
+		New:       func(service.Options) service.Service { return NewTimePacketServer() },
+	})
+}
+
+// NewDaytimeServer creates a daytime server (RFC 867), which sends the time as a line of text and
+// closes the connection
+func NewDaytimeServer() *Server {
+	return newServer("daytime", "Daytime", func(ctx context.Context, conn net.Conn) {
+		reply(ctx, conn, daytime())
+	})
+}
+
+// NewDaytimePacketServer creates a UDP daytime server, which answers every datagram with the time
+// as a line of text
+func NewDaytimePacketServer() *PacketServer {
+	return newPacketServer("daytime-udp", "UDP daytime", func([]byte) []byte { return daytime() })
+}
+
+// NewTimeServer creates a time server (RFC 868), which sends the seconds since 1900 as a 32 bit
+// big endian number and closes the connection
+func NewTimeServer() *Server {
+	return newServer("time", "Time", func(ctx context.Context, conn net.Conn) {
+		reply(ctx, conn, seconds())
+	})
+}
+
+// NewTimePacketServer creates a UDP time server, which answers every datagram with the seconds
+// since 1900
+func NewTimePacketServer() *PacketServer {
+	return newPacketServer("time-udp", "UDP time", func([]byte) []byte { return seconds() })
+}
+
+func daytime() []byte {
+	return []byte(time.Now().Format(DaytimeLayout) + "\r\n")
+}
+
+// seconds is the RFC 868 time. It wraps around in 2036, which clients are expected to handle
+func seconds() []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(time.Now().Unix()+timeEpoch))
+}
+
+// reply sends message and closes the connection
+func reply(ctx context.Context, conn net.Conn, message []byte) {
+	defer conn.Close()
+	if _, err := conn.Write(message); err != nil {
+		logging.FromContext(ctx).Debug("Error writing to client", "error", err)
+	}
+}
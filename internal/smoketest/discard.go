@@ -0,0 +1,56 @@
+package smoketest
+
+import (
+	"context"
+	"io"
+	"net"
+
+	"github.com/JeremyFenwick/firewatch/internal/logging"
+	"github.com/JeremyFenwick/firewatch/internal/service"
+)
+
+func init() {
+	service.Register(service.Definition{
+		Name:      "discard",
+		Transport: service.TCP,
+		Port:      5013,
+		Disabled:  true,
+		New:       func(o service.Options) service.Service { return NewDiscardServer(o.MaxBytes) },
+	})
+	service.Register(service.Definition{
+		Name:      "discard-udp",
+		Transport: service.UDP,
+		Port:      5014,
+		Disabled:  true,
+		New:       func(service.Options) service.Service { return NewDiscardPacketServer() },
+	})
+}
+
+// NewDiscardServer creates a discard server (RFC 863), which reads and throws away everything sent
+// to it. Connections are closed after maxBytes, or left open if it is 0
+func NewDiscardServer(maxBytes int64) *Server {
+	return newServer("discard", "Discard", func(ctx context.Context, conn net.Conn) {
+		defer conn.Close()
+		logger := logging.FromContext(ctx)
+
+		n, err := io.Copy(io.Discard, quota(conn, maxBytes))
+		if err != nil {
+			logger.Debug("Error reading from client", "bytes", n, "error", err)
+			return
+		}
+		logger.Debug("Discarded connection", "bytes", n)
+	})
+}
+
+// NewDiscardPacketServer creates a UDP discard server, which never replies
+func NewDiscardPacketServer() *PacketServer {
+	return newPacketServer("discard-udp", "UDP discard", func([]byte) []byte { return nil })
+}
+
+// quota limits r to maxBytes, or leaves it as it is if maxBytes is 0
+func quota(r io.Reader, maxBytes int64) io.Reader {
+	if maxBytes <= 0 {
+		return r
+	}
+	return io.LimitReader(r, maxBytes)
+}
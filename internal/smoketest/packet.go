@@ -0,0 +1,199 @@
+package smoketest
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/capture"
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/JeremyFenwick/firewatch/internal/service"
+)
+
+// Big enough for any UDP payload
+const maxDatagram = 64 * 1024
+
+func init() {
+	service.Register(service.Definition{
+		Name:      "smoketest-udp",
+		Transport: service.UDP,
+		Port:      5012,
+		Disabled:  true,
+		New:       func(service.Options) service.Service { return NewEchoPacketServer() },
+	})
+}
+
+// replyFunc answers a datagram. A nil reply sends nothing back
+type replyFunc func(request []byte) []byte
+
+// PacketServer is the UDP side of the echo and diagnostic services. Each datagram is answered on
+// its own, so the server keeps no state between them
+type PacketServer struct {
+	title         string // Used in log messages
+	reply         replyFunc
+	metrics       *metrics.Service
+	logger        *slog.Logger
+	mutex         sync.Mutex
+	udp           net.PacketConn
+	recorder      *capture.Recorder
+	proxyProtocol bool
+	done          chan struct{}
+	stopping      bool
+}
+
+// NewEchoPacketServer creates a UDP echo server (RFC 862), which sends every datagram back
+func NewEchoPacketServer() *PacketServer {
+	return newPacketServer("smoketest-udp", "UDP echo", func(request []byte) []byte { return request })
+}
+
+func newPacketServer(name, title string, reply replyFunc) *PacketServer {
+	return &PacketServer{
+		title:   title,
+		reply:   reply,
+		metrics: metrics.NewService(name),
+		logger:  slog.Default().With("service", name),
+	}
+}
+
+// Serve answers datagrams on udp until the server is stopped. The socket is closed on return
+func (s *PacketServer) Serve(udp net.PacketConn) error {
+	udp = s.instrument(udp)
+	if err := s.attach(udp); err != nil {
+		return err
+	}
+	s.logger.Info(s.title+" now listening", "address", udp.LocalAddr().String())
+	return s.serve(udp)
+}
+
+// Start listens on address and serves in the background. Use port 0 to pick a free port
+func (s *PacketServer) Start(address string) error {
+	udp, err := server.ListenPacket(address)
+	if err != nil {
+		return err
+	}
+	udp = s.instrument(udp)
+	if err := s.attach(udp); err != nil {
+		return err
+	}
+	s.logger.Info(s.title+" now listening", "address", udp.LocalAddr().String())
+	go s.serve(udp)
+	return nil
+}
+
+// Addr returns the address being listened on, or nil if the server has not started
+func (s *PacketServer) Addr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.udp == nil {
+		return nil
+	}
+	return s.udp.LocalAddr()
+}
+
+// Metrics returns the server's counters so they can be added to a metrics.Registry
+func (s *PacketServer) Metrics() *metrics.Service {
+	return s.metrics
+}
+
+// SetLogger replaces the server's logger. Call it before the server is started
+func (s *PacketServer) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+}
+
+// SetRecorder captures every datagram to r. Call it before the server is started
+func (s *PacketServer) SetRecorder(r *capture.Recorder) {
+	s.recorder = r
+}
+
+// SetProxyProtocol expects every datagram to start with a PROXY protocol v2 header giving the
+// real client address. Call it before the server is started
+func (s *PacketServer) SetProxyProtocol(enabled bool) {
+	s.proxyProtocol = enabled
+}
+
+// instrument wraps udp so proxy headers are stripped, its traffic is counted and, if a recorder
+// is set, captured
+func (s *PacketServer) instrument(udp net.PacketConn) net.PacketConn {
+	if s.proxyProtocol {
+		udp = server.ProxyPacketConn(udp)
+	}
+	if s.recorder != nil {
+		udp = s.recorder.PacketConn(udp)
+	}
+	return metrics.CountPacketConn(udp, s.metrics)
+}
+
+func (s *PacketServer) attach(udp net.PacketConn) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopping {
+		udp.Close()
+		return server.ErrServerClosed
+	}
+	if s.udp != nil {
+		udp.Close()
+		return server.ErrServerStarted
+	}
+	s.udp = udp
+	s.done = make(chan struct{})
+	return nil
+}
+
+func (s *PacketServer) serve(udp net.PacketConn) error {
+	defer close(s.done)
+	defer udp.Close()
+
+	buffer := make([]byte, maxDatagram)
+	for {
+		n, sender, err := udp.ReadFrom(buffer)
+		if err != nil {
+			if s.isStopping() || errors.Is(err, net.ErrClosed) {
+				return server.ErrServerClosed
+			}
+			s.logger.Warn("Could not receive packet, continuing", "error", err)
+			continue
+		}
+		// Replies are cheap, so they are sent from the read loop
+		reply := s.reply(buffer[:n])
+		if reply == nil {
+			continue
+		}
+		if _, err := udp.WriteTo(reply, sender); err != nil {
+			s.logger.Debug("Could not reply", "remote", sender.String(), "error", err)
+		}
+	}
+}
+
+func (s *PacketServer) isStopping() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.stopping
+}
+
+// Stop stops reading datagrams and closes the socket, or closes it straight away when ctx expires
+func (s *PacketServer) Stop(ctx context.Context) error {
+	s.mutex.Lock()
+	s.stopping = true
+	udp, done := s.udp, s.done
+	s.mutex.Unlock()
+	if udp == nil {
+		return nil
+	}
+	// Unblock the read loop
+	udp.SetReadDeadline(time.Now())
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		udp.Close()
+		<-done
+		return ctx.Err()
+	}
+}
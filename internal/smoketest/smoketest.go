@@ -1,79 +1,156 @@
 package smoketest
 
 import (
-	"bufio"
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+
+	"github.com/JeremyFenwick/firewatch/internal/capture"
+	"github.com/JeremyFenwick/firewatch/internal/logging"
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/JeremyFenwick/firewatch/internal/service"
 )
 
 const (
-	maxTotalBytes = 1024 * 1024 // 1MB max before disconnecting
-	batchSize     = 4 * 1024    // 4KB per batch
+	DefaultMaxBytes = 1024 * 1024 // Per connection quota unless one is configured
+	spliceChunk     = 64 * 1024   // Bytes echoed between updates to the connection's counters
 )
 
-func Listen(port int) {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+// Server is the TCP side of the echo service and of the diagnostic services that share its
+// acceptor loop
+type Server struct {
+	title   string // Used in log messages
+	metrics *metrics.Service
+	logger  *slog.Logger
+	tcp     server.TCPServer
+}
 
-	listener, err := net.Listen("tcp4", fmt.Sprintf(":%d", port))
-	if err != nil {
-		// Use Fatalf for formatted error messages
-		log.Fatalf("Could not start listener. REASON: %v", err)
+func init() {
+	service.Register(service.Definition{
+		Name:      "smoketest",
+		Transport: service.TCP,
+		Port:      5000,
+		Defaults:  service.Options{MaxBytes: DefaultMaxBytes},
+		New:       func(o service.Options) service.Service { return NewServer(o.MaxBytes) },
+	})
+}
+
+// NewServer creates an echo server. Connections are closed after echoing maxBytes, their quota
+func NewServer(maxBytes int64) *Server {
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
 	}
-	log.Printf("Smoke test now listening on port %d\n", port)
-	defer listener.Close()
+	return newServer("smoketest", "Smoke test", func(ctx context.Context, conn net.Conn) {
+		handleConnection(ctx, conn, maxBytes)
+	})
+}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			// Use Printf for formatted error messages
-			log.Printf("Encountered error accepting connection. REASON: %v", err)
-			continue
-		}
+func newServer(name, title string, handler server.Handler) *Server {
+	s := &Server{title: title, metrics: metrics.NewService(name)}
+	s.tcp.Metrics = s.metrics
+	s.SetLogger(slog.Default().With("service", name))
+	s.tcp.Handler = handler
+	return s
+}
 
-		go handleConnection(conn)
+// Serve accepts connections on listener until the server is stopped
+func (s *Server) Serve(listener net.Listener) error {
+	s.logger.Info(s.title+" now listening", "address", listener.Addr().String())
+	return s.tcp.Serve(listener)
+}
+
+// Start listens on address and serves in the background. Use port 0 to pick a free port
+func (s *Server) Start(address string) error {
+	listener, err := server.Listen(address)
+	if err != nil {
+		return fmt.Errorf("could not start listener: %w", err)
 	}
+	s.logger.Info(s.title+" now listening", "address", listener.Addr().String())
+	return s.tcp.Start(listener)
+}
+
+// Addr returns the listening address, or nil before the server has started
+func (s *Server) Addr() net.Addr {
+	return s.tcp.Addr()
+}
+
+// Err returns why the server stopped accepting connections on its own, or nil while it is serving
+func (s *Server) Err() error {
+	return s.tcp.Err()
+}
+
+// Metrics returns the server's counters so they can be added to a metrics.Registry
+func (s *Server) Metrics() *metrics.Service {
+	return s.metrics
+}
+
+// SetLogger replaces the server's logger. Call it before the server is started
+func (s *Server) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+	s.tcp.Logger = logger
+}
+
+// SetLimits sets the connection limits. Call it before the server is started
+func (s *Server) SetLimits(limits server.Limits) {
+	s.tcp.Limits = limits
+}
+
+// SetTLS serves every connection over TLS. Call it before the server is started
+func (s *Server) SetTLS(t *server.TLS) {
+	s.tcp.TLS = t
 }
 
-func handleConnection(conn net.Conn) {
+// SetProxyProtocol expects connections to open with a PROXY protocol header giving the real client
+// address. Call it before the server is started
+func (s *Server) SetProxyProtocol(enabled bool) {
+	s.tcp.ProxyProtocol = enabled
+}
+
+// SetRecorder captures the traffic of every connection to r. Call it before the server is started
+func (s *Server) SetRecorder(r *capture.Recorder) {
+	s.tcp.Recorder = r
+}
+
+// Sessions lists the connected clients
+func (s *Server) Sessions() []server.SessionInfo {
+	return s.tcp.Sessions()
+}
+
+// Disconnect closes the client connection with id. Returns false if there is none
+func (s *Server) Disconnect(id uint64) bool {
+	return s.tcp.Disconnect(id)
+}
+
+// Stop stops accepting connections and waits for open ones to finish until ctx expires
+func (s *Server) Stop(ctx context.Context) error {
+	return s.tcp.Stop(ctx)
+}
+
+func handleConnection(ctx context.Context, conn net.Conn, maxBytes int64) {
 	defer conn.Close()
-	log.Printf("Handling connection from %s", conn.RemoteAddr())
-
-	reader := bufio.NewReader(conn)
-	totalBytes := 0
-	buffer := make([]byte, batchSize)
-
-	for {
-		// Read a batch
-		n, err := reader.Read(buffer)
-		if n > 0 {
-			totalBytes += n
-
-			// Echo the batch back
-			_, writeErr := conn.Write(buffer[:n])
-			if writeErr != nil {
-				log.Printf("Error writing to %s: %v", conn.RemoteAddr(), writeErr)
-				return
-			}
-
-			log.Printf("Echoed %d bytes to %s: %s", n, conn.RemoteAddr(), string(buffer[:n]))
-		}
+	logger := logging.FromContext(ctx)
 
-		// Stop if we reached max allowed bytes
-		if totalBytes >= maxTotalBytes {
-			log.Printf("Max byte limit reached for %s. Closing connection.", conn.RemoteAddr())
+	// Echo until the client stops sending or uses its quota. A client that half-closes gets the
+	// rest of its bytes back before the connection closes. Copying between the sockets themselves
+	// lets Linux splice the bytes without them passing through the server
+	raw, count := server.Unwrap(conn)
+	var total int64
+	for total < maxBytes {
+		chunk := min(spliceChunk, maxBytes-total)
+		n, err := io.Copy(raw, io.LimitReader(raw, chunk))
+		count(n, n)
+		total += n
+		if err != nil {
+			logger.Debug("Error echoing to client", "bytes", total, "error", err)
 			return
 		}
-
-		// Handle errors or EOF
-		if err != nil {
-			if err == io.EOF {
-				log.Printf("Connection %s closed by client.", conn.RemoteAddr())
-			} else {
-				log.Printf("Error reading from %s: %v", conn.RemoteAddr(), err)
-			}
+		if n < chunk {
+			logger.Debug("Connection closed by client", "bytes", total)
 			return
 		}
 	}
+	logger.Info("Byte quota reached. Closing connection", "bytes", total)
 }
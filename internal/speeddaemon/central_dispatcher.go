@@ -1,11 +1,15 @@
 package speeddaemon
 
 import (
-	"log"
+	"log/slog"
 	"math"
 	"math/rand"
 	"slices"
 	"sort"
+	"sync"
+
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	protocol "github.com/JeremyFenwick/firewatch/pkg/speeddaemon"
 )
 
 type Message interface {
@@ -13,56 +17,78 @@ type Message interface {
 }
 
 type CentralDispatcher struct {
+	quit         chan struct{}
+	quitOnce     sync.Once
 	MessageQueue chan Message
-	Records      map[U16]map[Str][]*Record // Roads -> License -> List of Records
-	Dispatchers  map[U16][]chan<- ClientMessage
-	SpeedLimits  map[U16]U16
-	Tickets      map[Str][]U32
+	Records      map[protocol.U16]map[protocol.Str][]*Record // Roads -> License -> List of Records
+	Dispatchers  map[protocol.U16][]chan<- protocol.ClientMessage
+	SpeedLimits  map[protocol.U16]protocol.U16
+	Tickets      map[protocol.Str][]protocol.U32
+
+	Logger         *slog.Logger
+	TicketsIssued  metrics.Counter
+	TicketsPending metrics.Gauge // Sent to a dispatcher connection but not yet written
 }
 
 type Record struct {
-	Mile U16
-	Time U32
+	Mile protocol.U16
+	Time protocol.U32
 }
 
 type RegisterCamera struct {
-	Road  U16
-	Limit U16
+	Road  protocol.U16
+	Limit protocol.U16
 }
 
 type RegisterDispatcher struct {
-	Roads   []U16
-	Channel chan<- ClientMessage
+	Roads   []protocol.U16
+	Channel chan<- protocol.ClientMessage
+}
+
+type UnregisterDispatcher struct {
+	Channel chan<- protocol.ClientMessage
 }
 
 type Observation struct {
-	Road      U16
-	License   Str
-	Mile      U16
-	Timestamp U32
+	Road      protocol.U16
+	License   protocol.Str
+	Mile      protocol.U16
+	Timestamp protocol.U32
 }
 
 func NewCentralDispatcher() *CentralDispatcher {
 	return &CentralDispatcher{
+		quit:         make(chan struct{}),
 		MessageQueue: make(chan Message, 100),
-		Records:      make(map[U16]map[Str][]*Record),
-		Dispatchers:  make(map[U16][]chan<- ClientMessage),
-		SpeedLimits:  make(map[U16]U16),
-		Tickets:      make(map[Str][]U32),
+		Records:      make(map[protocol.U16]map[protocol.Str][]*Record),
+		Dispatchers:  make(map[protocol.U16][]chan<- protocol.ClientMessage),
+		SpeedLimits:  make(map[protocol.U16]protocol.U16),
+		Tickets:      make(map[protocol.Str][]protocol.U32),
+		Logger:       slog.Default(),
 	}
 }
 
 func (cd *CentralDispatcher) Start() {
-	for msg := range cd.MessageQueue {
-		msg.Process(cd)
+	for {
+		select {
+		case <-cd.quit:
+			return
+		case msg := <-cd.MessageQueue:
+			msg.Process(cd)
+		}
 	}
 }
 
+// Stop ends the Start loop. Messages still queued are dropped
+func (cd *CentralDispatcher) Stop() {
+	cd.quitOnce.Do(func() { close(cd.quit) })
+}
+
 func (rd *RegisterDispatcher) Process(cd *CentralDispatcher) {
-	log.Println("Registering dispatcher with roads", rd.Roads)
+	cd.Logger.Debug("Registering dispatcher", "roads", rd.Roads)
 	for _, road := range rd.Roads {
 		if _, exists := cd.Dispatchers[road]; !exists {
-			cd.Dispatchers[road] = make([]chan<- ClientMessage, 0)
+			cd.Dispatchers[road] = make([]chan<- protocol.ClientMessage, 0)
 		}
 		// Add the dispatcher channel to the list of dispatchers for the road
 		cd.Dispatchers[road] = append(cd.Dispatchers[road], rd.Channel)
@@ -75,19 +101,30 @@ func (rd *RegisterDispatcher) Process(cd *CentralDispatcher) {
 	}
 }
 
+func (ud *UnregisterDispatcher) Process(cd *CentralDispatcher) {
+	cd.Logger.Debug("Unregistering dispatcher")
+	for road, dispatchers := range cd.Dispatchers {
+		cd.Dispatchers[road] = slices.DeleteFunc(dispatchers, func(channel chan<- protocol.ClientMessage) bool {
+			return channel == ud.Channel
+		})
+	}
+	// Ends the dispatcher's listener once it has drained the channel
+	close(ud.Channel)
+}
+
 func (rc *RegisterCamera) Process(cd *CentralDispatcher) {
-	log.Println("Registering camera on road: ", rc.Road, "with limit: ", rc.Limit)
+	cd.Logger.Debug("Registering camera", "road", rc.Road, "limit", rc.Limit)
 	cd.SpeedLimits[rc.Road] = rc.Limit
 	if _, exists := cd.Records[rc.Road]; !exists {
-		cd.Records[rc.Road] = make(map[Str][]*Record, 0)
+		cd.Records[rc.Road] = make(map[protocol.Str][]*Record, 0)
 	}
 }
 
 func (o *Observation) Process(cd *CentralDispatcher) {
-	log.Println("Processing observation. Road: ", o.Road, "License: ", o.License, "Mile: ", o.Mile, "Timestamp: ", o.Timestamp)
+	cd.Logger.Debug("Processing observation", "road", o.Road, "plate", o.License, "mile", o.Mile, "timestamp", o.Timestamp)
 	roadRecords, exists := cd.Records[o.Road]
 	if !exists {
-		log.Printf("Could not register observation. Road %d not registered", o.Road)
+		cd.Logger.Warn("Could not register observation. Road not registered", "road", o.Road)
 		return
 	}
 
@@ -115,29 +152,27 @@ func (o *Observation) Process(cd *CentralDispatcher) {
 	cd.calculateTickets(o.Road, o.License, licenseRecords)
 }
 
-func (cd *CentralDispatcher) calculateTickets(road U16, license Str, licenseRecords []*Record) {
-	log.Printf("Calculating tickets for license %s on road %d", license, road)
+func (cd *CentralDispatcher) calculateTickets(road protocol.U16, license protocol.Str, licenseRecords []*Record) {
 	speedLimit := cd.SpeedLimits[road] * 100
 	for i := 1; i < len(licenseRecords); i++ {
 		lastRecord := *licenseRecords[i-1]
 		currentRecord := *licenseRecords[i]
 		speed := CalculateSpeed(lastRecord, currentRecord)
-		log.Println("Calculating speed. Speed limit", speedLimit, "Speed: ", speed)
 		if speed > speedLimit {
 			cd.generateTicket(license, road, lastRecord, currentRecord, speed)
 		}
 	}
 }
 
-func CalculateSpeed(r1 Record, r2 Record) U16 {
+func CalculateSpeed(r1 Record, r2 Record) protocol.U16 {
 	distance := float64(r2.Mile) - float64(r1.Mile)
 	timeHours := (float64(r2.Time) - float64(r1.Time)) / 3600.0
 	speedMph := distance / timeHours
 	speedHundredths := math.Abs(speedMph * 100)
-	return U16(speedHundredths)
+	return protocol.U16(speedHundredths)
 }
 
-func (cd *CentralDispatcher) generateTicket(license Str, road U16, r1 Record, r2 Record, speed U16) {
+func (cd *CentralDispatcher) generateTicket(license protocol.Str, road protocol.U16, r1 Record, r2 Record, speed protocol.U16) {
 	startDay := r1.Time / 86400
 	endDay := r2.Time / 86400
 	// Check if the ticket is already in the list from the same day
@@ -151,8 +186,8 @@ func (cd *CentralDispatcher) generateTicket(license Str, road U16, r1 Record, r2
 	if len(dispatchers) == 0 {
 		return
 	}
-	log.Println("Generating ticket for license: ", license, "Road: ", road, "Speed: ", speed)
-	ticket := &TicketMessage{
+	cd.Logger.Debug("Generating ticket", "plate", license, "road", road, "speed", speed)
+	ticket := &protocol.TicketMessage{
 		Plate:        license,
 		Road:         road,
 		MileOne:      r1.Mile,
@@ -162,8 +197,9 @@ func (cd *CentralDispatcher) generateTicket(license Str, road U16, r1 Record, r2
 		Speed:        speed,
 	}
 	// Send the ticket to the random dispatcher
-	log.Println("Dispatching ticket to random dispatcher for license: ", license, " on day: ")
 	random := rand.Intn(len(dispatchers))
+	cd.TicketsIssued.Inc()
+	cd.TicketsPending.Inc()
 	dispatchers[random] <- ticket
 	for i := startDay; i <= endDay; i++ {
 		cd.Tickets[license] = append(cd.Tickets[license], i)
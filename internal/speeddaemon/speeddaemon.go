@@ -1,10 +1,19 @@
 package speeddaemon
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"sync"
 	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/capture"
+	"github.com/JeremyFenwick/firewatch/internal/logging"
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/JeremyFenwick/firewatch/internal/service"
+	protocol "github.com/JeremyFenwick/firewatch/pkg/speeddaemon"
 )
 
 const (
@@ -18,120 +27,218 @@ type ConnKind int
 type Connection struct {
 	Conn       net.Conn
 	ConnKind   ConnKind
-	Limit      U16 // For a camera only
-	Road       U16 // For a camera only
-	Mile       U16 // For a camera only
+	Limit      protocol.U16 // For a camera only
+	Road       protocol.U16 // For a camera only
+	Mile       protocol.U16 // For a camera only
 	HBInterval float64
-}
-
-func Listen(port int) {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	Tickets    chan protocol.ClientMessage // For a dispatcher only
 
-	listener, err := net.Listen("tcp4", fmt.Sprintf(":%d", port))
-	if err != nil {
-		// Use Fatalf for formatted error messages
-		log.Fatalf("Could not start listener. REASON: %v", err)
-	}
-	log.Printf("Speed daemon now listening on port %d\n", port)
-	defer listener.Close()
+	metrics *metrics.Service
+	logger  *slog.Logger
+	session *server.Session
+}
 
-	dispatcher := NewCentralDispatcher()
-	go dispatcher.Start()
+type Server struct {
+	dispatcher     *CentralDispatcher
+	dispatcherOnce sync.Once
+	metrics        *metrics.Service
+	logger         *slog.Logger
+	tcp            server.TCPServer
+}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			// Use Printf for formatted error messages
-			log.Printf("Encountered error accepting connection. REASON: %v", err)
-			continue
-		}
+func init() {
+	service.Register(service.Definition{
+		Name:      "speeddaemon",
+		Transport: service.TCP,
+		Port:      5006,
+		New:       func(service.Options) service.Service { return NewServer() },
+	})
+}
 
+func NewServer() *Server {
+	s := &Server{
+		dispatcher: NewCentralDispatcher(),
+		metrics:    metrics.NewService("speeddaemon"),
+	}
+	s.metrics.RegisterCounter("speeddaemon_tickets_issued_total", "Tickets handed to a dispatcher", &s.dispatcher.TicketsIssued)
+	s.metrics.RegisterGauge("speeddaemon_tickets_pending", "Tickets waiting to be written to a dispatcher", &s.dispatcher.TicketsPending)
+	s.tcp.Metrics = s.metrics
+	s.SetLogger(slog.Default().With("service", "speeddaemon"))
+	s.tcp.Handler = func(ctx context.Context, conn net.Conn) {
 		connection := &Connection{
 			Conn:       conn,
 			ConnKind:   unknown,
 			HBInterval: 0,
+			metrics:    s.metrics,
+			logger:     logging.FromContext(ctx),
+			session:    server.SessionFromContext(ctx),
 		}
+		handleConnection(connection, s.dispatcher)
+	}
+	return s
+}
 
-		go handleConnection(connection, dispatcher)
+// Serve accepts connections on listener until the server is stopped
+func (s *Server) Serve(listener net.Listener) error {
+	s.logger.Info("Speed daemon now listening", "address", listener.Addr().String())
+	s.startDispatcher()
+	return s.tcp.Serve(listener)
+}
+
+// Start listens on address and serves in the background. Use port 0 to pick a free port
+func (s *Server) Start(address string) error {
+	listener, err := server.Listen(address)
+	if err != nil {
+		return fmt.Errorf("could not start listener: %w", err)
 	}
+	s.logger.Info("Speed daemon now listening", "address", listener.Addr().String())
+	s.startDispatcher()
+	return s.tcp.Start(listener)
+}
+
+func (s *Server) startDispatcher() {
+	s.dispatcherOnce.Do(func() { go s.dispatcher.Start() })
+}
+
+// Addr returns the listening address, or nil before the server has started
+func (s *Server) Addr() net.Addr {
+	return s.tcp.Addr()
+}
+
+// Err returns why the server stopped accepting connections on its own, or nil while it is serving
+func (s *Server) Err() error {
+	return s.tcp.Err()
+}
+
+// Metrics returns the server's counters so they can be added to a metrics.Registry
+func (s *Server) Metrics() *metrics.Service {
+	return s.metrics
+}
+
+// SetLogger replaces the server's logger. Call it before the server is started
+func (s *Server) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+	s.dispatcher.Logger = logger
+	s.tcp.Logger = logger
+}
+
+// SetLimits sets the connection limits. Call it before the server is started
+func (s *Server) SetLimits(limits server.Limits) {
+	s.tcp.Limits = limits
+}
+
+// SetTLS serves every connection over TLS. Call it before the server is started
+func (s *Server) SetTLS(t *server.TLS) {
+	s.tcp.TLS = t
+}
+
+// SetProxyProtocol expects connections to open with a PROXY protocol header giving the real client
+// address. Call it before the server is started
+func (s *Server) SetProxyProtocol(enabled bool) {
+	s.tcp.ProxyProtocol = enabled
+}
+
+// SetRecorder captures the traffic of every connection to r. Call it before the server is started
+func (s *Server) SetRecorder(r *capture.Recorder) {
+	s.tcp.Recorder = r
+}
+
+// Sessions lists the connected clients
+func (s *Server) Sessions() []server.SessionInfo {
+	return s.tcp.Sessions()
+}
+
+// Disconnect closes the client connection with id. Returns false if there is none
+func (s *Server) Disconnect(id uint64) bool {
+	return s.tcp.Disconnect(id)
+}
+
+// Stop stops accepting connections and waits for cameras and dispatchers to leave until ctx expires
+func (s *Server) Stop(ctx context.Context) error {
+	err := s.tcp.Stop(ctx)
+	s.dispatcher.Stop()
+	return err
 }
 
 func handleConnection(connection *Connection, dispatcher *CentralDispatcher) {
 	defer connection.Conn.Close()
+	defer func() {
+		// Stop sending tickets to a dispatcher that has gone
+		if connection.Tickets != nil {
+			dispatcher.MessageQueue <- &UnregisterDispatcher{Channel: connection.Tickets}
+		}
+	}()
 	buffer := make([]byte, 0, 1024) // Adjust buffer size as needed
 
 	for {
 		data := make([]byte, 1024)
 		n, err := connection.Conn.Read(data)
 		if err != nil {
-			log.Printf("Error reading from %s: %v", connection.Conn.RemoteAddr(), err)
+			connection.logger.Debug("Error reading from client", "error", err)
 			return
 		}
 		buffer = append(buffer, data[:n]...)
-		sfBuffer := NewSdBuffer(buffer)
-		messages, extractedBytes := ExtractFromSbBuffer(sfBuffer)
+		sfBuffer := protocol.NewSdBuffer(buffer)
+		messages, extractedBytes := protocol.ExtractFromSbBuffer(sfBuffer)
 		buffer = buffer[extractedBytes:]
 		processMessages(messages, connection, dispatcher)
 	}
 }
 
-func processMessages(messages []ClientMessage, connection *Connection, dispatcher *CentralDispatcher) {
+func processMessages(messages []protocol.ClientMessage, connection *Connection, dispatcher *CentralDispatcher) {
 	for _, message := range messages {
 		switch message.GetType() {
-		case IAmCameraType:
-			log.Printf("Received IAmCameraMessage from %s", connection.Conn.RemoteAddr())
-			registerCamera(message.(*IAmCameraMessage), connection, dispatcher)
-		case IAmDispatcherType:
-			log.Printf("Received IAmDispatcherMessage from %s", connection.Conn.RemoteAddr())
-			channel := registerDispatcher(message.(*IAmDispatcherMessage), connection, dispatcher)
+		case protocol.IAmCameraType:
+			registerCamera(message.(*protocol.IAmCameraMessage), connection, dispatcher)
+		case protocol.IAmDispatcherType:
+			channel := registerDispatcher(message.(*protocol.IAmDispatcherMessage), connection, dispatcher)
 			if channel == nil {
-				log.Printf("Failed to register dispatcher for %s", connection.Conn.RemoteAddr())
+				connection.logger.Debug("Failed to register dispatcher")
 				return
 			}
-			go dispatcherListener(channel, connection)
-		case PlateMsgType:
-			log.Printf("Received PlateMessage from %s", connection.Conn.RemoteAddr())
-			handlePlateMessage(message.(*PlateMessage), connection, dispatcher)
-		case WantHeartbeatType:
-			log.Printf("Received WantHeartbeatMessage from %s", connection.Conn.RemoteAddr())
-			handleHeartbeatRequest(message.(*WantHeartbeatMessage), connection)
+			connection.Tickets = channel
+			go dispatcherListener(channel, connection, dispatcher)
+		case protocol.PlateMsgType:
+			handlePlateMessage(message.(*protocol.PlateMessage), connection, dispatcher)
+		case protocol.WantHeartbeatType:
+			handleHeartbeatRequest(message.(*protocol.WantHeartbeatMessage), connection)
 		default:
-			log.Printf("Received unknown message type from %s: %d", connection.Conn.RemoteAddr(), message.GetType())
+			connection.logger.Debug("Received unknown message type", "type", message.GetType())
 			sendError("Unknown message. Closing connection", connection)
+			connection.Conn.Close()
 			return
 		}
 	}
 }
 
-func handleHeartbeatRequest(wantHeartbeatMessage *WantHeartbeatMessage, connection *Connection) {
+func handleHeartbeatRequest(wantHeartbeatMessage *protocol.WantHeartbeatMessage, connection *Connection) {
 	if connection.HBInterval != 0 {
 		sendError("Already registered a heartbeat to this connection", connection)
 		connection.Conn.Close()
 		return
 	}
 	connection.HBInterval = float64(wantHeartbeatMessage.Interval) * 0.1
-	log.Printf("Received WantHeartbeatMessage from %s with interval %f", connection.Conn.RemoteAddr(), connection.HBInterval)
+	connection.logger.Debug("Heartbeat requested", "interval", connection.HBInterval)
 	go heartbeat(connection)
 }
 
 func heartbeat(connection *Connection) {
-	heartbeat := &HeartbeatMessage{}
+	heartbeat := &protocol.HeartbeatMessage{}
 	encoded, err := heartbeat.Encode()
 	if err != nil {
-		log.Printf("Error encoding heartbeat message: %v", err)
+		connection.logger.Error("Error encoding heartbeat message", "error", err)
 		return
 	}
 	for range time.Tick(time.Duration(connection.HBInterval * float64(time.Second))) {
 		_, err := connection.Conn.Write(encoded)
 		if err != nil {
-			log.Printf("Error sending heartbeat message: %v", err)
+			connection.logger.Debug("Error sending heartbeat message", "error", err)
 			return
 		}
-		// log.Printf("Sent heartbeat to %s", connection.Conn.RemoteAddr())
 	}
 }
 
-func handlePlateMessage(plateMessage *PlateMessage, connection *Connection, dispatcher *CentralDispatcher) {
+func handlePlateMessage(plateMessage *protocol.PlateMessage, connection *Connection, dispatcher *CentralDispatcher) {
 	if connection.ConnKind != camera {
 		sendError("Only cameras can send plate messages", connection)
 		connection.Conn.Close()
@@ -145,7 +252,7 @@ func handlePlateMessage(plateMessage *PlateMessage, connection *Connection, disp
 	}
 }
 
-func registerCamera(message *IAmCameraMessage, connection *Connection, dispatcher *CentralDispatcher) {
+func registerCamera(message *protocol.IAmCameraMessage, connection *Connection, dispatcher *CentralDispatcher) {
 	if connection.ConnKind != unknown {
 		sendError("Already registered this connection", connection)
 		connection.Conn.Close()
@@ -159,55 +266,60 @@ func registerCamera(message *IAmCameraMessage, connection *Connection, dispatche
 		Road:  message.Road,
 		Limit: message.Limit,
 	}
-	log.Printf("Registering camera on road %d at mile %d with limit %d", message.Road, message.Mile, message.Limit)
+	connection.session.SetIdentity(fmt.Sprintf("camera road %d mile %d limit %d", message.Road, message.Mile, message.Limit))
+	connection.logger.Debug("Registering camera", "road", message.Road, "mile", message.Mile, "limit", message.Limit)
 }
 
-func registerDispatcher(message *IAmDispatcherMessage, connection *Connection, dispatcher *CentralDispatcher) chan ClientMessage {
+func registerDispatcher(message *protocol.IAmDispatcherMessage, connection *Connection, dispatcher *CentralDispatcher) chan protocol.ClientMessage {
 	if connection.ConnKind != unknown {
 		sendError("Already registered this connection", connection)
 		connection.Conn.Close()
 		return nil
 	}
 	connection.ConnKind = ticketDispatcher
-	dispatchChannel := make(chan ClientMessage, 10)
+	dispatchChannel := make(chan protocol.ClientMessage, 10)
 	dispatcher.MessageQueue <- &RegisterDispatcher{
 		Roads:   message.Roads,
 		Channel: dispatchChannel,
 	}
-	log.Printf("Registering dispatcher with roads %v", message.Roads)
+	connection.session.SetIdentity(fmt.Sprintf("dispatcher roads %v", message.Roads))
+	connection.logger.Debug("Registering dispatcher", "roads", message.Roads)
 	return dispatchChannel
 }
 
-func dispatcherListener(channel chan ClientMessage, connection *Connection) {
+func dispatcherListener(channel chan protocol.ClientMessage, connection *Connection, dispatcher *CentralDispatcher) {
 	for message := range channel {
 		switch message.GetType() {
-		case TicketMsgType:
-			log.Printf("Received ticket message from central dispatcher %s", connection.Conn.RemoteAddr())
-			ticketMessage := message.(*TicketMessage)
+		case protocol.TicketMsgType:
+			ticketMessage := message.(*protocol.TicketMessage)
+			dispatcher.TicketsPending.Dec()
 			encoded, err := ticketMessage.Encode()
 			if err != nil {
-				log.Printf("Error encoding ticket message: %v", err)
+				connection.logger.Error("Error encoding ticket message", "error", err)
 				return
 			}
 			connection.Conn.Write(encoded)
 		default:
-			log.Printf("Received unknown message type from dispatcher %s: %d", connection.Conn.RemoteAddr(), message.GetType())
+			connection.logger.Error("Received unknown message type from central dispatcher", "type", message.GetType())
 		}
 	}
 }
 
 func sendError(errorMessage string, connection *Connection) {
-	errorMsg := &ErrorMessage{
-		Content: Str(errorMessage),
+	if connection.metrics != nil {
+		connection.metrics.ProtocolErrors.Inc()
+	}
+	errorMsg := &protocol.ErrorMessage{
+		Content: protocol.Str(errorMessage),
 	}
 	encodedMessage, err := errorMsg.Encode()
 	if err != nil {
-		log.Printf("Error encoding error message: %v", err)
+		connection.logger.Error("Error encoding error message", "error", err)
 		return
 	}
 	_, err = connection.Conn.Write(encodedMessage)
 	if err != nil {
-		log.Printf("Error sending error message: %v", err)
+		connection.logger.Debug("Error sending error message", "error", err)
 		return
 	}
 }
@@ -1,11 +1,21 @@
 package unusualdatabase
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
-	"os"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/capture"
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/JeremyFenwick/firewatch/internal/service"
 )
 
 type udpMessage struct {
@@ -15,47 +25,218 @@ type udpMessage struct {
 
 const protectedKey = "version"
 
-func Listen(port int) {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+type Server struct {
+	db            *weirdDatase
+	metrics       *metrics.Service
+	logger        *slog.Logger
+	mutex         sync.Mutex
+	udp           net.PacketConn
+	recorder      *capture.Recorder
+	proxyProtocol bool
+	done          chan struct{}
+	wg            sync.WaitGroup
+	stopping      bool
+}
+
+func init() {
+	service.Register(service.Definition{
+		Name:      "unusualdatabase",
+		Transport: service.UDP,
+		Port:      5004,
+		New:       func(service.Options) service.Service { return NewServer() },
+	})
+}
 
+func NewServer() *Server {
 	// Create the database
 	db := &weirdDatase{
 		data: make(map[string]string, 0),
 	}
 	db.insert("version", "madvillains vault of villainy")
-	// Determine if we are local or remote (fly io)
-	bindingAddress := getBindingAddress(port)
-	// Setup the udp listener
-	udp, err := net.ListenPacket("udp", bindingAddress)
+	return &Server{
+		db:      db,
+		metrics: metrics.NewService("unusualdatabase"),
+		logger:  slog.Default().With("service", "unusualdatabase"),
+	}
+}
+
+// Serve answers requests on udp until the server is stopped. The socket is closed on return
+func (s *Server) Serve(udp net.PacketConn) error {
+	udp = s.instrument(udp)
+	if err := s.attach(udp); err != nil {
+		return err
+	}
+	s.logger.Info("Unusual database listening", "address", udp.LocalAddr().String())
+	return s.serve(udp)
+}
+
+// Start listens on address and serves in the background. Use port 0 to pick a free port
+func (s *Server) Start(address string) error {
+	udp, err := server.ListenPacket(address)
 	if err != nil {
-		log.Fatalf("can't listen on %d/udp: %s", port, err)
+		return err
+	}
+	udp = s.instrument(udp)
+	if err := s.attach(udp); err != nil {
+		return err
+	}
+	s.logger.Info("Unusual database listening", "address", udp.LocalAddr().String())
+	go s.serve(udp)
+	return nil
+}
+
+// Addr returns the address being listened on, or nil if the server has not started
+func (s *Server) Addr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.udp == nil {
+		return nil
+	}
+	return s.udp.LocalAddr()
+}
+
+// Metrics returns the server's counters so they can be added to a metrics.Registry
+func (s *Server) Metrics() *metrics.Service {
+	return s.metrics
+}
+
+// SetLogger replaces the server's logger. Call it before the server is started
+func (s *Server) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+}
+
+// SetRecorder captures every datagram to r. Call it before the server is started
+func (s *Server) SetRecorder(r *capture.Recorder) {
+	s.recorder = r
+}
+
+// SetProxyProtocol expects every datagram to start with a PROXY protocol v2 header giving the
+// real client address. Call it before the server is started
+func (s *Server) SetProxyProtocol(enabled bool) {
+	s.proxyProtocol = enabled
+}
+
+// instrument wraps udp so proxy headers are stripped, its traffic is counted and, if a recorder
+// is set, captured
+func (s *Server) instrument(udp net.PacketConn) net.PacketConn {
+	if s.proxyProtocol {
+		udp = server.ProxyPacketConn(udp)
+	}
+	if s.recorder != nil {
+		udp = s.recorder.PacketConn(udp)
 	}
+	return metrics.CountPacketConn(udp, s.metrics)
+}
+
+func (s *Server) attach(udp net.PacketConn) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopping {
+		udp.Close()
+		return server.ErrServerClosed
+	}
+	if s.udp != nil {
+		udp.Close()
+		return server.ErrServerStarted
+	}
+	s.udp = udp
+	s.done = make(chan struct{})
+	return nil
+}
+
+func (s *Server) serve(udp net.PacketConn) error {
+	defer close(s.done)
 	defer udp.Close()
-	log.Printf("Unusual database listening on port %d", port)
+
 	buffer := make([]byte, 999)
 	// Start recieving messages
 	for {
 		n, senderAddress, err := udp.ReadFrom(buffer)
 		if err != nil {
-			log.Println("Could not recieve packet, continuing...")
+			if s.isStopping() || errors.Is(err, net.ErrClosed) {
+				// Requests are answered on the same socket, so let them finish before it is closed
+				s.wg.Wait()
+				return server.ErrServerClosed
+			}
+			s.logger.Warn("Could not receive packet, continuing", "error", err)
 			continue
 		}
 		message := string(buffer[:n])
-		log.Printf("Recieved message: %s", message)
 		request := &udpMessage{
 			message: message,
 			sender:  senderAddress,
 		}
-		go handleRequest(request, db, udp)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			logger := s.logger.With("remote", request.sender.String())
+			logger.Debug("Received message", "message", request.message)
+			handleRequest(request, s.db, udp, logger)
+		}()
 	}
 }
 
-func handleRequest(request *udpMessage, db *weirdDatase, conn net.PacketConn) {
+func (s *Server) isStopping() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.stopping
+}
+
+// Stop stops reading requests and closes the socket once in-flight requests have been
+// answered, or when ctx expires
+func (s *Server) Stop(ctx context.Context) error {
+	s.mutex.Lock()
+	s.stopping = true
+	udp, done := s.udp, s.done
+	s.mutex.Unlock()
+	if udp == nil {
+		return nil
+	}
+	// Unblock the read loop
+	udp.SetReadDeadline(time.Now())
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		udp.Close()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Handoff stops the server like Stop and writes the stored values for Restore
+func (s *Server) Handoff(ctx context.Context, w io.Writer) error {
+	if err := s.Stop(ctx); err != nil {
+		return err
+	}
+	s.db.mutex.RLock()
+	defer s.db.mutex.RUnlock()
+
+	return json.NewEncoder(w).Encode(s.db.data)
+}
+
+// Restore loads values written by Handoff. The version is kept as it is, since it belongs to
+// this build. Call it before the server is started
+func (s *Server) Restore(r io.Reader) error {
+	var data map[string]string
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return fmt.Errorf("invalid database state: %w", err)
+	}
+	for key, value := range data {
+		handleInsert(key, value, s.db)
+	}
+	return nil
+}
+
+func handleRequest(request *udpMessage, db *weirdDatase, conn net.PacketConn, logger *slog.Logger) {
 	key, value, isInsert := strings.Cut(request.message, "=")
 	if isInsert {
 		handleInsert(key, value, db)
 	} else {
-		handleDataRequest(key, request, db, conn)
+		handleDataRequest(key, request, db, conn, logger)
 	}
 }
 
@@ -67,26 +248,17 @@ func handleInsert(key, value string, db *weirdDatase) {
 	db.insert(key, value)
 }
 
-func handleDataRequest(key string, request *udpMessage, db *weirdDatase, conn net.PacketConn) {
+func handleDataRequest(key string, request *udpMessage, db *weirdDatase, conn net.PacketConn, logger *slog.Logger) {
 	exists, value := db.retrieve(key)
 	if !exists {
 		_, err := conn.WriteTo([]byte(key+"="), request.sender)
 		if err != nil {
-			log.Println("Could not send key not found message back to sender")
+			logger.Debug("Could not send key not found message back to sender", "error", err)
 		}
 		return
 	}
 	_, err := conn.WriteTo([]byte(request.message+"="+value), request.sender)
 	if err != nil {
-		log.Println("Could not send value back to client")
-	}
-}
-
-func getBindingAddress(port int) string {
-	_, exists := os.LookupEnv("FLY_APP_NAME")
-	if exists {
-		return fmt.Sprintf("fly-global-services:%d", port)
-	} else {
-		return fmt.Sprintf("0.0.0.0:%d", port)
+		logger.Debug("Could not send value back to client", "error", err)
 	}
 }
@@ -7,10 +7,15 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 type FileManager struct {
 	Root *Folder
+
+	// Totals for the metrics endpoint
+	files     atomic.Int64
+	revisions atomic.Int64
 }
 
 type RawFile struct {
@@ -81,10 +86,15 @@ func (fm *FileManager) AddFile(fullPath string, r io.Reader, bytes int) (*Versio
 	// Check if the file already exists in the current folder
 	if existingFile, exists := currentFolder.Files[fileName]; exists {
 		// If it exists, add a new version to the existing file
-		_, err := existingFile.AddVersion(r, bytes)
+		latest, _ := existingFile.GetLatest()
+		file, err := existingFile.AddVersion(r, bytes)
 		if err != nil {
 			return nil, err
 		}
+		// An identical upload returns the latest version instead of making a new one
+		if file != latest {
+			fm.revisions.Add(1)
+		}
 		return currentFolder.Files[fileName], nil
 	}
 	// Create the file in the current folder
@@ -92,6 +102,8 @@ func (fm *FileManager) AddFile(fullPath string, r io.Reader, bytes int) (*Versio
 	if err != nil {
 		return nil, err
 	}
+	fm.files.Add(1)
+	fm.revisions.Add(1)
 	return currentFolder.Files[fileName], nil
 }
 
@@ -104,6 +116,13 @@ func (fm *FileManager) Clear() {
 	}
 	fm.Root.SubFolders = make(map[string]*Folder)   // Clear subfolders
 	fm.Root.Files = make(map[string]*VersionedFile) // Clear files in the root folder
+	fm.files.Store(0)
+	fm.revisions.Store(0)
+}
+
+// Counts returns the number of files stored and the total revisions across them
+func (fm *FileManager) Counts() (files, revisions int64) {
+	return fm.files.Load(), fm.revisions.Load()
 }
 
 func (fm *FileManager) populate() error {
@@ -114,9 +133,25 @@ func (fm *FileManager) populate() error {
 	if err != nil {
 		return err
 	}
+	files, revisions := countFolder(fm.Root)
+	fm.files.Store(files)
+	fm.revisions.Store(revisions)
 	return nil
 }
 
+func countFolder(folder *Folder) (files, revisions int64) {
+	for _, file := range folder.Files {
+		files++
+		revisions += int64(file.LatestVersion)
+	}
+	for _, subFolder := range folder.SubFolders {
+		subFiles, subRevisions := countFolder(subFolder)
+		files += subFiles
+		revisions += subRevisions
+	}
+	return files, revisions
+}
+
 func populateFolder(folder *Folder) error {
 	// Get the files and subfolders in the folder
 	entries, err := os.ReadDir(folder.AbsolutePath)
@@ -138,6 +173,11 @@ func populateFolder(folder *Folder) error {
 			}
 			continue
 		}
+		// Probes left behind by a health check that didn't finish aren't stored files
+		if isProbe(entry.Name()) {
+			os.Remove(folder.AbsolutePath + "/" + entry.Name())
+			continue
+		}
 		// If it's a file we need to reconstruct the versioned file
 		files = append(files, folder.AbsolutePath+"/"+entry.Name())
 	}
@@ -151,6 +191,12 @@ func populateFolder(folder *Folder) error {
 	return nil
 }
 
+// isProbe reports whether name matches probePattern
+func isProbe(name string) bool {
+	prefix, suffix, _ := strings.Cut(probePattern, "*")
+	return strings.HasPrefix(name, prefix) && strings.HasSuffix(name, suffix)
+}
+
 func groupVersionedFiles(entries []string) map[string][]RawFile {
 	grouped := make(map[string][]RawFile)
 
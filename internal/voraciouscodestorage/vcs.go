@@ -2,15 +2,22 @@ package voraciouscodestorage
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/JeremyFenwick/firewatch/internal/capture"
+	"github.com/JeremyFenwick/firewatch/internal/logging"
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/JeremyFenwick/firewatch/internal/service"
 )
 
 const (
@@ -19,137 +26,279 @@ const (
 	dirPerms            = 0755       // Permissions if creating local dir
 )
 
-func Listen(port int) {
-	// Listen for incoming connections on the specified port
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+// Check writes its probe files to the data directory with this pattern. Stored files always end
+// in a revision number, so a probe can't clash with one
+const probePattern = ".healthcheck-*.probe"
+
+type Server struct {
+	dataDir string
+	fm      *FileManager
+	metrics *metrics.Service
+	logger  *slog.Logger
+	tcp     server.TCPServer
+}
+
+func init() {
+	service.Register(service.Definition{
+		Name:      "voraciouscodestorage",
+		Transport: service.TCP,
+		Port:      5010,
+		Storage:   true,
+		New:       func(o service.Options) service.Service { return NewServer(o.DataDir) },
+	})
+}
+
+// NewServer creates a VCS server. An empty dataDir falls back to the DATA_DIR environment variable
+func NewServer(dataDir string) *Server {
+	s := &Server{dataDir: dataDir, metrics: metrics.NewService("voraciouscodestorage")}
+	s.tcp.Metrics = s.metrics
+	s.SetLogger(slog.Default().With("service", "voraciouscodestorage"))
+	s.tcp.Handler = func(ctx context.Context, conn net.Conn) {
+		handleConnection(ctx, conn, s.fm, s.metrics)
+	}
+	return s
+}
+
+// Serve accepts connections on listener until the server is stopped. PUTs in progress are
+// allowed to finish on Stop
+func (s *Server) Serve(listener net.Listener) error {
+	if err := s.openFileManager(); err != nil {
+		listener.Close()
+		return err
+	}
+	s.logger.Info("Voracious code storage listening", "address", listener.Addr().String())
+	return s.tcp.Serve(listener)
+}
+
+// Start listens on address and serves in the background. Use port 0 to pick a free port
+func (s *Server) Start(address string) error {
+	// Listen for incoming connections on the specified address
+	listener, err := server.Listen(address)
 	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
+		return fmt.Errorf("error starting server: %w", err)
 	}
-	defer listener.Close()
-	log.Printf("Server listening on port %d", port)
-	// Create the file system
-	dataDir := getDataDir()
-	log.Println("Data directory:", dataDir)
-	fs, err := NewFileManager(dataDir)
+	if err := s.openFileManager(); err != nil {
+		listener.Close()
+		return err
+	}
+	s.logger.Info("Voracious code storage listening", "address", listener.Addr().String())
+	return s.tcp.Start(listener)
+}
+
+// Addr returns the listening address, or nil before the server has started
+func (s *Server) Addr() net.Addr {
+	return s.tcp.Addr()
+}
+
+// Err returns why the server stopped accepting connections on its own, or nil while it is serving
+func (s *Server) Err() error {
+	return s.tcp.Err()
+}
+
+// Metrics returns the server's counters so they can be added to a metrics.Registry
+func (s *Server) Metrics() *metrics.Service {
+	return s.metrics
+}
+
+// SetLogger replaces the server's logger. Call it before the server is started
+func (s *Server) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+	s.tcp.Logger = logger
+}
+
+// SetLimits sets the connection limits. Call it before the server is started
+func (s *Server) SetLimits(limits server.Limits) {
+	s.tcp.Limits = limits
+}
+
+// SetTLS serves every connection over TLS. Call it before the server is started
+func (s *Server) SetTLS(t *server.TLS) {
+	s.tcp.TLS = t
+}
+
+// SetProxyProtocol expects connections to open with a PROXY protocol header giving the real client
+// address. Call it before the server is started
+func (s *Server) SetProxyProtocol(enabled bool) {
+	s.tcp.ProxyProtocol = enabled
+}
+
+// SetRecorder captures the traffic of every connection to r. Call it before the server is started
+func (s *Server) SetRecorder(r *capture.Recorder) {
+	s.tcp.Recorder = r
+}
+
+// Sessions lists the connected clients
+func (s *Server) Sessions() []server.SessionInfo {
+	return s.tcp.Sessions()
+}
+
+// Disconnect closes the client connection with id. Returns false if there is none
+func (s *Server) Disconnect(id uint64) bool {
+	return s.tcp.Disconnect(id)
+}
+
+// Check reports whether files can still be written to the data directory
+func (s *Server) Check(ctx context.Context) error {
+	probe, err := os.CreateTemp(s.dataDir, probePattern)
 	if err != nil {
-		log.Fatalf("Error creating file system: %v", err)
+		return fmt.Errorf("data directory is not writable: %w", err)
 	}
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("Error accepting connection: %v", err)
-			continue
-		}
+	defer os.Remove(probe.Name())
+	_, err = probe.WriteString("ok")
+	if closeErr := probe.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("data directory is not writable: %w", err)
+	}
+	return nil
+}
 
-		go handleConnection(conn, fs)
+func (s *Server) openFileManager() error {
+	if s.fm != nil {
+		return nil
+	}
+	// Create the file system
+	dataDir, err := getDataDir(s.dataDir)
+	if err != nil {
+		return err
+	}
+	s.dataDir = dataDir
+	s.logger.Info("Using data directory", "path", dataDir)
+	fm, err := NewFileManager(dataDir)
+	if err != nil {
+		return fmt.Errorf("error creating file system: %w", err)
 	}
+	s.fm = fm
+	// The counts only exist once the file system is loaded
+	s.metrics.RegisterGaugeFunc("vcs_files", "Files stored", func() float64 {
+		files, _ := fm.Counts()
+		return float64(files)
+	})
+	s.metrics.RegisterGaugeFunc("vcs_revisions", "Revisions stored across all files", func() float64 {
+		_, revisions := fm.Counts()
+		return float64(revisions)
+	})
+	return nil
+}
+
+// Stop stops accepting connections and waits for open ones to finish until ctx expires
+func (s *Server) Stop(ctx context.Context) error {
+	return s.tcp.Stop(ctx)
 }
 
-func handleConnection(conn net.Conn, fm *FileManager) {
+func handleConnection(ctx context.Context, conn net.Conn, fm *FileManager, m *metrics.Service) {
 	defer conn.Close()
+	Session(conn, conn, fm, logging.FromContext(ctx), m)
+}
+
+// Session opens with READY and answers the commands read from r by writing to w, until r runs out
+// or a command the session can't recover from
+func Session(r io.Reader, w io.Writer, fm *FileManager, logger *slog.Logger, m *metrics.Service) {
 	// Send the ready message
-	err := sendMessage(conn, "READY", false)
+	err := sendMessage(w, "READY", false)
 	if err != nil {
 		return
 	}
 	// Handle the connection
-	reader := bufio.NewReader(conn)
+	reader := bufio.NewReader(r)
 	for {
 		// Read the command from the connection
 		command, err := reader.ReadString('\n')
 		if err != nil {
-			log.Printf("Error reading from connection: %v", err)
+			logger.Debug("Error reading from client", "error", err)
 			return
 		}
-		log.Printf("Received command: %s", command)
+		logger.Debug("Received command", "command", strings.TrimSuffix(command, "\n"))
 		command = command[:len(command)-1] // Remove the newline character
 		commandList := strings.Split(command, " ")
 		// Match the command
 		switch strings.ToUpper(commandList[0]) {
 		case "HELP":
-			err := handleHelp(conn)
+			err := handleHelp(w)
 			if err != nil {
-				log.Printf("Error handling HELP command: %v", err)
+				logger.Debug("Error handling HELP command", "error", err)
 				return
 			}
 		case "LIST":
 			if len(commandList) < 2 {
-				err := sendMessage(conn, "ERR usage: LIST dir", true)
+				err := sendProtocolError(w, m, "ERR usage: LIST dir", true)
 				if err != nil {
 					return
 				}
 				continue
 			}
-			err := handleList(conn, fm, commandList)
+			err := handleList(w, fm, m, commandList)
 			if err != nil {
-				log.Printf("Error handling list request: %v", err)
+				logger.Debug("Error handling LIST command", "error", err)
 				return
 			}
 		case "GET":
-			err := handleGet(conn, fm, commandList)
+			err := handleGet(w, fm, m, commandList)
 			if err != nil {
-				log.Printf("Error handling get request: %v", err)
+				logger.Debug("Error handling GET command", "error", err)
 				return
 			}
 		case "PUT":
-			err = handlePut(reader, conn, fm, commandList)
+			err = handlePut(reader, w, fm, m, commandList)
 			if err != nil {
-				log.Printf("Error handling put request: %v", err)
+				logger.Debug("Error handling PUT command", "error", err)
 				return
 			}
 		case "CLEAR":
 			fm.Clear()
-			err := sendMessage(conn, "OK cleared fs contents", true)
+			err := sendMessage(w, "OK cleared fs contents", true)
 			if err != nil {
 				return
 			}
 		default:
-			sendMessage(conn, fmt.Sprintf("ERR illegal method %s", commandList[0]), false)
+			sendProtocolError(w, m, fmt.Sprintf("ERR illegal method %s", commandList[0]), false)
 			return
 		}
 	}
 }
 
-func handlePut(r io.Reader, conn net.Conn, fm *FileManager, commandList []string) error {
+func handlePut(r io.Reader, w io.Writer, fm *FileManager, m *metrics.Service, commandList []string) error {
 	// Validate the command
 	if len(commandList) != 3 {
-		return sendMessage(conn, "ERR usage: PUT file length newline data", true)
+		return sendProtocolError(w, m, "ERR usage: PUT file length newline data", true)
 	}
 	// Check if the file name is valid
-	if !isValidPath(commandList[1]) {
-		err := sendMessage(conn, "ERR illegal file name", false)
+	if !IsValidPath(commandList[1]) {
+		err := sendProtocolError(w, m, "ERR illegal file name", false)
 		if err != nil {
 			return err
 		}
 		return nil
 	}
 	fileName := commandList[1]
-	// Get the read limit. Default to 0 is fine
+	// Get the read limit. Default to 0 is fine, as is a negative one
 	readLimit, _ := strconv.Atoi(commandList[2])
+	readLimit = max(readLimit, 0)
 	// Create the file
 	limitReader := io.LimitReader(r, int64(readLimit))
 	file, err := fm.AddFile(fileName, limitReader, readLimit)
 	if err == ErrNonTextData {
-		return sendMessage(conn, "ERR text files only", true)
+		return sendProtocolError(w, m, "ERR text files only", true)
 	}
 	if err != nil {
 		return fmt.Errorf("error adding file: %v", err)
 	}
 	// Write the version number back to the connection
-	return sendMessage(conn, fmt.Sprintf("OK r%d", file.LatestVersion), true)
+	return sendMessage(w, fmt.Sprintf("OK r%d", file.LatestVersion), true)
 }
 
-func handleGet(conn net.Conn, fm *FileManager, commandList []string) error {
+func handleGet(w io.Writer, fm *FileManager, m *metrics.Service, commandList []string) error {
 	sendNoSuchFile := func() error {
-		return sendMessage(conn, "ERR no such file", true)
+		return sendMessage(w, "ERR no such file", true)
 	}
 	// Validate the command
 	if len(commandList) < 2 || len(commandList) > 3 {
-		return sendMessage(conn, "ERR usage: GET file [revision]", true)
+		return sendProtocolError(w, m, "ERR usage: GET file [revision]", true)
 	}
 	// Check if the file name is valid
-	if !isValidPath(commandList[1]) {
-		return sendMessage(conn, "ERR illegal file name", false)
+	if !IsValidPath(commandList[1]) {
+		return sendProtocolError(w, m, "ERR illegal file name", false)
 	}
 	fullPath := commandList[1]
 	dir, fileName := splitDirFile(fullPath)
@@ -174,41 +323,41 @@ func handleGet(conn net.Conn, fm *FileManager, commandList []string) error {
 		// Parse the revision number
 		parsedRevision, err := strconv.Atoi(revisionInput)
 		if err != nil || parsedRevision < 1 || parsedRevision > targetFolder.Files[fileName].LatestVersion {
-			return sendMessage(conn, "ERR no such revision", true)
+			return sendMessage(w, "ERR no such revision", true)
 		}
 		revision = parsedRevision
 	}
 	// Read the file
 	targetFile := targetFolder.Files[fileName].Files[revision-1]
-	err = sendMessage(conn, fmt.Sprintf("OK %d", targetFile.Bytes), false)
+	err = sendMessage(w, fmt.Sprintf("OK %d", targetFile.Bytes), false)
 	if err != nil {
 		return err
 	}
-	err = targetFolder.Files[fileName].Files[revision-1].ReadFile(conn)
+	err = targetFolder.Files[fileName].Files[revision-1].ReadFile(w)
 	if err != nil {
 		return fmt.Errorf("error reading file: %v", err)
 	}
-	return sendMessage(conn, "READY", false)
+	return sendMessage(w, "READY", false)
 }
 
-func handleHelp(conn net.Conn) error {
-	return sendMessage(conn, "OK Usage: HELP|GET|PUT|LIST", true)
+func handleHelp(w io.Writer) error {
+	return sendMessage(w, "OK Usage: HELP|GET|PUT|LIST", true)
 }
 
-func handleList(conn net.Conn, fm *FileManager, commandList []string) error {
+func handleList(w io.Writer, fm *FileManager, m *metrics.Service, commandList []string) error {
 	// Check if the directory is valid
-	if !isValidPath(commandList[1]) {
-		return sendMessage(conn, "ERR illegal dir name", false)
+	if !IsValidPath(commandList[1]) {
+		return sendProtocolError(w, m, "ERR illegal dir name", false)
 	}
 	targetDir := commandList[1]
 	// Get the target folder
 	targetFolder, err := fm.GetFolder(targetDir)
 	if err != nil {
-		return sendMessage(conn, "OK 0", true)
+		return sendMessage(w, "OK 0", true)
 	}
 	itemCount := len(targetFolder.Files) + len(targetFolder.SubFolders)
 	// Send the number of items in the folder
-	err = sendMessage(conn, fmt.Sprintf("OK %d", itemCount), false)
+	err = sendMessage(w, fmt.Sprintf("OK %d", itemCount), false)
 	if err != nil {
 		return err
 	}
@@ -219,7 +368,7 @@ func handleList(conn net.Conn, fm *FileManager, commandList []string) error {
 	})
 	// Send all folders in the folder
 	for _, folder := range folders {
-		err := sendMessage(conn, folder.Name+"/ DIR", false)
+		err := sendMessage(w, folder.Name+"/ DIR", false)
 		if err != nil {
 			return err
 		}
@@ -231,17 +380,19 @@ func handleList(conn net.Conn, fm *FileManager, commandList []string) error {
 	})
 	// Send all files in the folder
 	for _, file := range files {
-		err := sendMessage(conn, fmt.Sprintf("%s r%d", file.FileName, file.LatestVersion), false)
+		err := sendMessage(w, fmt.Sprintf("%s r%d", file.FileName, file.LatestVersion), false)
 		if err != nil {
 			return err
 		}
 	}
-	return sendMessage(conn, "READY", false)
+	return sendMessage(w, "READY", false)
 }
 
-func getDataDir() string {
+func getDataDir(dataDir string) (string, error) {
 	// Check if the environment variable is set
-	dataDir := os.Getenv(dataDirEnvVar)
+	if dataDir == "" {
+		dataDir = os.Getenv(dataDirEnvVar)
+	}
 	if dataDir == "" {
 		// If not set, use the default relative path
 		dataDir = localDefaultDataDir
@@ -251,14 +402,15 @@ func getDataDir() string {
 	if _, err := os.Stat(dataDir); os.IsNotExist(err) {
 		err := os.MkdirAll(dataDir, dirPerms)
 		if err != nil {
-			log.Fatalf("Error creating data directory: %v", err)
+			return "", fmt.Errorf("error creating data directory: %w", err)
 		}
 	}
 
-	return dataDir
+	return dataDir, nil
 }
 
-func isValidPath(p string) bool {
+// IsValidPath reports whether p is a legal file or directory name
+func IsValidPath(p string) bool {
 	isLegal := func(r rune) bool {
 		return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == '-' || r == '.' || r == '/' || r == '\\'
 	}
@@ -276,6 +428,12 @@ func isValidPath(p string) bool {
 			return false
 		}
 	}
+	// Must not climb out of the data directory
+	for _, element := range strings.Split(p, "/") {
+		if element == "." || element == ".." {
+			return false
+		}
+	}
 	// Must not be empty
 	if p == "" {
 		return false
@@ -288,16 +446,20 @@ func splitDirFile(fullPath string) (string, string) {
 	return fullPath[:lastSlash+1], fullPath[lastSlash+1:]
 }
 
-func sendMessage(conn net.Conn, message string, readyFollowUp bool) error {
+func sendMessage(w io.Writer, message string, readyFollowUp bool) error {
 	// Send a message to the connection
-	log.Printf("Sending message: %s", message)
-	_, err := conn.Write([]byte(message + "\n"))
+	_, err := w.Write([]byte(message + "\n"))
 	if err != nil {
-		log.Printf("Error writing to connection: %v", err)
 		return fmt.Errorf("error writing to connection: %v", err)
 	}
 	if readyFollowUp {
-		return sendMessage(conn, "READY", false)
+		return sendMessage(w, "READY", false)
 	}
 	return nil
 }
+
+// sendProtocolError sends an error for a malformed request and counts it
+func sendProtocolError(w io.Writer, m *metrics.Service, message string, readyFollowUp bool) error {
+	m.ProtocolErrors.Inc()
+	return sendMessage(w, message, readyFollowUp)
+}
@@ -0,0 +1,281 @@
+// Package budgetchat is a client for the budget chat room. It also works through mobinthemiddle,
+// which speaks the same protocol
+package budgetchat
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/pkg/internal/redial"
+)
+
+// Kind is what happened in the room
+type Kind int
+
+const (
+	Message Kind = iota // Someone said something
+	Joined              // Someone entered the room
+	Left                // Someone left the room
+)
+
+// Event is something that happened in the room. Text is only set for a Message
+type Event struct {
+	Kind Kind
+	Name string
+	Text string
+}
+
+// RejectedError is returned when the server refuses to let the client join
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return "could not join: " + e.Reason
+}
+
+// Client is a member of the room. Send and Receive can be called at the same time. If the
+// connection breaks the client joins again under the same name, missing what was said meanwhile
+type Client struct {
+	address string
+	name    string
+
+	mutex   sync.Mutex
+	current *session // nil until the client joins again
+	members []string
+	closed  bool
+
+	writeMutex sync.Mutex
+}
+
+// session is one connection to the room
+type session struct {
+	conn   *redial.Conn
+	lines  chan string   // Read from the room, closed when the connection breaks
+	closed chan struct{} // Closed when the session is dropped
+	once   sync.Once
+}
+
+func (s *session) close() {
+	s.once.Do(func() {
+		close(s.closed)
+		s.conn.Close()
+	})
+}
+
+// write sends line bound by ctx. Only the write deadline is used, as read is waiting on the
+// connection. It reports whether ctx interrupted the write
+func (s *session) write(ctx context.Context, line string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	deadline, _ := ctx.Deadline()
+	s.conn.SetWriteDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { s.conn.SetWriteDeadline(time.Unix(1, 0)) })
+	err := s.conn.WriteLine(line)
+	if !stop() {
+		return true, ctx.Err()
+	}
+	s.conn.SetWriteDeadline(time.Time{})
+	return false, err
+}
+
+// read passes lines from the room to Receive until the connection breaks
+func (s *session) read() {
+	defer close(s.lines)
+	for {
+		line, err := s.conn.ReadLine()
+		if err != nil {
+			return
+		}
+		select {
+		case s.lines <- line:
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// Join connects to the room at address under name, which is 1 to 16 letters or digits
+func Join(ctx context.Context, address, name string) (*Client, error) {
+	c := &Client{address: address, name: name}
+	if _, _, err := c.connection(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Name is the name the client joined as
+func (c *Client) Name() string {
+	return c.name
+}
+
+// Members returns who else was in the room when the client last joined
+func (c *Client) Members() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]string(nil), c.members...)
+}
+
+// Send says text to everyone else in the room. It is sent again after a reconnect if the
+// connection broke before it went out
+func (c *Client) Send(ctx context.Context, text string) error {
+	if strings.ContainsAny(text, "\r\n") {
+		return errors.New("a message can't contain a line break")
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	for retry := true; ; retry = false {
+		s, joined, err := c.connection(ctx)
+		if err != nil {
+			return err
+		}
+		interrupted, err := s.write(ctx, text)
+		if interrupted || err != nil {
+			c.drop(s)
+		}
+		if err == nil {
+			return nil
+		}
+		if !retry || joined || interrupted {
+			return fmt.Errorf("could not send a message: %w", err)
+		}
+	}
+}
+
+// Receive waits for the next event in the room
+func (c *Client) Receive(ctx context.Context) (Event, error) {
+	for {
+		s, joined, err := c.connection(ctx)
+		if err != nil {
+			return Event{}, err
+		}
+		select {
+		case <-ctx.Done():
+			return Event{}, ctx.Err()
+		case line, ok := <-s.lines:
+			if !ok {
+				c.drop(s)
+				// A connection that breaks straight after joining won't do better next time
+				if joined {
+					return Event{}, errors.New("could not receive: the server closed the connection")
+				}
+				continue
+			}
+			if event, ok := parseEvent(line); ok {
+				return event, nil
+			}
+		}
+	}
+}
+
+// Close leaves the room
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closed = true
+	if c.current != nil {
+		c.current.close()
+		c.current = nil
+	}
+	return nil
+}
+
+// connection returns the current connection, joining again if it broke. It reports whether it
+// joined
+func (c *Client) connection(ctx context.Context) (*session, bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil, false, net.ErrClosed
+	}
+	if c.current != nil {
+		return c.current, false, nil
+	}
+	conn, members, err := c.join(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	c.current = &session{conn: conn, lines: make(chan string), closed: make(chan struct{})}
+	c.members = members
+	go c.current.read()
+	return c.current, true, nil
+}
+
+// drop closes s if it is still the current session, so the next call joins again
+func (c *Client) drop(s *session) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	s.close()
+	if c.current == s {
+		c.current = nil
+	}
+}
+
+func (c *Client) join(ctx context.Context) (*redial.Conn, []string, error) {
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not connect to %s: %w", c.address, err)
+	}
+	conn := &redial.Conn{Conn: netConn, Reader: bufio.NewReader(netConn)}
+	var members []string
+	_, err = redial.WithContext(ctx, conn, func() error {
+		// The welcome message
+		if _, err := conn.ReadLine(); err != nil {
+			return err
+		}
+		if err := conn.WriteLine(c.name); err != nil {
+			return err
+		}
+		room, err := conn.ReadLine()
+		if err != nil {
+			return &RejectedError{Reason: "the server closed the connection"}
+		}
+		if room == "* The room is empty" {
+			return nil
+		}
+		list, ok := strings.CutPrefix(room, "* The room contains: ")
+		if !ok {
+			return &RejectedError{Reason: room}
+		}
+		members = strings.Split(list, ", ")
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("could not join as %s: %w", c.name, err)
+	}
+	return conn, members, nil
+}
+
+// parseEvent reads a line from the room. Lines it doesn't know are skipped
+func parseEvent(line string) (Event, bool) {
+	if rest, ok := strings.CutPrefix(line, "["); ok {
+		name, text, ok := strings.Cut(rest, "] ")
+		if !ok {
+			return Event{}, false
+		}
+		return Event{Kind: Message, Name: name, Text: text}, true
+	}
+	if rest, ok := strings.CutPrefix(line, "* "); ok {
+		if name, ok := strings.CutSuffix(rest, " has entered the room"); ok {
+			return Event{Kind: Joined, Name: name}, true
+		}
+		if name, ok := strings.CutSuffix(rest, " has left the room"); ok {
+			return Event{Kind: Left, Name: name}, true
+		}
+	}
+	return Event{}, false
+}
@@ -0,0 +1,168 @@
+// Package redial keeps a client's connection to a server, dialing again once it breaks
+package redial
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrMalformed is wrapped by errors for replies the client can't understand. The connection is
+// dropped after one, since the rest of the stream can't be trusted
+var ErrMalformed = errors.New("malformed reply")
+
+// Malformed returns an error wrapping ErrMalformed
+func Malformed(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrMalformed, fmt.Sprintf(format, args...))
+}
+
+// Conn is a connection with a reader buffering what the server sent
+type Conn struct {
+	net.Conn
+	Reader *bufio.Reader
+}
+
+// ReadLine returns the next line without its newline
+func (c *Conn) ReadLine() (string, error) {
+	line, err := c.Reader.ReadString('\n')
+	if err != nil {
+		if errors.Is(err, io.EOF) && line != "" {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return line[:len(line)-1], nil
+}
+
+// WriteLine sends line followed by a newline
+func (c *Conn) WriteLine(line string) error {
+	_, err := c.Write([]byte(line + "\n"))
+	return err
+}
+
+// Handshake runs on every new connection before it is used, such as to read the server's
+// greeting or to tell it again who the client is
+type Handshake func(conn *Conn) error
+
+// Client dials address when it first needs a connection and again after one breaks. It is safe
+// for concurrent use, running one call at a time
+type Client struct {
+	network   string
+	address   string
+	handshake Handshake
+	dialer    net.Dialer
+
+	mutex sync.Mutex
+	conn  *Conn
+}
+
+// New returns a client for address. handshake may be nil
+func New(network, address string, handshake Handshake) *Client {
+	return &Client{network: network, address: address, handshake: handshake}
+}
+
+// Do runs fn on the connection, dialing first if there is none. fn is bound by ctx, and a
+// connection it fails on is closed unless the error came from the server's reply. If retry is set
+// and a connection that was already open turns out to be broken, fn runs again on a new one. Only
+// requests that are safe to repeat should retry
+func (c *Client) Do(ctx context.Context, retry bool, fn func(conn *Conn) error) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for {
+		fresh := c.conn == nil
+		if fresh {
+			if err := c.connect(ctx); err != nil {
+				return err
+			}
+		}
+		conn := c.conn
+		interrupted, err := WithContext(ctx, conn, func() error { return fn(conn) })
+		if interrupted {
+			// The connection's deadline may still be moved by the interruption
+			c.drop()
+			return err
+		}
+		if err == nil || !Broken(err) {
+			return err
+		}
+		c.drop()
+		if !retry || fresh {
+			return err
+		}
+		retry = false
+	}
+}
+
+// Close closes the connection, if there is one. The next call dials again
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+func (c *Client) connect(ctx context.Context) error {
+	conn, err := c.dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return fmt.Errorf("could not connect to %s: %w", c.address, err)
+	}
+	c.conn = &Conn{Conn: conn, Reader: bufio.NewReader(conn)}
+	if c.handshake == nil {
+		return nil
+	}
+	if _, err := WithContext(ctx, c.conn, func() error { return c.handshake(c.conn) }); err != nil {
+		c.drop()
+		return fmt.Errorf("handshake with %s: %w", c.address, err)
+	}
+	return nil
+}
+
+func (c *Client) drop() {
+	c.conn.Close()
+	c.conn = nil
+}
+
+// WithContext calls fn with the connection's deadline set from ctx, and clears it afterwards.
+// Cancelling ctx interrupts fn, which is reported so the connection isn't used again
+func WithContext(ctx context.Context, conn net.Conn, fn func() error) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	err := fn()
+	if stop() {
+		conn.SetDeadline(time.Time{})
+		return false, err
+	}
+	if err != nil {
+		// The error is only the interrupted read or write
+		err = ctx.Err()
+	}
+	return true, err
+}
+
+// Broken reports whether err means the connection can't be used again: it was closed or reset,
+// timed out, or sent something malformed
+func Broken(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, ErrMalformed) ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &netErr)
+}
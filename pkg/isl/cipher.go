@@ -1,4 +1,6 @@
-package insecuresocketslayer
+// Package isl is the insecure sockets layer: the cipher that obfuscates each stream, and a client
+// for the toy workshop behind it
+package isl
 
 import (
 	"bytes" // For validation check comparison
@@ -38,7 +40,6 @@ type Cipher struct {
 var bitReverseTable [256]byte
 
 func init() {
-	fmt.Println("Precomputing bit reverse table...")
 	for i := range 256 {
 		var result byte
 		element := byte(i)
@@ -49,7 +50,6 @@ func init() {
 		}
 		bitReverseTable[i] = result
 	}
-	fmt.Println("Bit reverse table computed.")
 }
 
 // --- User Interface ---
@@ -0,0 +1,82 @@
+package isl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/JeremyFenwick/firewatch/pkg/internal/redial"
+)
+
+// ErrNoOpCipher is returned for a cipher that leaves data unchanged, which the server refuses
+var ErrNoOpCipher = errors.New("the cipher leaves data unchanged")
+
+// Client asks an insecure sockets layer server for the toy to make the most of, with every byte
+// passed through a cipher. Each connection starts the cipher again from position zero
+type Client struct {
+	client *redial.Client
+	cipher *Cipher
+
+	// Stream positions on the current connection
+	sent     int
+	received int
+}
+
+// NewClient returns a client for the server at address using the cipher in spec, which ends in a
+// zero byte. It connects on its first request
+func NewClient(address string, spec []byte) (*Client, error) {
+	cipher, err := NewCipher(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cipher: %w", err)
+	}
+	if !cipher.Valid {
+		return nil, ErrNoOpCipher
+	}
+	c := &Client{cipher: cipher}
+	c.client = redial.New("tcp", address, func(conn *redial.Conn) error {
+		c.sent, c.received = 0, 0
+		_, err := conn.Write(cipher.rawCipherSpec)
+		return err
+	})
+	return c, nil
+}
+
+// MostCopies takes a list of toys such as "10x toy car,15x dog on a string" and returns the one
+// with the most copies
+func (c *Client) MostCopies(ctx context.Context, toys string) (string, error) {
+	if strings.Contains(toys, "\n") {
+		return "", errors.New("the toy list can't contain a newline")
+	}
+	var toy string
+	err := c.client.Do(ctx, true, func(conn *redial.Conn) error {
+		encoded := c.cipher.EncodeData(c.sent, []byte(toys+"\n"))
+		c.sent += len(encoded)
+		if _, err := conn.Write(encoded); err != nil {
+			return err
+		}
+		var line []byte
+		for {
+			b, err := conn.Reader.ReadByte()
+			if err != nil {
+				return err
+			}
+			decoded := c.cipher.DecodeData(c.received, []byte{b})[0]
+			c.received++
+			if decoded == '\n' {
+				toy = string(line)
+				return nil
+			}
+			line = append(line, decoded)
+		}
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not ask about %q: %w", toys, err)
+	}
+	return toy, nil
+}
+
+// Close disconnects the client
+func (c *Client) Close() error {
+	return c.client.Close()
+}
@@ -0,0 +1,127 @@
+package jobcenter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/JeremyFenwick/firewatch/pkg/internal/redial"
+)
+
+// ErrNoJob is returned when there is no job to get, or the job to delete or abort doesn't exist
+var ErrNoJob = errors.New("no job")
+
+// ServerError is an error reply from the server, such as for aborting a job another client holds
+type ServerError struct {
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return "server error: " + e.Message
+}
+
+// Job is a job handed out by Get
+type Job struct {
+	ID       int
+	Queue    string
+	Priority int
+	Content  interface{}
+}
+
+// Client talks to a job centre. The server aborts the jobs a client holds when its connection
+// breaks, so after a reconnect they have to be fetched again
+type Client struct {
+	client *redial.Client
+}
+
+// NewClient returns a client for the job centre at address. It connects on its first request
+func NewClient(address string) *Client {
+	return &Client{client: redial.New("tcp", address, nil)}
+}
+
+// Put adds job to queue with priority and returns its id
+func (c *Client) Put(ctx context.Context, queue string, job interface{}, priority int) (int, error) {
+	var response PutResponse
+	err := c.request(ctx, false, PutRequest{Request: "put", Queue: queue, Job: job, Priority: priority}, &response)
+	if err != nil {
+		return 0, fmt.Errorf("could not put a job in %s: %w", queue, err)
+	}
+	return response.Id, nil
+}
+
+// Get hands out the highest priority job in queues. If there is none it returns ErrNoJob, or
+// waits for one if wait is set. The client holds the job until it deletes or aborts it
+func (c *Client) Get(ctx context.Context, queues []string, wait bool) (*Job, error) {
+	var response GetResponse
+	// A job handed out on a connection that broke is back in its queue, so asking again is safe
+	err := c.request(ctx, true, GetRequest{Request: "get", Queues: queues, Wait: &wait}, &response)
+	if err != nil {
+		return nil, fmt.Errorf("could not get a job from %v: %w", queues, err)
+	}
+	if response.ID == nil || response.Queue == nil || response.Priority == nil {
+		c.client.Close()
+		return nil, fmt.Errorf("could not get a job from %v: %w", queues, redial.Malformed("job without an id, queue or priority"))
+	}
+	return &Job{ID: *response.ID, Queue: *response.Queue, Priority: *response.Priority, Content: response.Job}, nil
+}
+
+// Delete removes job id, whether it is queued or held by any client
+func (c *Client) Delete(ctx context.Context, id int) error {
+	err := c.request(ctx, true, DeleteRequest{Request: "delete", Id: id}, nil)
+	if err != nil {
+		return fmt.Errorf("could not delete job %d: %w", id, err)
+	}
+	return nil
+}
+
+// Abort returns job id, which the client holds, to its queue
+func (c *Client) Abort(ctx context.Context, id int) error {
+	err := c.request(ctx, false, AbortRequest{Request: "abort", Id: id}, nil)
+	if err != nil {
+		return fmt.Errorf("could not abort job %d: %w", id, err)
+	}
+	return nil
+}
+
+// Close disconnects the client, aborting the jobs it holds
+func (c *Client) Close() error {
+	return c.client.Close()
+}
+
+// request sends request and decodes an ok reply into response, which may be nil
+func (c *Client) request(ctx context.Context, retry bool, request interface{}, response interface{}) error {
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	return c.client.Do(ctx, retry, func(conn *redial.Conn) error {
+		if err := conn.WriteLine(string(encoded)); err != nil {
+			return err
+		}
+		line, err := conn.ReadLine()
+		if err != nil {
+			return err
+		}
+		var status ErrorResponse
+		if err := json.Unmarshal([]byte(line), &status); err != nil {
+			return redial.Malformed("%q is not JSON", line)
+		}
+		switch status.Status {
+		case "ok":
+			if response == nil {
+				return nil
+			}
+			if err := json.Unmarshal([]byte(line), response); err != nil {
+				return redial.Malformed("%q: %v", line, err)
+			}
+			return nil
+		case "no-job":
+			return ErrNoJob
+		case "error":
+			return &ServerError{Message: status.Error}
+		default:
+			return redial.Malformed("unknown status %q", status.Status)
+		}
+	})
+}
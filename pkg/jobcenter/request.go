@@ -0,0 +1,66 @@
+// Package jobcenter holds the job centre request and response types, and a client that puts,
+// gets, deletes and aborts jobs
+package jobcenter
+
+// Base is used to peek at the 'request' field only
+type Base struct {
+	Request string `json:"request"`
+}
+
+// PutRequest represents the main JSON structure
+type PutRequest struct {
+	Request  string      `json:"request"` // Field names must be exported (start with uppercase)
+	Queue    string      `json:"queue"`
+	Job      interface{} `json:"job"` // Use the Job struct type for the nested object
+	Priority int         `json:"pri"` // Map Go's "Priority" field to JSON's "pri" key
+}
+
+type PutResponse struct {
+	Status string `json:"status"`
+	Id     int    `json:"id"`
+}
+
+// GetRequest represents the JSON structure
+type GetRequest struct {
+	Request string   `json:"request"`
+	Queues  []string `json:"queues"`
+
+	// Use a pointer (*bool) for the optional "wait" field.
+	// If "wait" is missing in the JSON, this field will be nil.
+	// If "wait" is present (true or false), this field will point to the boolean value.
+	// "omitempty" is good practice for marshaling: if Wait is nil, the key won't be included.
+	Wait *bool `json:"wait,omitempty"`
+}
+
+type GetResponse struct {
+	Status   string      `json:"status"`
+	ID       *int        `json:"id,omitempty"`
+	Job      interface{} `json:"job,omitempty"`
+	Priority *int        `json:"pri,omitempty"`
+	Queue    *string     `json:"queue,omitempty"`
+}
+
+// DeleteRequest represents the JSON structure for deleting a job
+type DeleteRequest struct {
+	Request string `json:"request"`
+	Id      int    `json:"id"`
+}
+
+type DeleteResponse struct {
+	Status string `json:"status"`
+}
+
+// AbortRequest represents the JSON structure for aborting a job
+type AbortRequest struct {
+	Request string `json:"request"`
+	Id      int    `json:"id"`
+}
+
+type AbortResponse struct {
+	Status string `json:"status"`
+}
+
+type ErrorResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
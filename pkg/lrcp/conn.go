@@ -0,0 +1,346 @@
+package lrcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Defaults for a zero Dialer, as suggested by the protocol
+const (
+	DefaultRetransmit = 3 * time.Second
+	DefaultExpiry     = 60 * time.Second
+)
+
+// ErrExpired is returned once the peer has stopped answering for longer than the session expiry
+var ErrExpired = errors.New("session expired")
+
+// Dialer opens LRCP sessions. The zero value uses the default timings
+type Dialer struct {
+	Retransmit time.Duration // How long to wait for an ack before sending data again
+	Expiry     time.Duration // How long the peer can stay silent while data is unacked
+	// Socket is used for the session instead of a new UDP socket, such as one that injects faults.
+	// Closing the Conn closes it
+	Socket net.PacketConn
+}
+
+// Dial opens a session with the server at address using the default Dialer
+func Dial(ctx context.Context, address string) (*Conn, error) {
+	var d Dialer
+	return d.Dial(ctx, address)
+}
+
+// Dial opens a session with the server at address. It sends connect messages until one is acked,
+// ctx is done or the session expiry has passed
+func (d *Dialer) Dial(ctx context.Context, address string) (*Conn, error) {
+	remote, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve %s: %w", address, err)
+	}
+	udp := d.Socket
+	if udp == nil {
+		udp, err = net.ListenPacket("udp", ":0")
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to %s: %w", address, err)
+		}
+	}
+	c := &Conn{
+		udp:        udp,
+		remote:     remote,
+		session:    rand.IntN(maxInteger),
+		retransmit: d.Retransmit,
+		expiry:     d.Expiry,
+		changed:    make(chan struct{}),
+		connected:  make(chan struct{}),
+		lastHeard:  time.Now(),
+	}
+	if c.retransmit <= 0 {
+		c.retransmit = DefaultRetransmit
+	}
+	if c.expiry <= 0 {
+		c.expiry = DefaultExpiry
+	}
+	go c.receive()
+	connect := &Message{Type: "connect", Session: c.session}
+	expired := time.After(c.expiry)
+	for {
+		c.send(connect)
+		select {
+		case <-c.connected:
+			go c.maintain()
+			return c, nil
+		case <-ctx.Done():
+			c.Close()
+			return nil, fmt.Errorf("could not connect to %s: %w", address, ctx.Err())
+		case <-expired:
+			c.Close()
+			return nil, fmt.Errorf("could not connect to %s: %w", address, ErrExpired)
+		case <-time.After(c.retransmit):
+		}
+	}
+}
+
+// Conn is an LRCP session. Data written is delivered in order, retransmitted until the peer
+// acks it
+type Conn struct {
+	udp        net.PacketConn
+	remote     net.Addr
+	session    int
+	retransmit time.Duration
+	expiry     time.Duration
+	connected  chan struct{}
+	once       sync.Once
+
+	mutex         sync.Mutex
+	changed       chan struct{} // Closed and replaced whenever the state below changes
+	received      []byte        // Arrived in order and not yet read
+	receivedTotal int           // Length of the peer's stream received so far
+	outgoing      []byte        // Written and not yet acked
+	acked         int           // Length of our stream the peer has acked
+	lastHeard     time.Time
+	err           error // Set once the session has ended
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// Read reads data from the peer. It returns io.EOF once the peer has closed the session
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for len(c.received) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if err := c.wait(c.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.received)
+	c.received = c.received[n:]
+	return n, nil
+}
+
+// Write sends b to the peer. It returns once the data is sent, which is before it is acked
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+	if !c.writeDeadline.IsZero() && time.Now().After(c.writeDeadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if c.acked+len(c.outgoing)+len(b) > maxInteger {
+		return 0, errors.New("the stream is longer than LRCP allows")
+	}
+	start := c.acked + len(c.outgoing)
+	if len(c.outgoing) == 0 {
+		// Nothing was waiting for an ack, so the peer has been silent for a good reason
+		c.lastHeard = time.Now()
+	}
+	c.outgoing = append(c.outgoing, b...)
+	c.sendFrom(start)
+	return len(b), nil
+}
+
+// Close ends the session
+func (c *Conn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.err == net.ErrClosed {
+		return nil
+	}
+	c.send(&Message{Type: "close", Session: c.session})
+	c.end(net.ErrClosed)
+	return nil
+}
+
+// LocalAddr is the address of the UDP socket
+func (c *Conn) LocalAddr() net.Addr {
+	return c.udp.LocalAddr()
+}
+
+// RemoteAddr is the address of the server
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Session is the session id
+func (c *Conn) Session() int {
+	return c.session
+}
+
+// SetDeadline sets the read and write deadlines
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline makes Read give up at t. A zero t means never
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.readDeadline = t
+	c.notify()
+	return nil
+}
+
+// SetWriteDeadline makes Write fail after t. Writes don't wait for acks, so they never block
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.writeDeadline = t
+	return nil
+}
+
+// wait releases the lock until the state changes or deadline passes. The caller holds c.mutex
+func (c *Conn) wait(deadline time.Time) error {
+	changed := c.changed
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	c.mutex.Unlock()
+	defer c.mutex.Lock()
+	select {
+	case <-changed:
+		return nil
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// notify wakes everything waiting on the state. The caller holds c.mutex
+func (c *Conn) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// end closes the session with err. The caller holds c.mutex
+func (c *Conn) end(err error) {
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.udp.Close()
+	c.notify()
+}
+
+// receive handles the peer's messages until the socket is closed
+func (c *Conn) receive() {
+	buffer := make([]byte, maxMessageSize+1)
+	for {
+		n, from, err := c.udp.ReadFrom(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil || n > maxMessageSize || from.String() != c.remote.String() {
+			continue
+		}
+		message, err := DecodeMessage(buffer[:n])
+		if err != nil || message.Session != c.session {
+			continue
+		}
+		c.handle(message)
+	}
+}
+
+func (c *Conn) handle(message *Message) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.err != nil {
+		return
+	}
+	c.lastHeard = time.Now()
+	switch message.Type {
+	case "ack":
+		if message.Length == 0 {
+			c.once.Do(func() { close(c.connected) })
+			return
+		}
+		sent := c.acked + len(c.outgoing)
+		if message.Length <= c.acked {
+			return
+		}
+		if message.Length > sent {
+			// The peer acked data we never sent
+			c.send(&Message{Type: "close", Session: c.session})
+			c.end(errors.New("peer misbehaved"))
+			return
+		}
+		c.outgoing = c.outgoing[message.Length-c.acked:]
+		c.acked = message.Length
+		if message.Length < sent {
+			c.sendFrom(message.Length)
+		}
+	case "data":
+		if message.Position <= c.receivedTotal && message.Position+len(message.Data) > c.receivedTotal {
+			fresh := message.Data[c.receivedTotal-message.Position:]
+			c.received = append(c.received, fresh...)
+			c.receivedTotal += len(fresh)
+			c.notify()
+		}
+		c.send(&Message{Type: "ack", Session: c.session, Length: c.receivedTotal})
+	case "close":
+		c.send(&Message{Type: "close", Session: c.session})
+		c.end(io.EOF)
+	}
+}
+
+// maintain retransmits unacked data and expires the session once the peer has gone quiet
+func (c *Conn) maintain() {
+	ticker := time.NewTicker(c.retransmit)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.mutex.Lock()
+		if c.err != nil {
+			c.mutex.Unlock()
+			return
+		}
+		if len(c.outgoing) > 0 {
+			if time.Since(c.lastHeard) > c.expiry {
+				c.end(ErrExpired)
+			} else {
+				c.sendFrom(c.acked)
+			}
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// sendFrom sends the stream from position on as data messages. The caller holds c.mutex
+func (c *Conn) sendFrom(position int) {
+	unsent := c.outgoing[position-c.acked:]
+	for len(unsent) > 0 {
+		message := &Message{Type: "data", Session: c.session}
+		used := PackDataMessage(message, unsent, position)
+		c.send(message)
+		unsent = unsent[used:]
+		position += used
+	}
+}
+
+// send encodes and sends message. Lost messages are recovered by retransmission, so errors are
+// ignored
+func (c *Conn) send(message *Message) {
+	buffer := make([]byte, 0, maxMessageSize+1)
+	n, err := message.Encode(buffer)
+	if err != nil {
+		return
+	}
+	c.udp.WriteTo(buffer[:n], c.remote)
+}
@@ -1,4 +1,6 @@
-package linereversal
+// Package lrcp is the line reversal control protocol, which carries ordered byte streams over
+// UDP. It holds the message codec and a Dial that opens sessions as net.Conns
+package lrcp
 
 import (
 	"fmt"
@@ -9,7 +11,7 @@ import (
 const maxInteger = 2147483647 // 2**31 - 1
 const maxMessageSize = 999
 
-type LRMessage struct {
+type Message struct {
 	Type     string
 	Session  int
 	Position int
@@ -17,7 +19,7 @@ type LRMessage struct {
 	Length   int
 }
 
-func (m *LRMessage) String() string {
+func (m *Message) String() string {
 	if m.Type == "data" {
 		containsNewline := strings.Contains(string(m.Data), "\n")
 		return fmt.Sprintf("Data message. Session: %d, Position: %d, Contains Newline: %t ", m.Session, m.Position, containsNewline)
@@ -26,7 +28,7 @@ func (m *LRMessage) String() string {
 	}
 }
 
-func (m *LRMessage) Validate() bool {
+func (m *Message) Validate() bool {
 	if m.Session < 0 || m.Session > maxInteger {
 		return false
 	}
@@ -58,7 +60,10 @@ func (m *LRMessage) Validate() bool {
 	return true
 }
 
-func (m *LRMessage) Encode(buffer []byte) (int, error) {
+// Encode writes the message to the start of buffer, which may have a length of 0 as long as its
+// capacity is large enough, and returns how many bytes it wrote. It returns an error if the message
+// doesn't fit
+func (m *Message) Encode(buffer []byte) (int, error) {
 	var data []byte
 	switch m.Type {
 	case "connect":
@@ -72,11 +77,13 @@ func (m *LRMessage) Encode(buffer []byte) (int, error) {
 	default:
 		return 0, fmt.Errorf("invalid message type: %s", m.Type)
 	}
-	copied := append(buffer, data...)
-	return len(copied), nil
+	if len(data) > cap(buffer) {
+		return 0, fmt.Errorf("%s message is %d bytes, the buffer holds %d", m.Type, len(data), cap(buffer))
+	}
+	return copy(buffer[:cap(buffer)], data), nil
 }
 
-func DecodeLRMessage(buffer []byte) (*LRMessage, error) {
+func DecodeMessage(buffer []byte) (*Message, error) {
 	// If the buffer is empty, return an error
 	if len(buffer) == 0 {
 		return nil, fmt.Errorf("empty message")
@@ -85,21 +92,17 @@ func DecodeLRMessage(buffer []byte) (*LRMessage, error) {
 	if buffer[0] != '/' || buffer[len(buffer)-1] != '/' {
 		return nil, fmt.Errorf("invalid message format: %s", buffer)
 	}
-	// Extract the message
+	// Extract the fields. Each unescaped slash ends one, and fields may be empty
 	fields := []string{}
 	var sb strings.Builder
-	for i := 0; i < len(buffer); i++ {
+	for i := 1; i < len(buffer); i++ {
 		char := buffer[i]
-		// If we encounter an unescaped slash, we should split the string
-		if char == '/' && (i == 0 || buffer[i-1] != '\\') {
-			if sb.Len() == 0 {
-				continue
-			}
+		if char == '/' {
 			fields = append(fields, sb.String())
 			sb.Reset()
 			continue
 		}
-		// If we encounter an escaped slash, we should just add it to the string
+		// An escaped slash or backslash is part of the field
 		if char == '\\' && i < len(buffer)-1 && (buffer[i+1] == '/' || buffer[i+1] == '\\') {
 			sb.WriteByte(buffer[i+1])
 			i += 1
@@ -108,7 +111,11 @@ func DecodeLRMessage(buffer []byte) (*LRMessage, error) {
 		// Otherwise, we just add the character to the string
 		sb.WriteByte(char)
 	}
-	message, err := constructLRMessage(fields)
+	// The closing slash was escaped
+	if sb.Len() > 0 {
+		return nil, fmt.Errorf("invalid message format: %s", buffer)
+	}
+	message, err := constructMessage(fields)
 	if err != nil {
 		return nil, err
 	}
@@ -118,7 +125,7 @@ func DecodeLRMessage(buffer []byte) (*LRMessage, error) {
 	return message, nil
 }
 
-func constructLRMessage(fields []string) (*LRMessage, error) {
+func constructMessage(fields []string) (*Message, error) {
 	if len(fields) < 2 {
 		return nil, fmt.Errorf("invalid message format")
 	}
@@ -127,11 +134,16 @@ func constructLRMessage(fields []string) (*LRMessage, error) {
 	if err != nil {
 		return nil, fmt.Errorf("invalid session ID: %s", fields[1])
 	}
-	message := &LRMessage{
+	message := &Message{
 		Type:    messageType,
 		Session: session,
 	}
-	if messageType == "ack" {
+	switch messageType {
+	case "connect", "close":
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid %s message format", messageType)
+		}
+	case "ack":
 		if len(fields) != 3 {
 			return nil, fmt.Errorf("invalid ack message format")
 		}
@@ -140,7 +152,7 @@ func constructLRMessage(fields []string) (*LRMessage, error) {
 			return nil, fmt.Errorf("invalid length: %s", fields[2])
 		}
 		message.Length = length
-	} else if messageType == "data" {
+	case "data":
 		if len(fields) != 4 {
 			return nil, fmt.Errorf("invalid data message format")
 		}
@@ -151,12 +163,14 @@ func constructLRMessage(fields []string) (*LRMessage, error) {
 		data := []byte(fields[3])
 		message.Position = position
 		message.Data = data
+	default:
+		return nil, fmt.Errorf("unknown message type: %s", messageType)
 	}
 	return message, nil
 }
 
 // Packs a byte array into a data message. Returns the amount of *unescaped* bytes written.
-func PackDataMessage(message *LRMessage, data []byte, startPosition int) int {
+func PackDataMessage(message *Message, data []byte, startPosition int) int {
 	sessionStr := strconv.Itoa(message.Session)
 	positionStr := strconv.Itoa(startPosition)
 
@@ -178,6 +192,10 @@ func PackDataMessage(message *LRMessage, data []byte, startPosition int) int {
 		if currentEscapedLen+bytesToAdd > maxDataSize {
 			break // Cannot add this byte, stop processing
 		}
+		// Streams can't go past the largest position
+		if startPosition+dataLength >= maxInteger {
+			break
+		}
 
 		// Add the byte(s)
 		if needsEscape {
@@ -191,3 +209,22 @@ func PackDataMessage(message *LRMessage, data []byte, startPosition int) int {
 	message.Position = startPosition
 	return dataLength
 }
+
+func UnescapeData(data []byte) ([]byte, error) {
+	output := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		// We end with an escaping slash which is invalid
+		if i == len(data)-1 && data[i] == '\\' {
+			return nil, fmt.Errorf("invalid data: %s", data)
+		}
+		// If we encounter an escaped slash, add the next character to the output
+		if data[i] == '\\' && i < len(data)-1 && (data[i+1] == '/' || data[i+1] == '\\') {
+			output = append(output, data[i+1])
+			i++
+			continue
+		}
+		// Otherwise, just add the character to the output
+		output = append(output, data[i])
+	}
+	return output, nil
+}
@@ -0,0 +1,107 @@
+// Package meanstoanend is a client for the means to an end service, which keeps timestamped
+// prices and reports their mean over a time range
+package meanstoanend
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/JeremyFenwick/firewatch/pkg/internal/redial"
+)
+
+// ErrSessionLost is returned once the connection has broken. The server keeps prices per
+// connection, so the ones inserted before are gone
+var ErrSessionLost = errors.New("session lost")
+
+// Client keeps prices in one server session
+type Client struct {
+	client *redial.Client
+
+	mutex   sync.Mutex
+	started bool // Whether the session has been used
+	lost    bool
+}
+
+// NewClient returns a client for the server at address. It connects on its first request
+func NewClient(address string) *Client {
+	return &Client{client: redial.New("tcp", address, nil)}
+}
+
+// Insert records price at timestamp
+func (c *Client) Insert(ctx context.Context, timestamp, price int32) error {
+	err := c.do(ctx, func(conn *redial.Conn) error {
+		_, err := conn.Write(message('I', timestamp, price))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not insert a price: %w", err)
+	}
+	return nil
+}
+
+// Mean returns the mean of the prices from minTime to maxTime inclusive, or 0 if there are none
+func (c *Client) Mean(ctx context.Context, minTime, maxTime int32) (int32, error) {
+	var mean int32
+	err := c.do(ctx, func(conn *redial.Conn) error {
+		if _, err := conn.Write(message('Q', minTime, maxTime)); err != nil {
+			return err
+		}
+		var reply [4]byte
+		if _, err := io.ReadFull(conn.Reader, reply[:]); err != nil {
+			return err
+		}
+		mean = int32(binary.BigEndian.Uint32(reply[:]))
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not query prices: %w", err)
+	}
+	return mean, nil
+}
+
+// Reset starts a new, empty session, after the last one was lost or to forget its prices
+func (c *Client) Reset() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.started, c.lost = false, false
+	return c.client.Close()
+}
+
+// Close disconnects the client
+func (c *Client) Close() error {
+	return c.client.Close()
+}
+
+// do runs fn in the current session. Requests are never retried, as a new connection would be a
+// new session
+func (c *Client) do(ctx context.Context, fn func(conn *redial.Conn) error) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.lost {
+		return ErrSessionLost
+	}
+	err := c.client.Do(ctx, false, fn)
+	if err == nil {
+		c.started = true
+		return nil
+	}
+	if c.started && redial.Broken(err) {
+		c.lost = true
+		return fmt.Errorf("%w: %w", ErrSessionLost, err)
+	}
+	return err
+}
+
+func message(kind byte, first, second int32) []byte {
+	encoded := make([]byte, 9)
+	encoded[0] = kind
+	binary.BigEndian.PutUint32(encoded[1:], uint32(first))
+	binary.BigEndian.PutUint32(encoded[5:], uint32(second))
+	return encoded
+}
@@ -0,0 +1,65 @@
+package pestcontrol
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/JeremyFenwick/firewatch/pkg/internal/redial"
+)
+
+// Client reports site visits to a pest control server. The server doesn't acknowledge visits, so
+// a broken connection is only noticed by the visit after it, which reconnects
+type Client struct {
+	client *redial.Client
+}
+
+// NewClient returns a client for the server at address. It connects on its first visit
+func NewClient(address string) *Client {
+	return &Client{client: redial.New("tcp", address, hello)}
+}
+
+// hello exchanges the Hello messages that open every connection
+func hello(conn *redial.Conn) error {
+	if err := send(conn, &HelloMessage{Protocol: Protocol, Version: Version}); err != nil {
+		return err
+	}
+	message, err := ReadMessage(conn.Reader)
+	if err != nil {
+		return err
+	}
+	if hello, ok := message.(*HelloMessage); !ok || !hello.Valid() {
+		return redial.Malformed("server opened with message 0x%02x instead of a valid hello", message.GetType())
+	}
+	return nil
+}
+
+// Visit reports the populations counted at site. A visit only sets the populations, so one that
+// failed is sent again on a new connection
+func (c *Client) Visit(ctx context.Context, site U32, populations ...Observation) error {
+	visit := &SiteVisitMessage{Site: site, Populations: populations}
+	// The server hangs up on a visit that counts a species twice
+	if _, ok := visit.Counts(); !ok {
+		return fmt.Errorf("site %d: a species has two different counts", site)
+	}
+	err := c.client.Do(ctx, true, func(conn *redial.Conn) error {
+		return send(conn, visit)
+	})
+	if err != nil {
+		return fmt.Errorf("could not report a visit to site %d: %w", site, err)
+	}
+	return nil
+}
+
+// Close disconnects the client
+func (c *Client) Close() error {
+	return c.client.Close()
+}
+
+func send(conn *redial.Conn, message Message) error {
+	encoded, err := message.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(encoded)
+	return err
+}
@@ -0,0 +1,125 @@
+// Package pestcontrol holds the pest control message codecs, and a client that reports site
+// visits
+package pestcontrol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Message type constants
+const (
+	HelloType             U8 = 0x50
+	ErrorType             U8 = 0x51
+	OKType                U8 = 0x52
+	DialAuthorityType     U8 = 0x53
+	TargetPopulationsType U8 = 0x54
+	CreatePolicyType      U8 = 0x55
+	DeletePolicyType      U8 = 0x56
+	PolicyResultType      U8 = 0x57
+	SiteVisitType         U8 = 0x58
+)
+
+// Policy actions
+const (
+	Cull     U8 = 0x90
+	Conserve U8 = 0xa0
+)
+
+// Values every Hello must carry
+const (
+	Protocol Str = "pestcontrol"
+	Version  U32 = 1
+)
+
+const (
+	// Type and length
+	headerLength = 5
+	// Header plus the checksum
+	minMessageLength = headerLength + 1
+	// MaxMessageLength bounds what a peer can make us allocate for one message
+	MaxMessageLength = 1024 * 1024
+)
+
+// ReadMessage reads one framed message from r. A message with a bad length, checksum, type or
+// body returns ErrInvalidMessage. Errors from r are returned as is
+func ReadMessage(r io.Reader) (Message, error) {
+	var header [headerLength]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length < minMessageLength || length > MaxMessageLength {
+		return nil, fmt.Errorf("%w: length %d", ErrInvalidMessage, length)
+	}
+	message := make([]byte, length)
+	copy(message, header[:])
+	if _, err := io.ReadFull(r, message[headerLength:]); err != nil {
+		return nil, err
+	}
+	return Decode(message)
+}
+
+// Decode parses a complete message, including its header and checksum
+func Decode(message []byte) (Message, error) {
+	if len(message) < minMessageLength || binary.BigEndian.Uint32(message[1:]) != uint32(len(message)) {
+		return nil, fmt.Errorf("%w: length does not match", ErrInvalidMessage)
+	}
+	if checksum(message) != 0 {
+		return nil, fmt.Errorf("%w: bad checksum", ErrInvalidMessage)
+	}
+	r := bytes.NewReader(message[headerLength : len(message)-1])
+
+	var msg Message
+	var err error
+	switch U8(message[0]) {
+	case HelloType:
+		msg, err = decodeHello(r)
+	case ErrorType:
+		msg, err = decodeError(r)
+	case OKType:
+		msg = &OKMessage{}
+	case DialAuthorityType:
+		msg, err = decodeDialAuthority(r)
+	case TargetPopulationsType:
+		msg, err = decodeTargetPopulations(r)
+	case CreatePolicyType:
+		msg, err = decodeCreatePolicy(r)
+	case DeletePolicyType:
+		msg, err = decodeDeletePolicy(r)
+	case PolicyResultType:
+		msg, err = decodePolicyResult(r)
+	case SiteVisitType:
+		msg, err = decodeSiteVisit(r)
+	default:
+		return nil, fmt.Errorf("%w: unknown type 0x%02x", ErrInvalidMessage, message[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The length has to match the content exactly
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%w: %d unused bytes", ErrInvalidMessage, r.Len())
+	}
+	return msg, nil
+}
+
+// frame wraps the content of a message with its type, length and checksum
+func frame(msgType U8, content []byte) []byte {
+	message := make([]byte, headerLength, headerLength+len(content)+1)
+	message[0] = byte(msgType)
+	binary.BigEndian.PutUint32(message[1:], uint32(headerLength+len(content)+1))
+	message = append(message, content...)
+	// The checksum makes every byte of the message sum to zero
+	return append(message, -checksum(message))
+}
+
+func checksum(message []byte) byte {
+	var sum byte
+	for _, b := range message {
+		sum += b
+	}
+	return sum
+}
@@ -0,0 +1,84 @@
+package pestcontrol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+type (
+	U8  uint8
+	U32 uint32
+	Str string
+)
+
+// ErrInvalidMessage is returned for a message that breaks the protocol. The stream can't
+// be trusted after one, so the connection should be closed
+var ErrInvalidMessage = errors.New("invalid message")
+
+func readU8(r *bytes.Reader) (U8, error) {
+	value, err := r.ReadByte()
+	if err != nil {
+		return 0, ErrInvalidMessage
+	}
+	return U8(value), nil
+}
+
+func readU32(r *bytes.Reader) (U32, error) {
+	var buffer [4]byte
+	if _, err := io.ReadFull(r, buffer[:]); err != nil {
+		return 0, ErrInvalidMessage
+	}
+	return U32(binary.BigEndian.Uint32(buffer[:])), nil
+}
+
+// Strings are prefixed with a u32 length, unlike speed daemon's u8
+func readStr(r *bytes.Reader) (Str, error) {
+	length, err := readU32(r)
+	if err != nil {
+		return "", err
+	}
+	// The length can't be trusted, so check it against what is left before allocating
+	if int64(length) > int64(r.Len()) {
+		return "", ErrInvalidMessage
+	}
+	buffer := make([]byte, length)
+	if _, err := io.ReadFull(r, buffer); err != nil {
+		return "", ErrInvalidMessage
+	}
+	return Str(buffer), nil
+}
+
+// readCount reads an array length. Each element takes at least minSize bytes
+func readCount(r *bytes.Reader, minSize int) (int, error) {
+	count, err := readU32(r)
+	if err != nil {
+		return 0, err
+	}
+	if int64(count)*int64(minSize) > int64(r.Len()) {
+		return 0, ErrInvalidMessage
+	}
+	return int(count), nil
+}
+
+func writeU8(w io.Writer, value U8) error {
+	_, err := w.Write([]byte{byte(value)})
+	return err
+}
+
+func writeU32(w io.Writer, value U32) error {
+	var buffer [4]byte
+	binary.BigEndian.PutUint32(buffer[:], uint32(value))
+	_, err := w.Write(buffer[:])
+	return err
+}
+
+func writeStr(w io.Writer, value Str) error {
+	err := writeU32(w, U32(len(value)))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte(value))
+	return err
+}
@@ -0,0 +1,342 @@
+package pestcontrol
+
+import (
+	"bytes"
+)
+
+type Message interface {
+	GetType() U8
+	Encode() ([]byte, error)
+}
+
+// HELLO MESSAGE
+
+type HelloMessage struct {
+	Protocol Str
+	Version  U32
+}
+
+func (message *HelloMessage) GetType() U8 {
+	return HelloType
+}
+
+func (message *HelloMessage) Encode() ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := writeStr(&buffer, message.Protocol); err != nil {
+		return nil, err
+	}
+	if err := writeU32(&buffer, message.Version); err != nil {
+		return nil, err
+	}
+	return frame(message.GetType(), buffer.Bytes()), nil
+}
+
+// Valid reports whether the peer speaks our protocol and version
+func (message *HelloMessage) Valid() bool {
+	return message.Protocol == Protocol && message.Version == Version
+}
+
+func decodeHello(r *bytes.Reader) (*HelloMessage, error) {
+	protocol, err := readStr(r)
+	if err != nil {
+		return nil, err
+	}
+	version, err := readU32(r)
+	if err != nil {
+		return nil, err
+	}
+	return &HelloMessage{Protocol: protocol, Version: version}, nil
+}
+
+// ERROR MESSAGE
+
+type ErrorMessage struct {
+	Content Str
+}
+
+func (message *ErrorMessage) GetType() U8 {
+	return ErrorType
+}
+
+func (message *ErrorMessage) Encode() ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := writeStr(&buffer, message.Content); err != nil {
+		return nil, err
+	}
+	return frame(message.GetType(), buffer.Bytes()), nil
+}
+
+func decodeError(r *bytes.Reader) (*ErrorMessage, error) {
+	content, err := readStr(r)
+	if err != nil {
+		return nil, err
+	}
+	return &ErrorMessage{Content: content}, nil
+}
+
+// OK MESSAGE
+
+type OKMessage struct{}
+
+func (message *OKMessage) GetType() U8 {
+	return OKType
+}
+
+func (message *OKMessage) Encode() ([]byte, error) {
+	return frame(message.GetType(), nil), nil
+}
+
+// DIALAUTHORITY MESSAGE
+
+type DialAuthorityMessage struct {
+	Site U32
+}
+
+func (message *DialAuthorityMessage) GetType() U8 {
+	return DialAuthorityType
+}
+
+func (message *DialAuthorityMessage) Encode() ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := writeU32(&buffer, message.Site); err != nil {
+		return nil, err
+	}
+	return frame(message.GetType(), buffer.Bytes()), nil
+}
+
+func decodeDialAuthority(r *bytes.Reader) (*DialAuthorityMessage, error) {
+	site, err := readU32(r)
+	if err != nil {
+		return nil, err
+	}
+	return &DialAuthorityMessage{Site: site}, nil
+}
+
+// TARGETPOPULATIONS MESSAGE
+
+type Target struct {
+	Species Str
+	Min     U32
+	Max     U32
+}
+
+type TargetPopulationsMessage struct {
+	Site        U32
+	Populations []Target
+}
+
+func (message *TargetPopulationsMessage) GetType() U8 {
+	return TargetPopulationsType
+}
+
+func (message *TargetPopulationsMessage) Encode() ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := writeU32(&buffer, message.Site); err != nil {
+		return nil, err
+	}
+	if err := writeU32(&buffer, U32(len(message.Populations))); err != nil {
+		return nil, err
+	}
+	for _, target := range message.Populations {
+		if err := writeStr(&buffer, target.Species); err != nil {
+			return nil, err
+		}
+		if err := writeU32(&buffer, target.Min); err != nil {
+			return nil, err
+		}
+		if err := writeU32(&buffer, target.Max); err != nil {
+			return nil, err
+		}
+	}
+	return frame(message.GetType(), buffer.Bytes()), nil
+}
+
+func decodeTargetPopulations(r *bytes.Reader) (*TargetPopulationsMessage, error) {
+	site, err := readU32(r)
+	if err != nil {
+		return nil, err
+	}
+	// Each target is at least an empty string and two u32s
+	count, err := readCount(r, 12)
+	if err != nil {
+		return nil, err
+	}
+	populations := make([]Target, 0, count)
+	for range count {
+		species, err := readStr(r)
+		if err != nil {
+			return nil, err
+		}
+		minimum, err := readU32(r)
+		if err != nil {
+			return nil, err
+		}
+		maximum, err := readU32(r)
+		if err != nil {
+			return nil, err
+		}
+		populations = append(populations, Target{Species: species, Min: minimum, Max: maximum})
+	}
+	return &TargetPopulationsMessage{Site: site, Populations: populations}, nil
+}
+
+// CREATEPOLICY MESSAGE
+
+type CreatePolicyMessage struct {
+	Species Str
+	Action  U8 // Cull or Conserve
+}
+
+func (message *CreatePolicyMessage) GetType() U8 {
+	return CreatePolicyType
+}
+
+func (message *CreatePolicyMessage) Encode() ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := writeStr(&buffer, message.Species); err != nil {
+		return nil, err
+	}
+	if err := writeU8(&buffer, message.Action); err != nil {
+		return nil, err
+	}
+	return frame(message.GetType(), buffer.Bytes()), nil
+}
+
+func decodeCreatePolicy(r *bytes.Reader) (*CreatePolicyMessage, error) {
+	species, err := readStr(r)
+	if err != nil {
+		return nil, err
+	}
+	action, err := readU8(r)
+	if err != nil {
+		return nil, err
+	}
+	if action != Cull && action != Conserve {
+		return nil, ErrInvalidMessage
+	}
+	return &CreatePolicyMessage{Species: species, Action: action}, nil
+}
+
+// DELETEPOLICY MESSAGE
+
+type DeletePolicyMessage struct {
+	Policy U32
+}
+
+func (message *DeletePolicyMessage) GetType() U8 {
+	return DeletePolicyType
+}
+
+func (message *DeletePolicyMessage) Encode() ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := writeU32(&buffer, message.Policy); err != nil {
+		return nil, err
+	}
+	return frame(message.GetType(), buffer.Bytes()), nil
+}
+
+func decodeDeletePolicy(r *bytes.Reader) (*DeletePolicyMessage, error) {
+	policy, err := readU32(r)
+	if err != nil {
+		return nil, err
+	}
+	return &DeletePolicyMessage{Policy: policy}, nil
+}
+
+// POLICYRESULT MESSAGE
+
+type PolicyResultMessage struct {
+	Policy U32
+}
+
+func (message *PolicyResultMessage) GetType() U8 {
+	return PolicyResultType
+}
+
+func (message *PolicyResultMessage) Encode() ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := writeU32(&buffer, message.Policy); err != nil {
+		return nil, err
+	}
+	return frame(message.GetType(), buffer.Bytes()), nil
+}
+
+func decodePolicyResult(r *bytes.Reader) (*PolicyResultMessage, error) {
+	policy, err := readU32(r)
+	if err != nil {
+		return nil, err
+	}
+	return &PolicyResultMessage{Policy: policy}, nil
+}
+
+// SITEVISIT MESSAGE
+
+type Observation struct {
+	Species Str
+	Count   U32
+}
+
+type SiteVisitMessage struct {
+	Site        U32
+	Populations []Observation
+}
+
+func (message *SiteVisitMessage) GetType() U8 {
+	return SiteVisitType
+}
+
+func (message *SiteVisitMessage) Encode() ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := writeU32(&buffer, message.Site); err != nil {
+		return nil, err
+	}
+	if err := writeU32(&buffer, U32(len(message.Populations))); err != nil {
+		return nil, err
+	}
+	for _, observation := range message.Populations {
+		if err := writeStr(&buffer, observation.Species); err != nil {
+			return nil, err
+		}
+		if err := writeU32(&buffer, observation.Count); err != nil {
+			return nil, err
+		}
+	}
+	return frame(message.GetType(), buffer.Bytes()), nil
+}
+
+// Counts returns the count for each species, or false if a species was given two different counts
+func (message *SiteVisitMessage) Counts() (map[Str]U32, bool) {
+	counts := make(map[Str]U32, len(message.Populations))
+	for _, observation := range message.Populations {
+		if count, seen := counts[observation.Species]; seen && count != observation.Count {
+			return nil, false
+		}
+		counts[observation.Species] = observation.Count
+	}
+	return counts, true
+}
+
+func decodeSiteVisit(r *bytes.Reader) (*SiteVisitMessage, error) {
+	site, err := readU32(r)
+	if err != nil {
+		return nil, err
+	}
+	// Each observation is at least an empty string and a u32
+	count, err := readCount(r, 8)
+	if err != nil {
+		return nil, err
+	}
+	populations := make([]Observation, 0, count)
+	for range count {
+		species, err := readStr(r)
+		if err != nil {
+			return nil, err
+		}
+		observed, err := readU32(r)
+		if err != nil {
+			return nil, err
+		}
+		populations = append(populations, Observation{Species: species, Count: observed})
+	}
+	return &SiteVisitMessage{Site: site, Populations: populations}, nil
+}
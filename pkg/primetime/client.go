@@ -0,0 +1,161 @@
+// Package primetime is a client for the prime time service, which says whether numbers are prime
+// and answers a few other questions about primes
+package primetime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+
+	"github.com/JeremyFenwick/firewatch/pkg/internal/redial"
+)
+
+type request struct {
+	Method string   `json:"method"`
+	Number any      `json:"number,omitempty"`
+	From   *big.Int `json:"from,omitempty"`
+	To     *big.Int `json:"to,omitempty"`
+}
+
+type response struct {
+	Method  *string     `json:"method"`
+	Prime   *bool       `json:"prime"`
+	Factors *[]uint64   `json:"factors"`
+	Number  *big.Int    `json:"number"`
+	Count   *int        `json:"count"`
+	Primes  *[]*big.Int `json:"primes"`
+}
+
+// RejectedError is returned when the server refuses a request, such as one over its limits
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return "the server refused the request: " + e.Reason
+}
+
+// Client asks a prime time server about numbers
+type Client struct {
+	client *redial.Client
+}
+
+// NewClient returns a client for the server at address. It connects on its first request
+func NewClient(address string) *Client {
+	return &Client{client: redial.New("tcp", address, nil)}
+}
+
+// IsPrime reports whether number is prime
+func (c *Client) IsPrime(ctx context.Context, number int64) (bool, error) {
+	var reply response
+	err := c.call(ctx, request{Method: "isPrime", Number: number}, &reply, func() bool {
+		return reply.Prime != nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("could not ask whether %d is prime: %w", number, err)
+	}
+	return *reply.Prime, nil
+}
+
+// Factorize returns the prime factors of number in ascending order, repeated by multiplicity
+func (c *Client) Factorize(ctx context.Context, number uint64) ([]uint64, error) {
+	var reply response
+	err := c.call(ctx, request{Method: "factorize", Number: number}, &reply, func() bool {
+		return reply.Factors != nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not factorize %d: %w", number, err)
+	}
+	return *reply.Factors, nil
+}
+
+// NextPrime returns the smallest prime greater than number
+func (c *Client) NextPrime(ctx context.Context, number *big.Int) (*big.Int, error) {
+	var reply response
+	err := c.call(ctx, request{Method: "nextPrime", Number: number}, &reply, func() bool {
+		return reply.Number != nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not find the prime after %s: %w", number, err)
+	}
+	return reply.Number, nil
+}
+
+// PrevPrime returns the largest prime less than number, which must be greater than 2
+func (c *Client) PrevPrime(ctx context.Context, number *big.Int) (*big.Int, error) {
+	var reply response
+	err := c.call(ctx, request{Method: "prevPrime", Number: number}, &reply, func() bool {
+		return reply.Number != nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not find the prime before %s: %w", number, err)
+	}
+	return reply.Number, nil
+}
+
+// PrimeCount returns how many primes there are up to and including number
+func (c *Client) PrimeCount(ctx context.Context, number int64) (int, error) {
+	var reply response
+	err := c.call(ctx, request{Method: "primeCount", Number: number}, &reply, func() bool {
+		return reply.Count != nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not count the primes up to %d: %w", number, err)
+	}
+	return *reply.Count, nil
+}
+
+// PrimesInRange returns the primes from from to to inclusive, in ascending order
+func (c *Client) PrimesInRange(ctx context.Context, from, to *big.Int) ([]*big.Int, error) {
+	var reply response
+	err := c.call(ctx, request{Method: "primesInRange", From: from, To: to}, &reply, func() bool {
+		return reply.Primes != nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list the primes from %s to %s: %w", from, to, err)
+	}
+	return *reply.Primes, nil
+}
+
+// Close disconnects the client
+func (c *Client) Close() error {
+	return c.client.Close()
+}
+
+// call sends req and decodes the reply into reply. complete reports whether the reply has the
+// field the method answers with. Every method only reads, so a call that failed is sent again on a
+// new connection
+func (c *Client) call(ctx context.Context, req request, reply *response, complete func() bool) error {
+	encoded, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return c.client.Do(ctx, true, func(conn *redial.Conn) error {
+		if err := conn.WriteLine(string(encoded)); err != nil {
+			return err
+		}
+		line, err := conn.Reader.ReadString('\n')
+		if errors.Is(err, io.EOF) && line != "" {
+			// The server says why it refused the request and hangs up
+			conn.Close()
+			_, reason, _ := strings.Cut(line, "REASON: ")
+			return &RejectedError{Reason: reason}
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		*reply = response{}
+		if err := json.Unmarshal([]byte(line), reply); err != nil {
+			return redial.Malformed("%q is not JSON", line)
+		}
+		if reply.Method == nil || *reply.Method != req.Method || !complete() {
+			return redial.Malformed("%q is not a %s response", line, req.Method)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,43 @@
+// Package smoketest is a client for the smoke test echo service
+package smoketest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Echo sends data to the server at address and returns what it sent back, which is the same data
+// from a working server. It closes its side of the connection once data is sent, so the server
+// knows when to stop
+func Echo(ctx context.Context, address string, data []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %w", address, err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(data)
+		if err == nil {
+			err = conn.(*net.TCPConn).CloseWrite()
+		}
+		written <- err
+	}()
+	echoed, err := io.ReadAll(conn)
+	if err == nil {
+		err = <-written
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("echo failed: %w", err)
+	}
+	return echoed, nil
+}
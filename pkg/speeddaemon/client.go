@@ -0,0 +1,128 @@
+package speeddaemon
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/JeremyFenwick/firewatch/pkg/internal/redial"
+)
+
+// ServerError is an error message sent by the server. The server disconnects after sending one
+type ServerError struct {
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return "server error: " + e.Message
+}
+
+// ReadMessage reads the next message from r
+func ReadMessage(r *bufio.Reader) (ClientMessage, error) {
+	for size := 1; ; size = r.Buffered() + 1 {
+		if _, err := r.Peek(size); err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) {
+				return nil, ErrInvalidMessage
+			}
+			return nil, err
+		}
+		data, _ := r.Peek(r.Buffered())
+		buffer := NewSdBuffer(data)
+		message, err := Decode(buffer)
+		if err == nil {
+			r.Discard(buffer.ValidBytes)
+			return message, nil
+		}
+		if !errors.Is(err, ErrIncompleteMessage) {
+			return nil, err
+		}
+	}
+}
+
+func send(conn *redial.Conn, message ClientMessage) error {
+	encoded, err := message.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(encoded)
+	return err
+}
+
+// Camera reports the plates it sees on one spot of a road. It identifies itself again whenever it
+// has to reconnect
+type Camera struct {
+	client *redial.Client
+}
+
+// NewCamera returns a camera at mile on road, where the speed limit is limit miles per hour. It
+// connects when it reports its first plate
+func NewCamera(address string, road, mile, limit U16) *Camera {
+	identity := &IAmCameraMessage{Road: road, Mile: mile, Limit: limit}
+	return &Camera{client: redial.New("tcp", address, func(conn *redial.Conn) error {
+		return send(conn, identity)
+	})}
+}
+
+// Observe reports that plate passed the camera at timestamp, in seconds. A report that fails is
+// not sent again, as the server may have seen it, but the next one is sent on a new connection
+func (c *Camera) Observe(ctx context.Context, plate Str, timestamp U32) error {
+	err := c.client.Do(ctx, false, func(conn *redial.Conn) error {
+		return send(conn, &PlateMessage{Plate: plate, Timestamp: timestamp})
+	})
+	if err != nil {
+		return fmt.Errorf("could not report plate %s: %w", plate, err)
+	}
+	return nil
+}
+
+// Close disconnects the camera
+func (c *Camera) Close() error {
+	return c.client.Close()
+}
+
+// Dispatcher receives the tickets for the roads it is responsible for. Tickets issued while it is
+// disconnected are kept by the server and sent once it reconnects
+type Dispatcher struct {
+	client *redial.Client
+}
+
+// NewDispatcher returns a dispatcher for roads. It connects when it first waits for a ticket
+func NewDispatcher(address string, roads ...U16) *Dispatcher {
+	identity := &IAmDispatcherMessage{Numroads: U8(len(roads)), Roads: roads}
+	return &Dispatcher{client: redial.New("tcp", address, func(conn *redial.Conn) error {
+		return send(conn, identity)
+	})}
+}
+
+// Ticket waits for the next ticket
+func (d *Dispatcher) Ticket(ctx context.Context) (*TicketMessage, error) {
+	var ticket *TicketMessage
+	err := d.client.Do(ctx, true, func(conn *redial.Conn) error {
+		for {
+			message, err := ReadMessage(conn.Reader)
+			if errors.Is(err, ErrInvalidMessage) {
+				return redial.Malformed("%v", err)
+			}
+			if err != nil {
+				return err
+			}
+			switch message := message.(type) {
+			case *TicketMessage:
+				ticket = message
+				return nil
+			case *ErrorMessage:
+				return &ServerError{Message: string(message.Content)}
+			}
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not receive a ticket: %w", err)
+	}
+	return ticket, nil
+}
+
+// Close disconnects the dispatcher
+func (d *Dispatcher) Close() error {
+	return d.client.Close()
+}
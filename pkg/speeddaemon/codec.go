@@ -1,3 +1,5 @@
+// Package speeddaemon holds the speed daemon message codecs, and Camera and Dispatcher clients
+// that report plates and receive tickets
 package speeddaemon
 
 import "bytes"
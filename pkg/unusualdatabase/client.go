@@ -0,0 +1,93 @@
+// Package unusualdatabase is a client for the unusual database, a key-value store spoken to in
+// single UDP datagrams
+package unusualdatabase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// DefaultRetry is how long Retrieve waits for a reply before asking again
+const DefaultRetry = 500 * time.Millisecond
+
+// maxDatagram is the largest request or reply the protocol allows
+const maxDatagram = 999
+
+// Client talks to an unusual database server
+type Client struct {
+	conn net.Conn
+	// How long Retrieve waits for a reply before asking again. Zero uses DefaultRetry
+	Retry time.Duration
+}
+
+// Dial returns a client for the server at address
+func Dial(ctx context.Context, address string) (*Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %w", address, err)
+	}
+	return &Client{conn: conn}, nil
+}
+
+// Insert sets key to value. The server doesn't acknowledge inserts, so one lost on the way is not
+// noticed
+func (c *Client) Insert(ctx context.Context, key, value string) error {
+	if strings.Contains(key, "=") {
+		return errors.New("a key can't contain =")
+	}
+	request := key + "=" + value
+	if len(request) > maxDatagram {
+		return fmt.Errorf("insert is %d bytes, more than the %d a datagram can hold", len(request), maxDatagram)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetWriteDeadline(deadline)
+	}
+	if _, err := c.conn.Write([]byte(request)); err != nil {
+		return fmt.Errorf("could not insert %s: %w", key, err)
+	}
+	return nil
+}
+
+// Retrieve returns the value of key, asking again until the server replies or ctx is done. Keys
+// that were never inserted have an empty value
+func (c *Client) Retrieve(ctx context.Context, key string) (string, error) {
+	if strings.Contains(key, "=") {
+		return "", errors.New("a key can't contain =")
+	}
+	retry := c.Retry
+	if retry <= 0 {
+		retry = DefaultRetry
+	}
+	buffer := make([]byte, maxDatagram+1)
+	for ctx.Err() == nil {
+		if _, err := c.conn.Write([]byte(key)); err != nil {
+			return "", fmt.Errorf("could not retrieve %s: %w", key, err)
+		}
+		deadline := time.Now().Add(retry)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		c.conn.SetReadDeadline(deadline)
+		for {
+			n, err := c.conn.Read(buffer)
+			if err != nil {
+				break
+			}
+			// Replies to earlier requests for other keys are skipped
+			if value, ok := strings.CutPrefix(string(buffer[:n]), key+"="); ok {
+				return value, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("could not retrieve %s: %w", key, ctx.Err())
+}
+
+// Close closes the client's socket
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
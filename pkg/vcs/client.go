@@ -0,0 +1,233 @@
+// Package vcs is a client for the voracious code storage service, which keeps every revision of
+// the text files put in it
+package vcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/JeremyFenwick/firewatch/pkg/internal/redial"
+)
+
+var (
+	// ErrNotFound is returned for a file or revision that doesn't exist
+	ErrNotFound = errors.New("not found")
+	// ErrIllegalName is returned for a path the server won't accept. Paths are absolute and made of
+	// letters, digits and the characters _-./
+	ErrIllegalName = errors.New("illegal name")
+)
+
+// ServerError is an error reply from the server, such as for a file that isn't text
+type ServerError struct {
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return "server error: " + e.Message
+}
+
+// Entry is an item in a directory
+type Entry struct {
+	Name     string
+	Dir      bool
+	Revision int // The latest revision of a file
+}
+
+// Client talks to a voracious code storage server
+type Client struct {
+	client *redial.Client
+}
+
+// NewClient returns a client for the server at address. It connects on its first request
+func NewClient(address string) *Client {
+	return &Client{client: redial.New("tcp", address, func(conn *redial.Conn) error {
+		return expectReady(conn)
+	})}
+}
+
+// Put stores data at path and returns its revision. Putting the contents a file already has
+// doesn't create a revision, so a Put that failed is sent again on a new connection
+func (c *Client) Put(ctx context.Context, path string, data []byte) (int, error) {
+	if !legal(path) {
+		return 0, fmt.Errorf("could not put %s: %w", path, ErrIllegalName)
+	}
+	var revision int
+	err := c.client.Do(ctx, true, func(conn *redial.Conn) error {
+		if _, err := fmt.Fprintf(conn, "PUT %s %d\n%s", path, len(data), data); err != nil {
+			return err
+		}
+		reply, err := readReply(conn)
+		if err != nil {
+			return err
+		}
+		revision, err = parseRevision(reply)
+		if err != nil {
+			return redial.Malformed("%q is not a revision", reply)
+		}
+		return expectReady(conn)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not put %s: %w", path, err)
+	}
+	return revision, nil
+}
+
+// Get returns the latest revision of the file at path
+func (c *Client) Get(ctx context.Context, path string) ([]byte, error) {
+	return c.get(ctx, path, "GET "+path)
+}
+
+// GetRevision returns revision of the file at path
+func (c *Client) GetRevision(ctx context.Context, path string, revision int) ([]byte, error) {
+	return c.get(ctx, path, fmt.Sprintf("GET %s r%d", path, revision))
+}
+
+func (c *Client) get(ctx context.Context, path, command string) ([]byte, error) {
+	if !legal(path) {
+		return nil, fmt.Errorf("could not get %s: %w", path, ErrIllegalName)
+	}
+	var data []byte
+	err := c.client.Do(ctx, true, func(conn *redial.Conn) error {
+		if err := conn.WriteLine(command); err != nil {
+			return err
+		}
+		reply, err := readReply(conn)
+		if err != nil {
+			return err
+		}
+		length, err := strconv.Atoi(reply)
+		if err != nil || length < 0 {
+			return redial.Malformed("%q is not a length", reply)
+		}
+		data = make([]byte, length)
+		if _, err := io.ReadFull(conn.Reader, data); err != nil {
+			return err
+		}
+		return expectReady(conn)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not get %s: %w", path, err)
+	}
+	return data, nil
+}
+
+// List returns the files and directories in dir, directories first and each sorted by name
+func (c *Client) List(ctx context.Context, dir string) ([]Entry, error) {
+	if !legal(dir) {
+		return nil, fmt.Errorf("could not list %s: %w", dir, ErrIllegalName)
+	}
+	var entries []Entry
+	err := c.client.Do(ctx, true, func(conn *redial.Conn) error {
+		if err := conn.WriteLine("LIST " + dir); err != nil {
+			return err
+		}
+		reply, err := readReply(conn)
+		if err != nil {
+			return err
+		}
+		count, err := strconv.Atoi(reply)
+		if err != nil || count < 0 {
+			return redial.Malformed("%q is not a count", reply)
+		}
+		entries = make([]Entry, 0, count)
+		for range count {
+			line, err := conn.ReadLine()
+			if err != nil {
+				return err
+			}
+			entry, err := parseEntry(line)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return expectReady(conn)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list %s: %w", dir, err)
+	}
+	return entries, nil
+}
+
+// Close disconnects the client
+func (c *Client) Close() error {
+	return c.client.Close()
+}
+
+// readReply returns the rest of an OK line. An ERR line is returned as an error once the READY
+// after it has been read
+func readReply(conn *redial.Conn) (string, error) {
+	line, err := conn.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if reply, ok := strings.CutPrefix(line, "OK "); ok {
+		return reply, nil
+	}
+	message, ok := strings.CutPrefix(line, "ERR ")
+	if !ok {
+		return "", redial.Malformed("unexpected reply %q", line)
+	}
+	if err := expectReady(conn); err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(message, "no such") {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, message)
+	}
+	return "", &ServerError{Message: message}
+}
+
+func expectReady(conn *redial.Conn) error {
+	line, err := conn.ReadLine()
+	if err != nil {
+		return err
+	}
+	if line != "READY" {
+		return redial.Malformed("got %q, want READY", line)
+	}
+	return nil
+}
+
+// parseRevision reads a revision such as r3
+func parseRevision(text string) (int, error) {
+	number, ok := strings.CutPrefix(text, "r")
+	if !ok {
+		return 0, fmt.Errorf("revision %q does not start with r", text)
+	}
+	return strconv.Atoi(number)
+}
+
+// parseEntry reads a LIST line, either "name/ DIR" or "name r3"
+func parseEntry(line string) (Entry, error) {
+	name, detail, ok := strings.Cut(line, " ")
+	if !ok {
+		return Entry{}, redial.Malformed("unexpected entry %q", line)
+	}
+	if detail == "DIR" {
+		return Entry{Name: strings.TrimSuffix(name, "/"), Dir: true}, nil
+	}
+	revision, err := parseRevision(detail)
+	if err != nil {
+		return Entry{}, redial.Malformed("unexpected entry %q", line)
+	}
+	return Entry{Name: name, Revision: revision}, nil
+}
+
+// legal reports whether the server accepts p as a file or directory name. The server doesn't say
+// READY after rejecting a name, so they are checked before sending
+func legal(p string) bool {
+	if !path.IsAbs(p) || strings.Contains(p, "//") {
+		return false
+	}
+	for _, r := range p {
+		if !(r >= 'a' && r <= 'z') && !(r >= 'A' && r <= 'Z') && !(r >= '0' && r <= '9') && !strings.ContainsRune("_-./", r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package bench_test
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/bench"
+	"github.com/JeremyFenwick/firewatch/internal/budgetchat"
+	"github.com/JeremyFenwick/firewatch/internal/chaos"
+	"github.com/JeremyFenwick/firewatch/internal/jobcenter"
+	"github.com/JeremyFenwick/firewatch/internal/linereversal"
+	"github.com/JeremyFenwick/firewatch/internal/primetime"
+	"github.com/JeremyFenwick/firewatch/internal/speeddaemon"
+	"github.com/JeremyFenwick/firewatch/internal/unusualdatabase"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type server interface {
+	Start(address string) error
+	Addr() net.Addr
+	Stop(ctx context.Context) error
+	SetLogger(logger *slog.Logger)
+}
+
+func start(t *testing.T, srv server) string {
+	srv.SetLogger(slog.New(slog.DiscardHandler))
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Stop(ctx)
+	})
+	return srv.Addr().String()
+}
+
+func TestLoadsRunWithoutErrors(t *testing.T) {
+	tests := []struct {
+		service    string
+		srv        func() server
+		operations []string
+		duration   time.Duration
+	}{
+		{"primetime", func() server { return primetime.NewServer() }, []string{"isPrime"}, 300 * time.Millisecond},
+		// Chat users first speak up to a second after joining
+		{"budgetchat", func() server { return budgetchat.NewServer() }, []string{"join", "send", "deliver"}, 1500 * time.Millisecond},
+		{"unusualdatabase", func() server { return unusualdatabase.NewServer() }, []string{"insert", "retrieve"}, 300 * time.Millisecond},
+		{"speeddaemon", func() server { return speeddaemon.NewServer() }, []string{"plate", "ticket"}, 300 * time.Millisecond},
+		{"linereversal", func() server { return linereversal.NewServer(time.Minute) }, []string{"connect", "line"}, 300 * time.Millisecond},
+		{"jobcenter", func() server { return jobcenter.NewServer() }, []string{"put", "get", "delete"}, 300 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.service, func(t *testing.T) {
+			address := start(t, test.srv())
+			report, err := bench.Run(context.Background(), test.service, address, bench.Options{Clients: 4, Duration: test.duration})
+			require.NoError(t, err)
+			for _, name := range test.operations {
+				stats, ok := report.Operation(name)
+				if assert.True(t, ok, "no %s operations", name) {
+					assert.Positive(t, stats.Count, name)
+					assert.LessOrEqual(t, stats.P50, stats.P99, name)
+					assert.LessOrEqual(t, stats.P99, stats.Max, name)
+				}
+			}
+			assert.Zero(t, report.Errors())
+		})
+	}
+}
+
+func TestLineReversalUnderLoss(t *testing.T) {
+	address := start(t, linereversal.NewServer(time.Minute))
+	faults := chaos.Faults{Loss: 0.1, Reorder: 0.1, Seed: 3}
+	report, err := bench.Run(context.Background(), "linereversal", address, bench.Options{Clients: 2, Duration: time.Second, Faults: faults})
+	require.NoError(t, err)
+
+	connects, _ := report.Operation("connect")
+	assert.Positive(t, connects.Count)
+	assert.Zero(t, report.Errors())
+}
+
+func TestReportWrite(t *testing.T) {
+	report, err := bench.Run(context.Background(), "jobcenter", start(t, jobcenter.NewServer()), bench.Options{Clients: 2, Duration: 200 * time.Millisecond})
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	require.NoError(t, report.Write(&out))
+	assert.Contains(t, out.String(), "jobcenter for ")
+	assert.Regexp(t, `operation +ok +errors +per sec +p50 +p90 +p99 +max`, out.String())
+	assert.Regexp(t, `\n +put +\d+ +0 `, out.String())
+}
+
+func TestRunUnknownService(t *testing.T) {
+	_, err := bench.Run(context.Background(), "nosuchservice", "127.0.0.1:1", bench.Options{})
+	assert.Error(t, err)
+}
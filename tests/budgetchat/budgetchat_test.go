@@ -2,10 +2,10 @@ package budgetchat_test
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"net"
 	"testing"
-	"time"
 
 	"github.com/JeremyFenwick/firewatch/internal/budgetchat"
 	// Replace with your actual module path
@@ -13,11 +13,12 @@ import (
 
 func TestChat(t *testing.T) {
 	// Start the server in a goroutine (assuming it's not already running)
-	port := 5003
-	go budgetchat.Listen(port) // Replace 'primetime' with your actual package name
-
-	// Give the server a little time to start
-	time.Sleep(100 * time.Millisecond) // Adjust as needed
+	srv := budgetchat.NewServer()
+	if err := srv.Start("127.0.0.1:0"); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	port := srv.Addr().(*net.TCPAddr).Port
 
 	t.Run("Test server response", func(t *testing.T) {
 		testSession(t, port)
@@ -0,0 +1,97 @@
+package budgetchat_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/budgetchat"
+	protocol "github.com/JeremyFenwick/firewatch/pkg/budgetchat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T) (*budgetchat.Server, string) {
+	srv := budgetchat.NewServer()
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	return srv, srv.Addr().String()
+}
+
+func TestClientChats(t *testing.T) {
+	_, address := startServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	alice, err := protocol.Join(ctx, address, "alice")
+	require.NoError(t, err)
+	defer alice.Close()
+	assert.Empty(t, alice.Members())
+	bob, err := protocol.Join(ctx, address, "bob")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alice"}, bob.Members())
+
+	event, err := alice.Receive(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.Event{Kind: protocol.Joined, Name: "bob"}, event)
+
+	require.NoError(t, bob.Send(ctx, "hi alice"))
+	event, err = alice.Receive(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.Event{Kind: protocol.Message, Name: "bob", Text: "hi alice"}, event)
+
+	require.NoError(t, bob.Close())
+	event, err = alice.Receive(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.Event{Kind: protocol.Left, Name: "bob"}, event)
+
+	assert.Error(t, alice.Send(ctx, "two\nlines"))
+}
+
+func TestClientRejected(t *testing.T) {
+	_, address := startServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := protocol.Join(ctx, address, "not a name")
+	var rejected *protocol.RejectedError
+	assert.ErrorAs(t, err, &rejected)
+}
+
+func TestClientRejoins(t *testing.T) {
+	srv, address := startServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	alice, err := protocol.Join(ctx, address, "alice")
+	require.NoError(t, err)
+	defer alice.Close()
+	bob, err := protocol.Join(ctx, address, "bob")
+	require.NoError(t, err)
+	defer bob.Close()
+	event, err := alice.Receive(ctx)
+	require.NoError(t, err)
+	require.Equal(t, protocol.Joined, event.Kind)
+
+	for _, session := range srv.Sessions() {
+		if session.Identity == "bob" {
+			srv.Disconnect(session.ID)
+		}
+	}
+	event, err = alice.Receive(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.Event{Kind: protocol.Left, Name: "bob"}, event)
+
+	// Bob notices the broken connection while receiving and joins again
+	received := make(chan error, 1)
+	go func() {
+		_, err := bob.Receive(ctx)
+		received <- err
+	}()
+	event, err = alice.Receive(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.Event{Kind: protocol.Joined, Name: "bob"}, event)
+	require.NoError(t, alice.Send(ctx, "welcome back"))
+	require.NoError(t, <-received)
+	assert.Equal(t, []string{"alice"}, bob.Members())
+}
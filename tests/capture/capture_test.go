@@ -0,0 +1,220 @@
+package capture_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/capture"
+	"github.com/JeremyFenwick/firewatch/internal/primetime"
+	"github.com/JeremyFenwick/firewatch/internal/unusualdatabase"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordable interface {
+	Start(address string) error
+	Addr() net.Addr
+	Stop(ctx context.Context) error
+	SetRecorder(r *capture.Recorder)
+}
+
+func start(t *testing.T, srv recordable, recorder *capture.Recorder) string {
+	if recorder != nil {
+		srv.SetRecorder(recorder)
+	}
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { stop(srv) })
+	return srv.Addr().String()
+}
+
+func stop(srv recordable) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	srv.Stop(ctx)
+}
+
+// recordPrimetime records one client asking about two numbers and then half closing
+func recordPrimetime(t *testing.T) *capture.Capture {
+	var file bytes.Buffer
+	recorder, err := capture.NewRecorder(&file, "primetime", "tcp")
+	require.NoError(t, err)
+	srv := primetime.NewServer()
+	address := start(t, srv, recorder)
+
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	for _, request := range []string{`{"method":"isPrime","number":7}`, `{"method":"isPrime","number":8}`} {
+		conn.Write([]byte(request + "\n"))
+		_, err := reader.ReadString('\n')
+		require.NoError(t, err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	reader.ReadString('\n')
+	conn.Close()
+	stop(srv)
+	require.NoError(t, recorder.Close())
+
+	recorded, err := capture.Read(&file)
+	require.NoError(t, err)
+	return recorded
+}
+
+func TestRecordTCP(t *testing.T) {
+	recorded := recordPrimetime(t)
+	assert.Equal(t, "primetime", recorded.Header.Service)
+	assert.Equal(t, "tcp", recorded.Header.Transport)
+
+	var events []capture.Event
+	var in, out string
+	for _, frame := range recorded.Frames {
+		assert.Equal(t, uint64(1), frame.Session)
+		events = append(events, frame.Event)
+		switch frame.Event {
+		case capture.In:
+			in += string(frame.Data)
+		case capture.Out:
+			out += string(frame.Data)
+		}
+	}
+	assert.Equal(t, capture.Open, events[0])
+	assert.Equal(t, capture.Close, events[len(events)-1])
+	assert.Contains(t, events, capture.EOF)
+	assert.Equal(t, "{\"method\":\"isPrime\",\"number\":7}\n{\"method\":\"isPrime\",\"number\":8}\n", in)
+	assert.Equal(t, "{\"method\":\"isPrime\",\"prime\":true}\n{\"method\":\"isPrime\",\"prime\":false}\n", out)
+	assert.True(t, strings.HasPrefix(recorded.Frames[0].Remote, "127.0.0.1:"))
+}
+
+func TestReplayMatches(t *testing.T) {
+	recorded := recordPrimetime(t)
+	address := start(t, primetime.NewServer(), nil)
+
+	results := capture.Replay(context.Background(), recorded, address, capture.Options{Speed: 0, Settle: time.Second})
+	require.Len(t, results, 1)
+	assert.True(t, results[0].Match(), results[0].Diff())
+	assert.Empty(t, results[0].Diff())
+}
+
+func TestReplayReportsDifferences(t *testing.T) {
+	recorded := recordPrimetime(t)
+	// Pretend the recorded server gave a different answer for 8
+	for i, frame := range recorded.Frames {
+		if frame.Event == capture.Out {
+			recorded.Frames[i].Data = bytes.ReplaceAll(frame.Data, []byte("false"), []byte("true"))
+		}
+	}
+	address := start(t, primetime.NewServer(), nil)
+
+	results := capture.Replay(context.Background(), recorded, address, capture.Options{Speed: 0, Settle: time.Second})
+	require.Len(t, results, 1)
+	assert.False(t, results[0].Match())
+	assert.Contains(t, results[0].Diff(), "differ at byte 62")
+}
+
+func TestReplayUnreachable(t *testing.T) {
+	recorded := recordPrimetime(t)
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	results := capture.Replay(context.Background(), recorded, address, capture.Options{Speed: 0})
+	require.Len(t, results, 1)
+	assert.False(t, results[0].Match())
+	assert.Contains(t, results[0].Diff(), "could not connect")
+}
+
+func TestRecordAndReplayUDP(t *testing.T) {
+	var file bytes.Buffer
+	recorder, err := capture.NewRecorder(&file, "unusualdatabase", "udp")
+	require.NoError(t, err)
+	srv := unusualdatabase.NewServer()
+	address := start(t, srv, recorder)
+
+	// Two peers, each of which gets its own session
+	for _, payload := range []string{"colour=blue", "colour"} {
+		conn, err := net.Dial("udp", address)
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte(payload))
+		if payload == "colour" {
+			buffer := make([]byte, 1000)
+			n, err := conn.Read(buffer)
+			require.NoError(t, err)
+			assert.Equal(t, "colour=blue", string(buffer[:n]))
+		}
+		conn.Close()
+		// Inserts have no reply, so give the server time to apply it
+		time.Sleep(50 * time.Millisecond)
+	}
+	stop(srv)
+	require.NoError(t, recorder.Close())
+
+	recorded, err := capture.Read(&file)
+	require.NoError(t, err)
+	require.Len(t, recorded.Sessions(), 2)
+
+	address = start(t, unusualdatabase.NewServer(), nil)
+	results := capture.Replay(context.Background(), recorded, address, capture.Options{Speed: 1, Settle: 200 * time.Millisecond})
+	require.Len(t, results, 2)
+	for _, result := range results {
+		assert.True(t, result.Match(), result.Diff())
+	}
+	assert.Equal(t, "colour=blue\n", string(results[1].Want))
+}
+
+func TestReadDropsTruncatedFrame(t *testing.T) {
+	file := `{"service":"smoketest","transport":"tcp","started":"2025-01-01T00:00:00Z"}
+{"time":"2025-01-01T00:00:00Z","session":1,"event":"open","remote":"10.0.0.1:1234"}
+{"time":"2025-01-01T00:00:01Z","session":1,"event":"in","data":"aGk="}
+{"time":"2025-01-01T00:00:02Z","session":1,"ev`
+	recorded, err := capture.Read(strings.NewReader(file))
+	require.NoError(t, err)
+	require.Len(t, recorded.Frames, 2)
+	assert.Equal(t, "hi", string(recorded.Frames[1].Data))
+
+	_, err = capture.Read(strings.NewReader(`{"service":"smoketest","transport":"sctp"}`))
+	assert.Error(t, err)
+}
+
+// discardPacketConn sends datagrams nowhere
+type discardPacketConn struct{ net.PacketConn }
+
+func (discardPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) { return len(b), nil }
+
+func TestRecordBoundsUDPPeers(t *testing.T) {
+	var file bytes.Buffer
+	recorder, err := capture.NewRecorder(&file, "unusualdatabase", "udp")
+	require.NoError(t, err)
+	conn := recorder.PacketConn(discardPacketConn{})
+
+	// The first peer is the least recently seen once the rest have been
+	for port := 1; port <= capture.MaxPeers+1; port++ {
+		_, err := conn.WriteTo([]byte("x"), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port})
+		require.NoError(t, err)
+	}
+	_, err = conn.WriteTo([]byte("x"), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1})
+	require.NoError(t, err)
+	require.NoError(t, recorder.Close())
+
+	recorded, err := capture.Read(&file)
+	require.NoError(t, err)
+	var closed []uint64
+	opened := 0
+	for _, frame := range recorded.Frames {
+		switch frame.Event {
+		case capture.Open:
+			opened++
+		case capture.Close:
+			closed = append(closed, frame.Session)
+		}
+	}
+	// Port 1 returns as a new session, closing port 2's
+	assert.Equal(t, capture.MaxPeers+2, opened)
+	assert.Equal(t, []uint64{1, 2}, closed)
+}
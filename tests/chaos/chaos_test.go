@@ -0,0 +1,193 @@
+package chaos_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/chaos"
+	"github.com/JeremyFenwick/firewatch/internal/check"
+	"github.com/JeremyFenwick/firewatch/internal/service"
+	_ "github.com/JeremyFenwick/firewatch/internal/service/builtin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	faults, err := chaos.Parse("latency=20ms, jitter=5ms,loss=0.1,duplicate=0.01,reorder=0.2,short_read=1,short_write=0.5,seed=42")
+	require.NoError(t, err)
+	assert.Equal(t, chaos.Faults{
+		Latency:    20 * time.Millisecond,
+		Jitter:     5 * time.Millisecond,
+		Loss:       0.1,
+		Duplicate:  0.01,
+		Reorder:    0.2,
+		ShortRead:  1,
+		ShortWrite: 0.5,
+		Seed:       42,
+	}, faults)
+
+	for _, spec := range []string{"loss", "loss=1.5", "loss=-0.1", "latency=soon", "latency=-1s", "flood=1"} {
+		_, err := chaos.Parse(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+// pair returns both ends of a TCP connection
+func pair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	server, err := listener.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestConnSplitsStreams(t *testing.T) {
+	client, server := pair(t)
+	conn := chaos.Conn(server, chaos.Faults{ShortRead: 1, ShortWrite: 1, Seed: 1})
+	data := bytes.Repeat([]byte("0123456789"), 100)
+
+	go client.Write(data)
+	received := make([]byte, len(data))
+	reads := 0
+	for total := 0; total < len(data); reads++ {
+		n, err := conn.Read(received[total:])
+		require.NoError(t, err)
+		total += n
+	}
+	assert.Equal(t, data, received)
+	assert.Greater(t, reads, 1, "the data arrived in pieces")
+
+	go func() {
+		conn.Write(data)
+		conn.(interface{ CloseWrite() error }).CloseWrite()
+	}()
+	echoed, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Equal(t, data, echoed, "split writes lose nothing")
+}
+
+// datagrams sends payloads from a client to a socket wrapped with faults and returns what the
+// wrapped socket reads
+func datagrams(t *testing.T, faults chaos.Faults, payloads ...string) []string {
+	socket, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	conn := chaos.PacketConn(socket, faults)
+	defer conn.Close()
+	client, err := net.Dial("udp", socket.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	for _, payload := range payloads {
+		_, err := client.Write([]byte(payload))
+		require.NoError(t, err)
+	}
+
+	var received []string
+	buffer := make([]byte, 100)
+	for {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return received
+		}
+		received = append(received, string(buffer[:n]))
+	}
+}
+
+func TestPacketConnFaults(t *testing.T) {
+	assert.Empty(t, datagrams(t, chaos.Faults{Loss: 1}, "a", "b"))
+	assert.Equal(t, []string{"a", "a", "b", "b"}, datagrams(t, chaos.Faults{Duplicate: 1}, "a", "b"))
+	assert.Equal(t, []string{"b", "a", "d", "c"}, datagrams(t, chaos.Faults{Reorder: 1}, "a", "b", "c", "d"))
+	assert.Equal(t, []string{"a", "b"}, datagrams(t, chaos.Faults{}, "a", "b"))
+}
+
+func TestPacketConnWriteFaults(t *testing.T) {
+	socket, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	conn := chaos.PacketConn(socket, chaos.Faults{Reorder: 1, Latency: 10 * time.Millisecond})
+	defer conn.Close()
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer peer.Close()
+
+	for _, payload := range []string{"first", "second"} {
+		n, err := conn.WriteTo([]byte(payload), peer.LocalAddr())
+		require.NoError(t, err)
+		assert.Equal(t, len(payload), n)
+	}
+	buffer := make([]byte, 100)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	var received []string
+	for range 2 {
+		n, _, err := peer.ReadFrom(buffer)
+		require.NoError(t, err)
+		received = append(received, string(buffer[:n]))
+	}
+	assert.ElementsMatch(t, []string{"first", "second"}, received)
+}
+
+// serve runs a registered TCP service behind l
+func serve(t *testing.T, name string, options service.Options, l net.Listener) {
+	def, ok := service.Lookup(name)
+	require.True(t, ok)
+	srv := def.New(options)
+	srv.SetLogger(slog.New(slog.DiscardHandler))
+	served, ok := srv.(interface{ Serve(net.Listener) error })
+	require.True(t, ok, "%s can serve a listener", name)
+	go served.Serve(l)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Stop(ctx)
+	})
+}
+
+func listen(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	return l
+}
+
+func TestSuitesPassOverFragmentedStreams(t *testing.T) {
+	// Every read and write is split and delayed, so messages reach the services in pieces
+	faults := chaos.Faults{Latency: time.Millisecond, ShortRead: 0.7, ShortWrite: 0.7, Seed: 1}
+	for _, name := range check.Services() {
+		def, _ := service.Lookup(name)
+		if def.Transport != service.TCP {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			options := def.Defaults
+			switch name {
+			case "mobinthemiddle":
+				upstream := listen(t)
+				serve(t, "budgetchat", service.Options{}, upstream)
+				options.Upstream = upstream.Addr().String()
+			case "voraciouscodestorage":
+				options.DataDir = t.TempDir()
+			case "pestcontrol":
+				// The suite never gets as far as contacting the authority
+				options.Upstream = "127.0.0.1:1"
+			}
+			l := listen(t)
+			serve(t, name, options, chaos.Listener(l, faults))
+
+			var output bytes.Buffer
+			failed, err := check.Run(context.Background(), name, l.Addr().String(), check.DefaultTimeout, &output)
+			require.NoError(t, err)
+			assert.Zero(t, failed, output.String())
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package check_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/budgetchat"
+	"github.com/JeremyFenwick/firewatch/internal/check"
+	"github.com/JeremyFenwick/firewatch/internal/insecuresocketslayer"
+	"github.com/JeremyFenwick/firewatch/internal/jobcenter"
+	"github.com/JeremyFenwick/firewatch/internal/linereversal"
+	"github.com/JeremyFenwick/firewatch/internal/meanstoanend"
+	"github.com/JeremyFenwick/firewatch/internal/mobinthemiddle"
+	"github.com/JeremyFenwick/firewatch/internal/pestcontrol"
+	"github.com/JeremyFenwick/firewatch/internal/primetime"
+	"github.com/JeremyFenwick/firewatch/internal/smoketest"
+	"github.com/JeremyFenwick/firewatch/internal/speeddaemon"
+	"github.com/JeremyFenwick/firewatch/internal/unusualdatabase"
+	"github.com/JeremyFenwick/firewatch/internal/voraciouscodestorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type server interface {
+	Start(address string) error
+	Addr() net.Addr
+	Stop(ctx context.Context) error
+}
+
+func start(t *testing.T, srv server) string {
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Stop(ctx)
+	})
+	return srv.Addr().String()
+}
+
+func TestSuitesPassAgainstLocalServers(t *testing.T) {
+	servers := map[string]func(t *testing.T) server{
+		"smoketest":       func(t *testing.T) server { return smoketest.NewServer(0) },
+		"primetime":       func(t *testing.T) server { return primetime.NewServer() },
+		"meanstoanend":    func(t *testing.T) server { return meanstoanend.NewServer() },
+		"budgetchat":      func(t *testing.T) server { return budgetchat.NewServer() },
+		"unusualdatabase": func(t *testing.T) server { return unusualdatabase.NewServer() },
+		"mobinthemiddle": func(t *testing.T) server {
+			return mobinthemiddle.NewServer(start(t, budgetchat.NewServer()))
+		},
+		"speeddaemon":          func(t *testing.T) server { return speeddaemon.NewServer() },
+		"linereversal":         func(t *testing.T) server { return linereversal.NewServer(time.Minute) },
+		"insecuresocketslayer": func(t *testing.T) server { return insecuresocketslayer.NewServer() },
+		"jobcenter":            func(t *testing.T) server { return jobcenter.NewServer() },
+		"voraciouscodestorage": func(t *testing.T) server { return voraciouscodestorage.NewServer(t.TempDir()) },
+		// The suite never gets as far as contacting the authority
+		"pestcontrol": func(t *testing.T) server { return pestcontrol.NewServer("127.0.0.1:1") },
+	}
+	require.ElementsMatch(t, check.Services(), keys(servers))
+
+	for name, create := range servers {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			address := start(t, create(t))
+			var output bytes.Buffer
+			failed, err := check.Run(context.Background(), name, address, check.DefaultTimeout, &output)
+			require.NoError(t, err)
+			assert.Zero(t, failed, output.String())
+		})
+	}
+}
+
+func TestUnknownService(t *testing.T) {
+	_, err := check.Run(context.Background(), "nope", "127.0.0.1:1", time.Second, &bytes.Buffer{})
+	assert.Error(t, err)
+}
+
+func TestFailuresAreReported(t *testing.T) {
+	// Nothing speaks the protocol on a closed port, so every case fails
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	var output bytes.Buffer
+	failed, err := check.Run(context.Background(), "primetime", address, time.Second, &output)
+	require.NoError(t, err)
+	cases, _ := check.Suite("primetime")
+	assert.Equal(t, len(cases), failed)
+	assert.Contains(t, output.String(), "FAIL primetime/primes")
+	assert.Contains(t, output.String(), "0 passed, 3 failed")
+}
+
+func keys[V any](m map[string]V) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,203 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/config"
+	_ "github.com/JeremyFenwick/firewatch/internal/service/builtin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0644))
+	return path
+}
+
+func TestDefaultConfig(t *testing.T) {
+	cfg := config.Default()
+	assert.Len(t, cfg.Services, 21)
+	assert.Equal(t, ":5000", cfg.Services["smoketest"].ListenAddress())
+	assert.Equal(t, "chat.protohackers.com:16963", cfg.Services["mobinthemiddle"].Upstream)
+	assert.True(t, cfg.Services["voraciouscodestorage"].IsEnabled())
+	// The diagnostic services are only started when asked for
+	assert.False(t, cfg.Services["chargen-udp"].IsEnabled())
+	assert.Equal(t, ":5016", cfg.Services["chargen-udp"].ListenAddress())
+	assert.Equal(t, "json", cfg.Log.Format)
+	assert.Equal(t, "info", cfg.Services["smoketest"].LogLevel)
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestLoadYaml(t *testing.T) {
+	path := writeConfig(t, "firewatch.yaml", `
+admin:
+  address: 127.0.0.1:9090
+services:
+  primetime:
+    enabled: false
+  mobinthemiddle:
+    address: 127.0.0.1
+    upstream: localhost:6000
+  linereversal:
+    limits:
+      session_timeout: 5s
+  budgetchat:
+    limits:
+      max_connections_per_ip: 4
+      read_timeout: 2m
+  jobcenter:
+    tls:
+      cert_file: /etc/firewatch/cert.pem
+      key_file: /etc/firewatch/key.pem
+`)
+	cfg, err := config.Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:9090", cfg.Admin.Address)
+	assert.False(t, cfg.Services["primetime"].IsEnabled())
+	assert.Equal(t, "127.0.0.1:5005", cfg.Services["mobinthemiddle"].ListenAddress())
+	assert.Equal(t, "localhost:6000", cfg.Services["mobinthemiddle"].Upstream)
+	assert.Equal(t, 5*time.Second, cfg.Services["linereversal"].Limits.SessionTimeout.Duration())
+	assert.Equal(t, 4, cfg.Services["budgetchat"].Limits.MaxConnectionsPerIP)
+	assert.Equal(t, 2*time.Minute, cfg.Services["budgetchat"].Limits.ReadTimeout.Duration())
+	assert.Equal(t, "/etc/firewatch/key.pem", cfg.Services["jobcenter"].TLS.KeyFile)
+	assert.Nil(t, cfg.Services["voraciouscodestorage"].TLS)
+	// Services not mentioned in the file keep their defaults
+	assert.True(t, cfg.Services["smoketest"].IsEnabled())
+	assert.Equal(t, int64(1024*1024), cfg.Services["smoketest"].Limits.MaxBytes)
+}
+
+func TestLoadLogLevels(t *testing.T) {
+	path := writeConfig(t, "firewatch.yaml", `
+log:
+  format: text
+  level: warn
+services:
+  jobcenter:
+    log_level: debug
+`)
+	cfg, err := config.Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, "text", cfg.Log.Format)
+	assert.Equal(t, "debug", cfg.Services["jobcenter"].LogLevel)
+	// Services without their own level inherit the global one
+	assert.Equal(t, "warn", cfg.Services["primetime"].LogLevel)
+}
+
+func TestLoadJson(t *testing.T) {
+	path := writeConfig(t, "firewatch.json", `{"services": {"smoketest": {"port": 7000, "limits": {"max_bytes": 64}}}}`)
+	cfg, err := config.Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, ":7000", cfg.Services["smoketest"].ListenAddress())
+	assert.Equal(t, int64(64), cfg.Services["smoketest"].Limits.MaxBytes)
+}
+
+func TestEnableDiagnosticService(t *testing.T) {
+	path := writeConfig(t, "firewatch.yaml", `
+services:
+  daytime:
+    enabled: true
+    port: 13
+  daytime-udp:
+    enabled: true
+    port: 13
+`)
+	cfg, err := config.Load(path)
+	require.NoError(t, err)
+	assert.True(t, cfg.Services["daytime"].IsEnabled())
+	assert.True(t, cfg.Services["daytime-udp"].IsEnabled())
+	assert.Equal(t, ":13", cfg.Services["daytime-udp"].ListenAddress())
+	assert.False(t, cfg.Services["time"].IsEnabled())
+}
+
+func TestLoadInvalid(t *testing.T) {
+	t.Run("Unknown service", func(t *testing.T) {
+		_, err := config.Load(writeConfig(t, "firewatch.yaml", "services:\n  nosuchservice: {}\n"))
+		assert.ErrorContains(t, err, `unknown service "nosuchservice"`)
+	})
+
+	t.Run("Unknown field", func(t *testing.T) {
+		_, err := config.Load(writeConfig(t, "firewatch.json", `{"services": {"smoketest": {"prot": 1}}}`))
+		assert.ErrorContains(t, err, "prot")
+	})
+
+	t.Run("Port out of range", func(t *testing.T) {
+		_, err := config.Load(writeConfig(t, "firewatch.yaml", "services:\n  smoketest:\n    port: 70000\n"))
+		assert.ErrorContains(t, err, "services.smoketest: port 70000")
+	})
+
+	t.Run("Port collision", func(t *testing.T) {
+		_, err := config.Load(writeConfig(t, "firewatch.yaml", "services:\n  primetime:\n    port: 5000\n"))
+		assert.ErrorContains(t, err, "already used by smoketest")
+	})
+
+	t.Run("Port collision on every interface", func(t *testing.T) {
+		for _, addresses := range [][2]string{{"", "0.0.0.0"}, {"0.0.0.0", "::"}, {"::", ""}, {"127.0.0.1", "0.0.0.0"}, {"::", "127.0.0.1"}} {
+			_, err := config.Load(writeConfig(t, "firewatch.yaml", "services:\n  smoketest:\n    address: \""+addresses[0]+"\"\n  primetime:\n    port: 5000\n    address: \""+addresses[1]+"\"\n"))
+			assert.ErrorContains(t, err, "already used by smoketest", "%q and %q", addresses[0], addresses[1])
+		}
+	})
+
+	t.Run("Different hosts may share a port", func(t *testing.T) {
+		_, err := config.Load(writeConfig(t, "firewatch.yaml", "services:\n  smoketest:\n    address: 127.0.0.1\n  primetime:\n    port: 5000\n    address: 127.0.0.2\n"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("UDP and TCP may share a port", func(t *testing.T) {
+		_, err := config.Load(writeConfig(t, "firewatch.yaml", "services:\n  unusualdatabase:\n    port: 5000\n"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("Bad upstream", func(t *testing.T) {
+		_, err := config.Load(writeConfig(t, "firewatch.yaml", "services:\n  mobinthemiddle:\n    upstream: nohost\n"))
+		assert.ErrorContains(t, err, "services.mobinthemiddle: upstream")
+	})
+
+	t.Run("Unsupported option", func(t *testing.T) {
+		_, err := config.Load(writeConfig(t, "firewatch.yaml", "services:\n  primetime:\n    upstream: localhost:1\n"))
+		assert.ErrorContains(t, err, "upstream is not supported")
+	})
+
+	t.Run("Bad duration", func(t *testing.T) {
+		_, err := config.Load(writeConfig(t, "firewatch.yaml", "services:\n  linereversal:\n    limits:\n      session_timeout: soon\n"))
+		assert.ErrorContains(t, err, "invalid duration")
+	})
+
+	t.Run("Bad log level", func(t *testing.T) {
+		_, err := config.Load(writeConfig(t, "firewatch.yaml", "services:\n  primetime:\n    log_level: loud\n"))
+		assert.ErrorContains(t, err, `unknown log level "loud"`)
+	})
+
+	t.Run("Bad log format", func(t *testing.T) {
+		_, err := config.Load(writeConfig(t, "firewatch.yaml", "log:\n  format: xml\n"))
+		assert.ErrorContains(t, err, `unknown log format "xml"`)
+	})
+
+	t.Run("Connection limits on a UDP service", func(t *testing.T) {
+		_, err := config.Load(writeConfig(t, "firewatch.yaml", "services:\n  unusualdatabase:\n    limits:\n      max_connections: 5\n"))
+		assert.ErrorContains(t, err, "services.unusualdatabase: connection limits are not supported")
+	})
+
+	t.Run("TLS on a UDP service", func(t *testing.T) {
+		_, err := config.Load(writeConfig(t, "firewatch.yaml", "services:\n  linereversal:\n    tls:\n      cert_file: a.pem\n      key_file: a.key\n"))
+		assert.ErrorContains(t, err, "services.linereversal: tls is not supported")
+	})
+
+	t.Run("TLS without a key", func(t *testing.T) {
+		_, err := config.Load(writeConfig(t, "firewatch.yaml", "services:\n  jobcenter:\n    tls:\n      cert_file: a.pem\n"))
+		assert.ErrorContains(t, err, "services.jobcenter: tls needs both cert_file and key_file")
+	})
+
+	t.Run("Negative connection limit", func(t *testing.T) {
+		_, err := config.Load(writeConfig(t, "firewatch.yaml", "services:\n  primetime:\n    limits:\n      max_connections_per_ip: -1\n"))
+		assert.ErrorContains(t, err, "must not be negative")
+	})
+
+	t.Run("Unsupported extension", func(t *testing.T) {
+		_, err := config.Load(writeConfig(t, "firewatch.toml", ""))
+		assert.ErrorContains(t, err, "unsupported config file extension")
+	})
+}
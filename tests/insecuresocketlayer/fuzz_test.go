@@ -0,0 +1,53 @@
+package insecuresocketlayer_test
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/JeremyFenwick/firewatch/internal/insecuresocketslayer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// copies returns the number of copies a toy entry asks for, if it is small enough to be sure the
+// server accepts it
+func copies(entry []byte) (int, bool) {
+	count, _, ok := bytes.Cut(bytes.TrimSpace(entry), []byte("x"))
+	if !ok || len(count) == 0 || len(count) > 9 || len(bytes.TrimSpace(entry)) == len(count)+1 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(string(count))
+	return n, err == nil && count[0] != '+' && count[0] != '-'
+}
+
+func FuzzMostCommonToy(f *testing.F) {
+	for _, seed := range []string{
+		"10x toy car,15x dog on a string,4x inflatable motorcycle\n",
+		"5x Toy1, 3x Toy2, 2x Toy3\n",
+		"",
+		",,,",
+		"x,1x,x1",
+		"99999999999x big,1x small",
+		"3x a,3x b",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, line []byte) {
+		toy, err := insecuresocketslayer.MostCommonToy(line)
+		if err != nil {
+			for _, entry := range bytes.Split(line, []byte(",")) {
+				_, ok := copies(entry)
+				assert.False(t, ok, "rejected %q with a valid entry %q", line, entry)
+			}
+			return
+		}
+		require.True(t, bytes.Contains(line, toy))
+		most, _ := strconv.Atoi(string(toy[:bytes.IndexByte(toy, 'x')]))
+		for _, entry := range bytes.Split(line, []byte(",")) {
+			if n, ok := copies(entry); ok {
+				assert.GreaterOrEqual(t, most, n, "picked %q over %q", toy, entry)
+			}
+		}
+	})
+}
@@ -1,14 +1,14 @@
-package insecuresocketlayer_test
+package isl_test
 
 import (
 	"testing"
 
-	"github.com/JeremyFenwick/firewatch/internal/insecuresocketslayer"
+	"github.com/JeremyFenwick/firewatch/pkg/isl"
 	"github.com/stretchr/testify/assert"
 )
 
-func SetupCipher(t *testing.T, cipherData []byte) *insecuresocketslayer.Cipher {
-	cipher, err := insecuresocketslayer.NewCipher(cipherData)
+func SetupCipher(t *testing.T, cipherData []byte) *isl.Cipher {
+	cipher, err := isl.NewCipher(cipherData)
 	assert.NoError(t, err)
 	assert.Equal(t, true, cipher.Valid)
 	return cipher
@@ -46,18 +46,18 @@ func TestBasicEncodeDecode(t *testing.T) {
 
 func TestInvalidCiphers(t *testing.T) {
 	codecData := []byte{00}
-	cipher, _ := insecuresocketslayer.NewCipher(codecData)
+	cipher, _ := isl.NewCipher(codecData)
 	assert.Equal(t, false, cipher.Valid)
 	codecData = []byte{0x02, 0x00, 0x00}
-	cipher, _ = insecuresocketslayer.NewCipher(codecData)
+	cipher, _ = isl.NewCipher(codecData)
 	assert.Equal(t, false, cipher.Valid)
 	codecData = []byte{0x02, 0xab, 0x02, 0xab, 0x00}
-	cipher, _ = insecuresocketslayer.NewCipher(codecData)
+	cipher, _ = isl.NewCipher(codecData)
 	assert.Equal(t, false, cipher.Valid)
 	codecData = []byte{0x01, 0x01, 0x00}
-	cipher, _ = insecuresocketslayer.NewCipher(codecData)
+	cipher, _ = isl.NewCipher(codecData)
 	assert.Equal(t, false, cipher.Valid)
 	codecData = []byte{0x02, 0xa0, 0x02, 0x0b, 0x02, 0xab, 0x00}
-	cipher, _ = insecuresocketslayer.NewCipher(codecData)
+	cipher, _ = isl.NewCipher(codecData)
 	assert.Equal(t, false, cipher.Valid)
 }
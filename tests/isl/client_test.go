@@ -0,0 +1,45 @@
+package isl_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/insecuresocketslayer"
+	"github.com/JeremyFenwick/firewatch/pkg/isl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientMostCopies(t *testing.T) {
+	srv := insecuresocketslayer.NewServer()
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// xor(123), addpos, reversebits
+	client, err := isl.NewClient(srv.Addr().String(), []byte{0x02, 0x7b, 0x05, 0x01, 0x00})
+	require.NoError(t, err)
+	defer client.Close()
+
+	toy, err := client.MostCopies(ctx, "4x dog,5x car")
+	require.NoError(t, err)
+	assert.Equal(t, "5x car", toy)
+	toy, err = client.MostCopies(ctx, "3x rat,2x cat")
+	require.NoError(t, err)
+	assert.Equal(t, "3x rat", toy)
+
+	// The cipher starts again on a new connection
+	for _, session := range srv.Sessions() {
+		srv.Disconnect(session.ID)
+	}
+	toy, err = client.MostCopies(ctx, "10x toy car,15x dog on a string,4x inflatable motorcycle")
+	require.NoError(t, err)
+	assert.Equal(t, "15x dog on a string", toy)
+}
+
+func TestClientNoOpCipher(t *testing.T) {
+	_, err := isl.NewClient("127.0.0.1:1", []byte{0x02, 0x00, 0x00})
+	assert.ErrorIs(t, err, isl.ErrNoOpCipher)
+}
@@ -0,0 +1,44 @@
+package isl_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/JeremyFenwick/firewatch/pkg/isl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func FuzzNewCipher(f *testing.F) {
+	for _, spec := range [][]byte{
+		{0x02, 0x01, 0x01, 0x00},
+		{0x05, 0x05, 0x00},
+		{0x02, 0x7b, 0x05, 0x01, 0x00},
+		{0x02, 0xa0, 0x02, 0x0b, 0x02, 0xab, 0x00},
+		{0x01, 0x01, 0x00},
+		{0x03, 0x03, 0x00},
+		{0x00},
+		{0x02},
+		{0x06, 0x00},
+	} {
+		f.Add(spec, []byte("4x dog,5x car\n"), 0)
+	}
+	// Long enough to take the parallel decode path
+	f.Add([]byte{0x04, 0x03, 0x00}, bytes.Repeat([]byte("10x toy car,"), 300), 255)
+	f.Fuzz(func(t *testing.T, spec, data []byte, position int) {
+		cipher, err := isl.NewCipher(spec)
+		if err != nil {
+			return
+		}
+		if position < 0 {
+			position = -position
+		}
+		encoded := cipher.EncodeData(position, data)
+		require.Len(t, encoded, len(data))
+		assert.Equal(t, data, cipher.DecodeData(position, encoded))
+		// The server hangs up on a cipher that changes nothing, so one reported as such must not
+		if !cipher.Valid {
+			assert.Equal(t, data, encoded)
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package jobcenter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/jobcenter"
+	protocol "github.com/JeremyFenwick/firewatch/pkg/jobcenter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T) (*jobcenter.Server, string) {
+	srv := jobcenter.NewServer()
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	return srv, srv.Addr().String()
+}
+
+func TestClientPutGetDelete(t *testing.T) {
+	_, address := startServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := protocol.NewClient(address)
+	defer client.Close()
+
+	low, err := client.Put(ctx, "queue1", map[string]any{"title": "low"}, 1)
+	require.NoError(t, err)
+	high, err := client.Put(ctx, "queue1", map[string]any{"title": "high"}, 10)
+	require.NoError(t, err)
+
+	job, err := client.Get(ctx, []string{"queue1"}, false)
+	require.NoError(t, err)
+	assert.Equal(t, high, job.ID)
+	assert.Equal(t, "queue1", job.Queue)
+	assert.Equal(t, 10, job.Priority)
+	assert.Equal(t, map[string]any{"title": "high"}, job.Content)
+
+	require.NoError(t, client.Delete(ctx, high))
+	assert.ErrorIs(t, client.Delete(ctx, high), protocol.ErrNoJob)
+	require.NoError(t, client.Delete(ctx, low))
+	_, err = client.Get(ctx, []string{"queue1"}, false)
+	assert.ErrorIs(t, err, protocol.ErrNoJob)
+}
+
+func TestClientAbort(t *testing.T) {
+	_, address := startServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	worker, other := protocol.NewClient(address), protocol.NewClient(address)
+	defer worker.Close()
+	defer other.Close()
+
+	id, err := worker.Put(ctx, "queue1", "job", 1)
+	require.NoError(t, err)
+	job, err := worker.Get(ctx, []string{"queue1"}, false)
+	require.NoError(t, err)
+
+	// Only the client holding a job can abort it
+	assert.Error(t, other.Abort(ctx, id))
+	require.NoError(t, worker.Abort(ctx, job.ID))
+	job, err = other.Get(ctx, []string{"queue1"}, true)
+	require.NoError(t, err)
+	assert.Equal(t, id, job.ID)
+}
+
+func TestClientReconnects(t *testing.T) {
+	srv, address := startServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := protocol.NewClient(address)
+	defer client.Close()
+
+	id, err := client.Put(ctx, "queue1", "job", 1)
+	require.NoError(t, err)
+	_, err = client.Get(ctx, []string{"queue1"}, false)
+	require.NoError(t, err)
+	for _, session := range srv.Sessions() {
+		srv.Disconnect(session.ID)
+	}
+
+	// The server aborted the job along with the connection, so it can be had again
+	job, err := client.Get(ctx, []string{"queue1"}, true)
+	require.NoError(t, err)
+	assert.Equal(t, id, job.ID)
+}
@@ -0,0 +1,68 @@
+package jobcenter_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/JeremyFenwick/firewatch/internal/jobcenter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func FuzzParseJsonLine(f *testing.F) {
+	for _, seed := range []string{
+		`{"request":"put","queue":"queue1","job":{"title":"example-job"},"pri":123}`,
+		`{"request":"get","queues":["queue1","queue2"],"wait":true}`,
+		`{"request":"get","queues":["queue1"]}`,
+		`{"request":"delete","id":12345}`,
+		`{"request":"abort","id":12345}`,
+		`{"request":"put","queue":"q","job":null,"pri":-1}`,
+		`{"request":"delete","id":"12345"}`,
+		`{"request":"fly"}`,
+		`{"request":7}`,
+		`[]`,
+		`{`,
+		``,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, line []byte) {
+		request := jobcenter.ParseJsonLine(line)
+		// Exactly the field for the request's type is set
+		fields := map[jobcenter.ProcessResultType]bool{
+			jobcenter.Put:    request.Request != nil,
+			jobcenter.Get:    request.Get != nil,
+			jobcenter.Delete: request.Delete != nil,
+			jobcenter.Abort:  request.Abort != nil,
+			jobcenter.Error:  request.Error != nil,
+		}
+		for kind, set := range fields {
+			assert.Equal(t, kind == request.Type, set, "type %d with field %d", request.Type, kind)
+		}
+		if request.Type == jobcenter.Error {
+			return
+		}
+
+		// What was parsed reads back the same
+		var parsed any
+		switch request.Type {
+		case jobcenter.Put:
+			parsed = request.Request
+		case jobcenter.Get:
+			parsed = request.Get
+		case jobcenter.Delete:
+			parsed = request.Delete
+		case jobcenter.Abort:
+			parsed = request.Abort
+		}
+		encoded, err := json.Marshal(parsed)
+		require.NoError(t, err)
+		again := jobcenter.ParseJsonLine(encoded)
+		require.NoError(t, again.Error)
+		assert.Equal(t, request.Type, again.Type)
+		assert.Equal(t, request.Request, again.Request)
+		assert.Equal(t, request.Get, again.Get)
+		assert.Equal(t, request.Delete, again.Delete)
+		assert.Equal(t, request.Abort, again.Abort)
+	})
+}
@@ -0,0 +1,44 @@
+package jobcenter_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/JeremyFenwick/firewatch/internal/jobcenter"
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmptyQueuesAreDropped(t *testing.T) {
+	qm := jobcenter.NewQueueManager()
+	for i := range 100 {
+		queue := fmt.Sprintf("queue%d", i)
+		qm.PutJob(queue, &jobcenter.Job{Id: qm.GetNextId(), Priority: i, Queue: queue})
+	}
+	queues, jobs := qm.Counts()
+	assert.Equal(t, 100, queues)
+	assert.Equal(t, 100, jobs)
+
+	// Half are taken, half deleted
+	for i := range 50 {
+		_, ok := qm.GetPriorityJob(fmt.Sprintf("queue%d", i))
+		require.True(t, ok)
+		assert.True(t, qm.DeleteJob(51+i))
+	}
+	queues, jobs = qm.Counts()
+	assert.Zero(t, queues)
+	assert.Zero(t, jobs)
+}
+
+func TestQueueMetricsAreTotals(t *testing.T) {
+	srv := jobcenter.NewServer()
+	registry := metrics.NewRegistry()
+	registry.Register(srv.Metrics())
+	var out bytes.Buffer
+	require.NoError(t, registry.Write(&out))
+	assert.Contains(t, out.String(), `firewatch_jobcenter_queues{service="jobcenter"} 0`)
+	assert.Contains(t, out.String(), `firewatch_jobcenter_jobs_queued{service="jobcenter"} 0`)
+	assert.NotContains(t, out.String(), "queue=")
+}
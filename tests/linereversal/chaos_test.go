@@ -0,0 +1,81 @@
+package linereversal_test
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/chaos"
+	"github.com/JeremyFenwick/firewatch/internal/linereversal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionSurvivesUnreliableNetwork(t *testing.T) {
+	socket, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := linereversal.NewServer(time.Minute)
+	srv.SetLogger(slog.New(slog.DiscardHandler))
+	go srv.Serve(chaos.PacketConn(socket, chaos.Faults{Loss: 0.2, Duplicate: 0.1, Reorder: 0.2, Seed: 7}))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		srv.Stop(ctx)
+	})
+	client, err := net.Dial("udp", socket.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	input := "hello\nunreliable\nworld\n"
+	want := "olleh\nelbailernu\ndlrow\n"
+	connected, acked, received := false, 0, ""
+	send := func(format string, args ...any) {
+		client.Write([]byte(fmt.Sprintf(format, args...)))
+	}
+	handle := func(packet string) {
+		fields := strings.SplitN(strings.Trim(packet, "/"), "/", 4)
+		if len(fields) < 3 {
+			return
+		}
+		number, _ := strconv.Atoi(fields[2])
+		switch {
+		case fields[0] == "ack":
+			connected = true
+			acked = max(acked, number)
+		case fields[0] == "data" && len(fields) == 4:
+			// Keep only what continues the stream, the server sends the rest again
+			if number <= len(received) && number+len(fields[3]) > len(received) {
+				received += fields[3][len(received)-number:]
+			}
+			send("/ack/1/%d/", len(received))
+		}
+	}
+
+	// Send until everything is acked and the reversed lines are back, resending anything lost
+	buffer := make([]byte, 1000)
+	deadline := time.Now().Add(10 * time.Second)
+	for (acked < len(input) || len(received) < len(want)) && time.Now().Before(deadline) {
+		switch {
+		case !connected:
+			send("/connect/1/")
+		case acked < len(input):
+			end := min(acked+4, len(input))
+			send("/data/1/%d/%s/", acked, input[acked:end])
+		}
+		client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		for {
+			n, err := client.Read(buffer)
+			if err != nil {
+				break
+			}
+			handle(string(buffer[:n]))
+		}
+	}
+	assert.Equal(t, len(input), acked)
+	assert.Equal(t, want, received)
+}
@@ -0,0 +1,92 @@
+package linereversal_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/linereversal"
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Run with -race: the sessions give up on their unacked replies and close themselves while Stop
+// and metrics scrapes count them
+func TestDrainWhileSessionsClose(t *testing.T) {
+	srv := linereversal.NewServer(300 * time.Millisecond)
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	registry := metrics.NewRegistry()
+	registry.Register(srv.Metrics())
+
+	conn, err := net.Dial("udp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for session := range 10 {
+		_, err := fmt.Fprintf(conn, "/connect/%d/", session)
+		require.NoError(t, err)
+		// The reversed line is never acked
+		_, err = fmt.Fprintf(conn, "/data/%d/0/hello\n/", session)
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool { return len(srv.Sessions()) == 10 }, time.Second, 10*time.Millisecond)
+
+	stopped := make(chan struct{})
+	scraped := make(chan struct{})
+	go func() {
+		defer close(scraped)
+		for {
+			select {
+			case <-stopped:
+				return
+			default:
+				registry.Write(new(discard))
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, srv.Stop(ctx), "the sessions should time out before the deadline")
+	close(stopped)
+	<-scraped
+	assert.Empty(t, srv.Sessions())
+}
+
+type discard struct{}
+
+func (discard) Write(b []byte) (int, error) { return len(b), nil }
+
+// Run with -race: the admin API lists and disconnects sessions while they close themselves
+func TestListSessionsWhileTheyClose(t *testing.T) {
+	srv := linereversal.NewServer(300 * time.Millisecond)
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+
+	conn, err := net.Dial("udp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	for session := range 10 {
+		_, err := fmt.Fprintf(conn, "/connect/%d/", session)
+		require.NoError(t, err)
+		_, err = fmt.Fprintf(conn, "/data/%d/0/hello\n/", session)
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool { return len(srv.Sessions()) == 10 }, time.Second, 10*time.Millisecond)
+
+	// Half are disconnected, the rest give up on their unacked replies
+	for session := 0; session < 10; session += 2 {
+		assert.True(t, srv.Disconnect(uint64(session)))
+	}
+	assert.Eventually(t, func() bool {
+		for _, session := range srv.Sessions() {
+			assert.Equal(t, conn.LocalAddr().String(), session.Remote)
+			srv.Disconnect(session.ID + 1)
+		}
+		return len(srv.Sessions()) == 0
+	}, 5*time.Second, time.Millisecond)
+	assert.False(t, srv.Disconnect(1))
+}
@@ -0,0 +1,62 @@
+package linereversal_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/linereversal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandoffCarriesSessions(t *testing.T) {
+	old := linereversal.NewServer(time.Minute)
+	require.NoError(t, old.Start("127.0.0.1:0"))
+	// The client is not connected, so it hears from whichever server has its session
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, 999)
+	exchange := func(to net.Addr, message string) string {
+		_, err := client.WriteTo([]byte(message), to)
+		require.NoError(t, err)
+		n, _, err := client.ReadFrom(buffer)
+		require.NoError(t, err)
+		return string(buffer[:n])
+	}
+	assert.Equal(t, "/ack/7/0/", exchange(old.Addr(), "/connect/7/"))
+	// Half a line waits in the session for its newline
+	assert.Equal(t, "/ack/7/5/", exchange(old.Addr(), "/data/7/0/hello/"))
+
+	var state bytes.Buffer
+	require.NoError(t, old.Handoff(context.Background(), &state))
+	assert.Empty(t, old.Sessions(), "handed off sessions leave the old server")
+
+	srv := linereversal.NewServer(time.Minute)
+	require.NoError(t, srv.Restore(&state))
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		srv.Stop(ctx)
+	})
+	sessions := srv.Sessions()
+	require.Len(t, sessions, 1)
+	assert.Equal(t, uint64(7), sessions[0].ID)
+	assert.Equal(t, int64(5), sessions[0].BytesIn)
+
+	// The session carries on with no new connect
+	assert.Equal(t, "/ack/7/6/", exchange(srv.Addr(), "/data/7/5/\n/"))
+	n, _, err := client.ReadFrom(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "/data/7/0/olleh\n/", string(buffer[:n]))
+}
+
+func TestRestoreRejectsInvalidState(t *testing.T) {
+	srv := linereversal.NewServer(time.Minute)
+	assert.Error(t, srv.Restore(bytes.NewBufferString("not json")))
+}
@@ -0,0 +1,69 @@
+package linereversal_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/linereversal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServersOnFreePorts(t *testing.T) {
+	// Two instances can run side by side in the same process
+	first := startServer(t)
+	second := startServer(t)
+	assert.NotEqual(t, first.String(), second.String())
+
+	for _, addr := range []net.Addr{first, second} {
+		conn, err := net.Dial("udp", addr.String())
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+
+		_, err = conn.Write([]byte("/connect/12345/"))
+		require.NoError(t, err)
+		buffer := make([]byte, 999)
+		n, err := conn.Read(buffer)
+		require.NoError(t, err)
+		assert.Equal(t, "/ack/12345/0/", string(buffer[:n]))
+	}
+}
+
+func TestEscapedDataIsUnescapedOnce(t *testing.T) {
+	conn, err := net.Dial("udp", startServer(t).String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	// a\\\\b on the wire is the line a\\b, which unescaping twice would turn into a\b
+	replies := make(map[string]bool)
+	for _, message := range []string{`/connect/1/`, `/data/1/0/a\\\\b` + "\n/"} {
+		_, err = conn.Write([]byte(message))
+		require.NoError(t, err)
+	}
+	buffer := make([]byte, 999)
+	for range 3 {
+		n, err := conn.Read(buffer)
+		require.NoError(t, err)
+		replies[string(buffer[:n])] = true
+	}
+	assert.Equal(t, map[string]bool{
+		`/ack/1/0/`:                true,
+		`/ack/1/5/`:                true,
+		`/data/1/0/b\\\\a` + "\n/": true,
+	}, replies)
+}
+
+func startServer(t *testing.T) net.Addr {
+	srv := linereversal.NewServer(time.Minute)
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		srv.Stop(ctx)
+	})
+	return srv.Addr()
+}
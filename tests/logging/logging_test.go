@@ -0,0 +1,91 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/logging"
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer lets the server goroutines and the test share a log buffer
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) Lines() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return strings.Split(strings.TrimSpace(b.buffer.String()), "\n")
+}
+
+func TestNew(t *testing.T) {
+	var output bytes.Buffer
+	logger, err := logging.New(&output, logging.JSON, slog.LevelWarn)
+	require.NoError(t, err)
+	logger.Info("hidden")
+	logger.Warn("shown", "port", 5000)
+
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(output.Bytes(), &record))
+	assert.Equal(t, "shown", record["msg"])
+	assert.Equal(t, "WARN", record["level"])
+	assert.Equal(t, float64(5000), record["port"])
+
+	_, err = logging.New(&output, "xml", 0)
+	assert.ErrorContains(t, err, `unknown log format "xml"`)
+}
+
+func TestConnectionLogger(t *testing.T) {
+	output := &syncBuffer{}
+	logger, err := logging.New(output, logging.JSON, slog.LevelDebug)
+	require.NoError(t, err)
+
+	handled := make(chan struct{})
+	tcp := &server.TCPServer{Logger: logger, Handler: func(ctx context.Context, conn net.Conn) {
+		logging.FromContext(ctx).Info("Handling")
+		close(handled)
+	}}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, tcp.Start(listener))
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	<-handled
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, tcp.Stop(ctx))
+
+	// Every record about the connection carries the same id and the client address
+	var ids []any
+	for _, line := range output.Lines() {
+		var record map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		if record["conn_id"] == nil {
+			continue
+		}
+		assert.Equal(t, conn.LocalAddr().String(), record["remote"])
+		ids = append(ids, record["conn_id"])
+	}
+	require.Len(t, ids, 3)
+	assert.Equal(t, ids[0], ids[1])
+	assert.Equal(t, ids[1], ids[2])
+}
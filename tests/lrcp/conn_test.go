@@ -0,0 +1,61 @@
+package lrcp_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/linereversal"
+	"github.com/JeremyFenwick/firewatch/pkg/lrcp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialReversesLines(t *testing.T) {
+	srv := linereversal.NewServer(time.Minute)
+	srv.SetLogger(slog.New(slog.DiscardHandler))
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		srv.Stop(ctx)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dialer := lrcp.Dialer{Retransmit: 100 * time.Millisecond}
+	conn, err := dialer.Dial(ctx, srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	_, err = io.WriteString(conn, "hello\n")
+	require.NoError(t, err)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "olleh\n", line)
+
+	// Longer than one datagram, and with characters that need escaping
+	long := strings.Repeat("a/b\\c", 400)
+	_, err = io.WriteString(conn, long+"\n")
+	require.NoError(t, err)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("c\\b/a", 400)+"\n", line)
+
+	// A backslash before a slash, and one at the end of a datagram, are data like anything else
+	_, err = io.WriteString(conn, "a\\/b\\\n")
+	require.NoError(t, err)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "\\b/\\a\n", line)
+
+	require.NoError(t, conn.Close())
+	_, err = conn.Write([]byte("late\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,40 @@
+package lrcp_test
+
+import (
+	"testing"
+
+	"github.com/JeremyFenwick/firewatch/pkg/lrcp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeMessageFields(t *testing.T) {
+	// Data ending in an escaped backslash
+	message, err := lrcp.DecodeMessage([]byte(`/data/1/0/a\\/`))
+	require.NoError(t, err)
+	assert.Equal(t, []byte(`a\`), message.Data)
+
+	// Empty data
+	message, err = lrcp.DecodeMessage([]byte(`/data/1/0//`))
+	require.NoError(t, err)
+	assert.Empty(t, message.Data)
+
+	for _, invalid := range []string{
+		`/data/1/0/a\/`, // The closing slash is escaped
+		`/connect/1/2/`,
+		`/close/1/x/`,
+		`/ack/1/`,
+		`/hello/1/`,
+		`//connect/1/`,
+	} {
+		_, err := lrcp.DecodeMessage([]byte(invalid))
+		assert.Error(t, err, "message %s", invalid)
+	}
+}
+
+func TestPackDataMessageStopsAtTheLargestPosition(t *testing.T) {
+	message := &lrcp.Message{Type: "data", Session: 1}
+	packed := lrcp.PackDataMessage(message, []byte("hello"), 2147483647-3)
+	assert.Equal(t, 3, packed)
+	assert.Equal(t, []byte("hel"), message.Data)
+}
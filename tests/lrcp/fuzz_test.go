@@ -0,0 +1,84 @@
+package lrcp_test
+
+import (
+	"testing"
+
+	"github.com/JeremyFenwick/firewatch/pkg/lrcp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encode returns message as it goes on the wire
+func encode(t *testing.T, message *lrcp.Message) []byte {
+	buffer := make([]byte, 0, 2048)
+	n, err := message.Encode(buffer)
+	require.NoError(t, err)
+	return buffer[:n]
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	for _, seed := range []string{
+		"/connect/12345/",
+		"/ack/12345/100/",
+		"/data/12345/0/hello\n/",
+		`/data/12345/5/a\/b\\c/`,
+		`/data/1/0/\\/`,
+		"/close/12345/",
+		"/data/1/0//",
+		"/ack/2147483648/0/",
+		"/connect/-1/",
+		"//",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, datagram []byte) {
+		message, err := lrcp.DecodeMessage(datagram)
+		if err != nil {
+			return
+		}
+		require.True(t, message.Validate())
+		// Decoded data is unescaped, so it is packed again before encoding
+		again := &lrcp.Message{Type: message.Type, Session: message.Session, Length: message.Length}
+		if message.Type == "data" {
+			lrcp.PackDataMessage(again, message.Data, message.Position)
+		}
+		decoded, err := lrcp.DecodeMessage(encode(t, again))
+		require.NoError(t, err)
+		assert.Equal(t, message.Type, decoded.Type)
+		assert.Equal(t, message.Session, decoded.Session)
+		assert.Equal(t, message.Position, decoded.Position)
+		assert.Equal(t, message.Length, decoded.Length)
+		assert.Equal(t, string(message.Data), string(decoded.Data))
+	})
+}
+
+func FuzzUnescapeData(f *testing.F) {
+	for _, seed := range []string{"hello\n", `a/b\c`, `\`, `\\/`, "/////", ""} {
+		f.Add([]byte(seed), 0)
+	}
+	f.Add([]byte("x"), 2147483646)
+	f.Add([]byte("xy"), 2147483646)
+	f.Fuzz(func(t *testing.T, data []byte, position int) {
+		if position < 0 || position > 2147483647 {
+			return
+		}
+		// Packed data fits a datagram and unescapes back to what was packed
+		message := &lrcp.Message{Type: "data", Session: 2147483647}
+		used := lrcp.PackDataMessage(message, data, position)
+		require.LessOrEqual(t, used, len(data))
+		if len(data) > 0 && position < 2147483647 {
+			require.Positive(t, used)
+		}
+		encoded := encode(t, message)
+		assert.LessOrEqual(t, len(encoded), 999)
+		unescaped, err := lrcp.UnescapeData(message.Data)
+		require.NoError(t, err)
+		assert.Equal(t, string(data[:used]), string(unescaped))
+		decoded, err := lrcp.DecodeMessage(encoded)
+		require.NoError(t, err)
+		assert.Equal(t, string(data[:used]), string(decoded.Data))
+
+		// Anything at all either unescapes or is rejected
+		lrcp.UnescapeData(data)
+	})
+}
@@ -1,14 +1,14 @@
-package linereversal_test
+package lrcp_test
 
 import (
 	"testing"
 
-	"github.com/JeremyFenwick/firewatch/internal/linereversal"
+	"github.com/JeremyFenwick/firewatch/pkg/lrcp"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestCreateLRConnectMessage(t *testing.T) {
-	connect := &linereversal.LRMessage{
+	connect := &lrcp.Message{
 		Type:    "connect",
 		Session: 12345,
 	}
@@ -19,7 +19,7 @@ func TestCreateLRConnectMessage(t *testing.T) {
 }
 
 func TestCreateLRAckMessage(t *testing.T) {
-	ack := &linereversal.LRMessage{
+	ack := &lrcp.Message{
 		Type:    "ack",
 		Session: 12345,
 		Length:  0,
@@ -31,7 +31,7 @@ func TestCreateLRAckMessage(t *testing.T) {
 }
 
 func TestCreateLRDataMessage(t *testing.T) {
-	data := &linereversal.LRMessage{
+	data := &lrcp.Message{
 		Type:     "data",
 		Session:  12345,
 		Position: 5,
@@ -44,7 +44,7 @@ func TestCreateLRDataMessage(t *testing.T) {
 }
 
 func TestCreateLRCloseMessage(t *testing.T) {
-	close := &linereversal.LRMessage{
+	close := &lrcp.Message{
 		Type:    "close",
 		Session: 12345,
 	}
@@ -55,7 +55,7 @@ func TestCreateLRCloseMessage(t *testing.T) {
 }
 
 func TestValidateConnectMessage(t *testing.T) {
-	connect := &linereversal.LRMessage{
+	connect := &lrcp.Message{
 		Type:     "connect",
 		Session:  12345,
 		Position: 4,
@@ -64,7 +64,7 @@ func TestValidateConnectMessage(t *testing.T) {
 }
 
 func TestValidateAckMessage(t *testing.T) {
-	ack := &linereversal.LRMessage{
+	ack := &lrcp.Message{
 		Type:    "ack",
 		Session: -12345,
 		Length:  4,
@@ -73,13 +73,13 @@ func TestValidateAckMessage(t *testing.T) {
 }
 
 func TestPackDataMessage(t *testing.T) {
-	message := &linereversal.LRMessage{
+	message := &lrcp.Message{
 		Type:     "data",
 		Session:  12345,
 		Position: 0,
 	}
 	rawData := []byte("hello/")
-	added := linereversal.PackDataMessage(message, rawData, 0)
+	added := lrcp.PackDataMessage(message, rawData, 0)
 	assert.Equal(t, []byte("hello\\/"), message.Data)
 	assert.Equal(t, 6, added)
 }
@@ -87,7 +87,7 @@ func TestPackDataMessage(t *testing.T) {
 func TestDecodeMessage(t *testing.T) {
 	message := "/connect/12345/"
 	buffer := []byte(message)
-	decodedMessage, err := linereversal.DecodeLRMessage(buffer)
+	decodedMessage, err := lrcp.DecodeMessage(buffer)
 	assert.NoError(t, err)
 	assert.Equal(t, "connect", decodedMessage.Type)
 	assert.Equal(t, 12345, decodedMessage.Session)
@@ -96,7 +96,7 @@ func TestDecodeMessage(t *testing.T) {
 func TestSlashMessage(t *testing.T) {
 	message := "/data/123/0/foo\\/\\/bar\\/\\/baz/"
 	buffer := []byte(message)
-	decodedMessage, err := linereversal.DecodeLRMessage(buffer)
+	decodedMessage, err := lrcp.DecodeMessage(buffer)
 	assert.NoError(t, err)
 	assert.Equal(t, "data", decodedMessage.Type)
 	assert.Equal(t, 123, decodedMessage.Session)
@@ -106,7 +106,20 @@ func TestSlashMessage(t *testing.T) {
 
 func TestUnescapeData(t *testing.T) {
 	data := []byte("a\\/b")
-	unescaped, err := linereversal.UnescapeData(data)
+	unescaped, err := lrcp.UnescapeData(data)
 	assert.NoError(t, err)
 	assert.Equal(t, []byte("a/b"), unescaped)
 }
+
+func TestEncodeIntoBuffers(t *testing.T) {
+	message := &lrcp.Message{Type: "ack", Session: 1, Length: 2}
+
+	// Only the capacity matters
+	buffer := make([]byte, 0, 10)
+	n, err := message.Encode(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, "/ack/1/2/", string(buffer[:n]))
+
+	_, err = message.Encode(make([]byte, 8))
+	assert.Error(t, err, "the message doesn't fit")
+}
@@ -0,0 +1,45 @@
+package meanstoanend_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/meanstoanend"
+	protocol "github.com/JeremyFenwick/firewatch/pkg/meanstoanend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientSession(t *testing.T) {
+	srv := meanstoanend.NewServer()
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := protocol.NewClient(srv.Addr().String())
+	defer client.Close()
+
+	require.NoError(t, client.Insert(ctx, 12345, 101))
+	require.NoError(t, client.Insert(ctx, 12346, 102))
+	require.NoError(t, client.Insert(ctx, 40960, 5))
+	mean, err := client.Mean(ctx, 12288, 16384)
+	require.NoError(t, err)
+	assert.Equal(t, int32(101), mean)
+
+	// The prices were kept by the connection that broke, so the client doesn't quietly reconnect
+	for _, session := range srv.Sessions() {
+		srv.Disconnect(session.ID)
+	}
+	require.Eventually(t, func() bool {
+		_, err := client.Mean(ctx, 12288, 16384)
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	_, err = client.Mean(ctx, 12288, 16384)
+	assert.ErrorIs(t, err, protocol.ErrSessionLost)
+
+	require.NoError(t, client.Reset())
+	mean, err = client.Mean(ctx, 12288, 16384)
+	require.NoError(t, err)
+	assert.Equal(t, int32(0), mean)
+}
@@ -0,0 +1,68 @@
+package meanstoanend_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"testing"
+
+	"github.com/JeremyFenwick/firewatch/internal/meanstoanend"
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// means is what the server should reply to a session: the mean of each query over the prices
+// inserted before it. Bytes after the last whole frame are ignored
+func means(session []byte) []byte {
+	prices := map[int32]int32{}
+	var replies []byte
+	for ; len(session) >= 9; session = session[9:] {
+		first := int32(binary.BigEndian.Uint32(session[1:5]))
+		second := int32(binary.BigEndian.Uint32(session[5:9]))
+		switch session[0] {
+		case 'I':
+			prices[first] = second
+		case 'Q':
+			var sum, count int64
+			for at, price := range prices {
+				if at >= first && at <= second {
+					sum += int64(price)
+					count++
+				}
+			}
+			var mean int32
+			if count > 0 {
+				mean = int32(sum / count)
+			}
+			replies = binary.BigEndian.AppendUint32(replies, uint32(mean))
+		}
+	}
+	return replies
+}
+
+func FuzzFrames(f *testing.F) {
+	f.Add(bytes.Join([][]byte{
+		createInsertMessage(12345, 101),
+		createInsertMessage(12346, 102),
+		createInsertMessage(12347, 100),
+		createInsertMessage(40960, 5),
+		createQueryMessage(12288, 16384),
+	}, nil))
+	f.Add(createQueryMessage(1000, 0))
+	f.Add(append(createInsertMessage(-5, -2147483648), createQueryMessage(-2147483648, 2147483647)...))
+	f.Add(append(createInsertMessage(1, 2147483647), append(createInsertMessage(2, 2147483647), createQueryMessage(0, 3)...)...))
+	f.Add([]byte("X12345678" + "Q\x00\x00\x00\x00\x00\x00\x00"))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, session []byte) {
+		// Queries scan every price, so long sessions only make fuzzing slow
+		if len(session) > 9*1000 {
+			return
+		}
+		var replies bytes.Buffer
+		err := meanstoanend.Session(bytes.NewReader(session), &replies, slog.New(slog.DiscardHandler), metrics.NewService("meanstoanend"))
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(means(session), replies.Bytes()), "want %x, got %x", means(session), replies.Bytes())
+	})
+}
@@ -1,6 +1,7 @@
 package meanstoanend_test
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"net"
@@ -12,12 +13,13 @@ import (
 )
 
 func TestMeansToAnEnd(t *testing.T) {
-	// Start the server in a goroutine (assuming it's not already running)
-	port := 5002
-	go meanstoanend.Listen(port) // Replace 'primetime' with your actual package name
-
-	// Give the server a little time to start
-	time.Sleep(100 * time.Millisecond) // Adjust as needed
+	// Start the server on a free port
+	srv := meanstoanend.NewServer()
+	if err := srv.Start("127.0.0.1:0"); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	port := srv.Addr().(*net.TCPAddr).Port
 
 	t.Run("Test server response", func(t *testing.T) {
 		testSession(t, port)
@@ -0,0 +1,106 @@
+package metrics_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	registry := metrics.NewRegistry()
+	chat := metrics.NewService("budgetchat")
+	chat.ActiveConnections.Set(2)
+	chat.BytesIn.Add(10)
+	chat.RegisterGaugeFunc("budgetchat_room_size", "Users currently in the chat room", func() float64 { return 2 })
+	jobs := metrics.NewService("jobcenter")
+	jobs.ProtocolErrors.Inc()
+	jobs.RegisterGaugeVecFunc("jobcenter_queue_depth", "Jobs waiting in each queue", "queue", func() map[string]float64 {
+		return map[string]float64{"queue2": 1, "queue\"1": 3}
+	})
+	registry.Register(chat)
+	registry.Register(jobs)
+
+	var output strings.Builder
+	require.NoError(t, registry.Write(&output))
+	expected := `# HELP firewatch_connections_active Connections currently open
+# TYPE firewatch_connections_active gauge
+firewatch_connections_active{service="budgetchat"} 2
+firewatch_connections_active{service="jobcenter"} 0
+# HELP firewatch_connections_accepted_total Connections accepted since start
+# TYPE firewatch_connections_accepted_total counter
+firewatch_connections_accepted_total{service="budgetchat"} 0
+firewatch_connections_accepted_total{service="jobcenter"} 0
+# HELP firewatch_connections_rejected_total Connections closed on accept by a connection limit
+# TYPE firewatch_connections_rejected_total counter
+firewatch_connections_rejected_total{service="budgetchat"} 0
+firewatch_connections_rejected_total{service="jobcenter"} 0
+# HELP firewatch_bytes_received_total Bytes read from clients
+# TYPE firewatch_bytes_received_total counter
+firewatch_bytes_received_total{service="budgetchat"} 10
+firewatch_bytes_received_total{service="jobcenter"} 0
+# HELP firewatch_bytes_sent_total Bytes written to clients
+# TYPE firewatch_bytes_sent_total counter
+firewatch_bytes_sent_total{service="budgetchat"} 0
+firewatch_bytes_sent_total{service="jobcenter"} 0
+# HELP firewatch_protocol_errors_total Malformed or invalid requests from clients
+# TYPE firewatch_protocol_errors_total counter
+firewatch_protocol_errors_total{service="budgetchat"} 0
+firewatch_protocol_errors_total{service="jobcenter"} 1
+# HELP firewatch_budgetchat_room_size Users currently in the chat room
+# TYPE firewatch_budgetchat_room_size gauge
+firewatch_budgetchat_room_size{service="budgetchat"} 2
+# HELP firewatch_jobcenter_queue_depth Jobs waiting in each queue
+# TYPE firewatch_jobcenter_queue_depth gauge
+firewatch_jobcenter_queue_depth{service="jobcenter",queue="queue\"1"} 3
+firewatch_jobcenter_queue_depth{service="jobcenter",queue="queue2"} 1
+`
+	assert.Equal(t, expected, output.String())
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.Register(metrics.NewService("smoketest"))
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, metrics.ContentType, recorder.Header().Get("Content-Type"))
+	assert.Contains(t, recorder.Body.String(), `firewatch_connections_active{service="smoketest"} 0`)
+}
+
+func TestTCPServerCounts(t *testing.T) {
+	service := metrics.NewService("echo")
+	srv := &server.TCPServer{
+		Metrics: service,
+		Handler: func(ctx context.Context, conn net.Conn) {
+			io.Copy(conn, conn)
+		},
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, srv.Start(listener))
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	reply := make([]byte, 5)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), service.ActiveConnections.Value())
+	assert.Equal(t, int64(1), service.AcceptedConnections.Value())
+	assert.Equal(t, int64(5), service.BytesIn.Value())
+	assert.Equal(t, int64(5), service.BytesOut.Value())
+
+	conn.Close()
+	assert.Eventually(t, func() bool { return service.ActiveConnections.Value() == 0 }, time.Second, 10*time.Millisecond)
+}
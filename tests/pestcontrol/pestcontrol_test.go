@@ -0,0 +1,247 @@
+package pestcontrol_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/pestcontrol"
+	protocol "github.com/JeremyFenwick/firewatch/pkg/pestcontrol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHelloMessage(t *testing.T) {
+	// The example from the problem statement
+	expected, _ := hex.DecodeString("50000000190000000b70657374636f6e74726f6c00000001ce")
+	hello := &protocol.HelloMessage{Protocol: protocol.Protocol, Version: protocol.Version}
+	encoded, err := hello.Encode()
+	require.NoError(t, err)
+	assert.Equal(t, expected, encoded)
+
+	decoded, err := protocol.Decode(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, hello, decoded)
+}
+
+func TestRoundTrip(t *testing.T) {
+	messages := []protocol.Message{
+		&protocol.ErrorMessage{Content: "bad"},
+		&protocol.OKMessage{},
+		&protocol.DialAuthorityMessage{Site: 12345},
+		&protocol.TargetPopulationsMessage{Site: 12345, Populations: []protocol.Target{
+			{Species: "dog", Min: 1, Max: 3},
+			{Species: "rat", Min: 0, Max: 10},
+		}},
+		&protocol.CreatePolicyMessage{Species: "dog", Action: protocol.Conserve},
+		&protocol.DeletePolicyMessage{Policy: 123},
+		&protocol.PolicyResultMessage{Policy: 123},
+		&protocol.SiteVisitMessage{Site: 12345, Populations: []protocol.Observation{
+			{Species: "dog", Count: 1},
+			{Species: "rat", Count: 5},
+		}},
+	}
+	for _, message := range messages {
+		encoded, err := message.Encode()
+		require.NoError(t, err)
+		decoded, err := protocol.Decode(encoded)
+		require.NoError(t, err)
+		assert.Equal(t, message, decoded)
+	}
+}
+
+func TestInvalidMessages(t *testing.T) {
+	hello, _ := (&protocol.HelloMessage{Protocol: protocol.Protocol, Version: protocol.Version}).Encode()
+
+	badChecksum := append([]byte(nil), hello...)
+	badChecksum[len(badChecksum)-1]++
+	_, err := protocol.Decode(badChecksum)
+	assert.ErrorIs(t, err, protocol.ErrInvalidMessage)
+
+	unknownType, _ := hex.DecodeString("99000000066b")
+	_, err = protocol.Decode(unknownType)
+	assert.ErrorIs(t, err, protocol.ErrInvalidMessage)
+
+	// A string length that runs past the end of the message
+	longString, _ := hex.DecodeString("51000000090000ffff00")
+	longString[len(longString)-1] = -checksum(longString)
+	_, err = protocol.Decode(longString)
+	assert.ErrorIs(t, err, protocol.ErrInvalidMessage)
+}
+
+func checksum(message []byte) byte {
+	var sum byte
+	for _, b := range message {
+		sum += b
+	}
+	return sum
+}
+
+// authority is a stand in for the protohackers authority server
+type authority struct {
+	t        *testing.T
+	targets  map[uint32][]protocol.Target
+	mutex    sync.Mutex
+	nextID   uint32
+	policies map[uint32]map[protocol.Str]protocol.U8 // Site -> species -> action
+}
+
+func startAuthority(t *testing.T, targets map[uint32][]protocol.Target) (*authority, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	a := &authority{t: t, targets: targets, policies: make(map[uint32]map[protocol.Str]protocol.U8)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go a.serve(conn)
+		}
+	}()
+	return a, listener.Addr().String()
+}
+
+func (a *authority) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	send(a.t, conn, &protocol.HelloMessage{Protocol: protocol.Protocol, Version: protocol.Version})
+	if _, err := protocol.ReadMessage(reader); err != nil {
+		return
+	}
+	message, err := protocol.ReadMessage(reader)
+	if err != nil {
+		return
+	}
+	site := uint32(message.(*protocol.DialAuthorityMessage).Site)
+	send(a.t, conn, &protocol.TargetPopulationsMessage{Site: protocol.U32(site), Populations: a.targets[site]})
+
+	ids := make(map[protocol.U32]protocol.Str)
+	for {
+		message, err := protocol.ReadMessage(reader)
+		if err != nil {
+			return
+		}
+		a.mutex.Lock()
+		if a.policies[site] == nil {
+			a.policies[site] = make(map[protocol.Str]protocol.U8)
+		}
+		switch message := message.(type) {
+		case *protocol.CreatePolicyMessage:
+			a.nextID++
+			ids[protocol.U32(a.nextID)] = message.Species
+			a.policies[site][message.Species] = message.Action
+			send(a.t, conn, &protocol.PolicyResultMessage{Policy: protocol.U32(a.nextID)})
+		case *protocol.DeletePolicyMessage:
+			delete(a.policies[site], ids[message.Policy])
+			send(a.t, conn, &protocol.OKMessage{})
+		}
+		a.mutex.Unlock()
+	}
+}
+
+func (a *authority) Policies(site uint32) map[protocol.Str]protocol.U8 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	policies := make(map[protocol.Str]protocol.U8)
+	for species, action := range a.policies[site] {
+		policies[species] = action
+	}
+	return policies
+}
+
+func send(t *testing.T, conn net.Conn, message protocol.Message) {
+	encoded, err := message.Encode()
+	require.NoError(t, err)
+	conn.Write(encoded)
+}
+
+func startServer(t *testing.T, authorityAddress string) string {
+	server := pestcontrol.NewServer(authorityAddress)
+	require.NoError(t, server.Start("127.0.0.1:0"))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Stop(ctx)
+	})
+	return server.Addr().String()
+}
+
+func connect(t *testing.T, address string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	reader := bufio.NewReader(conn)
+	message, err := protocol.ReadMessage(reader)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.HelloType, message.GetType())
+	return conn, reader
+}
+
+func TestPolicies(t *testing.T) {
+	authority, authorityAddress := startAuthority(t, map[uint32][]protocol.Target{
+		12345: {
+			{Species: "dog", Min: 1, Max: 3},
+			{Species: "rat", Min: 0, Max: 10},
+			{Species: "fox", Min: 2, Max: 4},
+		},
+	})
+	conn, _ := connect(t, startServer(t, authorityAddress))
+	send(t, conn, &protocol.HelloMessage{Protocol: protocol.Protocol, Version: protocol.Version})
+
+	// Too many rats, no foxes and the right number of dogs. Cats have no target
+	send(t, conn, &protocol.SiteVisitMessage{Site: 12345, Populations: []protocol.Observation{
+		{Species: "dog", Count: 2},
+		{Species: "rat", Count: 20},
+		{Species: "cat", Count: 5},
+	}})
+	expected := map[protocol.Str]protocol.U8{"rat": protocol.Cull, "fox": protocol.Conserve}
+	assert.Eventually(t, func() bool { return assert.ObjectsAreEqual(expected, authority.Policies(12345)) }, time.Second, 10*time.Millisecond)
+
+	// Rats are back in range and dogs are now scarce
+	send(t, conn, &protocol.SiteVisitMessage{Site: 12345, Populations: []protocol.Observation{
+		{Species: "dog", Count: 0},
+		{Species: "rat", Count: 5},
+		{Species: "fox", Count: 3},
+	}})
+	expected = map[protocol.Str]protocol.U8{"dog": protocol.Conserve}
+	assert.Eventually(t, func() bool { return assert.ObjectsAreEqual(expected, authority.Policies(12345)) }, time.Second, 10*time.Millisecond)
+}
+
+func TestClientErrors(t *testing.T) {
+	_, authorityAddress := startAuthority(t, nil)
+	address := startServer(t, authorityAddress)
+
+	cases := map[string]protocol.Message{
+		"Bad hello":      &protocol.HelloMessage{Protocol: "pestcontrol", Version: 2},
+		"Skipped hello":  &protocol.SiteVisitMessage{Site: 1},
+		"Server message": &protocol.OKMessage{},
+	}
+	for name, message := range cases {
+		t.Run(name, func(t *testing.T) {
+			conn, reader := connect(t, address)
+			send(t, conn, message)
+			reply, err := protocol.ReadMessage(reader)
+			require.NoError(t, err)
+			assert.Equal(t, protocol.ErrorType, reply.GetType())
+		})
+	}
+
+	t.Run("Conflicting counts", func(t *testing.T) {
+		conn, reader := connect(t, address)
+		send(t, conn, &protocol.HelloMessage{Protocol: protocol.Protocol, Version: protocol.Version})
+		send(t, conn, &protocol.SiteVisitMessage{Site: 1, Populations: []protocol.Observation{
+			{Species: "dog", Count: 1},
+			{Species: "dog", Count: 2},
+		}})
+		reply, err := protocol.ReadMessage(reader)
+		require.NoError(t, err)
+		assert.Equal(t, protocol.ErrorType, reply.GetType())
+	})
+}
@@ -0,0 +1,135 @@
+package primetime_test
+
+import (
+	"bufio"
+	"context"
+	"math/big"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/primetime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsPrimeBig(t *testing.T) {
+	for number, want := range map[string]bool{
+		"2305843009213693951":          true,  // 2^61-1, which a float64 rounds to 2^61
+		"2305843009213693953":          false, // 2^61+1
+		"18446744073709551557":         true,  // The largest 64 bit prime
+		"3825123056546413051":          false, // Passes Miller-Rabin for every base up to 23
+		"618970019642690137449562111":  true,  // 2^89-1
+		"618970019642690137449562113":  false, // 2^89+1
+		"-618970019642690137449562111": false,
+	} {
+		n, ok := new(big.Int).SetString(number, 10)
+		require.True(t, ok)
+		assert.Equal(t, want, primetime.IsPrimeBig(n), "number %s", number)
+	}
+}
+
+func TestIsPrimeBigMatchesProbablyPrime(t *testing.T) {
+	for range 10000 {
+		n := new(big.Int).SetUint64(rand.Uint64() | 1)
+		assert.Equal(t, n.ProbablyPrime(20), primetime.IsPrimeBig(n), "number %s", n)
+	}
+}
+
+func TestExactNumbers(t *testing.T) {
+	srv := primetime.NewServer()
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	for _, request := range []struct {
+		number string
+		prime  bool
+	}{
+		{"2305843009213693951", true},
+		{"9007199254740993", false},
+		{"618970019642690137449562111", true},
+		{"618970019642690137449562111.0", true},
+		{"6.18970019642690137449562111e26", true},
+		{"7.0", true},
+		{"7e0", true},
+		{"70e-1", true},
+		{"7.0000000000000000000001", false},
+		{"1e1", false},
+		{"1e40", false},
+		{"1.0000000000000000000000000000000000000121e40", true}, // 10^40+121
+		{"10000000000000000000000000000000000000121e-0", true},
+		{"1.0000000000000000000000000000000000000123e40", false},
+		{"1e100", false},
+		{"1" + strings.Repeat("0", 97) + "267", true}, // 10^100+267
+		{"1." + strings.Repeat("0", 97) + "267e100", true},
+		{"1e-99999999999", false},
+		{"0e99999999999", false},
+		{"-2305843009213693951", false},
+	} {
+		_, err := conn.Write([]byte(`{"method":"isPrime","number":` + request.number + "}\n"))
+		require.NoError(t, err)
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		want := `{"method":"isPrime","prime":false}`
+		if request.prime {
+			want = `{"method":"isPrime","prime":true}`
+		}
+		assert.Equal(t, want+"\n", line, "number %s", request.number)
+	}
+}
+
+func TestNumberTooLarge(t *testing.T) {
+	srv := primetime.NewServer()
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Numbers too large to test that are negative or divisible by 2 or 5 are known not to be prime
+	reader := bufio.NewReader(conn)
+	for request, want := range map[string]string{
+		`{"method":"isPrime","number":1e5000}`:               `{"method":"isPrime","prime":false}`,
+		`{"method":"isPrime","number":1e99999999999}`:        `{"method":"isPrime","prime":false}`,
+		`{"method":"isPrime","number":-1e99999999999}`:       `{"method":"isPrime","prime":false}`,
+		`{"method":"isPrime","number":` + even4097Bits + `}`: `{"method":"isPrime","prime":false}`,
+		`{"method":"isPrime","number":-` + odd4097Bits + `}`: `{"method":"isPrime","prime":false}`,
+		`{"method":"isPrime","number":7}`:                    `{"method":"isPrime","prime":true}`,
+	} {
+		_, err = conn.Write([]byte(request + "\n"))
+		require.NoError(t, err)
+		response, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, want+"\n", response, "request %.50s", request)
+	}
+
+	// The rest are refused, as they are by the other methods
+	for _, request := range []string{
+		`{"method":"isPrime","number":` + odd4097Bits + `}`,
+		`{"method":"nextPrime","number":1e5000}`,
+	} {
+		conn, err := net.Dial("tcp", srv.Addr().String())
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write([]byte(request + "\n"))
+		require.NoError(t, err)
+		response, err := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		assert.Error(t, err, "the server should hang up")
+		assert.Contains(t, response, "more than 4096 bits", "request %.50s", request)
+	}
+}
+
+var (
+	even4097Bits = new(big.Int).Lsh(big.NewInt(1), 4096).String() // 2^4096
+	// 2^4096+1, which ends in 7
+	odd4097Bits = new(big.Int).Add(new(big.Int).Lsh(big.NewInt(1), 4096), big.NewInt(1)).String()
+)
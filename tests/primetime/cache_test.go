@@ -0,0 +1,143 @@
+package primetime_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/primetime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := primetime.NewCache(2)
+	cache.Add("a", []byte("1"))
+	cache.Add("b", []byte("2"))
+	_, ok := cache.Get("a")
+	require.True(t, ok)
+
+	// b was used least recently
+	cache.Add("c", []byte("3"))
+	_, ok = cache.Get("b")
+	assert.False(t, ok)
+	value, ok := cache.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1"), value)
+	assert.Equal(t, 2, cache.Len())
+	assert.Equal(t, int64(2), cache.Hits.Value())
+	assert.Equal(t, int64(1), cache.Misses.Value())
+
+	cache.Resize(1)
+	assert.Equal(t, 1, cache.Len())
+	_, ok = cache.Get("a")
+	assert.True(t, ok, "a was used most recently")
+
+	cache.Resize(0)
+	cache.Add("d", []byte("4"))
+	assert.Equal(t, 0, cache.Len())
+}
+
+func TestCacheConcurrentUse(t *testing.T) {
+	cache := primetime.NewCache(100)
+	var wg sync.WaitGroup
+	for worker := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 1000 {
+				key := strconv.Itoa((worker + i) % 200)
+				if value, ok := cache.Get(key); ok {
+					assert.Equal(t, key, string(value))
+				} else {
+					cache.Add(key, []byte(key))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 100, cache.Len())
+}
+
+func TestServerCachesResponses(t *testing.T) {
+	for _, size := range []int{primetime.DefaultCacheSize, 0} {
+		t.Run(fmt.Sprintf("size %d", size), func(t *testing.T) {
+			srv := primetime.NewServer()
+			srv.SetCacheSize(size)
+			require.NoError(t, srv.Start("127.0.0.1:0"))
+			t.Cleanup(func() { srv.Stop(context.Background()) })
+			conn, err := net.Dial("tcp", srv.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			reader := bufio.NewReader(conn)
+
+			for range 3 {
+				for request, want := range map[string]string{
+					`{"method":"isPrime","number":7919}`:       `{"method":"isPrime","prime":true}`,
+					`{"method":"isPrime","number":7919.5}`:     `{"method":"isPrime","prime":false}`,
+					`{"number":84,"method":"factorize"}`:       `{"method":"factorize","factors":[2,2,3,7]}`,
+					`{"method":"primeCount","number":7919}`:    `{"method":"primeCount","count":1000}`,
+					`{"method":"nextPrime","number":7919}`:     `{"method":"nextPrime","number":7927}`,
+					`{"method":"isPrime","number":7919,"x":1}`: `{"method":"isPrime","prime":true}`,
+				} {
+					_, err := conn.Write([]byte(request + "\n"))
+					require.NoError(t, err)
+					line, err := reader.ReadString('\n')
+					require.NoError(t, err)
+					assert.Equal(t, want+"\n", line, "request %s", request)
+				}
+			}
+
+			hits := cacheHits(t, srv.Metrics())
+			if size == 0 {
+				assert.Zero(t, hits)
+			} else {
+				// The two isPrime 7919 requests share an entry, and every round after the first hits
+				assert.Equal(t, 2*6+1, hits)
+			}
+		})
+	}
+}
+
+func TestMalformedRequestsAreNotCached(t *testing.T) {
+	srv := primetime.NewServer()
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+
+	for range 2 {
+		conn, err := net.Dial("tcp", srv.Addr().String())
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write([]byte(`{"method":"prevPrime","number":2}` + "\n"))
+		require.NoError(t, err)
+		response, err := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		assert.Error(t, err, "the server should hang up")
+		assert.Contains(t, response, "Malformed request")
+	}
+}
+
+// cacheHits reads the primetime_cache_hits_total counter from m
+func cacheHits(t *testing.T, m *metrics.Service) int {
+	registry := metrics.NewRegistry()
+	registry.Register(m)
+	var out bytes.Buffer
+	require.NoError(t, registry.Write(&out))
+	for _, line := range bytes.Split(out.Bytes(), []byte("\n")) {
+		if value, ok := bytes.CutPrefix(line, []byte(`firewatch_primetime_cache_hits_total{service="primetime"} `)); ok {
+			hits, err := strconv.Atoi(string(value))
+			require.NoError(t, err)
+			return hits
+		}
+	}
+	t.Fatalf("no cache hits metric in\n%s", out.String())
+	return 0
+}
@@ -0,0 +1,35 @@
+package primetime_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/primetime"
+	protocol "github.com/JeremyFenwick/firewatch/pkg/primetime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIsPrime(t *testing.T) {
+	srv := primetime.NewServer()
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := protocol.NewClient(srv.Addr().String())
+	defer client.Close()
+
+	for number, want := range map[int64]bool{-7: false, 1: false, 2: true, 91: false, 7919: true} {
+		prime, err := client.IsPrime(ctx, number)
+		require.NoError(t, err)
+		assert.Equal(t, want, prime, "number %d", number)
+	}
+
+	for _, session := range srv.Sessions() {
+		srv.Disconnect(session.ID)
+	}
+	prime, err := client.IsPrime(ctx, 13)
+	require.NoError(t, err)
+	assert.True(t, prime)
+}
@@ -0,0 +1,157 @@
+package primetime_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"math/big"
+	"math/rand/v2"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/primetime"
+	protocol "github.com/JeremyFenwick/firewatch/pkg/primetime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFactorize(t *testing.T) {
+	assert.Equal(t, []uint64{}, primetime.Factorize(1))
+	assert.Equal(t, []uint64{2, 2, 3, 7}, primetime.Factorize(84))
+	assert.Equal(t, []uint64{4294967291, 4294967291}, primetime.Factorize(4294967291*4294967291))
+	assert.Equal(t, []uint64{18446744073709551557}, primetime.Factorize(18446744073709551557))
+
+	for range 1000 {
+		n := rand.Uint64()
+		product := uint64(1)
+		for _, factor := range primetime.Factorize(n) {
+			assert.True(t, primetime.IsPrimeBig(new(big.Int).SetUint64(factor)), "factor %d of %d", factor, n)
+			product *= factor
+		}
+		assert.Equal(t, n, product)
+	}
+}
+
+func TestPrimeCount(t *testing.T) {
+	for n, want := range map[int]int{-5: 0, 1: 0, 2: 1, 3: 2, 10: 4, 100: 25, 1_000_000: 78498, 10_000_000: 664579} {
+		assert.Equal(t, want, primetime.PrimeCount(n), "up to %d", n)
+	}
+}
+
+func TestNextAndPrevPrime(t *testing.T) {
+	for n, want := range map[int64]int64{-10: 2, 0: 2, 2: 3, 3: 5, 13: 17, 24: 29} {
+		assert.Equal(t, big.NewInt(want), primetime.NextPrime(big.NewInt(n)), "after %d", n)
+	}
+	for n, want := range map[int64]int64{3: 2, 4: 3, 13: 11, 30: 29} {
+		assert.Equal(t, big.NewInt(want), primetime.PrevPrime(big.NewInt(n)), "before %d", n)
+	}
+	assert.Nil(t, primetime.PrevPrime(big.NewInt(2)))
+
+	// 2^89-1 is prime
+	mersenne, _ := new(big.Int).SetString("618970019642690137449562111", 10)
+	assert.Equal(t, mersenne, primetime.NextPrime(new(big.Int).Sub(mersenne, big.NewInt(5))))
+	assert.Equal(t, mersenne, primetime.PrevPrime(new(big.Int).Add(mersenne, big.NewInt(1))))
+}
+
+func TestClientMethods(t *testing.T) {
+	srv := primetime.NewServer()
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := protocol.NewClient(srv.Addr().String())
+	defer client.Close()
+
+	factors, err := client.Factorize(ctx, 600851475143)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{71, 839, 1471, 6857}, factors)
+
+	next, err := client.NextPrime(ctx, big.NewInt(7919))
+	require.NoError(t, err)
+	assert.Equal(t, big.NewInt(7927), next)
+
+	prev, err := client.PrevPrime(ctx, big.NewInt(7919))
+	require.NoError(t, err)
+	assert.Equal(t, big.NewInt(7907), prev)
+
+	count, err := client.PrimeCount(ctx, 1000)
+	require.NoError(t, err)
+	assert.Equal(t, 168, count)
+
+	primes, err := client.PrimesInRange(ctx, big.NewInt(90), big.NewInt(110))
+	require.NoError(t, err)
+	assert.Equal(t, []*big.Int{big.NewInt(97), big.NewInt(101), big.NewInt(103), big.NewInt(107), big.NewInt(109)}, primes)
+
+	primes, err = client.PrimesInRange(ctx, big.NewInt(24), big.NewInt(28))
+	require.NoError(t, err)
+	assert.Empty(t, primes)
+
+	// A refused request explains why, and the client reconnects for the next one
+	_, err = client.PrevPrime(ctx, big.NewInt(2))
+	var rejected *protocol.RejectedError
+	require.ErrorAs(t, err, &rejected)
+	assert.Contains(t, rejected.Reason, "no prime below 2")
+	prime, err := client.IsPrime(ctx, 13)
+	require.NoError(t, err)
+	assert.True(t, prime)
+}
+
+// Numbers written with an exponent are exact, however large
+func TestExponentFormMethodRequests(t *testing.T) {
+	srv := primetime.NewServer()
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	for _, exchange := range []struct{ request, response string }{
+		{`{"method":"nextPrime","number":1e40}`, `{"method":"nextPrime","number":10000000000000000000000000000000000000121}`},
+		{`{"method":"prevPrime","number":1e40}`, `{"method":"prevPrime","number":9999999999999999999999999999999999999983}`},
+		{`{"method":"nextPrime","number":1e100}`, `{"method":"nextPrime","number":10000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000267}`},
+		{`{"method":"nextPrime","number":10E+1}`, `{"method":"nextPrime","number":101}`},
+		{`{"method":"primesInRange","from":1e20,"to":1.000000000000000002e20}`, `{"method":"primesInRange","primes":[100000000000000000039,100000000000000000129,100000000000000000151,100000000000000000193]}`},
+		{`{"method":"factorize","number":1.2e1}`, `{"method":"factorize","factors":[2,2,3]}`},
+	} {
+		_, err := conn.Write([]byte(exchange.request + "\n"))
+		require.NoError(t, err)
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, exchange.response+"\n", line, "request %s", exchange.request)
+	}
+}
+
+func TestMalformedMethodRequests(t *testing.T) {
+	srv := primetime.NewServer()
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+
+	for _, request := range []string{
+		`{"method":"factorize"}`,
+		`{"method":"factorize","number":"84"}`,
+		`{"method":"factorize","number":8.4}`,
+		`{"method":"factorize","number":0}`,
+		`{"method":"factorize","number":18446744073709551616}`,
+		`{"method":"nextPrime","number":1e400}`,
+		`{"method":"prevPrime","number":2}`,
+		`{"method":"primeCount","number":10000001}`,
+		`{"method":"primesInRange","from":10}`,
+		`{"method":"primesInRange","from":10,"to":5}`,
+		`{"method":"primesInRange","from":0,"to":10000}`,
+		`{"method":"primesInRange","from":0.5,"to":10}`,
+		`{"method":"isComposite","number":7}`,
+	} {
+		conn, err := net.Dial("tcp", srv.Addr().String())
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write([]byte(request + "\n"))
+		require.NoError(t, err)
+		response, err := io.ReadAll(bufio.NewReader(conn))
+		conn.Close()
+		require.NoError(t, err, "request %s", request)
+		assert.Contains(t, string(response), "Malformed request", "request %s", request)
+	}
+}
@@ -2,11 +2,11 @@ package primetime_test
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"net"
 	"strings"
 	"testing"
-	"time"
 
 	"github.com/JeremyFenwick/firewatch/internal/primetime" // Replace with your actual module path
 )
@@ -28,12 +28,13 @@ func TestIsPrime(t *testing.T) {
 		testIsPrime(t, 7921, false)
 	})
 
-	// Start the server in a goroutine (assuming it's not already running)
-	port := 5001
-	go primetime.Listen(port) // Replace 'primetime' with your actual package name
-
-	// Give the server a little time to start
-	time.Sleep(100 * time.Millisecond) // Adjust as needed
+	// Start the server on a free port
+	srv := primetime.NewServer()
+	if err := srv.Start("127.0.0.1:0"); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	port := srv.Addr().(*net.TCPAddr).Port
 
 	t.Run("Test server response", func(t *testing.T) {
 		testPrimeNumberCheck(t, port, 7, true)
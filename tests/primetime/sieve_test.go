@@ -0,0 +1,120 @@
+package primetime_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net"
+	"testing"
+
+	"github.com/JeremyFenwick/firewatch/internal/primetime"
+	"github.com/stretchr/testify/require"
+)
+
+// trialDivision is how IsPrime used to work, kept to check the sieve against and to benchmark
+func trialDivision(n int) bool {
+	if n <= 1 {
+		return false
+	}
+	if n <= 3 {
+		return true
+	}
+	if n%2 == 0 || n%3 == 0 {
+		return false
+	}
+	sqrtN := int(math.Sqrt(float64(n)))
+	for i := 5; i <= sqrtN; i = i + 6 {
+		if n%i == 0 || n%(i+2) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestIsPrimeMatchesTrialDivision(t *testing.T) {
+	for n := -1; n < 1<<20; n++ {
+		if primetime.IsPrime(n) != trialDivision(n) {
+			t.Fatalf("IsPrime(%d) is %t", n, primetime.IsPrime(n))
+		}
+	}
+	// Either side of where the sieve hands over to Miller-Rabin
+	for n := 1<<24 - 1000; n < 1<<24+1000; n++ {
+		if primetime.IsPrime(n) != trialDivision(n) {
+			t.Fatalf("IsPrime(%d) is %t", n, primetime.IsPrime(n))
+		}
+	}
+	for range 100000 {
+		n := rand.IntN(1 << 32)
+		if primetime.IsPrime(n) != trialDivision(n) {
+			t.Fatalf("IsPrime(%d) is %t", n, primetime.IsPrime(n))
+		}
+	}
+}
+
+// Numbers like those the load generator and checker ask about
+var benchmarkRanges = []struct {
+	name  string
+	limit int
+}{
+	{"below 2^16", 1 << 16},
+	{"below 2^24", 1 << 24},
+	{"below 2^32", 1 << 32},
+	{"below 2^40", 1 << 40},
+}
+
+func BenchmarkIsPrime(b *testing.B) {
+	for _, r := range benchmarkRanges {
+		numbers := make([]int, 1024)
+		for i := range numbers {
+			numbers[i] = rand.IntN(r.limit)
+		}
+		b.Run("trial division "+r.name, func(b *testing.B) {
+			for i := range b.N {
+				trialDivision(numbers[i%len(numbers)])
+			}
+		})
+		b.Run("sieve and Miller-Rabin "+r.name, func(b *testing.B) {
+			primetime.IsPrime(0) // Build the sieve outside the timing
+			b.ResetTimer()
+			for i := range b.N {
+				primetime.IsPrime(numbers[i%len(numbers)])
+			}
+		})
+	}
+}
+
+// BenchmarkServer has many connections asking about the same few numbers, as the checker does
+func BenchmarkServer(b *testing.B) {
+	numbers := make([]int, 100)
+	for i := range numbers {
+		numbers[i] = rand.IntN(1 << 40)
+	}
+	for _, size := range []int{0, primetime.DefaultCacheSize} {
+		b.Run(fmt.Sprintf("cache size %d", size), func(b *testing.B) {
+			srv := primetime.NewServer()
+			srv.SetCacheSize(size)
+			require.NoError(b, srv.Start("127.0.0.1:0"))
+			b.Cleanup(func() { srv.Stop(context.Background()) })
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				conn, err := net.Dial("tcp", srv.Addr().String())
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for i := 0; pb.Next(); i++ {
+					fmt.Fprintf(conn, `{"method":"isPrime","number":%d}`+"\n", numbers[i%len(numbers)])
+					if _, err := reader.ReadString('\n'); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
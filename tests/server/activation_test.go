@@ -0,0 +1,91 @@
+package server_test
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// passListener binds a TCP socket the way a supervisor would and returns the copy a child gets
+func passListener(t *testing.T) (*os.File, string) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer listener.Close()
+	file, err := listener.File()
+	require.NoError(t, err)
+	return file, listener.Addr().String()
+}
+
+// passPacketConn is passListener for a UDP socket
+func passPacketConn(t *testing.T) (*os.File, string) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+	file, err := conn.File()
+	require.NoError(t, err)
+	return file, conn.LocalAddr().String()
+}
+
+func TestListenClaimsInheritedSockets(t *testing.T) {
+	tcpFile, tcpAddress := passListener(t)
+	udpFile, udpAddress := passPacketConn(t)
+	require.NoError(t, server.Inherit([]*os.File{tcpFile, udpFile}))
+	assert.Equal(t, 2, server.Inherited())
+
+	// The ports are still bound by the inherited sockets, so binding them again would fail
+	listener, err := server.Listen(tcpAddress)
+	require.NoError(t, err)
+	defer listener.Close()
+	assert.Equal(t, tcpAddress, listener.Addr().String())
+	conn, err := server.ListenPacket(udpAddress)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, udpAddress, conn.LocalAddr().String())
+	assert.Equal(t, 0, server.Inherited())
+
+	client, err := net.Dial("tcp", tcpAddress)
+	require.NoError(t, err)
+	defer client.Close()
+	accepted, err := listener.Accept()
+	require.NoError(t, err)
+	accepted.Close()
+
+	// Both can be passed on again
+	passed := make(map[string]bool)
+	for _, file := range server.Files() {
+		if l, err := net.FileListener(file); err == nil {
+			passed[l.Addr().String()] = true
+			l.Close()
+		} else if c, err := net.FilePacketConn(file); err == nil {
+			passed[c.LocalAddr().String()] = true
+			c.Close()
+		}
+		file.Close()
+	}
+	assert.True(t, passed[tcpAddress])
+	assert.True(t, passed[udpAddress])
+}
+
+func TestUnclaimedSocketsAreClosed(t *testing.T) {
+	file, address := passListener(t)
+	require.NoError(t, server.Inherit([]*os.File{file}))
+
+	// A different port leaves the socket unclaimed
+	other, err := server.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	other.Close()
+	assert.Equal(t, 1, server.CloseInherited())
+	assert.Equal(t, 0, server.Inherited())
+	_, err = net.Dial("tcp", address)
+	assert.Error(t, err, "nothing listens once the inherited socket is closed")
+}
+
+func TestInheritRejectsFilesThatAreNotSockets(t *testing.T) {
+	file, err := os.CreateTemp(t.TempDir(), "not-a-socket")
+	require.NoError(t, err)
+	assert.Error(t, server.Inherit([]*os.File{file}))
+}
@@ -0,0 +1,125 @@
+package server_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/primetime"
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func requireIPv6(t *testing.T) {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback is not available")
+	}
+	listener.Close()
+}
+
+func port(t *testing.T, addr net.Addr) string {
+	_, p, err := net.SplitHostPort(addr.String())
+	require.NoError(t, err)
+	return p
+}
+
+func canDial(network, address string) bool {
+	conn, err := net.DialTimeout(network, address, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func TestListenDualStack(t *testing.T) {
+	requireIPv6(t)
+	listener, err := server.Listen(":0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	p := port(t, listener.Addr())
+	assert.True(t, canDial("tcp", net.JoinHostPort("127.0.0.1", p)))
+	assert.True(t, canDial("tcp", net.JoinHostPort("::1", p)))
+}
+
+func TestListenSingleFamily(t *testing.T) {
+	requireIPv6(t)
+	v4, err := server.Listen("0.0.0.0:0")
+	require.NoError(t, err)
+	defer v4.Close()
+	assert.True(t, canDial("tcp", net.JoinHostPort("127.0.0.1", port(t, v4.Addr()))))
+	assert.False(t, canDial("tcp", net.JoinHostPort("::1", port(t, v4.Addr()))))
+
+	v6, err := server.Listen("[::]:0")
+	require.NoError(t, err)
+	defer v6.Close()
+	assert.True(t, canDial("tcp", net.JoinHostPort("::1", port(t, v6.Addr()))))
+	assert.False(t, canDial("tcp", net.JoinHostPort("127.0.0.1", port(t, v6.Addr()))))
+}
+
+func TestListenExplicitAddress(t *testing.T) {
+	listener, err := server.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	assert.Equal(t, "127.0.0.1", listener.Addr().(*net.TCPAddr).IP.String())
+
+	_, err = server.Listen("127.0.0.1")
+	assert.ErrorContains(t, err, "invalid listen address")
+}
+
+func TestListenPacket(t *testing.T) {
+	requireIPv6(t)
+	for _, address := range []string{"127.0.0.1:0", "[::1]:0", ":0"} {
+		conn, err := server.ListenPacket(address)
+		require.NoError(t, err, address)
+		conn.Close()
+	}
+	conn, err := server.ListenPacket("[::1]:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "::1", conn.LocalAddr().(*net.UDPAddr).IP.String())
+}
+
+func TestListenPacketOnFly(t *testing.T) {
+	t.Setenv("FLY_APP_NAME", "firewatch")
+	// fly-global-services only resolves on fly, so the bind fails naming it
+	conn, err := server.ListenPacket(":0")
+	if err == nil {
+		conn.Close()
+		t.Skip("running on fly")
+	}
+	assert.ErrorContains(t, err, server.FlyGlobalServices)
+	// Explicit addresses are left alone
+	conn, err = server.ListenPacket("127.0.0.1:0")
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestServiceOverIPv6(t *testing.T) {
+	requireIPv6(t)
+	srv := primetime.NewServer()
+	require.NoError(t, srv.Start("[::1]:0"))
+	defer srv.Stop(t.Context())
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte(`{"method":"isPrime","number":7}` + "\n"))
+	buffer := make([]byte, 100)
+	n, err := conn.Read(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, `{"method":"isPrime","prime":true}`+"\n", string(buffer[:n]))
+}
@@ -0,0 +1,98 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startLimited serves a handler that holds each connection open until the client closes it
+func startLimited(t *testing.T, limits server.Limits) (*server.TCPServer, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	tcp := &server.TCPServer{
+		Metrics: metrics.NewService("limits"),
+		Limits:  limits,
+		Handler: func(ctx context.Context, conn net.Conn) {
+			io.Copy(conn, conn)
+		},
+	}
+	require.NoError(t, tcp.Start(listener))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		tcp.Stop(ctx)
+	})
+	return tcp, listener.Addr().String()
+}
+
+// isOpen reports whether the server echoes on conn, rather than closing it
+func isOpen(t *testing.T, conn net.Conn) bool {
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("x")); err != nil {
+		return false
+	}
+	_, err := conn.Read(make([]byte, 1))
+	return err == nil
+}
+
+func dial(t *testing.T, address string) net.Conn {
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	tcp, address := startLimited(t, server.Limits{MaxConnectionsPerIP: 2})
+	first, second := dial(t, address), dial(t, address)
+	require.True(t, isOpen(t, first))
+	require.True(t, isOpen(t, second))
+
+	assert.False(t, isOpen(t, dial(t, address)))
+	assert.Equal(t, int64(1), tcp.Metrics.RejectedConnections.Value())
+
+	// Closing a connection frees a slot for the same IP
+	first.Close()
+	require.Eventually(t, func() bool { return tcp.ActiveConnections() == 1 }, time.Second, 10*time.Millisecond)
+	assert.True(t, isOpen(t, dial(t, address)))
+}
+
+func TestMaxConnections(t *testing.T) {
+	tcp, address := startLimited(t, server.Limits{MaxConnections: 1})
+	require.True(t, isOpen(t, dial(t, address)))
+	assert.False(t, isOpen(t, dial(t, address)))
+	assert.Equal(t, 1, tcp.ActiveConnections())
+}
+
+func TestAcceptRate(t *testing.T) {
+	_, address := startLimited(t, server.Limits{AcceptRate: 5, AcceptBurst: 2})
+	assert.True(t, isOpen(t, dial(t, address)))
+	assert.True(t, isOpen(t, dial(t, address)))
+	assert.False(t, isOpen(t, dial(t, address)))
+
+	// The bucket refills at 5 per second
+	time.Sleep(250 * time.Millisecond)
+	assert.True(t, isOpen(t, dial(t, address)))
+}
+
+func TestReadTimeout(t *testing.T) {
+	_, address := startLimited(t, server.Limits{ReadTimeout: 100 * time.Millisecond})
+	conn := dial(t, address)
+	// Activity keeps the connection open past the timeout
+	for range 3 {
+		require.True(t, isOpen(t, conn))
+		time.Sleep(60 * time.Millisecond)
+	}
+	// An idle client is disconnected
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
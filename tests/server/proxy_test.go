@@ -0,0 +1,155 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// proxyV2 builds a v2 PROXY header. transport is 0x1 for TCP and 0x2 for UDP
+func proxyV2(command byte, transport byte, source, destination *net.UDPAddr) []byte {
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	header = append(header, 0x20|command)
+	var addresses []byte
+	if source.IP.To4() != nil {
+		header = append(header, 0x10|transport)
+		addresses = append(addresses, source.IP.To4()...)
+		addresses = append(addresses, destination.IP.To4()...)
+	} else {
+		header = append(header, 0x20|transport)
+		addresses = append(addresses, source.IP.To16()...)
+		addresses = append(addresses, destination.IP.To16()...)
+	}
+	addresses = binary.BigEndian.AppendUint16(addresses, uint16(source.Port))
+	addresses = binary.BigEndian.AppendUint16(addresses, uint16(destination.Port))
+	// A TLV the parser has to skip
+	addresses = append(addresses, 0x05, 0x00, 0x02, 'i', 'd')
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func udpAddr(s string) *net.UDPAddr {
+	addr, err := net.ResolveUDPAddr("udp", s)
+	if err != nil {
+		panic(err)
+	}
+	return addr
+}
+
+// startProxied runs a server that reports each client's address and first line back to it
+func startProxied(t *testing.T, limits server.Limits) (string, *metrics.Service) {
+	m := metrics.NewService("proxy")
+	tcp := &server.TCPServer{ProxyProtocol: true, Limits: limits, Metrics: m, Handler: func(ctx context.Context, conn net.Conn) {
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Write([]byte(conn.RemoteAddr().String() + " " + line))
+		// Hold the connection open until the client leaves
+		io.Copy(io.Discard, conn)
+	}}
+	listener, err := server.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, tcp.Start(listener))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		tcp.Stop(ctx)
+	})
+	return listener.Addr().String(), m
+}
+
+// sendProxied connects, sends header and a line in one write and returns the server's reply
+func sendProxied(t *testing.T, address string, header []byte) (net.Conn, string) {
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write(append(header, "hello\n"...))
+	reply, _ := bufio.NewReader(conn).ReadString('\n')
+	return conn, reply
+}
+
+func TestProxyProtocolV1(t *testing.T) {
+	address, _ := startProxied(t, server.Limits{})
+	_, reply := sendProxied(t, address, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+	assert.Equal(t, "192.0.2.1:56324 hello\n", reply)
+
+	_, reply = sendProxied(t, address, []byte("PROXY TCP6 2001:db8::1 2001:db8::2 4000 443\r\n"))
+	assert.Equal(t, "[2001:db8::1]:4000 hello\n", reply)
+
+	// Health checks from the proxy keep the proxy's own address
+	_, reply = sendProxied(t, address, []byte("PROXY UNKNOWN\r\n"))
+	assert.Regexp(t, `^127\.0\.0\.1:\d+ hello\n$`, reply)
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	address, _ := startProxied(t, server.Limits{})
+	_, reply := sendProxied(t, address, proxyV2(0x1, 0x1, udpAddr("203.0.113.9:1234"), udpAddr("10.0.0.1:5000")))
+	assert.Equal(t, "203.0.113.9:1234 hello\n", reply)
+
+	_, reply = sendProxied(t, address, proxyV2(0x1, 0x1, udpAddr("[2001:db8::7]:99"), udpAddr("[2001:db8::1]:5000")))
+	assert.Equal(t, "[2001:db8::7]:99 hello\n", reply)
+
+	_, reply = sendProxied(t, address, proxyV2(0x0, 0x1, udpAddr("203.0.113.9:1234"), udpAddr("10.0.0.1:5000")))
+	assert.Regexp(t, `^127\.0\.0\.1:\d+ hello\n$`, reply)
+}
+
+func TestProxyProtocolRejectsMissingHeader(t *testing.T) {
+	address, m := startProxied(t, server.Limits{})
+	for _, header := range [][]byte{nil, []byte("PROXY TCP4 nonsense\r\n"), []byte("\r\n\r\n\x00\r\nQUIT\n\x31\x11\x00\x00")} {
+		_, reply := sendProxied(t, address, header)
+		assert.Empty(t, reply)
+	}
+	// The connection can close before the rejection is counted
+	assert.Eventually(t, func() bool { return m.RejectedConnections.Value() == 3 }, time.Second, 10*time.Millisecond)
+}
+
+func TestProxyProtocolPerIPLimit(t *testing.T) {
+	address, _ := startProxied(t, server.Limits{MaxConnectionsPerIP: 1})
+	_, reply := sendProxied(t, address, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 1000 443\r\n"))
+	assert.Equal(t, "192.0.2.1:1000 hello\n", reply)
+	// A different client behind the same proxy is let in
+	_, reply = sendProxied(t, address, []byte("PROXY TCP4 192.0.2.2 198.51.100.1 1000 443\r\n"))
+	assert.Equal(t, "192.0.2.2:1000 hello\n", reply)
+	// A second connection from the first client is not
+	_, reply = sendProxied(t, address, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 1001 443\r\n"))
+	assert.Empty(t, reply)
+}
+
+func TestProxyPacketConn(t *testing.T) {
+	socket, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	udp := server.ProxyPacketConn(socket)
+	defer udp.Close()
+	proxy, err := net.Dial("udp", udp.LocalAddr().String())
+	require.NoError(t, err)
+	defer proxy.Close()
+	proxy.SetDeadline(time.Now().Add(time.Second))
+	udp.SetDeadline(time.Now().Add(time.Second))
+
+	// Datagrams without a header are dropped
+	proxy.Write([]byte("no header"))
+	client := udpAddr("198.51.100.20:7000")
+	proxy.Write(append(proxyV2(0x1, 0x2, client, udpAddr("10.0.0.1:5004")), "key=value"...))
+
+	buffer := make([]byte, 100)
+	n, from, err := udp.ReadFrom(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "key=value", string(buffer[:n]))
+	assert.Equal(t, client.String(), from.String())
+
+	// Replies to the client go back through the proxy
+	_, err = udp.WriteTo([]byte("reply"), from)
+	require.NoError(t, err)
+	n, err = proxy.Read(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "reply", string(buffer[:n]))
+}
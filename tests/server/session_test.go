@@ -0,0 +1,61 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionsListAndDisconnect(t *testing.T) {
+	tcp, address, _ := startServer(t, func(ctx context.Context, conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		name, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		server.SessionFromContext(ctx).SetIdentity(name[:len(name)-1])
+		conn.Write([]byte("hello " + name))
+		io.Copy(io.Discard, reader)
+	})
+	defer tcp.Stop(context.Background())
+
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("alice\n"))
+	require.NoError(t, err)
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "hello alice\n", reply)
+
+	sessions := tcp.Sessions()
+	require.Len(t, sessions, 1)
+	session := sessions[0]
+	assert.NotZero(t, session.ID)
+	assert.Equal(t, conn.LocalAddr().String(), session.Remote)
+	assert.Equal(t, "alice", session.Identity)
+	assert.Equal(t, int64(6), session.BytesIn)
+	assert.Equal(t, int64(12), session.BytesOut)
+	assert.WithinDuration(t, time.Now(), session.Started, time.Second)
+
+	assert.False(t, tcp.Disconnect(session.ID+1000))
+	assert.True(t, tcp.Disconnect(session.ID))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "the server closed the connection")
+	assert.Eventually(t, func() bool { return len(tcp.Sessions()) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestSessionWithoutServer(t *testing.T) {
+	// Handlers run outside a TCPServer have no session, and setting an identity is ignored
+	session := server.SessionFromContext(context.Background())
+	assert.Nil(t, session)
+	assert.NotPanics(t, func() { session.SetIdentity("nobody") })
+}
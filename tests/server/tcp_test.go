@@ -0,0 +1,107 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, handler server.Handler) (*server.TCPServer, string, chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	tcp := &server.TCPServer{Handler: handler}
+	served := make(chan error, 1)
+	go func() {
+		served <- tcp.Serve(listener)
+	}()
+	return tcp, listener.Addr().String(), served
+}
+
+func TestStopWaitsForConnections(t *testing.T) {
+	finished := make(chan struct{})
+	tcp, address, served := startServer(t, func(ctx context.Context, conn net.Conn) {
+		// Echo a single message slowly, then finish
+		buffer := make([]byte, 5)
+		io.ReadFull(conn, buffer)
+		time.Sleep(100 * time.Millisecond)
+		conn.Write(buffer)
+		close(finished)
+	})
+
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 1, tcp.ActiveConnections())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, tcp.Stop(ctx))
+	assert.ErrorIs(t, <-served, server.ErrServerClosed)
+
+	// The in-flight connection was allowed to finish its reply
+	<-finished
+	reply := make([]byte, 5)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(reply))
+
+	// New connections are refused
+	_, err = net.Dial("tcp", address)
+	assert.Error(t, err)
+}
+
+func TestStopForceClosesAfterDeadline(t *testing.T) {
+	cancelled := make(chan struct{})
+	tcp, address, served := startServer(t, func(ctx context.Context, conn net.Conn) {
+		// Never finishes on its own
+		io.Copy(io.Discard, conn)
+		<-ctx.Done()
+		close(cancelled)
+	})
+
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, tcp.Stop(ctx), context.DeadlineExceeded)
+	assert.ErrorIs(t, <-served, server.ErrServerClosed)
+	<-cancelled
+	assert.Equal(t, 0, tcp.ActiveConnections())
+
+	// The client sees the connection closed
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestErrReportsADeadListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	tcp := &server.TCPServer{Handler: func(ctx context.Context, conn net.Conn) {}}
+	require.NoError(t, tcp.Start(listener))
+	assert.NoError(t, tcp.Err())
+
+	// Closing the listener out from under the server ends the accept loop
+	listener.Close()
+	assert.Eventually(t, func() bool { return tcp.Err() != nil }, time.Second, 10*time.Millisecond)
+	assert.ErrorIs(t, tcp.Err(), net.ErrClosed)
+	assert.NotNil(t, tcp.Addr())
+
+	// A server that was stopped did not fail
+	stopped, _, served := startServer(t, func(ctx context.Context, conn net.Conn) {})
+	require.NoError(t, stopped.Stop(context.Background()))
+	assert.ErrorIs(t, <-served, server.ErrServerClosed)
+	assert.NoError(t, stopped.Err())
+}
@@ -0,0 +1,202 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// authority issues certificates for the tests
+type authority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+	pem  []byte
+}
+
+func newAuthority(t *testing.T) *authority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "firewatch test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &authority{cert: cert, key: key, pool: pool, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key with the given serial number
+func (a *authority) issue(t *testing.T, serial int64, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &key.PublicKey, a.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, dir, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	return path
+}
+
+// startTLSEcho serves a line echo over TLS
+func startTLSEcho(t *testing.T, settings *server.TLS) (string, *metrics.Service) {
+	m := metrics.NewService("tls")
+	tcp := &server.TCPServer{TLS: settings, Metrics: m, Handler: func(ctx context.Context, conn net.Conn) {
+		defer conn.Close()
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err == nil {
+			conn.Write([]byte(line))
+		}
+	}}
+	listener, err := server.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, tcp.Start(listener))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		tcp.Stop(ctx)
+	})
+	return listener.Addr().String(), m
+}
+
+// echo sends a line over TLS and returns the server certificate's serial number
+func echo(address string, config *tls.Config) (int64, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", address, config)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("hello\n")); err != nil {
+		return 0, err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	if line != "hello\n" {
+		return 0, assert.AnError
+	}
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), nil
+}
+
+func TestTLS(t *testing.T) {
+	ca := newAuthority(t)
+	dir := t.TempDir()
+	cert, key := ca.issue(t, 10, x509.ExtKeyUsageServerAuth)
+	settings, err := server.NewTLS(writeFile(t, dir, "cert.pem", cert), writeFile(t, dir, "key.pem", key), "")
+	require.NoError(t, err)
+	address, m := startTLSEcho(t, settings)
+
+	serial, err := echo(address, &tls.Config{RootCAs: ca.pool})
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), serial)
+
+	// A plaintext client never gets an echo
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("hello\n"))
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	assert.NotEqual(t, "hello\n", line)
+	assert.Eventually(t, func() bool { return m.ProtocolErrors.Value() == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestTLSClientCertificates(t *testing.T) {
+	ca := newAuthority(t)
+	dir := t.TempDir()
+	cert, key := ca.issue(t, 10, x509.ExtKeyUsageServerAuth)
+	settings, err := server.NewTLS(writeFile(t, dir, "cert.pem", cert), writeFile(t, dir, "key.pem", key),
+		writeFile(t, dir, "ca.pem", ca.pem))
+	require.NoError(t, err)
+	address, _ := startTLSEcho(t, settings)
+
+	_, err = echo(address, &tls.Config{RootCAs: ca.pool})
+	assert.Error(t, err, "clients without a certificate are refused")
+
+	clientCert, clientKey := ca.issue(t, 20, x509.ExtKeyUsageClientAuth)
+	pair, err := tls.X509KeyPair(clientCert, clientKey)
+	require.NoError(t, err)
+	_, err = echo(address, &tls.Config{RootCAs: ca.pool, Certificates: []tls.Certificate{pair}})
+	assert.NoError(t, err)
+
+	// A certificate from some other CA is refused too
+	other := newAuthority(t)
+	otherCert, otherKey := other.issue(t, 30, x509.ExtKeyUsageClientAuth)
+	pair, err = tls.X509KeyPair(otherCert, otherKey)
+	require.NoError(t, err)
+	_, err = echo(address, &tls.Config{RootCAs: ca.pool, Certificates: []tls.Certificate{pair}})
+	assert.Error(t, err)
+}
+
+func TestTLSReload(t *testing.T) {
+	ca := newAuthority(t)
+	dir := t.TempDir()
+	cert, key := ca.issue(t, 10, x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := writeFile(t, dir, "cert.pem", cert), writeFile(t, dir, "key.pem", key)
+	settings, err := server.NewTLS(certFile, keyFile, "")
+	require.NoError(t, err)
+	address, _ := startTLSEcho(t, settings)
+
+	cert, key = ca.issue(t, 11, x509.ExtKeyUsageServerAuth)
+	writeFile(t, dir, "cert.pem", cert)
+	writeFile(t, dir, "key.pem", key)
+	require.NoError(t, settings.Reload())
+	serial, err := echo(address, &tls.Config{RootCAs: ca.pool})
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), serial)
+
+	// A broken reload keeps the previous certificate
+	writeFile(t, dir, "key.pem", []byte("not a key"))
+	assert.Error(t, settings.Reload())
+	serial, err = echo(address, &tls.Config{RootCAs: ca.pool})
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), serial)
+}
+
+func TestNewTLSMissingFiles(t *testing.T) {
+	_, err := server.NewTLS("missing.pem", "missing.key", "")
+	assert.ErrorContains(t, err, "could not load TLS certificate")
+}
@@ -0,0 +1,53 @@
+package server_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamCheckRemembersTheResult(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	accepted := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+			accepted <- struct{}{}
+		}
+	}()
+
+	check := server.UpstreamCheck{Address: upstream.Addr().String(), TTL: 200 * time.Millisecond}
+	for range 5 {
+		require.NoError(t, check.Check(context.Background()))
+	}
+	<-accepted
+	assert.Empty(t, accepted, "probes within the TTL don't dial")
+
+	// Once the TTL passes the closed upstream is noticed
+	upstream.Close()
+	assert.NoError(t, check.Check(context.Background()))
+	time.Sleep(200 * time.Millisecond)
+	assert.Error(t, check.Check(context.Background()))
+}
+
+func TestUpstreamCheckForgetsCancelledDials(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer upstream.Close()
+	check := server.UpstreamCheck{Address: upstream.Addr().String()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, check.Check(ctx))
+	assert.NoError(t, check.Check(context.Background()))
+}
@@ -0,0 +1,342 @@
+package service_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/service"
+	_ "github.com/JeremyFenwick/firewatch/internal/service/builtin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echo is a service defined outside the firewatch packages
+type echo struct {
+	listener net.Listener
+	metrics  *metrics.Service
+	health   error
+	exited   error
+}
+
+func (e *echo) Start(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	e.listener = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			e.metrics.AcceptedConnections.Inc()
+			conn.Close()
+		}
+	}()
+	return nil
+}
+
+func (e *echo) Addr() net.Addr {
+	if e.listener == nil {
+		return nil
+	}
+	return e.listener.Addr()
+}
+
+func (e *echo) Stop(ctx context.Context) error  { return e.listener.Close() }
+func (e *echo) Metrics() *metrics.Service       { return e.metrics }
+func (e *echo) SetLogger(logger *slog.Logger)   {}
+func (e *echo) Check(ctx context.Context) error { return e.health }
+func (e *echo) Err() error                      { return e.exited }
+func newEcho(options service.Options) service.Service {
+	return &echo{metrics: metrics.NewService("echo")}
+}
+
+func init() {
+	service.Register(service.Definition{Name: "testecho", Transport: service.TCP, Port: 6000, New: newEcho})
+}
+
+func TestBuiltinServicesAreRegistered(t *testing.T) {
+	definitions := service.Definitions()
+	require.GreaterOrEqual(t, len(definitions), 13)
+	assert.Equal(t, "smoketest", definitions[0].Name)
+	for i := 1; i < len(definitions); i++ {
+		assert.Less(t, definitions[i-1].Port, definitions[i].Port, "definitions are in port order")
+	}
+
+	def, ok := service.Lookup("linereversal")
+	require.True(t, ok)
+	assert.Equal(t, service.UDP, def.Transport)
+	assert.Equal(t, 5007, def.Port)
+	def, ok = service.Lookup("voraciouscodestorage")
+	require.True(t, ok)
+	assert.True(t, def.Storage)
+	_, ok = service.Lookup("nope")
+	assert.False(t, ok)
+}
+
+func TestRegisterRejectsBadDefinitions(t *testing.T) {
+	assert.Panics(t, func() {
+		service.Register(service.Definition{Name: "testecho", Transport: service.TCP, New: newEcho})
+	}, "duplicate name")
+	assert.Panics(t, func() {
+		service.Register(service.Definition{Name: "nameless", Transport: service.TCP})
+	}, "no constructor")
+	assert.Panics(t, func() {
+		service.Register(service.Definition{Name: "sctp", Transport: "sctp", New: newEcho})
+	}, "unknown transport")
+}
+
+func TestGroupStatus(t *testing.T) {
+	var group service.Group
+	for _, name := range []string{"primetime", "testecho"} {
+		def, ok := service.Lookup(name)
+		require.True(t, ok)
+		srv := def.New(def.Defaults)
+		srv.SetLogger(slog.New(slog.DiscardHandler))
+		require.NoError(t, srv.Start("127.0.0.1:0"))
+		group.Add(def, srv)
+	}
+
+	conn, err := net.Dial("tcp", group.Status(context.Background())[0].Address)
+	require.NoError(t, err)
+	conn.Write([]byte("{\"method\":\"isPrime\",\"number\":7}\n"))
+	reply := make([]byte, 64)
+	_, err = conn.Read(reply)
+	require.NoError(t, err)
+	conn.Close()
+
+	statuses := group.Status(context.Background())
+	require.Len(t, statuses, 2)
+	assert.Equal(t, "primetime", statuses[0].Name)
+	assert.Equal(t, service.TCP, statuses[0].Transport)
+	assert.Equal(t, service.Listening, statuses[0].State)
+	assert.Equal(t, int64(1), statuses[0].Stats.AcceptedConnections)
+	assert.Positive(t, statuses[0].Stats.BytesIn)
+	assert.Equal(t, "testecho", statuses[1].Name)
+	assert.Equal(t, service.Listening, statuses[1].State)
+
+	echoDef, _ := service.Lookup("testecho")
+	degraded := &echo{metrics: metrics.NewService("echo"), health: errors.New("upstream unreachable")}
+	require.NoError(t, degraded.Start("127.0.0.1:0"))
+	group.Add(echoDef, degraded)
+	group.Fail(echoDef, errors.New("address already in use"))
+	// A service whose listener died still has an address, but is not serving
+	dead := &echo{metrics: metrics.NewService("echo"), exited: net.ErrClosed}
+	require.NoError(t, dead.Start("127.0.0.1:0"))
+	group.Add(echoDef, dead)
+	statuses = group.Status(context.Background())
+	require.Len(t, statuses, 5)
+	assert.Equal(t, service.Degraded, statuses[2].State)
+	assert.Equal(t, "upstream unreachable", statuses[2].Error)
+	assert.Equal(t, service.Failed, statuses[3].State)
+	assert.Equal(t, "address already in use", statuses[3].Error)
+	assert.Equal(t, service.Failed, statuses[4].State)
+	assert.Equal(t, net.ErrClosed.Error(), statuses[4].Error)
+	assert.NotEmpty(t, statuses[4].Address)
+
+	require.NoError(t, group.Stop(context.Background()))
+	statuses = group.Status(context.Background())
+	for _, status := range statuses[:3] {
+		assert.Equal(t, service.Stopped, status.State)
+	}
+	assert.Equal(t, service.Failed, statuses[3].State)
+}
+
+// get calls handler and decodes the JSON report it answers with
+func get(t *testing.T, handler http.Handler) (int, map[string]any) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	var body map[string]any
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+	return recorder.Code, body
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	var group service.Group
+	def, _ := service.Lookup("testecho")
+	healthy := &echo{metrics: metrics.NewService("echo")}
+	require.NoError(t, healthy.Start("127.0.0.1:0"))
+	group.Add(def, healthy)
+
+	code, body := get(t, group.HealthHandler())
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, body["ok"])
+	code, _ = get(t, group.ReadyHandler())
+	assert.Equal(t, http.StatusOK, code)
+
+	// A degraded service is alive but not ready
+	degraded := &echo{metrics: metrics.NewService("echo"), health: errors.New("upstream unreachable")}
+	require.NoError(t, degraded.Start("127.0.0.1:0"))
+	group.Add(def, degraded)
+	code, _ = get(t, group.HealthHandler())
+	assert.Equal(t, http.StatusOK, code)
+	code, body = get(t, group.ReadyHandler())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, false, body["ok"])
+	assert.Len(t, body["services"], 2)
+
+	group.Fail(def, errors.New("address already in use"))
+	code, _ = get(t, group.HealthHandler())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	group.Stop(context.Background())
+}
+
+func TestStorageCheck(t *testing.T) {
+	def, _ := service.Lookup("voraciouscodestorage")
+	dataDir := t.TempDir()
+	srv := def.New(service.Options{DataDir: dataDir})
+	srv.SetLogger(slog.New(slog.DiscardHandler))
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	defer srv.Stop(context.Background())
+	checker, ok := srv.(service.Checker)
+	require.True(t, ok)
+
+	require.NoError(t, checker.Check(context.Background()))
+	entries, err := os.ReadDir(dataDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "the probe file is removed")
+
+	require.NoError(t, os.RemoveAll(dataDir))
+	assert.ErrorContains(t, checker.Check(context.Background()), "data directory is not writable")
+}
+
+func TestUpstreamCheck(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	def, _ := service.Lookup("mobinthemiddle")
+	srv := def.New(service.Options{Upstream: upstream.Addr().String()})
+	checker, ok := srv.(service.Checker)
+	require.True(t, ok)
+
+	require.NoError(t, checker.Check(context.Background()))
+	upstream.Close()
+	assert.NoError(t, checker.Check(context.Background()), "the result is remembered")
+
+	srv = def.New(service.Options{Upstream: upstream.Addr().String()})
+	assert.ErrorContains(t, srv.(service.Checker).Check(context.Background()), "is unreachable")
+}
+
+func TestGroupHandoff(t *testing.T) {
+	var group service.Group
+	started := make(map[string]service.Service)
+	for _, name := range []string{"smoketest", "unusualdatabase", "linereversal"} {
+		def, _ := service.Lookup(name)
+		srv := def.New(def.Defaults)
+		srv.SetLogger(slog.New(slog.DiscardHandler))
+		require.NoError(t, srv.Start("127.0.0.1:0"))
+		defer srv.Stop(context.Background())
+		group.Add(def, srv)
+		started[name] = srv
+	}
+
+	// Only the services with state to lose stop
+	dir := t.TempDir()
+	handedOff, err := group.Handoff(context.Background(), dir)
+	require.NoError(t, err)
+	names := make([]string, 0, len(handedOff))
+	for _, def := range handedOff {
+		names = append(names, def.Name)
+		assert.FileExists(t, service.StateFile(dir, def.Name))
+	}
+	assert.Equal(t, []string{"unusualdatabase", "linereversal"}, names)
+	_, err = net.Dial("tcp", started["smoketest"].Addr().String())
+	assert.NoError(t, err, "stateless services keep serving")
+
+	def, _ := service.Lookup("unusualdatabase")
+	srv := def.New(def.Defaults)
+	assert.Same(t, started["unusualdatabase"], group.Replace(def, srv))
+}
+
+func TestConnectionsAPI(t *testing.T) {
+	var group service.Group
+	for _, name := range []string{"budgetchat", "linereversal", "unusualdatabase"} {
+		def, _ := service.Lookup(name)
+		srv := def.New(def.Defaults)
+		srv.SetLogger(slog.New(slog.DiscardHandler))
+		require.NoError(t, srv.Start("127.0.0.1:0"))
+		group.Add(def, srv)
+	}
+	defer group.Stop(context.Background())
+	statuses := group.Status(context.Background())
+
+	chat, err := net.Dial("tcp", statuses[0].Address)
+	require.NoError(t, err)
+	defer chat.Close()
+	reader := bufio.NewReader(chat)
+	_, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	chat.Write([]byte("alice\n"))
+	_, err = reader.ReadString('\n')
+	require.NoError(t, err)
+
+	lrcp, err := net.Dial("udp", statuses[1].Address)
+	require.NoError(t, err)
+	defer lrcp.Close()
+	lrcp.Write([]byte("/connect/12345/"))
+	reply := make([]byte, 100)
+	lrcp.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := lrcp.Read(reply)
+	require.NoError(t, err)
+	assert.Equal(t, "/ack/12345/0/", string(reply[:n]))
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /connections", group.ConnectionsHandler())
+	mux.Handle("DELETE /connections/{service}/{id}", group.DisconnectHandler())
+	request := func(method, target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+		return recorder
+	}
+
+	var connections []service.Connection
+	response := request(http.MethodGet, "/connections")
+	require.Equal(t, http.StatusOK, response.Code)
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &connections))
+	require.Len(t, connections, 2)
+	assert.Equal(t, "budgetchat", connections[0].Service)
+	assert.Equal(t, "alice", connections[0].Identity)
+	assert.Equal(t, "linereversal", connections[1].Service)
+	assert.Equal(t, uint64(12345), connections[1].ID)
+
+	response = request(http.MethodGet, "/connections?service=linereversal")
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &connections))
+	assert.Len(t, connections, 1)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/connections?service=nope").Code)
+
+	chatID := strconv.FormatUint(connectionID(t, &group, "budgetchat"), 10)
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, "/connections/budgetchat/"+chatID).Code)
+	chat.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.Copy(io.Discard, reader)
+	assert.NoError(t, err, "the chat client was disconnected")
+
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, "/connections/linereversal/12345").Code)
+	n, err = lrcp.Read(reply)
+	require.NoError(t, err)
+	assert.Equal(t, "/close/12345/", string(reply[:n]))
+
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, "/connections/budgetchat/"+chatID).Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, "/connections/nope/1").Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodDelete, "/connections/budgetchat/x").Code)
+	assert.Equal(t, http.StatusNotImplemented, request(http.MethodDelete, "/connections/unusualdatabase/1").Code)
+}
+
+func connectionID(t *testing.T, group *service.Group, name string) uint64 {
+	connections, err := group.Connections(name)
+	require.NoError(t, err)
+	require.Len(t, connections, 1)
+	return connections[0].ID
+}
@@ -0,0 +1,26 @@
+package smoketest_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/smoketest"
+	protocol "github.com/JeremyFenwick/firewatch/pkg/smoketest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEcho(t *testing.T) {
+	srv := smoketest.NewServer(0)
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	data := bytes.Repeat([]byte("echo"), 100000)
+	echoed, err := protocol.Echo(ctx, srv.Addr().String(), data)
+	require.NoError(t, err)
+	assert.Equal(t, data, echoed)
+}
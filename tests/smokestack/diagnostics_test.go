@@ -0,0 +1,150 @@
+package smoketest_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/service"
+	"github.com/JeremyFenwick/firewatch/internal/smoketest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func start(t *testing.T, srv service.Service) string {
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	return srv.Addr().String()
+}
+
+// exchange sends request to a UDP server and returns its reply
+func exchange(t *testing.T, address string, request []byte) ([]byte, error) {
+	conn, err := net.Dial("udp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	_, err = conn.Write(request)
+	require.NoError(t, err)
+	buffer := make([]byte, 64*1024)
+	n, err := conn.Read(buffer)
+	return buffer[:n], err
+}
+
+// fetch reads everything a TCP server sends before it closes the connection
+func fetch(t *testing.T, address string) []byte {
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reply, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	return reply
+}
+
+func TestUDPEcho(t *testing.T) {
+	address := start(t, smoketest.NewEchoPacketServer())
+	for _, request := range [][]byte{[]byte("ping"), bytes.Repeat([]byte{0xff}, 60000), {}} {
+		reply, err := exchange(t, address, request)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(request, reply), "echoed %d bytes of %d", len(reply), len(request))
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	srv := smoketest.NewDiscardServer(0)
+	conn, err := net.Dial("tcp", start(t, srv))
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	go send(conn.(*net.TCPConn), make([]byte, 1<<20))
+
+	reply, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Empty(t, reply)
+	assert.Eventually(t, func() bool { return srv.Metrics().BytesIn.Value() == 1<<20 }, time.Second, 10*time.Millisecond)
+}
+
+func TestUDPDiscard(t *testing.T) {
+	srv := smoketest.NewDiscardPacketServer()
+	address := start(t, srv)
+	_, err := exchange(t, address, []byte("into the void"))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), "got %v, want no reply", err)
+	assert.Equal(t, int64(len("into the void")), srv.Metrics().BytesIn.Value())
+}
+
+func TestChargen(t *testing.T) {
+	address := start(t, smoketest.NewChargenServer(0))
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Enough lines to go round the pattern more than once
+	lines := make([]byte, 200*74)
+	_, err = io.ReadFull(conn, lines)
+	require.NoError(t, err)
+	for i, line := range strings.SplitAfter(string(lines), "\r\n")[:200] {
+		require.Len(t, line, 74, "line %d", i)
+		assert.Equal(t, byte(' '+i%95), line[0], "line %d starts one character after the last", i)
+		for j := 1; j < 72; j++ {
+			assert.Equal(t, byte(' '+(i+j)%95), line[j], "line %d", i)
+		}
+	}
+}
+
+func TestChargenQuota(t *testing.T) {
+	address := start(t, smoketest.NewChargenServer(1000))
+	assert.Len(t, fetch(t, address), 1000)
+}
+
+func TestUDPChargen(t *testing.T) {
+	address := start(t, smoketest.NewChargenPacketServer())
+	pattern := fetch(t, start(t, smoketest.NewChargenServer(512)))
+	for range 20 {
+		reply, err := exchange(t, address, []byte{})
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(reply), 512)
+		assert.True(t, bytes.HasPrefix(pattern, reply))
+	}
+}
+
+func TestDaytime(t *testing.T) {
+	check := func(t *testing.T, reply []byte) {
+		line, ok := strings.CutSuffix(string(reply), "\r\n")
+		require.True(t, ok, "%q is not a line", reply)
+		sent, err := time.Parse(smoketest.DaytimeLayout, line)
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now(), sent, 5*time.Second)
+	}
+	t.Run("TCP", func(t *testing.T) {
+		check(t, fetch(t, start(t, smoketest.NewDaytimeServer())))
+	})
+	t.Run("UDP", func(t *testing.T) {
+		reply, err := exchange(t, start(t, smoketest.NewDaytimePacketServer()), []byte{})
+		require.NoError(t, err)
+		check(t, reply)
+	})
+}
+
+func TestTime(t *testing.T) {
+	check := func(t *testing.T, reply []byte) {
+		require.Len(t, reply, 4)
+		sent := time.Unix(int64(binary.BigEndian.Uint32(reply))-2208988800, 0)
+		assert.WithinDuration(t, time.Now(), sent, 5*time.Second)
+	}
+	t.Run("TCP", func(t *testing.T) {
+		check(t, fetch(t, start(t, smoketest.NewTimeServer())))
+	})
+	t.Run("UDP", func(t *testing.T) {
+		reply, err := exchange(t, start(t, smoketest.NewTimePacketServer()), []byte{})
+		require.NoError(t, err)
+		check(t, reply)
+	})
+}
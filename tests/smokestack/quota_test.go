@@ -0,0 +1,63 @@
+package smoketest_test
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/smoketest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, maxBytes int64) *smoketest.Server {
+	srv := smoketest.NewServer(maxBytes)
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	return srv
+}
+
+// send writes data and then half-closes the connection, leaving it open for the echo
+func send(conn *net.TCPConn, data []byte) {
+	conn.Write(data)
+	conn.CloseWrite()
+}
+
+func TestEchoAfterHalfClose(t *testing.T) {
+	srv := startServer(t, 64<<20)
+	data := make([]byte, 16<<20)
+	rand.Read(data)
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	go send(conn.(*net.TCPConn), data)
+
+	echoed, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Len(t, echoed, len(data))
+	assert.Equal(t, data, echoed)
+	// Spliced bytes are still counted
+	assert.Eventually(t, func() bool {
+		return srv.Metrics().BytesIn.Value() == int64(len(data)) && srv.Metrics().BytesOut.Value() == int64(len(data))
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestEchoStopsAtQuota(t *testing.T) {
+	srv := startServer(t, 100000)
+	data := make([]byte, 300000)
+	rand.Read(data)
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	go send(conn.(*net.TCPConn), data)
+
+	echoed, _ := io.ReadAll(conn)
+	assert.Equal(t, data[:100000], echoed)
+}
@@ -16,32 +16,13 @@ import (
 )
 
 func TestEchoServer(t *testing.T) {
-	// Use a random available port for testing
-	port := getFreePort(t)
-
-	// Start the server in a goroutine
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	go func() {
-		defer wg.Done()
-		go func() {
-			<-ctx.Done()
-			// This is a trick to unblock the Listen function by connecting to it
-			// after the test is done
-			conn, _ := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
-			if conn != nil {
-				conn.Close()
-			}
-		}()
-		smoketest.Listen(port)
-	}()
-
-	// Wait a short time for the server to start
-	time.Sleep(100 * time.Millisecond)
+	// Start the server on a free port
+	srv := smoketest.NewServer(smoketest.DefaultMaxBytes)
+	if err := srv.Start("127.0.0.1:0"); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	port := srv.Addr().(*net.TCPAddr).Port
 
 	t.Run("SingleMessage", func(t *testing.T) {
 		testSingleMessage(t, port)
@@ -234,22 +215,6 @@ func testConnectionClosed(t *testing.T, port int) {
 	defer newConn.Close()
 }
 
-// Helper function to get a free port
-func getFreePort(t *testing.T) int {
-	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
-	if err != nil {
-		t.Fatalf("Failed to resolve TCP address: %v", err)
-	}
-
-	l, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		t.Fatalf("Failed to listen: %v", err)
-	}
-	defer l.Close()
-
-	return l.Addr().(*net.TCPAddr).Port
-}
-
 // Helper function to generate a random string of specified length
 func generateRandomString(length int) string {
 	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
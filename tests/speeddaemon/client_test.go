@@ -0,0 +1,50 @@
+package speeddaemon_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/speeddaemon"
+	protocol "github.com/JeremyFenwick/firewatch/pkg/speeddaemon"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCameraAndDispatcherClients(t *testing.T) {
+	srv := speeddaemon.NewServer()
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	address := srv.Addr().String()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	first := protocol.NewCamera(address, 123, 8, 60)
+	defer first.Close()
+	second := protocol.NewCamera(address, 123, 9, 60)
+	defer second.Close()
+	dispatcher := protocol.NewDispatcher(address, 123)
+	defer dispatcher.Close()
+
+	require.NoError(t, first.Observe(ctx, "UN1X", 0))
+	require.NoError(t, second.Observe(ctx, "UN1X", 45))
+	ticket, err := dispatcher.Ticket(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.TicketMessage{Plate: "UN1X", Road: 123, MileOne: 8, TimeStampOne: 0, MileTwo: 9, TimeStampTwo: 45, Speed: 8000}, *ticket)
+
+	// A dispatcher that lost its connection identifies itself again and gets the next ticket
+	for _, session := range srv.Sessions() {
+		srv.Disconnect(session.ID)
+	}
+	require.Eventually(t, func() bool { return len(srv.Sessions()) == 0 }, time.Second, 10*time.Millisecond)
+	third := protocol.NewCamera(address, 123, 10, 60)
+	defer third.Close()
+	require.NoError(t, third.Observe(ctx, "UN1X", 3600+45))
+	require.NoError(t, third.Observe(ctx, "ABC", 2*86400))
+	fourth := protocol.NewCamera(address, 123, 11, 60)
+	defer fourth.Close()
+	require.NoError(t, fourth.Observe(ctx, "ABC", 2*86400+30))
+	ticket, err = dispatcher.Ticket(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.Str("ABC"), ticket.Plate)
+}
@@ -0,0 +1,75 @@
+package speeddaemon_test
+
+import (
+	"bytes"
+	"testing"
+
+	protocol "github.com/JeremyFenwick/firewatch/pkg/speeddaemon"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// speeddaemonSeeds returns one encoded message of each type
+func speeddaemonSeeds(t testing.TB) [][]byte {
+	messages := []protocol.ClientMessage{
+		&protocol.ErrorMessage{Content: "bad"},
+		&protocol.PlateMessage{Plate: "UN1X", Timestamp: 1000},
+		&protocol.TicketMessage{Plate: "UN1X", Road: 66, MileOne: 100, TimeStampOne: 123456, MileTwo: 110, TimeStampTwo: 123816, Speed: 10000},
+		&protocol.WantHeartbeatMessage{Interval: 10},
+		&protocol.HeartbeatMessage{},
+		&protocol.IAmCameraMessage{Road: 66, Mile: 100, Limit: 60},
+		&protocol.IAmDispatcherMessage{Numroads: 3, Roads: []protocol.U16{66, 368, 5000}},
+	}
+	seeds := make([][]byte, 0, len(messages))
+	for _, message := range messages {
+		encoded, err := message.Encode()
+		require.NoError(t, err)
+		seeds = append(seeds, encoded)
+	}
+	return seeds
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, seed := range speeddaemonSeeds(f) {
+		f.Add(seed)
+		f.Add(seed[:len(seed)-1])
+	}
+	f.Add([]byte{0x20, 0xff})
+	f.Add([]byte{0x81, 0xff, 0x00, 0x01})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		buffer := protocol.NewSdBuffer(data)
+		message, err := protocol.Decode(buffer)
+		if err != nil {
+			assert.Nil(t, message)
+			return
+		}
+		// A decoded message encodes back to the bytes it was read from
+		require.LessOrEqual(t, buffer.ValidBytes, len(data))
+		encoded, err := message.Encode()
+		require.NoError(t, err)
+		assert.Equal(t, data[:buffer.ValidBytes], encoded)
+	})
+}
+
+func FuzzExtractFromSbBuffer(f *testing.F) {
+	seeds := speeddaemonSeeds(f)
+	f.Add(bytes.Join(seeds, nil))
+	f.Add(append(bytes.Clone(seeds[1]), seeds[5][:3]...))
+	f.Add(append(bytes.Clone(seeds[5]), 0x99, 0x20))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		messages, extracted := protocol.ExtractFromSbBuffer(protocol.NewSdBuffer(data))
+		require.GreaterOrEqual(t, extracted, 0)
+		require.LessOrEqual(t, extracted, len(data))
+		// Everything extracted is re-encoded, apart from the error reported for an unknown type
+		var encoded []byte
+		for i, message := range messages {
+			if i == len(messages)-1 && message.GetType() == protocol.ErrorMsgType && len(encoded) == extracted {
+				break
+			}
+			bytes, err := message.Encode()
+			require.NoError(t, err)
+			encoded = append(encoded, bytes...)
+		}
+		assert.True(t, bytes.Equal(data[:extracted], encoded), "extracted %x, re-encoded %x", data[:extracted], encoded)
+	})
+}
@@ -1,51 +1,52 @@
 package speeddaemon_test
 
 import (
+	"context"
 	"net"
 	"strconv"
 	"testing"
-	"time"
 
 	"github.com/JeremyFenwick/firewatch/internal/speeddaemon" // Replace with your actual module path
+	protocol "github.com/JeremyFenwick/firewatch/pkg/speeddaemon"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestErrorMessage(t *testing.T) {
-	errorMessage := &speeddaemon.ErrorMessage{
+	errorMessage := &protocol.ErrorMessage{
 		Content: "Test error message",
 	}
 	encodedMessage, err := errorMessage.Encode()
 	assert.NoError(t, err, "Encoding should not produce an error")
 
-	buffer := speeddaemon.NewSdBuffer(encodedMessage)
-	decodedMessage, err := speeddaemon.Decode(buffer)
+	buffer := protocol.NewSdBuffer(encodedMessage)
+	decodedMessage, err := protocol.Decode(buffer)
 	assert.NoError(t, err, "Decoding should not produce an error")
 
-	msg := decodedMessage.(*speeddaemon.ErrorMessage)
-	assert.Equal(t, speeddaemon.ErrorMsgType, decodedMessage.GetType(), "Message type should match")
+	msg := decodedMessage.(*protocol.ErrorMessage)
+	assert.Equal(t, protocol.ErrorMsgType, decodedMessage.GetType(), "Message type should match")
 	assert.Equal(t, errorMessage, msg)
 }
 
 func TestPlateMessage(t *testing.T) {
-	plateMessage := &speeddaemon.PlateMessage{
+	plateMessage := &protocol.PlateMessage{
 		Plate:     "ABC123",
 		Timestamp: 1234567890,
 	}
 	encodedMessage, err := plateMessage.Encode()
 	assert.NoError(t, err)
 
-	buffer := speeddaemon.NewSdBuffer(encodedMessage)
-	decodedMessage, err := speeddaemon.Decode(buffer)
+	buffer := protocol.NewSdBuffer(encodedMessage)
+	decodedMessage, err := protocol.Decode(buffer)
 	assert.NoError(t, err)
 
-	msg := decodedMessage.(*speeddaemon.PlateMessage)
-	assert.Equal(t, speeddaemon.PlateMsgType, decodedMessage.GetType())
+	msg := decodedMessage.(*protocol.PlateMessage)
+	assert.Equal(t, protocol.PlateMsgType, decodedMessage.GetType())
 	assert.Equal(t, plateMessage, msg)
 
 }
 
 func TestTicketMessage(t *testing.T) {
-	ticketMessage := &speeddaemon.TicketMessage{
+	ticketMessage := &protocol.TicketMessage{
 		Plate:        "XYZ789",
 		Road:         16,
 		MileOne:      100,
@@ -57,45 +58,45 @@ func TestTicketMessage(t *testing.T) {
 	encodedMessage, err := ticketMessage.Encode()
 	assert.NoError(t, err)
 
-	buffer := speeddaemon.NewSdBuffer(encodedMessage)
-	decodedMessage, err := speeddaemon.Decode(buffer)
+	buffer := protocol.NewSdBuffer(encodedMessage)
+	decodedMessage, err := protocol.Decode(buffer)
 	assert.NoError(t, err)
 
-	msg := decodedMessage.(*speeddaemon.TicketMessage)
-	assert.Equal(t, speeddaemon.TicketMsgType, decodedMessage.GetType())
+	msg := decodedMessage.(*protocol.TicketMessage)
+	assert.Equal(t, protocol.TicketMsgType, decodedMessage.GetType())
 	assert.Equal(t, ticketMessage, msg)
 }
 
 func TestWantHeartbeatMessage(t *testing.T) {
-	wantHeartbeatMessage := &speeddaemon.WantHeartbeatMessage{
+	wantHeartbeatMessage := &protocol.WantHeartbeatMessage{
 		Interval: 25,
 	}
 	encodedMessage, err := wantHeartbeatMessage.Encode()
 	assert.NoError(t, err)
 
-	buffer := speeddaemon.NewSdBuffer(encodedMessage)
-	decodedMessage, err := speeddaemon.Decode(buffer)
+	buffer := protocol.NewSdBuffer(encodedMessage)
+	decodedMessage, err := protocol.Decode(buffer)
 	assert.NoError(t, err)
 
-	msg := decodedMessage.(*speeddaemon.WantHeartbeatMessage)
-	assert.Equal(t, speeddaemon.WantHeartbeatType, decodedMessage.GetType())
+	msg := decodedMessage.(*protocol.WantHeartbeatMessage)
+	assert.Equal(t, protocol.WantHeartbeatType, decodedMessage.GetType())
 	assert.Equal(t, wantHeartbeatMessage, msg)
 }
 
 func TestHeartbeatMessage(t *testing.T) {
-	heartbeatMessage := &speeddaemon.HeartbeatMessage{}
+	heartbeatMessage := &protocol.HeartbeatMessage{}
 	encodedMessage, err := heartbeatMessage.Encode()
 	assert.NoError(t, err)
 
-	buffer := speeddaemon.NewSdBuffer(encodedMessage)
-	decodedMessage, err := speeddaemon.Decode(buffer)
+	buffer := protocol.NewSdBuffer(encodedMessage)
+	decodedMessage, err := protocol.Decode(buffer)
 	assert.NoError(t, err)
 
-	assert.Equal(t, speeddaemon.HeartbeatType, decodedMessage.GetType())
+	assert.Equal(t, protocol.HeartbeatType, decodedMessage.GetType())
 }
 
 func TestIAmCameraMessage(t *testing.T) {
-	cameraMessage := &speeddaemon.IAmCameraMessage{
+	cameraMessage := &protocol.IAmCameraMessage{
 		Road:  120,
 		Mile:  100,
 		Limit: 80,
@@ -103,38 +104,38 @@ func TestIAmCameraMessage(t *testing.T) {
 	encodedMessage, err := cameraMessage.Encode()
 	assert.NoError(t, err)
 
-	buffer := speeddaemon.NewSdBuffer(encodedMessage)
-	decodedMessage, err := speeddaemon.Decode(buffer)
+	buffer := protocol.NewSdBuffer(encodedMessage)
+	decodedMessage, err := protocol.Decode(buffer)
 	assert.NoError(t, err)
 
-	msg := decodedMessage.(*speeddaemon.IAmCameraMessage)
+	msg := decodedMessage.(*protocol.IAmCameraMessage)
 	assert.Equal(t, cameraMessage, msg)
 }
 
 func TestIAmDispatcherMessage(t *testing.T) {
-	dispatcherMessage := &speeddaemon.IAmDispatcherMessage{
+	dispatcherMessage := &protocol.IAmDispatcherMessage{
 		Numroads: 5,
-		Roads:    []speeddaemon.U16{1, 2, 3, 4, 5},
+		Roads:    []protocol.U16{1, 2, 3, 4, 5},
 	}
 	encodedMessage, err := dispatcherMessage.Encode()
 	assert.NoError(t, err)
 
-	buffer := speeddaemon.NewSdBuffer(encodedMessage)
-	decodedMessage, err := speeddaemon.Decode(buffer)
+	buffer := protocol.NewSdBuffer(encodedMessage)
+	decodedMessage, err := protocol.Decode(buffer)
 	assert.NoError(t, err)
 
-	msg := decodedMessage.(*speeddaemon.IAmDispatcherMessage)
+	msg := decodedMessage.(*protocol.IAmDispatcherMessage)
 	assert.Equal(t, dispatcherMessage, msg)
 }
 
 func TestExtractor(t *testing.T) {
-	errorMessage := &speeddaemon.ErrorMessage{
+	errorMessage := &protocol.ErrorMessage{
 		Content: "Test error message",
 	}
 	encodedMessage, err := errorMessage.Encode()
 	assert.NoError(t, err, "Encoding should not produce an error")
-	buffer := speeddaemon.NewSdBuffer(encodedMessage)
-	messages, extractedBytes := speeddaemon.ExtractFromSbBuffer(buffer)
+	buffer := protocol.NewSdBuffer(encodedMessage)
+	messages, extractedBytes := protocol.ExtractFromSbBuffer(buffer)
 	assert.Equal(t, 1, len(messages), "Should extract one message")
 	assert.Equal(t, len(encodedMessage), extractedBytes, "Extracted bytes should match encoded message length")
 	assert.Equal(t, errorMessage, messages[0], "Extracted message should match original")
@@ -142,21 +143,21 @@ func TestExtractor(t *testing.T) {
 
 func TestIncompleteMessage(t *testing.T) {
 	// Create a buffer with an incomplete message
-	incompleteBuffer := speeddaemon.NewSdBuffer([]byte{0x01, 0x02}) // Incomplete message
-	messages, extractedBytes := speeddaemon.ExtractFromSbBuffer(incompleteBuffer)
+	incompleteBuffer := protocol.NewSdBuffer([]byte{0x01, 0x02}) // Incomplete message
+	messages, extractedBytes := protocol.ExtractFromSbBuffer(incompleteBuffer)
 	assert.Equal(t, 1, len(messages), "There should be one message")
 	assert.Equal(t, 0, extractedBytes, "No bytes should be extracted from an incomplete message")
 }
 
 func TestPartialMessage(t *testing.T) {
-	errorMessage := &speeddaemon.ErrorMessage{
+	errorMessage := &protocol.ErrorMessage{
 		Content: "Test error message",
 	}
 	encodedMessage, err := errorMessage.Encode()
 	assert.NoError(t, err, "Encoding should not produce an error")
 	incompleteBuffer := append(encodedMessage, 0x80, 0x00, 0x00) // Incomplete message
-	buffer := speeddaemon.NewSdBuffer(incompleteBuffer)
-	messages, extractedBytes := speeddaemon.ExtractFromSbBuffer(buffer)
+	buffer := protocol.NewSdBuffer(incompleteBuffer)
+	messages, extractedBytes := protocol.ExtractFromSbBuffer(buffer)
 	assert.Equal(t, 1, len(messages), "Should extract one message")
 	assert.Equal(t, len(encodedMessage), extractedBytes, "Extracted bytes should match encoded message length")
 	assert.Equal(t, errorMessage, messages[0], "Extracted message should match original")
@@ -174,18 +175,18 @@ func TestCalculateSpeed(t *testing.T) {
 		Time: 45,
 	}
 	speed := speeddaemon.CalculateSpeed(r1, r2)
-	assert.Equal(t, speed, speeddaemon.U16(8000), "Speed should be 80")
+	assert.Equal(t, speed, protocol.U16(8000), "Speed should be 80")
 	// Now check the reverse
 	speed = speeddaemon.CalculateSpeed(r2, r1)
-	assert.Equal(t, speed, speeddaemon.U16(8000), "Speed should be 80")
+	assert.Equal(t, speed, protocol.U16(8000), "Speed should be 80")
 }
 
 func TestCentralDispatcher(t *testing.T) {
 	dispatcher := speeddaemon.NewCentralDispatcher()
 	go dispatcher.Start()
-	dispatcherChannel := make(chan speeddaemon.ClientMessage, 5)
+	dispatcherChannel := make(chan protocol.ClientMessage, 5)
 	dispatcher.MessageQueue <- &speeddaemon.RegisterDispatcher{
-		Roads:   []speeddaemon.U16{1},
+		Roads:   []protocol.U16{1},
 		Channel: dispatcherChannel,
 	}
 	dispatcher.MessageQueue <- &speeddaemon.RegisterCamera{
@@ -206,7 +207,7 @@ func TestCentralDispatcher(t *testing.T) {
 	}
 	// Recieves speeding ticket
 	ticket := <-dispatcherChannel
-	assert.Equal(t, ticket.GetType(), speeddaemon.TicketMsgType, "Ticket message type should match")
+	assert.Equal(t, ticket.GetType(), protocol.TicketMsgType, "Ticket message type should match")
 	// Doesn't recieve speeding ticket on same day
 	dispatcher.MessageQueue <- &speeddaemon.Observation{
 		Road:      1,
@@ -224,14 +225,17 @@ func TestCentralDispatcher(t *testing.T) {
 
 func TestSession(t *testing.T) {
 	// Start the server
-	port := 5006
-	go speeddaemon.Listen(port)
-	time.Sleep(100 * time.Millisecond)
+	srv := speeddaemon.NewServer()
+	if err := srv.Start("127.0.0.1:0"); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	port := srv.Addr().(*net.TCPAddr).Port
 	dispatcher, err := net.Dial("tcp", "localhost:"+strconv.Itoa(port))
 	assert.NoError(t, err, "Failed to connect to server")
-	dMessage := &speeddaemon.IAmDispatcherMessage{
+	dMessage := &protocol.IAmDispatcherMessage{
 		Numroads: 2,
-		Roads:    []speeddaemon.U16{1, 2},
+		Roads:    []protocol.U16{1, 2},
 	}
 	encodedMessage, err := dMessage.Encode()
 	assert.NoError(t, err, "Encoding should not produce an error")
@@ -240,7 +244,7 @@ func TestSession(t *testing.T) {
 	// Register camera 1
 	camera1, err := net.Dial("tcp", "localhost:"+strconv.Itoa(port))
 	assert.NoError(t, err, "Failed to connect to server")
-	cMessage1 := &speeddaemon.IAmCameraMessage{
+	cMessage1 := &protocol.IAmCameraMessage{
 		Road:  1,
 		Mile:  8,
 		Limit: 60,
@@ -252,7 +256,7 @@ func TestSession(t *testing.T) {
 	// Register camera 2
 	camera2, err := net.Dial("tcp", "localhost:"+strconv.Itoa(port))
 	assert.NoError(t, err, "Failed to connect to server")
-	cMessage2 := &speeddaemon.IAmCameraMessage{
+	cMessage2 := &protocol.IAmCameraMessage{
 		Road:  1,
 		Mile:  9,
 		Limit: 60,
@@ -262,7 +266,7 @@ func TestSession(t *testing.T) {
 	_, err = camera2.Write(encodedMessage)
 	assert.NoError(t, err, "Failed to write to server")
 	// Send the first plate message
-	plate1 := &speeddaemon.PlateMessage{
+	plate1 := &protocol.PlateMessage{
 		Plate:     "ABC123",
 		Timestamp: 0,
 	}
@@ -271,7 +275,7 @@ func TestSession(t *testing.T) {
 	_, err = camera1.Write(encodedMessage)
 	assert.NoError(t, err, "Failed to write to server")
 	// Send the second plate message
-	plate2 := &speeddaemon.PlateMessage{
+	plate2 := &protocol.PlateMessage{
 		Plate:     "ABC123",
 		Timestamp: 45,
 	}
@@ -283,17 +287,17 @@ func TestSession(t *testing.T) {
 	buffer := make([]byte, 1024)
 	n, err := dispatcher.Read(buffer)
 	assert.NoError(t, err, "Failed to read from server")
-	ticketMessage, err := speeddaemon.Decode(speeddaemon.NewSdBuffer(buffer[:n]))
+	ticketMessage, err := protocol.Decode(protocol.NewSdBuffer(buffer[:n]))
 	assert.NoError(t, err, "Failed to decode message")
-	assert.Equal(t, ticketMessage.GetType(), speeddaemon.TicketMsgType, "Ticket message type should match")
-	ticket := ticketMessage.(*speeddaemon.TicketMessage)
-	assert.Equal(t, ticket.Plate, speeddaemon.Str("ABC123"), "Ticket plate should match")
-	assert.Equal(t, ticket.Road, speeddaemon.U16(1), "Ticket road should match")
-	assert.Equal(t, ticket.MileOne, speeddaemon.U16(8), "Ticket mile one should match")
-	assert.Equal(t, ticket.TimeStampOne, speeddaemon.U32(0), "Ticket timestamp one should match")
-	assert.Equal(t, ticket.MileTwo, speeddaemon.U16(9), "Ticket mile two should match")
-	assert.Equal(t, ticket.TimeStampTwo, speeddaemon.U32(45), "Ticket timestamp two should match")
-	assert.Equal(t, ticket.Speed, speeddaemon.U16(8000), "Ticket speed should match")
+	assert.Equal(t, ticketMessage.GetType(), protocol.TicketMsgType, "Ticket message type should match")
+	ticket := ticketMessage.(*protocol.TicketMessage)
+	assert.Equal(t, ticket.Plate, protocol.Str("ABC123"), "Ticket plate should match")
+	assert.Equal(t, ticket.Road, protocol.U16(1), "Ticket road should match")
+	assert.Equal(t, ticket.MileOne, protocol.U16(8), "Ticket mile one should match")
+	assert.Equal(t, ticket.TimeStampOne, protocol.U32(0), "Ticket timestamp one should match")
+	assert.Equal(t, ticket.MileTwo, protocol.U16(9), "Ticket mile two should match")
+	assert.Equal(t, ticket.TimeStampTwo, protocol.U32(45), "Ticket timestamp two should match")
+	assert.Equal(t, ticket.Speed, protocol.U16(8000), "Ticket speed should match")
 	// Clean up
 	dispatcher.Close()
 	camera1.Close()
@@ -0,0 +1,31 @@
+package unusualdatabase_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	protocol "github.com/JeremyFenwick/firewatch/pkg/unusualdatabase"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientInsertRetrieve(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := protocol.Dial(ctx, serverAddr.String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	require.NoError(t, client.Insert(ctx, "client-key", "a=b"))
+	// Inserts aren't acknowledged, so the value may take a retry to arrive
+	require.Eventually(t, func() bool {
+		value, err := client.Retrieve(ctx, "client-key")
+		return err == nil && value == "a=b"
+	}, time.Second, 10*time.Millisecond)
+
+	value, err := client.Retrieve(ctx, "version")
+	require.NoError(t, err)
+	assert.NotEmpty(t, value)
+	assert.Error(t, client.Insert(ctx, "a=b", "c"))
+}
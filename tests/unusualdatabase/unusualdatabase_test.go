@@ -1,9 +1,12 @@
 package unusualdatabase_test
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"net"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -12,30 +15,31 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-const (
-	testPort = 4321
-	timeout  = 500 * time.Millisecond
-)
+const timeout = 500 * time.Millisecond
+
+// The address of the shared server, set in TestMain
+var serverAddr net.Addr
 
 // TestMain manages the test suite setup and teardown
 func TestMain(m *testing.M) {
 	// Start the server once for all tests
-	go func() {
-		unusualdatabase.Listen(testPort)
-	}()
-
-	// Wait for server to start
-	time.Sleep(100 * time.Millisecond)
+	srv := unusualdatabase.NewServer()
+	if err := srv.Start("127.0.0.1:0"); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start server: %v\n", err)
+		os.Exit(1)
+	}
+	serverAddr = srv.Addr()
 
 	// Run all tests
 	exitCode := m.Run()
+	srv.Stop(context.Background())
 
 	// Exit with the same code
 	os.Exit(exitCode)
 }
 
 func createUDPClient(t *testing.T) *net.UDPConn {
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", testPort))
+	addr, err := net.ResolveUDPAddr("udp", serverAddr.String())
 	require.NoError(t, err)
 
 	conn, err := net.DialUDP("udp", nil, addr)
@@ -182,3 +186,37 @@ func TestConcurrentRequests(t *testing.T) {
 		assert.Equal(t, expected, string(buffer[:n]))
 	}
 }
+
+func TestHandoffKeepsValues(t *testing.T) {
+	old := unusualdatabase.NewServer()
+	require.NoError(t, old.Start("127.0.0.1:0"))
+	client, err := net.Dial("udp", old.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("kept=across restarts"))
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	var state bytes.Buffer
+	require.NoError(t, old.Handoff(context.Background(), &state))
+
+	// The version belongs to the new build, so a handed over one is ignored
+	restored := strings.Replace(state.String(), "madvillains vault of villainy", "old build", 1)
+	srv := unusualdatabase.NewServer()
+	require.NoError(t, srv.Restore(strings.NewReader(restored)))
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	defer srv.Stop(context.Background())
+
+	client, err = net.Dial("udp", srv.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(timeout))
+	buffer := make([]byte, 1024)
+	for key, want := range map[string]string{"kept": "kept=across restarts", "version": "version=madvillains vault of villainy"} {
+		_, err = client.Write([]byte(key))
+		require.NoError(t, err)
+		n, err := client.Read(buffer)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(buffer[:n]))
+	}
+}
@@ -0,0 +1,84 @@
+package vcs_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/JeremyFenwick/firewatch/internal/voraciouscodestorage"
+	"github.com/JeremyFenwick/firewatch/pkg/vcs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T) (*voraciouscodestorage.Server, string) {
+	srv := voraciouscodestorage.NewServer(t.TempDir())
+	require.NoError(t, srv.Start("127.0.0.1:0"))
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	return srv, srv.Addr().String()
+}
+
+func TestClientRevisions(t *testing.T) {
+	_, address := startServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := vcs.NewClient(address)
+	defer client.Close()
+
+	revision, err := client.Put(ctx, "/src/main.go", []byte("one\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, revision)
+	revision, err = client.Put(ctx, "/src/main.go", []byte("two\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, revision)
+	_, err = client.Put(ctx, "/README", []byte("read me\n"))
+	require.NoError(t, err)
+
+	data, err := client.Get(ctx, "/src/main.go")
+	require.NoError(t, err)
+	assert.Equal(t, "two\n", string(data))
+	data, err = client.GetRevision(ctx, "/src/main.go", 1)
+	require.NoError(t, err)
+	assert.Equal(t, "one\n", string(data))
+
+	entries, err := client.List(ctx, "/")
+	require.NoError(t, err)
+	assert.Equal(t, []vcs.Entry{{Name: "src", Dir: true}, {Name: "README", Revision: 1}}, entries)
+}
+
+func TestClientErrors(t *testing.T) {
+	_, address := startServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := vcs.NewClient(address)
+	defer client.Close()
+
+	_, err := client.Get(ctx, "/missing")
+	assert.ErrorIs(t, err, vcs.ErrNotFound)
+	_, err = client.Put(ctx, "relative", []byte("x\n"))
+	assert.ErrorIs(t, err, vcs.ErrIllegalName)
+	_, err = client.Put(ctx, "/binary", []byte{0, 1, 2})
+	var serverError *vcs.ServerError
+	assert.ErrorAs(t, err, &serverError)
+
+	// The connection is still usable after errors
+	_, err = client.Put(ctx, "/ok", []byte("fine\n"))
+	assert.NoError(t, err)
+}
+
+func TestClientReconnects(t *testing.T) {
+	srv, address := startServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := vcs.NewClient(address)
+	defer client.Close()
+
+	_, err := client.Put(ctx, "/file", []byte("kept\n"))
+	require.NoError(t, err)
+	for _, session := range srv.Sessions() {
+		srv.Disconnect(session.ID)
+	}
+	data, err := client.Get(ctx, "/file")
+	require.NoError(t, err)
+	assert.Equal(t, "kept\n", string(data))
+}
@@ -0,0 +1,68 @@
+package voraciouscodestorage_test
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/voraciouscodestorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func FuzzIsValidPath(f *testing.F) {
+	for _, seed := range []string{"/", "/a", "/dir/file.txt", "/a-b_c/d.e", "a", "", "//a", "/a//b", "/a/../../b", "/.", "/a/..", "/a b", "/\\"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, p string) {
+		if !voraciouscodestorage.IsValidPath(p) {
+			return
+		}
+		for _, element := range strings.Split(p, "/") {
+			assert.NotEqual(t, ".", element)
+			assert.NotEqual(t, "..", element)
+		}
+		// A valid path can't reach outside the data directory
+		joined := filepath.Join("/data", p)
+		assert.True(t, joined == "/data" || strings.HasPrefix(joined, "/data/"), "%q leaves the data directory", p)
+	})
+}
+
+func FuzzSession(f *testing.F) {
+	for _, seed := range []string{
+		"HELP\n",
+		"PUT /test.txt 5\nhello",
+		"PUT /dir/test.txt 6\nhello\nGET /dir/test.txt\nGET /dir/test.txt r1\nLIST /\nLIST /dir\n",
+		"PUT /a 3\nabcPUT /a 3\nabdGET /a r2\nGET /a r3\nGET /a x\n",
+		"PUT /bin 4\n\x00\x01\x02\x03LIST /\n",
+		"PUT /a -5\nGET /a\n",
+		"PUT /../escape 3\nabc",
+		"LIST\nGET\nPUT\nput /a 1\nb",
+		"CLEAR\nLIST /\n",
+		"FLY /\n",
+	} {
+		f.Add([]byte(seed))
+	}
+	dir := f.TempDir()
+	require.NoError(f, os.Mkdir(filepath.Join(dir, "data"), 0755))
+	fm, err := voraciouscodestorage.NewFileManager(filepath.Join(dir, "data"))
+	require.NoError(f, err)
+	logger := slog.New(slog.DiscardHandler)
+	m := metrics.NewService("voraciouscodestorage")
+
+	f.Fuzz(func(t *testing.T, commands []byte) {
+		defer fm.Clear()
+		var replies bytes.Buffer
+		voraciouscodestorage.Session(bytes.NewReader(commands), &replies, fm, logger, m)
+		assert.True(t, strings.HasPrefix(replies.String(), "READY\n"))
+		// Nothing is written outside the data directory
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "data", entries[0].Name())
+	})
+}
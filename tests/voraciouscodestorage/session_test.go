@@ -0,0 +1,68 @@
+package voraciouscodestorage_test
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/JeremyFenwick/firewatch/internal/metrics"
+	"github.com/JeremyFenwick/firewatch/internal/voraciouscodestorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// session runs commands against a file manager whose data directory is inside dir, and returns
+// the replies
+func session(t *testing.T, dir, commands string) string {
+	data := filepath.Join(dir, "data")
+	require.NoError(t, os.MkdirAll(data, 0755))
+	fm, err := voraciouscodestorage.NewFileManager(data)
+	require.NoError(t, err)
+	var replies bytes.Buffer
+	voraciouscodestorage.Session(bytes.NewBufferString(commands), &replies, fm, slog.New(slog.DiscardHandler), metrics.NewService("voraciouscodestorage"))
+	return replies.String()
+}
+
+func TestPathsCantLeaveTheDataDir(t *testing.T) {
+	for p, valid := range map[string]bool{
+		"/a/b.txt":      true,
+		"/a/.b":         true,
+		"/a/..b":        true,
+		"/.":            false,
+		"/..":           false,
+		"/a/./b":        false,
+		"/a/../b":       false,
+		"/../escape":    false,
+		"/a/../../b.go": false,
+	} {
+		assert.Equal(t, valid, voraciouscodestorage.IsValidPath(p), "path %s", p)
+	}
+
+	dir := t.TempDir()
+	replies := session(t, dir, "PUT /../escape.txt 3\nabc")
+	assert.Equal(t, "READY\nERR illegal file name\n", replies)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "only the data directory")
+}
+
+func TestPutWithNegativeLength(t *testing.T) {
+	// Read as an empty file rather than stored with a negative size
+	replies := session(t, t.TempDir(), "PUT /a.txt -5\nGET /a.txt\n")
+	assert.Equal(t, "READY\nOK r1\nREADY\nOK 0\nREADY\n", replies)
+}
+
+func TestHealthCheckProbesAreNotFiles(t *testing.T) {
+	dir := t.TempDir()
+	// A client file with a name like a probe's is kept
+	assert.Equal(t, "READY\nOK r1\nREADY\n", session(t, dir, "PUT /.healthcheck-1.probe 2\nhi"))
+	// A probe left behind by a health check that didn't finish is removed
+	probe := filepath.Join(dir, "data", ".healthcheck-2.probe")
+	require.NoError(t, os.WriteFile(probe, []byte("ok"), 0644))
+
+	replies := session(t, dir, "LIST /\nGET /.healthcheck-1.probe\n")
+	assert.Equal(t, "READY\nOK 1\n.healthcheck-1.probe r1\nREADY\nOK 2\nhiREADY\n", replies)
+	assert.NoFileExists(t, probe)
+}